@@ -37,6 +37,7 @@ type Server struct {
 	user          *cluster.ClusterAdmin
 	shutdown      chan bool
 	udpEnabled    bool
+	droppedPoints *coordinator.DroppedPointsCounter
 }
 
 // TODO: check that database exists and create it if not
@@ -48,6 +49,7 @@ func NewServer(config *configuration.Configuration, coord coordinator.Coordinato
 	self.shutdown = make(chan bool, 1)
 	self.clusterConfig = clusterConfig
 	self.udpEnabled = config.GraphiteUdpEnabled
+	self.droppedPoints = coord.DroppedPointsCounter("GraphiteServer")
 
 	return self
 }
@@ -134,6 +136,10 @@ func (self *Server) writePoints(series *protocol.Series) error {
 	err := self.coordinator.WriteSeriesData(self.user, self.database, serie)
 	if err != nil {
 		switch err.(type) {
+		case *WriteRateLimitError:
+			// graphite clients can't be told to back off, drop the points
+			self.droppedPoints.Add(self.database, serie)
+			return nil
 		case AuthorizationError:
 			// user information got stale, get a fresh one (this should happen rarely)
 			self.getAuth()
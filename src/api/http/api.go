@@ -105,6 +105,8 @@ func (self *HttpServer) Serve(listener net.Listener) {
 	// Write points to the given database
 	self.registerEndpoint(p, "post", "/db/:db/series", self.writePoints)
 	self.registerEndpoint(p, "del", "/db/:db/series/:series", self.dropSeries)
+	self.registerEndpoint(p, "get", "/db/:db/delete_jobs", self.listDeleteJobs)
+	self.registerEndpoint(p, "get", "/db/:db/delete_jobs/:id", self.getDeleteJob)
 	self.registerEndpoint(p, "get", "/db", self.listDatabases)
 	self.registerEndpoint(p, "post", "/db", self.createDatabase)
 	self.registerEndpoint(p, "del", "/db/:name", self.dropDatabase)
@@ -140,9 +142,24 @@ func (self *HttpServer) Serve(listener net.Listener) {
 
 	// cluster config endpoints
 	self.registerEndpoint(p, "get", "/cluster/servers", self.listServers)
+	self.registerEndpoint(p, "get", "/cluster/status", self.clusterStatus)
+	self.registerEndpoint(p, "del", "/cluster/servers/:id", self.removeServer)
 	self.registerEndpoint(p, "post", "/cluster/shards", self.createShard)
 	self.registerEndpoint(p, "get", "/cluster/shards", self.getShards)
 	self.registerEndpoint(p, "del", "/cluster/shards/:id", self.dropShard)
+	self.registerEndpoint(p, "get", "/cluster/shards/:id/stats", self.getShardStats)
+	self.registerEndpoint(p, "post", "/cluster/shards/:id/migrate", self.migrateShard)
+	self.registerEndpoint(p, "post", "/cluster/shards/:id/compact", self.compactShard)
+	self.registerEndpoint(p, "post", "/cluster/shards/:id/verify", self.verifyShard)
+	self.registerEndpoint(p, "post", "/cluster/shards/:id/copy", self.copyShard)
+	self.registerEndpoint(p, "post", "/cluster/shards/:id/move", self.moveShard)
+	self.registerEndpoint(p, "get", "/cluster/shard_jobs", self.listShardJobs)
+	self.registerEndpoint(p, "get", "/cluster/shard_jobs/:id", self.getShardJob)
+	self.registerEndpoint(p, "post", "/cluster/rebalance", self.rebalance)
+	self.registerEndpoint(p, "get", "/cluster/hinted_handoff", self.listHintedHandoff)
+	self.registerEndpoint(p, "del", "/cluster/hinted_handoff/:id", self.purgeHintedHandoff)
+	self.registerEndpoint(p, "get", "/cluster/queries", self.listQueries)
+	self.registerEndpoint(p, "del", "/cluster/queries/:id", self.killQuery)
 
 	// return whether the cluster is in sync or not
 	self.registerEndpoint(p, "get", "/sync", self.isInSync)
@@ -296,6 +313,19 @@ func (self *HttpServer) query(w libhttp.ResponseWriter, r *libhttp.Request) {
 			return libhttp.StatusBadRequest, err.Error()
 		}
 
+		// delete queries can run in the background, the returned job id
+		// is used to poll the status of the delete
+		if r.URL.Query().Get("async") == "true" {
+			id, err := self.coordinator.RunDeleteQueryAsync(user, db, query)
+			if err != nil {
+				if e, ok := err.(*parser.QueryError); ok {
+					return errorToStatusCode(err), e.PrettyPrint()
+				}
+				return errorToStatusCode(err), err.Error()
+			}
+			return libhttp.StatusAccepted, map[string]uint64{"id": id}
+		}
+
 		var writer Writer
 		if r.URL.Query().Get("chunked") == "true" {
 			writer = &ChunkWriter{w, precision, false}
@@ -324,6 +354,8 @@ func errorToStatusCode(err error) int {
 		return libhttp.StatusForbidden // HTTP 403
 	case DatabaseExistsError:
 		return libhttp.StatusConflict // HTTP 409
+	case *WriteRateLimitError:
+		return 429 // HTTP 429 Too Many Requests
 	default:
 		return libhttp.StatusBadRequest // HTTP 400
 	}
@@ -338,6 +370,13 @@ func (self *HttpServer) writePoints(w libhttp.ResponseWriter, r *libhttp.Request
 		return
 	}
 
+	consistency, err := cluster.ParseWriteConsistency(r.URL.Query().Get("consistency"))
+	if err != nil {
+		w.WriteHeader(libhttp.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
 	self.tryAsDbUserAndClusterAdmin(w, r, func(user User) (int, interface{}) {
 		series, err := ioutil.ReadAll(r.Body)
 		if err != nil {
@@ -364,9 +403,23 @@ func (self *HttpServer) writePoints(w libhttp.ResponseWriter, r *libhttp.Request
 			dataStoreSeries = append(dataStoreSeries, series)
 		}
 
-		err = self.coordinator.WriteSeriesData(user, db, dataStoreSeries)
+		err = self.coordinator.WriteSeriesDataWithConsistency(user, db, dataStoreSeries, consistency)
 
 		if err != nil {
+			if consistencyErr, ok := err.(*cluster.WriteConsistencyError); ok {
+				// the write is logged, report which copies of the shards
+				// didn't acknowledge it in time
+				return libhttp.StatusInternalServerError, map[string]interface{}{
+					"error":       err.Error(),
+					"consistency": consistencyErr.Consistency.String(),
+					"shards":      consistencyErr.Shards,
+				}
+			}
+			if rateLimitErr, ok := err.(*WriteRateLimitError); ok {
+				// round up, the client shouldn't retry before the quota is refilled
+				retryAfter := int64((rateLimitErr.RetryAfter + time.Second - 1) / time.Second)
+				w.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+			}
 			return errorToStatusCode(err), err.Error()
 		}
 
@@ -375,7 +428,8 @@ func (self *HttpServer) writePoints(w libhttp.ResponseWriter, r *libhttp.Request
 }
 
 type createDatabaseRequest struct {
-	Name string `json:"name"`
+	Name              string `json:"name"`
+	ReplicationFactor uint8  `json:"replicationFactor"`
 }
 
 func (self *HttpServer) listDatabases(w libhttp.ResponseWriter, r *libhttp.Request) {
@@ -399,7 +453,7 @@ func (self *HttpServer) createDatabase(w libhttp.ResponseWriter, r *libhttp.Requ
 		if err != nil {
 			return libhttp.StatusBadRequest, err.Error()
 		}
-		err = self.coordinator.CreateDatabase(user, createRequest.Name)
+		err = self.coordinator.CreateDatabase(user, createRequest.Name, createRequest.ReplicationFactor)
 		if err != nil {
 			log.Error("Cannot create database %s. Error: %s", createRequest.Name, err)
 			return errorToStatusCode(err), err.Error()
@@ -563,6 +617,10 @@ type ApiUser struct {
 	Name string `json:"name"`
 }
 
+type UpdateDbUserLimits struct {
+	Limits *QueryLimits `json:"limits"`
+}
+
 type UserDetail struct {
 	Name    string `json:"name"`
 	IsAdmin bool   `json:"isAdmin"`
@@ -859,6 +917,17 @@ func (self *HttpServer) updateDbUser(w libhttp.ResponseWriter, r *libhttp.Reques
 				return errorToStatusCode(err), err.Error()
 			}
 		}
+
+		if _, ok := updateUser["limits"]; ok {
+			updateLimits := &UpdateDbUserLimits{}
+			if err := json.Unmarshal(body, updateLimits); err != nil {
+				return libhttp.StatusBadRequest, err.Error()
+			}
+
+			if err := self.userManager.SetDbUserQueryLimits(u, db, newUser, updateLimits.Limits); err != nil {
+				return errorToStatusCode(err), err.Error()
+			}
+		}
 		return libhttp.StatusOK, nil
 	})
 }
@@ -954,11 +1023,44 @@ func (self *HttpServer) listServers(w libhttp.ResponseWriter, r *libhttp.Request
 	})
 }
 
+// Returns the raft state, the state of the connections from this server
+// to the other servers, the wal lag of the servers and the shards that
+// don't have enough copies that are up
+func (self *HttpServer) clusterStatus(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		status, err := self.coordinator.ClusterStatus(u)
+		if err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+		return libhttp.StatusOK, status
+	})
+}
+
+// Moves the copies of the shards on the server to the other servers and
+// removes the server from the cluster afterwards, this runs in the
+// background
+func (self *HttpServer) removeServer(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		id, err := strconv.ParseUint(r.URL.Query().Get(":id"), 10, 32)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+		moves, err := self.coordinator.RemoveServer(u, uint32(id))
+		if err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+		return libhttp.StatusAccepted, moves
+	})
+}
+
 type newShardInfo struct {
 	StartTime int64               `json:"startTime"`
 	EndTime   int64               `json:"endTime"`
 	Shards    []newShardServerIds `json:"shards"`
 	LongTerm  bool                `json:"longTerm"`
+	// The shards are written to by the databases with this replication
+	// factor, 0 for the one in the configuration
+	ReplicationFactor uint8 `json:"replicationFactor"`
 }
 
 type newShardServerIds struct {
@@ -988,6 +1090,8 @@ func (self *HttpServer) createShard(w libhttp.ResponseWriter, r *libhttp.Request
 				EndTime:   time.Unix(newShards.EndTime, 0),
 				ServerIds: s.ServerIds,
 				Type:      shardType,
+
+				ReplicationFactor: newShards.ReplicationFactor,
 			}
 			shards = append(shards, newShardData)
 		}
@@ -999,15 +1103,33 @@ func (self *HttpServer) createShard(w libhttp.ResponseWriter, r *libhttp.Request
 	})
 }
 
+// The stats of the shards are only returned with stats=true since
+// they're requested from every server that has a copy of a shard
 func (self *HttpServer) getShards(w libhttp.ResponseWriter, r *libhttp.Request) {
 	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		withStats := r.URL.Query().Get("stats") == "true"
 		result := make(map[string]interface{})
-		result["shortTerm"] = self.convertShardsToMap(self.clusterConfig.GetShortTermShards())
-		result["longTerm"] = self.convertShardsToMap(self.clusterConfig.GetLongTermShards())
+		result["shortTerm"] = self.convertShardsToMap(self.clusterConfig.GetShortTermShards(), withStats)
+		result["longTerm"] = self.convertShardsToMap(self.clusterConfig.GetLongTermShards(), withStats)
 		return libhttp.StatusOK, result
 	})
 }
 
+// Returns the stats of every copy of the shard
+func (self *HttpServer) getShardStats(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		id, err := strconv.ParseInt(r.URL.Query().Get(":id"), 10, 64)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+		shard := self.clusterConfig.GetShardById(uint32(id))
+		if shard == nil {
+			return libhttp.StatusNotFound, fmt.Sprintf("Shard %d doesn't exist", id)
+		}
+		return libhttp.StatusOK, shard.Stats()
+	})
+}
+
 // Note: this is meant for testing purposes only and doesn't guarantee
 // data integrity and shouldn't be used in client code.
 func (self *HttpServer) isInSync(w libhttp.ResponseWriter, r *libhttp.Request) {
@@ -1051,7 +1173,245 @@ func (self *HttpServer) dropShard(w libhttp.ResponseWriter, r *libhttp.Request)
 	})
 }
 
-func (self *HttpServer) convertShardsToMap(shards []*cluster.ShardData) []interface{} {
+// Starts compacting the shard on every server that has a copy of it.
+// The progress is reported in the stats returned by
+// GET /cluster/shards/:id/stats
+func (self *HttpServer) compactShard(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		id, err := strconv.ParseInt(r.URL.Query().Get(":id"), 10, 64)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+		shard := self.clusterConfig.GetShardById(uint32(id))
+		if shard == nil {
+			return libhttp.StatusNotFound, fmt.Sprintf("Shard %d doesn't exist", id)
+		}
+		if err := shard.Compact(); err != nil {
+			return libhttp.StatusInternalServerError, err.Error()
+		}
+		return libhttp.StatusAccepted, nil
+	})
+}
+
+// Compares the copies of the shard on all the servers and returns the
+// time ranges of the series that don't match. The missing points are
+// copied between the servers if repair is set to true.
+func (self *HttpServer) verifyShard(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		id, err := strconv.ParseInt(r.URL.Query().Get(":id"), 10, 64)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+		shard := self.clusterConfig.GetShardById(uint32(id))
+		if shard == nil {
+			return libhttp.StatusNotFound, fmt.Sprintf("Shard %d doesn't exist", id)
+		}
+		verification, err := shard.Verify(r.URL.Query().Get("repair") == "true")
+		if err != nil {
+			return libhttp.StatusInternalServerError, err.Error()
+		}
+		return libhttp.StatusOK, verification
+	})
+}
+
+// Moves copies of shards from the servers with the most shards to the
+// servers with the fewest, e.g. after servers joined the cluster.
+// Returns the moves, which run in the background unless dryRun is set
+// to true.
+func (self *HttpServer) rebalance(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		dryRun := r.URL.Query().Get("dryRun") == "true"
+		moves, err := self.coordinator.Rebalance(u, dryRun)
+		if err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+		if dryRun {
+			return libhttp.StatusOK, moves
+		}
+		return libhttp.StatusAccepted, moves
+	})
+}
+
+func (self *HttpServer) copyShard(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.copyOrMoveShard(w, r, false)
+}
+
+func (self *HttpServer) moveShard(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.copyOrMoveShard(w, r, true)
+}
+
+// Copies the shard from the server in the from parameter to the server
+// in the to parameter in the background and returns the id of the job
+func (self *HttpServer) copyOrMoveShard(w libhttp.ResponseWriter, r *libhttp.Request, move bool) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		ids := make([]uint32, 0, 3)
+		for _, param := range []string{":id", "from", "to"} {
+			id, err := strconv.ParseUint(r.URL.Query().Get(param), 10, 32)
+			if err != nil {
+				return libhttp.StatusBadRequest, fmt.Sprintf("Invalid %s: %s", strings.TrimPrefix(param, ":"), err)
+			}
+			ids = append(ids, uint32(id))
+		}
+		id, err := self.coordinator.CopyShardAsync(u, ids[0], ids[1], ids[2], move)
+		if err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+		return libhttp.StatusAccepted, map[string]uint64{"id": id}
+	})
+}
+
+func (self *HttpServer) listShardJobs(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		jobs, err := self.coordinator.ListShardJobs(u)
+		if err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+		return libhttp.StatusOK, jobs
+	})
+}
+
+func (self *HttpServer) getShardJob(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		id, err := strconv.ParseUint(r.URL.Query().Get(":id"), 10, 64)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+		job, err := self.coordinator.GetShardJob(u, id)
+		if err != nil {
+			if _, ok := err.(*QueryError); ok {
+				return libhttp.StatusNotFound, err.Error()
+			}
+			return errorToStatusCode(err), err.Error()
+		}
+		return libhttp.StatusOK, job
+	})
+}
+
+type shardMigrationInfo struct {
+	Engine         string `json:"engine"`
+	PointBlockSize int    `json:"pointBlockSize"`
+}
+
+// Rewrites the local copy of the shard with another storage engine or
+// point block size. The shard stays online while it's copied, the
+// writes and deletes during the copy are replayed before the new copy
+// replaces the old one.
+func (self *HttpServer) migrateShard(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		id, err := strconv.ParseInt(r.URL.Query().Get(":id"), 10, 64)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return libhttp.StatusInternalServerError, err.Error()
+		}
+		info := &shardMigrationInfo{}
+		err = json.Unmarshal(body, info)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+		if info.Engine == "" {
+			return libhttp.StatusBadRequest, "Request must include the 'engine' to migrate the shard to"
+		}
+		if info.PointBlockSize < 0 {
+			return libhttp.StatusBadRequest, "'pointBlockSize' can't be negative"
+		}
+
+		migration, err := self.clusterConfig.MigrateLocalShard(uint32(id), info.Engine, info.PointBlockSize)
+		if err != nil {
+			return libhttp.StatusInternalServerError, err.Error()
+		}
+		return libhttp.StatusOK, migration
+	})
+}
+
+func (self *HttpServer) listQueries(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		series, err := self.coordinator.ListQueries(u, "")
+		if err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+
+		queries := make([]map[string]interface{}, 0, len(series[0].Points))
+		for _, point := range series[0].Points {
+			query := make(map[string]interface{})
+			for i, field := range series[0].Fields {
+				query[field] = point.GetFieldValue(i)
+			}
+			queries = append(queries, query)
+		}
+		return libhttp.StatusOK, queries
+	})
+}
+
+// Returns the depth of the hinted handoff queues of this server per
+// destination server
+func (self *HttpServer) listHintedHandoff(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		return libhttp.StatusOK, self.clusterConfig.HintedHandoffStats()
+	})
+}
+
+// Drops the queued writes for a server from the hinted handoff queue of
+// this server
+func (self *HttpServer) purgeHintedHandoff(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		id, err := strconv.ParseUint(r.URL.Query().Get(":id"), 10, 32)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+		purged, err := self.clusterConfig.PurgeHintedHandoff(uint32(id))
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+		return libhttp.StatusOK, map[string]int{"purged": purged}
+	})
+}
+
+func (self *HttpServer) killQuery(w libhttp.ResponseWriter, r *libhttp.Request) {
+	self.tryAsClusterAdmin(w, r, func(u User) (int, interface{}) {
+		id, err := strconv.ParseUint(r.URL.Query().Get(":id"), 10, 64)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+		if err := self.coordinator.KillQuery(u, id); err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+		return libhttp.StatusOK, nil
+	})
+}
+
+func (self *HttpServer) listDeleteJobs(w libhttp.ResponseWriter, r *libhttp.Request) {
+	db := r.URL.Query().Get(":db")
+	self.tryAsDbUserAndClusterAdmin(w, r, func(u User) (int, interface{}) {
+		jobs, err := self.coordinator.ListDeleteJobs(u, db)
+		if err != nil {
+			return errorToStatusCode(err), err.Error()
+		}
+		return libhttp.StatusOK, jobs
+	})
+}
+
+func (self *HttpServer) getDeleteJob(w libhttp.ResponseWriter, r *libhttp.Request) {
+	db := r.URL.Query().Get(":db")
+	self.tryAsDbUserAndClusterAdmin(w, r, func(u User) (int, interface{}) {
+		id, err := strconv.ParseUint(r.URL.Query().Get(":id"), 10, 64)
+		if err != nil {
+			return libhttp.StatusBadRequest, err.Error()
+		}
+		job, err := self.coordinator.GetDeleteJob(u, db, id)
+		if err != nil {
+			if _, ok := err.(*QueryError); ok {
+				return libhttp.StatusNotFound, err.Error()
+			}
+			return errorToStatusCode(err), err.Error()
+		}
+		return libhttp.StatusOK, job
+	})
+}
+
+func (self *HttpServer) convertShardsToMap(shards []*cluster.ShardData, withStats bool) []interface{} {
 	result := make([]interface{}, 0)
 	for _, shard := range shards {
 		s := make(map[string]interface{})
@@ -1059,6 +1419,10 @@ func (self *HttpServer) convertShardsToMap(shards []*cluster.ShardData) []interf
 		s["startTime"] = shard.StartTime().Unix()
 		s["endTime"] = shard.EndTime().Unix()
 		s["serverIds"] = shard.ServerIds()
+		s["replicationFactor"] = shard.ReplicationFactor()
+		if withStats {
+			s["stats"] = shard.Stats()
+		}
 		result = append(result, s)
 	}
 	return result
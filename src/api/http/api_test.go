@@ -98,11 +98,20 @@ type MockCoordinator struct {
 	continuousQueries map[string][]*cluster.ContinuousQuery
 	deleteQueries     []*parser.DeleteQuery
 	db                string
+	replicationFactor uint8
 	droppedDb         string
+	killedQuery       uint64
+	asyncDeleteQuery  string
+	shardJob          *coordinator.ShardJob
 	returnedError     error
+	consistency       cluster.WriteConsistency
 }
 
-func (self *MockCoordinator) WriteSeriesData(_ User, db string, series []*protocol.Series) error {
+func (self *MockCoordinator) WriteSeriesDataWithConsistency(_ User, db string, series []*protocol.Series, consistency cluster.WriteConsistency) error {
+	if self.returnedError != nil {
+		return self.returnedError
+	}
+	self.consistency = consistency
 	self.series = append(self.series, series...)
 	return nil
 }
@@ -112,13 +121,14 @@ func (self *MockCoordinator) DeleteSeriesData(_ User, db string, query *parser.D
 	return nil
 }
 
-func (self *MockCoordinator) CreateDatabase(_ User, db string) error {
+func (self *MockCoordinator) CreateDatabase(_ User, db string, replicationFactor uint8) error {
 	self.db = db
+	self.replicationFactor = replicationFactor
 	return nil
 }
 
 func (self *MockCoordinator) ListDatabases(_ User) ([]*cluster.Database, error) {
-	return []*cluster.Database{&cluster.Database{"db1"}, &cluster.Database{"db2"}}, nil
+	return []*cluster.Database{&cluster.Database{Name: "db1"}, &cluster.Database{Name: "db2"}}, nil
 }
 
 func (self *MockCoordinator) DropDatabase(_ User, db string) error {
@@ -162,6 +172,93 @@ func (self *MockCoordinator) DeleteContinuousQuery(_ User, db string, id uint32)
 	return nil
 }
 
+func (self *MockCoordinator) ListQueries(_ User, db string) ([]*protocol.Series, error) {
+	queryId := int64(10001)
+	database := "db1"
+	queryString := "select * from foo;"
+	seriesName := "queries"
+	series := []*protocol.Series{&protocol.Series{
+		Name:   &seriesName,
+		Fields: []string{"id", "database", "query"},
+		Points: []*protocol.Point{
+			&protocol.Point{
+				Values: []*protocol.FieldValue{
+					&protocol.FieldValue{Int64Value: &queryId},
+					&protocol.FieldValue{StringValue: &database},
+					&protocol.FieldValue{StringValue: &queryString},
+				},
+			},
+		},
+	}}
+	return series, nil
+}
+
+func (self *MockCoordinator) KillQuery(_ User, id uint64) error {
+	self.killedQuery = id
+	return nil
+}
+
+func (self *MockCoordinator) RunDeleteQueryAsync(_ User, db string, query string) (uint64, error) {
+	self.asyncDeleteQuery = query
+	return 10001, nil
+}
+
+func (self *MockCoordinator) GetDeleteJob(_ User, db string, id uint64) (*coordinator.DeleteJob, error) {
+	if id != 10001 {
+		return nil, NewQueryError(InvalidArgument, "Delete job %d doesn't exist", id)
+	}
+	return &coordinator.DeleteJob{Id: id, Database: db, Query: self.asyncDeleteQuery, Done: true}, nil
+}
+
+func (self *MockCoordinator) Rebalance(_ User, dryRun bool) ([]*coordinator.ShardMove, error) {
+	return []*coordinator.ShardMove{&coordinator.ShardMove{ShardId: 1, From: 1, To: 3}}, nil
+}
+
+func (self *MockCoordinator) RemoveServer(_ User, id uint32) ([]*coordinator.ShardMove, error) {
+	if id != 2 {
+		return nil, fmt.Errorf("Server %d doesn't exist", id)
+	}
+	return []*coordinator.ShardMove{&coordinator.ShardMove{ShardId: 1, From: 2, To: 3}}, nil
+}
+
+func (self *MockCoordinator) CopyShardAsync(_ User, shardId, from, to uint32, move bool) (uint64, error) {
+	jobType := coordinator.SHARD_JOB_COPY
+	if move {
+		jobType = coordinator.SHARD_JOB_MOVE
+	}
+	self.shardJob = &coordinator.ShardJob{Id: 20001, Type: jobType, ShardId: shardId, From: from, To: to}
+	return 20001, nil
+}
+
+func (self *MockCoordinator) GetShardJob(_ User, id uint64) (*coordinator.ShardJob, error) {
+	if self.shardJob == nil || id != self.shardJob.Id {
+		return nil, NewQueryError(InvalidArgument, "Shard job %d doesn't exist", id)
+	}
+	return self.shardJob, nil
+}
+
+func (self *MockCoordinator) ListShardJobs(_ User) ([]*coordinator.ShardJob, error) {
+	return []*coordinator.ShardJob{self.shardJob}, nil
+}
+
+func (self *MockCoordinator) DroppedPointsCounter(input string) *coordinator.DroppedPointsCounter {
+	return coordinator.NewDroppedPointsCounter(input)
+}
+
+func (self *MockCoordinator) ClusterStatus(_ User) (*coordinator.ClusterStatus, error) {
+	return &coordinator.ClusterStatus{
+		Raft: &coordinator.RaftStatus{Name: "abc", State: "leader", Leader: "abc", Term: 2, CommitIndex: 10, Peers: []*coordinator.RaftPeerStatus{}},
+		Servers: []*cluster.ServerStatus{
+			{Id: 1, RaftName: "abc", Local: true, Up: true},
+			{Id: 2, RaftName: "def", Up: false, WalLag: 5},
+		},
+		UnderReplicatedShards: []*cluster.UnderReplicatedShard{
+			{ShardId: 1, ReplicationFactor: 2, ServerIds: []uint32{1, 2}, DownServerIds: []uint32{2}},
+		},
+		HintedHandoff: []*cluster.HintedHandoffStats{},
+	}, nil
+}
+
 func (self *ApiSuite) formatUrl(path string, args ...interface{}) string {
 	path = fmt.Sprintf(path, args...)
 	port := self.listener.Addr().(*net.TCPAddr).Port
@@ -535,6 +632,55 @@ func (self *ApiSuite) TestWriteData(c *C) {
 	c.Assert(*series.Points[0].Values[3].BoolValue, Equals, true)
 }
 
+func (self *ApiSuite) TestWriteDataOverQuota(c *C) {
+	self.coordinator.returnedError = NewWriteRateLimitError(1500*time.Millisecond, "quota exceeded")
+	data := `[{"points": [[1]], "name": "foo", "columns": ["column_one"]}]`
+
+	addr := self.formatUrl("/db/foo/series?u=dbuser&p=password")
+	resp, err := libhttp.Post(addr, "application/json", bytes.NewBufferString(data))
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, 429)
+	c.Assert(resp.Header.Get("Retry-After"), Equals, "2")
+	c.Assert(self.coordinator.series, HasLen, 0)
+}
+
+func (self *ApiSuite) TestWriteDataWithConsistency(c *C) {
+	data := `[{"points": [[1]], "name": "foo", "columns": ["column_one"]}]`
+
+	addr := self.formatUrl("/db/foo/series?u=dbuser&p=password&consistency=quorum")
+	resp, err := libhttp.Post(addr, "application/json", bytes.NewBufferString(data))
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	c.Assert(self.coordinator.consistency, Equals, cluster.WRITE_CONSISTENCY_QUORUM)
+
+	addr = self.formatUrl("/db/foo/series?u=dbuser&p=password&consistency=most")
+	resp, err = libhttp.Post(addr, "application/json", bytes.NewBufferString(data))
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusBadRequest)
+
+	self.coordinator.returnedError = &cluster.WriteConsistencyError{
+		Consistency: cluster.WRITE_CONSISTENCY_ALL,
+		Shards: []*cluster.ShardWriteError{
+			&cluster.ShardWriteError{ShardId: 3, Required: 2, Acknowledged: []uint32{1}, Missing: []uint32{2}},
+		},
+	}
+	addr = self.formatUrl("/db/foo/series?u=dbuser&p=password&consistency=all")
+	resp, err = libhttp.Post(addr, "application/json", bytes.NewBufferString(data))
+	c.Assert(err, IsNil)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusInternalServerError)
+	result := map[string]interface{}{}
+	c.Assert(json.Unmarshal(body, &result), IsNil)
+	c.Assert(result["consistency"], Equals, "all")
+	c.Assert(result["shards"], DeepEquals, []interface{}{
+		map[string]interface{}{"shardId": 3.0, "required": 2.0, "acknowledged": []interface{}{1.0}, "missing": []interface{}{2.0}},
+	})
+}
+
 func (self *ApiSuite) TestWriteDataAsClusterAdmin(c *C) {
 	data := `
 [
@@ -563,6 +709,21 @@ func (self *ApiSuite) TestCreateDatabase(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(resp.StatusCode, Equals, libhttp.StatusCreated)
 	c.Assert(self.coordinator.db, Equals, "foo")
+	c.Assert(self.coordinator.replicationFactor, Equals, uint8(0))
+
+	data = `{"name": "bar", "replicationFactor": 3}`
+	resp, err = libhttp.Post(addr, "application/json", bytes.NewBufferString(data))
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusCreated)
+	c.Assert(self.coordinator.db, Equals, "bar")
+	c.Assert(self.coordinator.replicationFactor, Equals, uint8(3))
+
+	data = `{"name": "baz", "replicationFactor": -1}`
+	resp, err = libhttp.Post(addr, "application/json", bytes.NewBufferString(data))
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusBadRequest)
 }
 
 func (self *ApiSuite) TestDropDatabase(c *C) {
@@ -681,6 +842,18 @@ func (self *ApiSuite) TestDbUserOperations(c *C) {
 	c.Assert(self.manager.ops[0].isAdmin, Equals, false)
 	self.manager.ops = nil
 
+	// override the query limits
+	url = self.formatUrl("/db/db1/users/dbuser?u=root&p=root")
+	resp, err = libhttp.Post(url, "", bytes.NewBufferString(`{"limits": {"max_regex_series": 10, "max_concurrent_queries": 2}}`))
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	c.Assert(self.manager.ops, HasLen, 1)
+	c.Assert(self.manager.ops[0].operation, Equals, "db_user_limits")
+	c.Assert(self.manager.ops[0].username, Equals, "dbuser")
+	c.Assert(self.manager.ops[0].limits, DeepEquals, &QueryLimits{MaxRegexSeries: 10, MaxConcurrentQueries: 2})
+	self.manager.ops = nil
+
 	url = self.formatUrl("/db/db1/users/dbuser?u=root&p=root")
 	req, _ := libhttp.NewRequest("DELETE", url, nil)
 	resp, err = libhttp.DefaultClient.Do(req)
@@ -749,7 +922,7 @@ func (self *ApiSuite) TestDatabasesIndex(c *C) {
 		c.Assert(err, IsNil)
 		err = json.Unmarshal(body, &databases)
 		c.Assert(err, IsNil)
-		c.Assert(databases, DeepEquals, []*cluster.Database{&cluster.Database{"db1"}, &cluster.Database{"db2"}})
+		c.Assert(databases, DeepEquals, []*cluster.Database{&cluster.Database{Name: "db1"}, &cluster.Database{Name: "db2"}})
 	}
 }
 
@@ -768,7 +941,7 @@ func (self *ApiSuite) TestBasicAuthentication(c *C) {
 	c.Assert(err, IsNil)
 	err = json.Unmarshal(body, &databases)
 	c.Assert(err, IsNil)
-	c.Assert(databases, DeepEquals, []*cluster.Database{&cluster.Database{"db1"}, &cluster.Database{"db2"}})
+	c.Assert(databases, DeepEquals, []*cluster.Database{&cluster.Database{Name: "db1"}, &cluster.Database{Name: "db2"}})
 }
 
 func (self *ApiSuite) TestContinuousQueryOperations(c *C) {
@@ -842,3 +1015,172 @@ func (self *ApiSuite) TestContinuousQueryOperations(c *C) {
 	c.Assert(queries[0].Query, Equals, "select * from foo into bar;")
 	resp.Body.Close()
 }
+
+func (self *ApiSuite) TestRunningQueryOperations(c *C) {
+	url := self.formatUrl("/cluster/queries?u=root&p=root")
+	resp, err := libhttp.Get(url)
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	queries := []map[string]interface{}{}
+	err = json.Unmarshal(body, &queries)
+	c.Assert(err, IsNil)
+	c.Assert(queries, HasLen, 1)
+	c.Assert(queries[0]["id"], Equals, float64(10001))
+	c.Assert(queries[0]["database"], Equals, "db1")
+	c.Assert(queries[0]["query"], Equals, "select * from foo;")
+
+	url = self.formatUrl("/cluster/queries/10001?u=root&p=root")
+	req, err := libhttp.NewRequest("DELETE", url, nil)
+	c.Assert(err, IsNil)
+	resp, err = libhttp.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	c.Assert(self.coordinator.killedQuery, Equals, uint64(10001))
+}
+
+func (self *ApiSuite) TestAsyncDeleteQuery(c *C) {
+	query := "delete from foo where time < now() - 1d;"
+	addr := self.formatUrl("/db/foo/series?q=%s&u=dbuser&p=password&async=true", url.QueryEscape(query))
+	resp, err := libhttp.Get(addr)
+	c.Assert(err, IsNil)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusAccepted)
+	c.Assert(string(body), Equals, `{"id":10001}`)
+	c.Assert(self.coordinator.asyncDeleteQuery, Equals, query)
+
+	resp, err = libhttp.Get(self.formatUrl("/db/foo/delete_jobs/10001?u=dbuser&p=password"))
+	c.Assert(err, IsNil)
+	body, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	job := &coordinator.DeleteJob{}
+	c.Assert(json.Unmarshal(body, job), IsNil)
+	c.Assert(job.Database, Equals, "foo")
+	c.Assert(job.Query, Equals, query)
+	c.Assert(job.Done, Equals, true)
+
+	resp, err = libhttp.Get(self.formatUrl("/db/foo/delete_jobs/10002?u=dbuser&p=password"))
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusNotFound)
+}
+
+func (self *ApiSuite) TestRebalance(c *C) {
+	for _, dryRun := range []bool{true, false} {
+		resp, err := libhttp.Post(self.formatUrl("/cluster/rebalance?u=root&p=root&dryRun=%v", dryRun), "", nil)
+		c.Assert(err, IsNil)
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		c.Assert(err, IsNil)
+		if dryRun {
+			c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+		} else {
+			c.Assert(resp.StatusCode, Equals, libhttp.StatusAccepted)
+		}
+		c.Assert(string(body), Equals, `[{"shardId":1,"from":1,"to":3}]`)
+	}
+
+	resp, err := libhttp.Post(self.formatUrl("/cluster/rebalance?u=dbuser&p=password"), "", nil)
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Not(Equals), libhttp.StatusAccepted)
+}
+
+func (self *ApiSuite) TestCopyAndMoveShard(c *C) {
+	for _, jobType := range []string{coordinator.SHARD_JOB_COPY, coordinator.SHARD_JOB_MOVE} {
+		resp, err := libhttp.Post(self.formatUrl("/cluster/shards/4/%s?u=root&p=root&from=1&to=3", jobType), "", nil)
+		c.Assert(err, IsNil)
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		c.Assert(err, IsNil)
+		c.Assert(resp.StatusCode, Equals, libhttp.StatusAccepted)
+		c.Assert(string(body), Equals, `{"id":20001}`)
+
+		resp, err = libhttp.Get(self.formatUrl("/cluster/shard_jobs/20001?u=root&p=root"))
+		c.Assert(err, IsNil)
+		body, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		c.Assert(err, IsNil)
+		c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+		job := &coordinator.ShardJob{}
+		c.Assert(json.Unmarshal(body, job), IsNil)
+		c.Assert(*job, DeepEquals, coordinator.ShardJob{Id: 20001, Type: jobType, ShardId: 4, From: 1, To: 3})
+	}
+
+	resp, err := libhttp.Get(self.formatUrl("/cluster/shard_jobs?u=root&p=root"))
+	c.Assert(err, IsNil)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	c.Assert(err, IsNil)
+	jobs := []*coordinator.ShardJob{}
+	c.Assert(json.Unmarshal(body, &jobs), IsNil)
+	c.Assert(jobs, HasLen, 1)
+
+	resp, err = libhttp.Get(self.formatUrl("/cluster/shard_jobs/20002?u=root&p=root"))
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusNotFound)
+
+	resp, err = libhttp.Post(self.formatUrl("/cluster/shards/4/copy?u=root&p=root&from=1"), "", nil)
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusBadRequest)
+}
+
+func (self *ApiSuite) TestRemoveServer(c *C) {
+	req, _ := libhttp.NewRequest("DELETE", self.formatUrl("/cluster/servers/2?u=root&p=root"), nil)
+	resp, err := libhttp.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusAccepted)
+	c.Assert(string(body), Equals, `[{"shardId":1,"from":2,"to":3}]`)
+
+	req, _ = libhttp.NewRequest("DELETE", self.formatUrl("/cluster/servers/5?u=root&p=root"), nil)
+	resp, err = libhttp.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusBadRequest)
+}
+
+func (self *ApiSuite) TestClusterStatus(c *C) {
+	resp, err := libhttp.Get(self.formatUrl("/cluster/status?u=root&p=root"))
+	c.Assert(err, IsNil)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	status := &coordinator.ClusterStatus{}
+	c.Assert(json.Unmarshal(body, status), IsNil)
+	c.Assert(status.Raft.Leader, Equals, "abc")
+	c.Assert(status.Servers, HasLen, 2)
+	c.Assert(status.Servers[1].Up, Equals, false)
+	c.Assert(status.Servers[1].WalLag, Equals, uint32(5))
+	c.Assert(status.UnderReplicatedShards, HasLen, 1)
+	c.Assert(status.UnderReplicatedShards[0].DownServerIds, DeepEquals, []uint32{2})
+}
+
+func (self *ApiSuite) TestHintedHandoff(c *C) {
+	resp, err := libhttp.Get(self.formatUrl("/cluster/hinted_handoff?u=root&p=root"))
+	c.Assert(err, IsNil)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusOK)
+	c.Assert(string(body), Equals, "[]")
+
+	// hinted handoff isn't enabled in the test configuration
+	req, _ := libhttp.NewRequest("DELETE", self.formatUrl("/cluster/hinted_handoff/2?u=root&p=root"), nil)
+	resp, err = libhttp.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, libhttp.StatusBadRequest)
+}
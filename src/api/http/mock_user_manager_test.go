@@ -10,6 +10,7 @@ type Operation struct {
 	username  string
 	password  string
 	isAdmin   bool
+	limits    *common.QueryLimits
 }
 
 type MockDbUser struct {
@@ -81,17 +82,17 @@ func (self *MockUserManager) CreateClusterAdminUser(request common.User, usernam
 		return fmt.Errorf("Invalid empty username")
 	}
 
-	self.ops = append(self.ops, &Operation{"cluster_admin_add", username, password, false})
+	self.ops = append(self.ops, &Operation{"cluster_admin_add", username, password, false, nil})
 	return nil
 }
 
 func (self *MockUserManager) DeleteClusterAdminUser(requester common.User, username string) error {
-	self.ops = append(self.ops, &Operation{"cluster_admin_del", username, "", false})
+	self.ops = append(self.ops, &Operation{"cluster_admin_del", username, "", false, nil})
 	return nil
 }
 
 func (self *MockUserManager) ChangeClusterAdminPassword(requester common.User, username, password string) error {
-	self.ops = append(self.ops, &Operation{"cluster_admin_passwd", username, password, false})
+	self.ops = append(self.ops, &Operation{"cluster_admin_passwd", username, password, false, nil})
 	return nil
 }
 
@@ -100,22 +101,27 @@ func (self *MockUserManager) CreateDbUser(request common.User, db, username, pas
 		return fmt.Errorf("Invalid empty username")
 	}
 
-	self.ops = append(self.ops, &Operation{"db_user_add", username, password, false})
+	self.ops = append(self.ops, &Operation{"db_user_add", username, password, false, nil})
 	return nil
 }
 
 func (self *MockUserManager) DeleteDbUser(requester common.User, db, username string) error {
-	self.ops = append(self.ops, &Operation{"db_user_del", username, "", false})
+	self.ops = append(self.ops, &Operation{"db_user_del", username, "", false, nil})
 	return nil
 }
 
 func (self *MockUserManager) ChangeDbUserPassword(requester common.User, db, username, password string) error {
-	self.ops = append(self.ops, &Operation{"db_user_passwd", username, password, false})
+	self.ops = append(self.ops, &Operation{"db_user_passwd", username, password, false, nil})
 	return nil
 }
 
 func (self *MockUserManager) SetDbAdmin(requester common.User, db, username string, isAdmin bool) error {
-	self.ops = append(self.ops, &Operation{"db_user_admin", username, "", isAdmin})
+	self.ops = append(self.ops, &Operation{"db_user_admin", username, "", isAdmin, nil})
+	return nil
+}
+
+func (self *MockUserManager) SetDbUserQueryLimits(requester common.User, db, username string, limits *common.QueryLimits) error {
+	self.ops = append(self.ops, &Operation{"db_user_limits", username, "", false, limits})
 	return nil
 }
 
@@ -32,4 +32,8 @@ type UserManager interface {
 	// isn't a db admin or cluster admin or if user isn't a db user
 	// for the given db
 	SetDbAdmin(requester common.User, db, username string, isAdmin bool) error
+	// override the default query limits for the given db user, nil
+	// limits restore the defaults. It's an error if the requester isn't
+	// a cluster admin
+	SetDbUserQueryLimits(requester common.User, db, username string, limits *common.QueryLimits) error
 }
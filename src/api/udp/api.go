@@ -20,6 +20,7 @@ type Server struct {
 	conn          *net.UDPConn
 	user          *cluster.ClusterAdmin
 	shutdown      chan bool
+	droppedPoints *coordinator.DroppedPointsCounter
 }
 
 func NewServer(config *configuration.Configuration, coord coordinator.Coordinator, clusterConfig *cluster.ClusterConfiguration) *Server {
@@ -30,6 +31,7 @@ func NewServer(config *configuration.Configuration, coord coordinator.Coordinato
 	self.coordinator = coord
 	self.shutdown = make(chan bool, 1)
 	self.clusterConfig = clusterConfig
+	self.droppedPoints = coord.DroppedPointsCounter("UDP")
 
 	return self
 }
@@ -92,6 +94,10 @@ func (self *Server) HandleSocket(socket *net.UDPConn) {
 
 			serie := []*protocol.Series{series}
 			err = self.coordinator.WriteSeriesData(self.user, self.database, serie)
+			if _, ok := err.(*WriteRateLimitError); ok {
+				self.droppedPoints.Add(self.database, serie)
+				continue
+			}
 			if err != nil {
 				log.Error("UDP cannot write data: %s", err)
 				continue
@@ -0,0 +1,574 @@
+package cluster
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	p "protocol"
+	"sort"
+	"time"
+
+	log "code.google.com/p/log4go"
+)
+
+const (
+	// The number of time ranges of a shard that are compared separately
+	// when the replicas of a series don't match
+	DIGEST_RANGES = 64
+	// The maximum number of series digests or points sent in a response
+	// or written in a request while the replicas are compared
+	ANTI_ENTROPY_CHUNK_SIZE = 1000
+	// How long to wait for a response of another server while the
+	// replicas are compared
+	ANTI_ENTROPY_RESPONSE_TIMEOUT = 5 * time.Minute
+)
+
+var (
+	writeRequest       = p.Request_WRITE
+	shardDigestRequest = p.Request_SHARD_DIGEST
+	shardPointsRequest = p.Request_SHARD_POINTS
+	shardWriteRequest  = p.Request_SHARD_WRITE
+)
+
+// The digest of the points of a series in a time range of a shard
+type RangeDigest struct {
+	// in microseconds, the end is exclusive
+	StartTime int64
+	EndTime   int64
+	Points    int64
+	Hash      []byte
+	// set if points in the range were deleted and the deletes weren't
+	// purged yet, the deleted points aren't part of the hash
+	Deleted bool
+}
+
+// The digest of the points of a series in a shard. The digests have two
+// levels, not a full Merkle tree: the hash of the series is computed from
+// the hashes of its DIGEST_RANGES time ranges and the ranges are only
+// compared when the series hashes differ. The ranges without points or
+// deletes are left out.
+type SeriesDigest struct {
+	Database string
+	Name     string
+	Points   int64
+	Hash     []byte
+	Ranges   []*RangeDigest
+}
+
+func (self *SeriesDigest) ToProtobuf(withRanges bool) *p.SeriesDigest {
+	digest := &p.SeriesDigest{
+		Database: &self.Database,
+		Name:     &self.Name,
+		Points:   &self.Points,
+		Hash:     self.Hash,
+	}
+	if !withRanges {
+		return digest
+	}
+	for _, r := range self.Ranges {
+		digest.Ranges = append(digest.Ranges, &p.RangeDigest{
+			StartTime: p.Int64(r.StartTime),
+			EndTime:   p.Int64(r.EndTime),
+			Points:    p.Int64(r.Points),
+			Hash:      r.Hash,
+			Deleted:   &r.Deleted,
+		})
+	}
+	return digest
+}
+
+func NewSeriesDigestFromProtobuf(digest *p.SeriesDigest) *SeriesDigest {
+	s := &SeriesDigest{
+		Database: digest.GetDatabase(),
+		Name:     digest.GetName(),
+		Points:   digest.GetPoints(),
+		Hash:     digest.Hash,
+	}
+	for _, r := range digest.Ranges {
+		s.Ranges = append(s.Ranges, &RangeDigest{
+			StartTime: r.GetStartTime(),
+			EndTime:   r.GetEndTime(),
+			Points:    r.GetPoints(),
+			Hash:      r.Hash,
+			Deleted:   r.GetDeleted(),
+		})
+	}
+	return s
+}
+
+// The number of points a server has in a range that doesn't match on
+// all the servers
+type ReplicaPoints struct {
+	ServerId uint32 `json:"serverId"`
+	Points   int64  `json:"points"`
+}
+
+type RangeDivergence struct {
+	Database string `json:"database"`
+	Series   string `json:"series"`
+	// in microseconds, the end is exclusive
+	StartTime int64            `json:"startTime"`
+	EndTime   int64            `json:"endTime"`
+	Replicas  []*ReplicaPoints `json:"replicas"`
+	// the number of points copied to the servers that were missing them
+	RepairedPoints int64 `json:"repairedPoints"`
+	// set if points in the range were deleted on some of the servers, the
+	// range isn't repaired since the deleted points would be copied back
+	Deleted bool `json:"deleted"`
+}
+
+// The result of comparing the replicas of a shard
+type ShardVerification struct {
+	ShardId     uint32             `json:"shardId"`
+	ServerIds   []uint32           `json:"serverIds"`
+	Consistent  bool               `json:"consistent"`
+	Divergences []*RangeDivergence `json:"divergences"`
+	Repaired    bool               `json:"repaired"`
+}
+
+// A copy of a shard on this or another server
+type shardReplica interface {
+	serverId() uint32
+	// returns the digests of the given series with their ranges or the
+	// digests of all the series without the ranges if database is empty
+	digests(database string, series []string) ([]*SeriesDigest, error)
+	// returns the digest of the series in the time range as one range,
+	// nil if the series doesn't have points or deletes in the range
+	rangeDigest(database, series string, startTime, endTime int64) (*RangeDigest, error)
+	points(database, series string, startTime, endTime int64, yield func(*p.Series) error) error
+	write(database string, series *p.Series) error
+}
+
+// The copy of the shard in the local store. The local server doesn't
+// have to be one of the servers of the shard, e.g. while a copy of the
+// shard is moved to it.
+type localReplica struct {
+	shard         *ShardData
+	store         LocalShardStore
+	localServerId uint32
+}
+
+func (self *localReplica) serverId() uint32 {
+	return self.localServerId
+}
+
+func (self *localReplica) digests(database string, series []string) ([]*SeriesDigest, error) {
+	return self.store.GetShardDigests(self.shard.id, database, series, self.shard.startMicro, self.shard.endMicro, DIGEST_RANGES)
+}
+
+func (self *localReplica) rangeDigest(database, series string, startTime, endTime int64) (*RangeDigest, error) {
+	digests, err := self.store.GetShardDigests(self.shard.id, database, []string{series}, startTime, endTime, 1)
+	return singleRange(digests), err
+}
+
+// Returns the range of the digests of a single series with one range
+func singleRange(digests []*SeriesDigest) *RangeDigest {
+	if len(digests) == 0 || len(digests[0].Ranges) == 0 {
+		return nil
+	}
+	return digests[0].Ranges[0]
+}
+
+func (self *localReplica) points(database, series string, startTime, endTime int64, yield func(*p.Series) error) error {
+	return self.store.GetShardPoints(self.shard.id, database, series, startTime, endTime, yield)
+}
+
+func (self *localReplica) write(database string, series *p.Series) error {
+	request := &p.Request{Type: &writeRequest, Database: &database, MultiSeries: []*p.Series{series}, ShardId: &self.shard.id}
+	return self.store.Write(request)
+}
+
+type remoteReplica struct {
+	shard  *ShardData
+	server *ClusterServer
+}
+
+func (self *remoteReplica) serverId() uint32 {
+	return self.server.Id
+}
+
+// Makes the request and calls yield with every response until the end
+// of the stream. The request is canceled if it stops before the end of
+// the stream.
+func (self *remoteReplica) makeRequest(request *p.Request, yield func(*p.Response) error) error {
+	request.ShardId = &self.shard.id
+	responses := make(chan *p.Response, 10)
+	go self.server.MakeRequest(request, responses)
+	for {
+		select {
+		case response := <-responses:
+			if response.ErrorMessage != nil {
+				self.server.CancelRequest(responses)
+				return errors.New(response.GetErrorMessage())
+			}
+			if err := yield(response); err != nil {
+				self.server.CancelRequest(responses)
+				return err
+			}
+			if response.GetType() == p.Response_END_STREAM {
+				return nil
+			}
+		case <-time.After(ANTI_ENTROPY_RESPONSE_TIMEOUT):
+			self.server.CancelRequest(responses)
+			return fmt.Errorf("Server %d didn't respond in %s", self.server.Id, ANTI_ENTROPY_RESPONSE_TIMEOUT)
+		}
+	}
+}
+
+func (self *remoteReplica) digests(database string, series []string) ([]*SeriesDigest, error) {
+	request := &p.Request{Type: &shardDigestRequest, Database: &database, SeriesNames: series}
+	digests := []*SeriesDigest{}
+	err := self.makeRequest(request, func(response *p.Response) error {
+		for _, digest := range response.SeriesDigests {
+			digests = append(digests, NewSeriesDigestFromProtobuf(digest))
+		}
+		return nil
+	})
+	return digests, err
+}
+
+func (self *remoteReplica) rangeDigest(database, series string, startTime, endTime int64) (*RangeDigest, error) {
+	request := &p.Request{
+		Type:        &shardDigestRequest,
+		Database:    &database,
+		SeriesNames: []string{series},
+		StartTime:   &startTime,
+		EndTime:     &endTime,
+	}
+	digests := []*SeriesDigest{}
+	err := self.makeRequest(request, func(response *p.Response) error {
+		for _, digest := range response.SeriesDigests {
+			digests = append(digests, NewSeriesDigestFromProtobuf(digest))
+		}
+		return nil
+	})
+	return singleRange(digests), err
+}
+
+func (self *remoteReplica) points(database, series string, startTime, endTime int64, yield func(*p.Series) error) error {
+	request := &p.Request{
+		Type:        &shardPointsRequest,
+		Database:    &database,
+		SeriesNames: []string{series},
+		StartTime:   &startTime,
+		EndTime:     &endTime,
+	}
+	return self.makeRequest(request, func(response *p.Response) error {
+		for _, s := range response.MultiSeries {
+			if err := yield(s); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// The server doesn't have to be one of the servers of the shard yet, a
+// shard write goes to its copy of the shard directly
+func (self *remoteReplica) write(database string, series *p.Series) error {
+	request := &p.Request{Type: &shardWriteRequest, Database: &database, MultiSeries: []*p.Series{series}, ShardId: &self.shard.id}
+	return self.server.Write(request)
+}
+
+// Returns the digests of the series of the copy of the shard on this
+// server, see shardReplica.digests
+func (self *ClusterConfiguration) LocalShardDigests(shard *ShardData, database string, series []string) ([]*SeriesDigest, error) {
+	return self.localReplica(shard).digests(database, series)
+}
+
+// Returns the digest of the series in the time range of the copy of the
+// shard on this server as one range, see shardReplica.rangeDigest
+func (self *ClusterConfiguration) LocalShardRangeDigest(shard *ShardData, database, series string, startTime, endTime int64) (*RangeDigest, error) {
+	return self.localReplica(shard).rangeDigest(database, series, startTime, endTime)
+}
+
+// Writes the series to the copy of the shard on this server, the local
+// server doesn't have to be one of the servers of the shard
+func (self *ClusterConfiguration) LocalShardWrite(shard *ShardData, database string, series *p.Series) error {
+	return self.localReplica(shard).write(database, series)
+}
+
+// Calls yield with the points of the series in the time range of the
+// copy of the shard on this server, one column at a time
+func (self *ClusterConfiguration) LocalShardPoints(shard *ShardData, database, series string, startTime, endTime int64, yield func(*p.Series) error) error {
+	return self.localReplica(shard).points(database, series, startTime, endTime, yield)
+}
+
+func (self *ClusterConfiguration) localReplica(shard *ShardData) *localReplica {
+	return &localReplica{shard, self.shardStore, self.LocalServer.Id}
+}
+
+func (self *ShardData) replicas() []shardReplica {
+	replicas := []shardReplica{}
+	servers, store := self.serversAndStore()
+	if store != nil {
+		replicas = append(replicas, &localReplica{self, store, self.localServerId})
+	}
+	for _, server := range servers {
+		replicas = append(replicas, &remoteReplica{self, server})
+	}
+	return replicas
+}
+
+type seriesKey struct {
+	database string
+	name     string
+}
+
+func digestsByKey(digests []*SeriesDigest) map[seriesKey]*SeriesDigest {
+	byKey := make(map[seriesKey]*SeriesDigest, len(digests))
+	for _, digest := range digests {
+		byKey[seriesKey{digest.Database, digest.Name}] = digest
+	}
+	return byKey
+}
+
+// Compares the copies of the shard on all the servers. The digests of
+// the series are compared first, the ranges are only compared for the
+// series that don't match. If repair is set the points that are missing
+// on a server are copied from the other servers. Points that have
+// different values on different servers are left alone since there's
+// no way to tell which one is right, and so are the ranges with deletes
+// that weren't purged on any server so the deleted points aren't copied
+// back. The deletes that were purged can't be told apart from missing
+// points.
+func (self *ShardData) Verify(repair bool) (*ShardVerification, error) {
+	return self.verifyReplicas(self.replicas(), repair)
+}
+
+func (self *ShardData) verifyReplicas(replicas []shardReplica, repair bool) (*ShardVerification, error) {
+	serverIds := make([]uint32, 0, len(replicas))
+	for _, replica := range replicas {
+		serverIds = append(serverIds, replica.serverId())
+	}
+	verification := &ShardVerification{
+		ShardId:     self.id,
+		ServerIds:   serverIds,
+		Consistent:  true,
+		Divergences: []*RangeDivergence{},
+		Repaired:    repair,
+	}
+	if len(replicas) < 2 {
+		return verification, nil
+	}
+
+	seriesDigests := make([]map[seriesKey]*SeriesDigest, len(replicas))
+	for i, replica := range replicas {
+		digests, err := replica.digests("", nil)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read the digests of shard %d on server %d: %s", self.id, replica.serverId(), err)
+		}
+		seriesDigests[i] = digestsByKey(digests)
+	}
+
+	// the series that are missing or different on any server
+	divergent := make(map[string][]string)
+	for i := range replicas {
+		for key, digest := range seriesDigests[i] {
+			for j := range replicas {
+				other := seriesDigests[j][key]
+				if other != nil && bytes.Equal(other.Hash, digest.Hash) {
+					continue
+				}
+				divergent[key.database] = append(divergent[key.database], key.name)
+				// don't add the series again for the other servers
+				for k := range replicas {
+					delete(seriesDigests[k], key)
+				}
+				break
+			}
+		}
+	}
+
+	databases := make([]string, 0, len(divergent))
+	for database := range divergent {
+		databases = append(databases, database)
+	}
+	sort.Strings(databases)
+
+	for _, database := range databases {
+		names := divergent[database]
+		sort.Strings(names)
+		for start := 0; start < len(names); start += ANTI_ENTROPY_CHUNK_SIZE {
+			end := start + ANTI_ENTROPY_CHUNK_SIZE
+			if end > len(names) {
+				end = len(names)
+			}
+			divergences, err := self.compareRanges(replicas, database, names[start:end], repair)
+			if err != nil {
+				return nil, err
+			}
+			verification.Divergences = append(verification.Divergences, divergences...)
+		}
+	}
+	verification.Consistent = len(verification.Divergences) == 0
+	return verification, nil
+}
+
+func (self *ShardData) compareRanges(replicas []shardReplica, database string, names []string, repair bool) ([]*RangeDivergence, error) {
+	seriesDigests := make([]map[seriesKey]*SeriesDigest, len(replicas))
+	for i, replica := range replicas {
+		digests, err := replica.digests(database, names)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read the digests of shard %d on server %d: %s", self.id, replica.serverId(), err)
+		}
+		seriesDigests[i] = digestsByKey(digests)
+	}
+
+	divergences := []*RangeDivergence{}
+	for _, name := range names {
+		key := seriesKey{database, name}
+		// the ranges of the series on every server by start time
+		ranges := make([]map[int64]*RangeDigest, len(replicas))
+		startTimes := []int64{}
+		endTimes := make(map[int64]int64)
+		for i := range replicas {
+			ranges[i] = make(map[int64]*RangeDigest)
+			if seriesDigests[i][key] == nil {
+				continue
+			}
+			for _, r := range seriesDigests[i][key].Ranges {
+				ranges[i][r.StartTime] = r
+				if _, ok := endTimes[r.StartTime]; !ok {
+					startTimes = append(startTimes, r.StartTime)
+					endTimes[r.StartTime] = r.EndTime
+				}
+			}
+		}
+		sort.Sort(int64Slice(startTimes))
+
+		for _, startTime := range startTimes {
+			divergence := &RangeDivergence{
+				Database:  database,
+				Series:    name,
+				StartTime: startTime,
+				EndTime:   endTimes[startTime],
+				Replicas:  make([]*ReplicaPoints, len(replicas)),
+			}
+			matches := true
+			var firstHash []byte
+			for i, replica := range replicas {
+				divergence.Replicas[i] = &ReplicaPoints{ServerId: replica.serverId()}
+				var hash []byte
+				if r := ranges[i][startTime]; r != nil {
+					divergence.Replicas[i].Points = r.Points
+					divergence.Deleted = divergence.Deleted || r.Deleted
+					hash = r.Hash
+				}
+				if i == 0 {
+					firstHash = hash
+				} else if !bytes.Equal(firstHash, hash) {
+					matches = false
+				}
+			}
+			if matches {
+				continue
+			}
+
+			if repair && divergence.Deleted {
+				log.Info("Not repairing %s in shard %d between %d and %d, points were deleted on some of the servers", name, self.id, startTime, divergence.EndTime)
+			} else if repair {
+				repaired, err := self.repairRange(replicas, database, name, divergence.StartTime, divergence.EndTime)
+				if err != nil {
+					return nil, err
+				}
+				divergence.RepairedPoints = repaired
+			}
+			divergences = append(divergences, divergence)
+		}
+	}
+	return divergences, nil
+}
+
+type replicaPointKey struct {
+	column    string
+	timestamp int64
+	sequence  uint64
+}
+
+// Copies the points of the range that are missing on a server from the
+// other servers, returns the number of copied points
+func (self *ShardData) repairRange(replicas []shardReplica, database, series string, startTime, endTime int64) (int64, error) {
+	points := make([]map[replicaPointKey]*p.Point, len(replicas))
+	for i, replica := range replicas {
+		points[i] = make(map[replicaPointKey]*p.Point)
+		err := replica.points(database, series, startTime, endTime, func(s *p.Series) error {
+			if len(s.Fields) == 0 {
+				return nil
+			}
+			for _, point := range s.Points {
+				points[i][replicaPointKey{s.Fields[0], point.GetTimestamp(), point.GetSequenceNumber()}] = point
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, fmt.Errorf("Cannot read the points of shard %d on server %d: %s", self.id, replica.serverId(), err)
+		}
+	}
+
+	repaired := int64(0)
+	for i, replica := range replicas {
+		missing := make(map[string][]*p.Point)
+		for j := range replicas {
+			if j == i {
+				continue
+			}
+			for key, point := range points[j] {
+				if _, ok := points[i][key]; ok {
+					continue
+				}
+				missing[key.column] = append(missing[key.column], point)
+				// don't copy the point again from the next server
+				points[i][key] = point
+			}
+		}
+
+		for column, columnPoints := range missing {
+			for start := 0; start < len(columnPoints); start += ANTI_ENTROPY_CHUNK_SIZE {
+				end := start + ANTI_ENTROPY_CHUNK_SIZE
+				if end > len(columnPoints) {
+					end = len(columnPoints)
+				}
+				s := &p.Series{Name: &series, Fields: []string{column}, Points: columnPoints[start:end]}
+				if err := replica.write(database, s); err != nil {
+					return repaired, fmt.Errorf("Cannot repair shard %d on server %d: %s", self.id, replica.serverId(), err)
+				}
+				repaired += int64(end - start)
+			}
+		}
+		if len(missing) > 0 {
+			log.Info("Copied the missing points of %s in shard %d to server %d", series, self.id, replica.serverId())
+		}
+	}
+	return repaired, nil
+}
+
+type int64Slice []int64
+
+func (self int64Slice) Len() int           { return len(self) }
+func (self int64Slice) Less(i, j int) bool { return self[i] < self[j] }
+func (self int64Slice) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+
+// Compares the replicas of the shards of this server every interval and
+// copies the missing points between them. A shard is repaired by the
+// server with the smallest id that has a copy of it.
+func (self *ClusterConfiguration) RepairShardsPeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for _ = range ticker.C {
+		for _, shard := range self.GetAllShards() {
+			serverIds := shard.ServerIds()
+			if !shard.IsLocal() || len(serverIds) < 2 || serverIds[0] != self.LocalServer.Id {
+				continue
+			}
+			verification, err := shard.Verify(true)
+			if err != nil {
+				log.Error("Cannot compare the replicas of shard %d: %s", shard.Id(), err)
+				continue
+			}
+			if !verification.Consistent {
+				log.Warn("Repaired %d ranges of shard %d that didn't match on all the servers", len(verification.Divergences), shard.Id())
+			}
+		}
+	}
+}
@@ -39,6 +39,8 @@ type WAL interface {
 	CreateCheckpoint() error
 	RecoverServerFromRequestNumber(requestNumber uint32, shardIds []uint32, yield func(request *protocol.Request, shardId uint32) error) error
 	RecoverServerFromLastCommit(serverId uint32, shardIds []uint32, yield func(request *protocol.Request, shardId uint32) error) error
+	RemoveServer(serverId uint32) error
+	ServerLag(serverIds []uint32) map[uint32]uint32
 }
 
 type ShardCreator interface {
@@ -57,7 +59,7 @@ const (
 */
 type ClusterConfiguration struct {
 	createDatabaseLock         sync.RWMutex
-	DatabaseReplicationFactors map[string]struct{}
+	DatabaseReplicationFactors map[string]uint8
 	usersLock                  sync.RWMutex
 	clusterAdmins              map[string]*ClusterAdmin
 	dbUsers                    map[string]map[string]*DbUser
@@ -84,6 +86,7 @@ type ClusterConfiguration struct {
 	shardsByIdLock             sync.RWMutex
 	LocalRaftName              string
 	writeBuffers               []*WriteBuffer
+	hintedHandoff              *HintedHandoff
 }
 
 type ContinuousQuery struct {
@@ -92,7 +95,8 @@ type ContinuousQuery struct {
 }
 
 type Database struct {
-	Name string `json:"name"`
+	Name              string `json:"name"`
+	ReplicationFactor uint8  `json:"replicationFactor"`
 }
 
 func NewClusterConfiguration(
@@ -100,8 +104,12 @@ func NewClusterConfiguration(
 	wal WAL,
 	shardStore LocalShardStore,
 	connectionCreator func(string) ServerConnection) *ClusterConfiguration {
+	var hintedHandoff *HintedHandoff
+	if config.HintedHandoffDir != "" {
+		hintedHandoff = NewHintedHandoff(config.HintedHandoffDir, config.HintedHandoffMaxSize, config.HintedHandoffMaxAge)
+	}
 	return &ClusterConfiguration{
-		DatabaseReplicationFactors: make(map[string]struct{}),
+		DatabaseReplicationFactors: make(map[string]uint8),
 		clusterAdmins:              make(map[string]*ClusterAdmin),
 		dbUsers:                    make(map[string]map[string]*DbUser),
 		continuousQueries:          make(map[string][]*ContinuousQuery),
@@ -116,6 +124,7 @@ func NewClusterConfiguration(
 		shortTermShards:            make([]*ShardData, 0),
 		random:                     rand.New(rand.NewSource(time.Now().UnixNano())),
 		shardsById:                 make(map[uint32]*ShardData, 0),
+		hintedHandoff:              hintedHandoff,
 	}
 }
 
@@ -138,16 +147,30 @@ func (self *ClusterConfiguration) CreateFutureShardsAutomaticallyBeforeTimeComes
 }
 
 func (self *ClusterConfiguration) automaticallyCreateFutureShard(shards []*ShardData, shardType ShardType) {
-	if len(shards) == 0 {
-		// don't automatically create shards if they haven't created any yet.
-		return
+	// only the replication factors of the databases need new shards
+	used := make(map[uint8]bool)
+	for _, database := range self.GetDatabases() {
+		used[database.ReplicationFactor] = true
+	}
+
+	// don't automatically create shards if they haven't created any
+	// yet. The shards are in time descending order, so the first shard
+	// of every replication factor is the latest one.
+	latestShards := make(map[uint8]*ShardData)
+	for _, shard := range shards {
+		rf := self.shardReplicationFactor(shard)
+		if _, ok := latestShards[rf]; !ok && used[rf] {
+			latestShards[rf] = shard
+		}
 	}
-	latestShard := shards[0]
-	if latestShard.endTime.Add(-15*time.Minute).Unix() < time.Now().Unix() {
-		newShardTime := latestShard.endTime.Add(time.Second)
-		microSecondEpochForNewShard := newShardTime.Unix() * 1000 * 1000
-		log.Info("Automatically creating shard for %s", newShardTime.Format("Mon Jan 2 15:04:05 -0700 MST 2006"))
-		self.createShards(microSecondEpochForNewShard, shardType)
+
+	for rf, latestShard := range latestShards {
+		if latestShard.endTime.Add(-15*time.Minute).Unix() < time.Now().Unix() {
+			newShardTime := latestShard.endTime.Add(time.Second)
+			microSecondEpochForNewShard := newShardTime.Unix() * 1000 * 1000
+			log.Info("Automatically creating shard for %s with replication factor %d", newShardTime.Format("Mon Jan 2 15:04:05 -0700 MST 2006"), rf)
+			self.createShards(microSecondEpochForNewShard, shardType, rf)
+		}
 	}
 }
 
@@ -155,6 +178,33 @@ func (self *ClusterConfiguration) ServerId() uint32 {
 	return self.LocalServer.Id
 }
 
+// Returns true if the server is the local one or the heartbeats reach it
+func (self *ClusterConfiguration) IsServerUp(id uint32) bool {
+	if self.LocalServer != nil && self.LocalServer.Id == id {
+		return true
+	}
+	self.serversLock.RLock()
+	defer self.serversLock.RUnlock()
+	for _, server := range self.servers {
+		if server.Id == id {
+			return server.IsUp()
+		}
+	}
+	return false
+}
+
+// Returns the ids of the servers in the cluster, the local server
+// included
+func (self *ClusterConfiguration) ServerIds() []uint32 {
+	self.serversLock.RLock()
+	defer self.serversLock.RUnlock()
+	ids := make([]uint32, 0, len(self.servers))
+	for _, server := range self.servers {
+		ids = append(ids, server.Id)
+	}
+	return ids
+}
+
 func (self *ClusterConfiguration) IsSingleServer() bool {
 	return len(self.servers) < 2
 }
@@ -221,8 +271,15 @@ func (self *ClusterConfiguration) AddPotentialServer(server *ClusterServer) {
 	self.serversLock.Lock()
 	defer self.serversLock.Unlock()
 	server.State = Potential
+	// ids of removed servers aren't reused, the new server gets the next
+	// id after the highest one
+	server.Id = 1
+	for _, s := range self.servers {
+		if s.Id >= server.Id {
+			server.Id = s.Id + 1
+		}
+	}
 	self.servers = append(self.servers, server)
-	server.Id = uint32(len(self.servers))
 	log.Info("Added server to cluster config: %d, %s, %s", server.Id, server.RaftConnectionString, server.ProtobufConnectionString)
 	log.Info("Checking whether this is the local server local: %s, new: %s", self.config.ProtobufConnectionString(), server.ProtobufConnectionString)
 
@@ -246,20 +303,102 @@ func (self *ClusterConfiguration) AddPotentialServer(server *ClusterServer) {
 		server.connection = self.connectionCreator(server.ProtobufConnectionString)
 		server.Connect()
 	}
-	writeBuffer := NewWriteBuffer(fmt.Sprintf("%d", server.GetId()), server, self.wal, server.Id, self.config.PerServerWriteBufferSize)
+	writeBuffer := NewWriteBuffer(fmt.Sprintf("%d", server.GetId()), server, self.wal, server.Id, self.config.PerServerWriteBufferSize, self.hintedHandoffQueue(server.Id))
 	self.writeBuffers = append(self.writeBuffers, writeBuffer)
 	server.SetWriteBuffer(writeBuffer)
 	server.StartHeartbeat()
 	return
 }
 
+// Removes a server that doesn't have a copy of any shard anymore from the
+// cluster. Its writes aren't buffered anymore, the wal doesn't keep the
+// requests it didn't commit and its hinted handoff queue is dropped.
+func (self *ClusterConfiguration) RemoveServer(id uint32) error {
+	for _, shard := range self.GetAllShards() {
+		for _, serverId := range shard.ServerIds() {
+			if serverId == id {
+				return fmt.Errorf("Server %d still has a copy of shard %d", id, shard.Id())
+			}
+		}
+	}
+
+	self.serversLock.Lock()
+	var server *ClusterServer
+	servers := make([]*ClusterServer, 0, len(self.servers))
+	for _, s := range self.servers {
+		if s.Id == id {
+			server = s
+			continue
+		}
+		servers = append(servers, s)
+	}
+	if server == nil {
+		self.serversLock.Unlock()
+		return fmt.Errorf("Server %d doesn't exist", id)
+	}
+	self.servers = servers
+	for i, buffer := range self.writeBuffers {
+		if buffer == server.writeBuffer {
+			self.writeBuffers = append(self.writeBuffers[:i], self.writeBuffers[i+1:]...)
+			break
+		}
+	}
+	self.serversLock.Unlock()
+	log.Info("Removed server %d (%s) from the cluster", id, server.ProtobufConnectionString)
+
+	if server == self.LocalServer {
+		log.Warn("The local server was removed from the cluster, it can be shut down")
+		return nil
+	}
+	server.Stop()
+	if self.hintedHandoff != nil {
+		if err := self.hintedHandoff.Remove(id); err != nil {
+			log.Error("Cannot remove the hinted handoff queue of server %d: %s", id, err)
+		}
+	}
+	return self.wal.RemoveServer(id)
+}
+
+// Returns nil if hinted handoff is disabled or the queue can't be opened,
+// the writes for the server are kept in the wal until it's back then
+func (self *ClusterConfiguration) hintedHandoffQueue(serverId uint32) *HintedHandoffQueue {
+	if self.hintedHandoff == nil {
+		return nil
+	}
+	queue, err := self.hintedHandoff.Queue(serverId)
+	if err != nil {
+		log.Error("Cannot open the hinted handoff queue of server %d: %s", serverId, err)
+		return nil
+	}
+	return queue
+}
+
+// Returns the depth and the counters of the hinted handoff queues of the
+// local server
+func (self *ClusterConfiguration) HintedHandoffStats() []*HintedHandoffStats {
+	if self.hintedHandoff == nil {
+		return []*HintedHandoffStats{}
+	}
+	return self.hintedHandoff.Stats()
+}
+
+// Drops the requests for the server from the local hinted handoff queue,
+// e.g. for a server that is gone for good. Returns the number of dropped
+// requests.
+func (self *ClusterConfiguration) PurgeHintedHandoff(serverId uint32) (int, error) {
+	if self.hintedHandoff == nil {
+		return 0, fmt.Errorf("Hinted handoff isn't enabled")
+	}
+	return self.hintedHandoff.Purge(serverId)
+}
+
 func (self *ClusterConfiguration) GetDatabases() []*Database {
 	self.createDatabaseLock.RLock()
 	defer self.createDatabaseLock.RUnlock()
 
 	dbs := make([]*Database, 0, len(self.DatabaseReplicationFactors))
 	for name, _ := range self.DatabaseReplicationFactors {
-		dbs = append(dbs, &Database{Name: name})
+		dbs = append(dbs, &Database{Name: name, ReplicationFactor: self.getReplicationFactor(name)})
 	}
 	return dbs
 }
@@ -272,17 +411,41 @@ func (self *ClusterConfiguration) DatabaseExists(name string) bool {
 	}
 }
 
-func (self *ClusterConfiguration) CreateDatabase(name string) error {
+// A replication factor of 0 means the replication factor in the
+// configuration of the server
+func (self *ClusterConfiguration) CreateDatabase(name string, replicationFactor uint8) error {
 	self.createDatabaseLock.Lock()
 	defer self.createDatabaseLock.Unlock()
 
 	if _, ok := self.DatabaseReplicationFactors[name]; ok {
 		return common.NewDatabaseExistsError(name)
 	}
-	self.DatabaseReplicationFactors[name] = struct{}{}
+	self.DatabaseReplicationFactors[name] = replicationFactor
 	return nil
 }
 
+func (self *ClusterConfiguration) GetReplicationFactor(name string) uint8 {
+	self.createDatabaseLock.RLock()
+	defer self.createDatabaseLock.RUnlock()
+	return self.getReplicationFactor(name)
+}
+
+func (self *ClusterConfiguration) getReplicationFactor(name string) uint8 {
+	if rf := self.DatabaseReplicationFactors[name]; rf > 0 {
+		return rf
+	}
+	return uint8(self.config.ReplicationFactor)
+}
+
+// Shards that were created before the replication factor was recorded
+// use the replication factor in the configuration
+func (self *ClusterConfiguration) shardReplicationFactor(shard *ShardData) uint8 {
+	if shard.replicationFactor > 0 {
+		return shard.replicationFactor
+	}
+	return uint8(self.config.ReplicationFactor)
+}
+
 func (self *ClusterConfiguration) DropDatabase(name string) error {
 	self.createDatabaseLock.Lock()
 	defer self.createDatabaseLock.Unlock()
@@ -450,6 +613,22 @@ func (self *ClusterConfiguration) ChangeDbUserPermissions(db, username, readPerm
 	return nil
 }
 
+// Returns the query limits of the given user, i.e. the defaults from
+// the config file overridden by the limits set on the db user
+func (self *ClusterConfiguration) GetQueryLimits(user common.User) *common.QueryLimits {
+	limits := &common.QueryLimits{
+		MaxRegexSeries:        self.config.QueryMaxRegexSeries,
+		MaxPointsScanned:      self.config.QueryMaxPointsScanned,
+		MaxConcurrentQueries:  self.config.QueryMaxConcurrentQueries,
+		MaxGroupByCardinality: self.config.QueryMaxGroupByCardinality,
+	}
+
+	if dbUser, ok := user.(*DbUser); ok {
+		return limits.Merge(dbUser.Limits)
+	}
+	return limits
+}
+
 func (self *ClusterConfiguration) GetClusterAdmins() (names []string) {
 	self.usersLock.RLock()
 	defer self.usersLock.RUnlock()
@@ -501,8 +680,8 @@ func (self *ClusterConfiguration) Save() ([]byte, error) {
 		LongTermShards:    self.convertShardsToNewShardData(self.longTermShards),
 	}
 
-	for k, _ := range self.DatabaseReplicationFactors {
-		data.Databases[k] = 0
+	for k, v := range self.DatabaseReplicationFactors {
+		data.Databases[k] = v
 	}
 
 	b := bytes.NewBuffer(nil)
@@ -517,7 +696,7 @@ func (self *ClusterConfiguration) Save() ([]byte, error) {
 func (self *ClusterConfiguration) convertShardsToNewShardData(shards []*ShardData) []*NewShardData {
 	newShardData := make([]*NewShardData, len(shards), len(shards))
 	for i, shard := range shards {
-		newShardData[i] = &NewShardData{Id: shard.id, Type: shard.shardType, StartTime: shard.startTime, EndTime: shard.endTime, ServerIds: shard.serverIds, DurationSplit: shard.durationIsSplit}
+		newShardData[i] = &NewShardData{Id: shard.id, Type: shard.shardType, StartTime: shard.startTime, EndTime: shard.endTime, ServerIds: shard.ServerIds(), DurationSplit: shard.durationIsSplit, ReplicationFactor: shard.replicationFactor}
 	}
 	return newShardData
 }
@@ -526,6 +705,7 @@ func (self *ClusterConfiguration) convertNewShardDataToShards(newShards []*NewSh
 	shards := make([]*ShardData, len(newShards), len(newShards))
 	for i, newShard := range newShards {
 		shard := NewShard(newShard.Id, newShard.StartTime, newShard.EndTime, newShard.Type, newShard.DurationSplit, self.wal)
+		shard.replicationFactor = newShard.ReplicationFactor
 		servers := make([]*ClusterServer, 0)
 		for _, serverId := range newShard.ServerIds {
 			if serverId == self.LocalServer.Id {
@@ -554,9 +734,9 @@ func (self *ClusterConfiguration) Recovery(b []byte) error {
 		return err
 	}
 
-	self.DatabaseReplicationFactors = make(map[string]struct{}, len(data.Databases))
-	for k, _ := range data.Databases {
-		self.DatabaseReplicationFactors[k] = struct{}{}
+	self.DatabaseReplicationFactors = make(map[string]uint8, len(data.Databases))
+	for k, v := range data.Databases {
+		self.DatabaseReplicationFactors[k] = v
 	}
 	self.clusterAdmins = data.Admins
 	self.dbUsers = data.DbUsers
@@ -572,7 +752,7 @@ func (self *ClusterConfiguration) Recovery(b []byte) error {
 		}
 
 		server.connection = self.connectionCreator(server.ProtobufConnectionString)
-		writeBuffer := NewWriteBuffer(fmt.Sprintf("server: %d", server.GetId()), server, self.wal, server.Id, self.config.PerServerWriteBufferSize)
+		writeBuffer := NewWriteBuffer(fmt.Sprintf("server: %d", server.GetId()), server, self.wal, server.Id, self.config.PerServerWriteBufferSize, self.hintedHandoffQueue(server.Id))
 		self.writeBuffers = append(self.writeBuffers, writeBuffer)
 		server.SetWriteBuffer(writeBuffer)
 		server.Connect()
@@ -665,8 +845,14 @@ func (self *ClusterConfiguration) GetShardToWriteToBySeriesAndTime(db, series st
 		hasRandomSplit = self.config.LongTermShard.HasRandomSplit()
 		splitRegex = self.config.LongTermShard.SplitRegex()
 	}
+	// databases with different replication factors are written to
+	// different shards for the same time
+	replicationFactor := self.GetReplicationFactor(db)
 	matchingShards := make([]*ShardData, 0)
 	for _, s := range shards {
+		if self.shardReplicationFactor(s) != replicationFactor {
+			continue
+		}
 		if s.IsMicrosecondInRange(microsecondsEpoch) {
 			matchingShards = append(matchingShards, s)
 		} else if len(matchingShards) > 0 {
@@ -678,7 +864,7 @@ func (self *ClusterConfiguration) GetShardToWriteToBySeriesAndTime(db, series st
 	var err error
 	if len(matchingShards) == 0 {
 		log.Info("No matching shards for write at time %du, creating...", microsecondsEpoch)
-		matchingShards, err = self.createShards(microsecondsEpoch, shardType)
+		matchingShards, err = self.createShards(microsecondsEpoch, shardType, replicationFactor)
 		if err != nil {
 			return nil, err
 		}
@@ -696,7 +882,7 @@ func (self *ClusterConfiguration) GetShardToWriteToBySeriesAndTime(db, series st
 	return matchingShards[index], nil
 }
 
-func (self *ClusterConfiguration) createShards(microsecondsEpoch int64, shardType ShardType) ([]*ShardData, error) {
+func (self *ClusterConfiguration) createShards(microsecondsEpoch int64, shardType ShardType, replicationFactor uint8) ([]*ShardData, error) {
 	numberOfShardsToCreateForDuration := 1
 	var secondsOfDuration float64
 	if shardType == LONG_TERM {
@@ -725,7 +911,7 @@ func (self *ClusterConfiguration) createShards(microsecondsEpoch int64, shardTyp
 		serverIds := make([]uint32, 0)
 
 		// if they have the replication factor set higher than the number of servers in the cluster, limit it
-		rf := self.config.ReplicationFactor
+		rf := int(replicationFactor)
 		if rf > len(self.servers) {
 			rf = len(self.servers)
 		}
@@ -739,7 +925,7 @@ func (self *ClusterConfiguration) createShards(microsecondsEpoch int64, shardTyp
 			serverIds = append(serverIds, server.Id)
 			startIndex += 1
 		}
-		shards = append(shards, &NewShardData{StartTime: *startTime, EndTime: *endTime, ServerIds: serverIds, Type: shardType})
+		shards = append(shards, &NewShardData{StartTime: *startTime, EndTime: *endTime, ServerIds: serverIds, Type: shardType, ReplicationFactor: replicationFactor})
 	}
 
 	// call out to rafter server to create the shards (or return shard objects that the leader already knows about)
@@ -855,8 +1041,8 @@ func (self *ClusterConfiguration) HashDbAndSeriesToInt(database, series string)
 }
 
 // Add shards expects all shards to be of the same type (long term or short term) and have the same
-// start and end times. This is called to add the shard set for a given duration. If existing
-// shards have the same times, those are returned.
+// start and end times and replication factor. This is called to add the shard set for a given
+// duration. If existing shards have the same times and replication factor, those are returned.
 func (self *ClusterConfiguration) AddShards(shards []*NewShardData) ([]*ShardData, error) {
 	self.shardLock.Lock()
 	defer self.shardLock.Unlock()
@@ -878,7 +1064,11 @@ func (self *ClusterConfiguration) AddShards(shards []*NewShardData) ([]*ShardDat
 		existingShards = self.longTermShards
 	}
 
+	replicationFactor := shards[0].ReplicationFactor
 	for _, s := range existingShards {
+		if replicationFactor > 0 && self.shardReplicationFactor(s) != replicationFactor {
+			continue
+		}
 		if s.startTime.Unix() == startTime.Unix() && s.endTime.Unix() == endTime.Unix() {
 			createdShards = append(createdShards, s)
 		}
@@ -893,6 +1083,7 @@ func (self *ClusterConfiguration) AddShards(shards []*NewShardData) ([]*ShardDat
 	for _, newShard := range shards {
 		id := uint32(len(self.GetAllShards()) + 1)
 		shard := NewShard(id, newShard.StartTime, newShard.EndTime, shardType, durationIsSplit, self.wal)
+		shard.replicationFactor = newShard.ReplicationFactor
 		servers := make([]*ClusterServer, 0)
 		for _, serverId := range newShard.ServerIds {
 			// if a shard is created before the local server then the local
@@ -930,7 +1121,7 @@ func (self *ClusterConfiguration) AddShards(shards []*NewShardData) ([]*ShardDat
 			message, shard.Id(),
 			shard.StartTime().Format("Mon Jan 2 15:04:05 -0700 MST 2006"), shard.StartTime().Unix(),
 			shard.EndTime().Format("Mon Jan 2 15:04:05 -0700 MST 2006"), shard.EndTime().Unix(),
-			shard.IsLocal, shard.ServerIds())
+			shard.IsLocal(), shard.ServerIds())
 	}
 	return createdShards, nil
 }
@@ -940,6 +1131,7 @@ func (self *ClusterConfiguration) MarshalNewShardArrayToShards(newShards []*NewS
 	durationIsSplit := len(newShards) > 1
 	for i, s := range newShards {
 		shard := NewShard(s.Id, s.StartTime, s.EndTime, s.Type, durationIsSplit, self.wal)
+		shard.replicationFactor = s.ReplicationFactor
 		servers := make([]*ClusterServer, 0)
 		for _, serverId := range s.ServerIds {
 			if serverId == self.LocalServer.Id {
@@ -958,6 +1150,13 @@ func (self *ClusterConfiguration) MarshalNewShardArrayToShards(newShards []*NewS
 	return shards, nil
 }
 
+// Returns nil if the shard doesn't exist
+func (self *ClusterConfiguration) GetShardById(id uint32) *ShardData {
+	self.shardsByIdLock.RLock()
+	defer self.shardsByIdLock.RUnlock()
+	return self.shardsById[id]
+}
+
 // This function is for the request handler to get the shard to write a
 // request to locally.
 func (self *ClusterConfiguration) GetLocalShardById(id uint32) *ShardData {
@@ -988,8 +1187,15 @@ func (self *ClusterConfiguration) DropShard(shardId uint32, serverIds []uint32)
 	return nil
 }
 
+// Rewrites the local copy of the shard with the given storage engine and
+// point block size. The shard stays online, requests only wait for the
+// swap of the copies at the end.
+func (self *ClusterConfiguration) MigrateLocalShard(id uint32, engine string, pointBlockSize int) (*ShardMigration, error) {
+	return self.shardStore.MigrateShard(id, engine, pointBlockSize)
+}
+
 func (self *ClusterConfiguration) RecoverFromWAL() error {
-	writeBuffer := NewWriteBuffer("local", self.shardStore, self.wal, self.LocalServer.Id, self.config.LocalStoreWriteBufferSize)
+	writeBuffer := NewWriteBuffer("local", self.shardStore, self.wal, self.LocalServer.Id, self.config.LocalStoreWriteBufferSize, nil)
 	self.writeBuffers = append(self.writeBuffers, writeBuffer)
 	self.shardStore.SetWriteBuffer(writeBuffer)
 	var waitForAll sync.WaitGroup
@@ -1000,7 +1206,7 @@ func (self *ClusterConfiguration) RecoverFromWAL() error {
 			self.LocalServer = server
 			go func(serverId uint32) {
 				log.Info("Recovering local server")
-				self.recover(serverId, self.shardStore)
+				self.recover(serverId, self.shardStore, nil)
 				log.Info("Recovered local server")
 				waitForAll.Done()
 			}(server.Id)
@@ -1011,7 +1217,7 @@ func (self *ClusterConfiguration) RecoverFromWAL() error {
 					server.Connect()
 				}
 				log.Info("Recovering remote server %d", serverId)
-				self.recover(serverId, server)
+				self.recover(serverId, server, self.hintedHandoffQueue(serverId))
 				log.Info("Recovered remote server %d", serverId)
 				waitForAll.Done()
 			}(server.Id)
@@ -1022,7 +1228,7 @@ func (self *ClusterConfiguration) RecoverFromWAL() error {
 	return nil
 }
 
-func (self *ClusterConfiguration) recover(serverId uint32, writer Writer) error {
+func (self *ClusterConfiguration) recover(serverId uint32, writer Writer, hints *HintedHandoffQueue) error {
 	shardIds := self.shardIdsForServerId(serverId)
 	if len(shardIds) == 0 {
 		log.Info("No shards to recover for %d", serverId)
@@ -1037,7 +1243,7 @@ func (self *ClusterConfiguration) recover(serverId uint32, writer Writer) error
 		}
 		requestNumber := request.GetRequestNumber()
 		log.Debug("Sending request %s for shard %d to server %d", request.GetDescription(), shardId, serverId)
-		err := writer.Write(request)
+		_, err := writeOrHint(writer, hints, request)
 		if err != nil {
 			return err
 		}
@@ -1049,7 +1255,7 @@ func (self *ClusterConfiguration) recover(serverId uint32, writer Writer) error
 func (self *ClusterConfiguration) shardIdsForServerId(serverId uint32) []uint32 {
 	shardIds := make([]uint32, 0)
 	for _, shard := range self.GetAllShards() {
-		for _, id := range shard.serverIds {
+		for _, id := range shard.ServerIds() {
 			if id == serverId {
 				shardIds = append(shardIds, shard.Id())
 				break
@@ -1077,26 +1283,11 @@ func (self *ClusterConfiguration) updateOrRemoveShard(shardId uint32, serverIds
 		log.Error("Attempted to remove shard %d, which we couldn't find. %d shards currently loaded.", shardId, len(self.GetAllShards()))
 	}
 
-	if len(shard.serverIds) == len(serverIds) {
+	if len(shard.ServerIds()) == len(serverIds) {
 		self.removeShard(shardId)
 		return
 	}
-	self.shardsByIdLock.Lock()
-	defer self.shardsByIdLock.Unlock()
-	newIds := make([]uint32, 0)
-	for _, oldId := range shard.serverIds {
-		include := true
-		for _, removeId := range serverIds {
-			if oldId == removeId {
-				include = false
-				break
-			}
-		}
-		if include {
-			newIds = append(newIds, oldId)
-		}
-	}
-	shard.serverIds = newIds
+	shard.removeServerIds(serverIds)
 }
 
 func (self *ClusterConfiguration) removeShard(shardId uint32) {
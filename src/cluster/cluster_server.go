@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net"
 	"protocol"
+	"sync"
 	"time"
 
 	log "code.google.com/p/log4go"
@@ -29,6 +30,12 @@ type ClusterServer struct {
 	isUp                     bool
 	writeBuffer              *WriteBuffer
 	heartbeatStarted         bool
+	// closed when the server is stopped
+	stopped chan bool
+	// the round trip time and the time of the last successful heartbeat
+	heartbeatLatency time.Duration
+	lastHeartbeat    time.Time
+	heartbeatLock    sync.Mutex
 }
 
 type ServerConnection interface {
@@ -36,6 +43,7 @@ type ServerConnection interface {
 	Close()
 	ClearRequests()
 	MakeRequest(request *protocol.Request, responseStream chan *protocol.Response) error
+	CancelRequest(responseStream chan *protocol.Response)
 }
 
 type ServerState int
@@ -60,11 +68,20 @@ func NewClusterServer(raftName, raftConnectionString, protobufConnectionString s
 		MinBackoff:               config.ProtobufMinBackoff.Duration,
 		MaxBackoff:               config.ProtobufMaxBackoff.Duration,
 		heartbeatStarted:         false,
+		stopped:                  make(chan bool),
 	}
 
 	return s
 }
 
+// Returns the round trip time and the time of the last successful
+// heartbeat, the time is zero if there wasn't any
+func (self *ClusterServer) lastHeartbeatStats() (time.Duration, time.Time) {
+	self.heartbeatLock.Lock()
+	defer self.heartbeatLock.Unlock()
+	return self.heartbeatLatency, self.lastHeartbeat
+}
+
 func (self *ClusterServer) StartHeartbeat() {
 	if self.heartbeatStarted {
 		return
@@ -75,6 +92,23 @@ func (self *ClusterServer) StartHeartbeat() {
 	go self.heartbeat()
 }
 
+// Stops the heartbeat and the writes to the server and closes the
+// connection, this is called when the server is removed from the cluster
+func (self *ClusterServer) Stop() {
+	select {
+	case <-self.stopped:
+		return
+	default:
+		close(self.stopped)
+	}
+	if self.writeBuffer != nil {
+		self.writeBuffer.Stop()
+	}
+	if self.connection != nil {
+		self.connection.Close()
+	}
+}
+
 func (self *ClusterServer) SetWriteBuffer(writeBuffer *WriteBuffer) {
 	self.writeBuffer = writeBuffer
 }
@@ -104,6 +138,22 @@ func (self *ClusterServer) MakeRequest(request *protocol.Request, responseStream
 	}
 }
 
+// Stops the responses of a request that isn't read to the end. The
+// responses that are on their way are drained so the connection doesn't
+// block on the response stream.
+func (self *ClusterServer) CancelRequest(responseStream chan *protocol.Response) {
+	self.connection.CancelRequest(responseStream)
+	go func() {
+		for {
+			select {
+			case <-responseStream:
+			case <-time.After(time.Minute):
+				return
+			}
+		}
+	}()
+}
+
 func (self *ClusterServer) Write(request *protocol.Request) error {
 	responseChan := make(chan *protocol.Response, 1)
 	err := self.connection.MakeRequest(request, responseChan)
@@ -122,6 +172,10 @@ func (self *ClusterServer) BufferWrite(request *protocol.Request) {
 	self.writeBuffer.Write(request)
 }
 
+func (self *ClusterServer) BufferWriteWithAck(request *protocol.Request, ack chan<- uint32) {
+	self.writeBuffer.WriteWithAck(request, ack)
+}
+
 func (self *ClusterServer) IsUp() bool {
 	return self.isUp
 }
@@ -140,17 +194,28 @@ func (self *ClusterServer) heartbeat() {
 		Database: protocol.String(""),
 	}
 	for {
+		select {
+		case <-self.stopped:
+			return
+		default:
+		}
+
 		// this chan is buffered and in the loop on purpose. This is so
 		// that if reading a heartbeat times out, and the heartbeat then comes through
 		// later, it will be dumped into this chan and not block the protobuf client reader.
 		responseChan := make(chan *protocol.Response, 1)
 		heartbeatRequest.Id = nil
+		start := time.Now()
 		self.MakeRequest(heartbeatRequest, responseChan)
 		err := self.getHeartbeatResponse(responseChan)
 		if err != nil {
 			self.handleHeartbeatError(err)
 			continue
 		}
+		self.heartbeatLock.Lock()
+		self.lastHeartbeat = time.Now()
+		self.heartbeatLatency = self.lastHeartbeat.Sub(start)
+		self.heartbeatLock.Unlock()
 
 		if !self.isUp {
 			log.Warn("Server marked as up. Hearbeat succeeded")
@@ -158,7 +223,11 @@ func (self *ClusterServer) heartbeat() {
 		// otherwise, reset the backoff and mark the server as up
 		self.isUp = true
 		self.Backoff = self.MinBackoff
-		<-time.After(self.HeartbeatInterval)
+		select {
+		case <-self.stopped:
+			return
+		case <-time.After(self.HeartbeatInterval):
+		}
 	}
 }
 
@@ -193,7 +262,10 @@ func (self *ClusterServer) handleHeartbeatError(err error) {
 	if self.Backoff > self.MaxBackoff {
 		self.Backoff = self.MaxBackoff
 	}
-	<-time.After(self.Backoff)
+	select {
+	case <-self.stopped:
+	case <-time.After(self.Backoff):
+	}
 }
 
 // in the coordinator test we don't want to create protobuf servers,
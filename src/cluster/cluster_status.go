@@ -0,0 +1,97 @@
+package cluster
+
+import (
+	"time"
+)
+
+// The connection state of a server as seen by the local server
+type ServerStatus struct {
+	Id                       uint32 `json:"id"`
+	RaftName                 string `json:"raftName"`
+	ProtobufConnectionString string `json:"protobufConnectString"`
+	Local                    bool   `json:"local"`
+	Up                       bool   `json:"up"`
+	// the round trip time of the last successful heartbeat in
+	// milliseconds and the time it was received, 0 if there wasn't any
+	HeartbeatLatency float64 `json:"heartbeatLatency"`
+	LastHeartbeat    int64   `json:"lastHeartbeat"`
+	// the number of requests in the local wal the server didn't write
+	// yet, counted from the start of the wal if the server didn't write
+	// any request yet. Always 0 for the local server.
+	WalLag uint32 `json:"walLag"`
+}
+
+// A shard that has fewer copies than its replication factor or copies on
+// servers that are down
+type UnderReplicatedShard struct {
+	ShardId           uint32   `json:"shardId"`
+	ReplicationFactor uint8    `json:"replicationFactor"`
+	ServerIds         []uint32 `json:"serverIds"`
+	DownServerIds     []uint32 `json:"downServerIds"`
+}
+
+func (self *ClusterConfiguration) ServerStatuses() []*ServerStatus {
+	var lags map[uint32]uint32
+	if self.wal != nil {
+		self.serversLock.RLock()
+		serverIds := make([]uint32, 0, len(self.servers))
+		for _, server := range self.servers {
+			if server != self.LocalServer {
+				serverIds = append(serverIds, server.Id)
+			}
+		}
+		self.serversLock.RUnlock()
+		lags = self.wal.ServerLag(serverIds)
+	}
+
+	self.serversLock.RLock()
+	defer self.serversLock.RUnlock()
+	statuses := make([]*ServerStatus, 0, len(self.servers))
+	for _, server := range self.servers {
+		status := &ServerStatus{
+			Id:                       server.Id,
+			RaftName:                 server.RaftName,
+			ProtobufConnectionString: server.ProtobufConnectionString,
+			Local:                    server == self.LocalServer,
+			Up:                       server == self.LocalServer || server.IsUp(),
+			WalLag:                   lags[server.Id],
+		}
+		if latency, lastHeartbeat := server.lastHeartbeatStats(); !lastHeartbeat.IsZero() {
+			status.HeartbeatLatency = float64(latency) / float64(time.Millisecond)
+			status.LastHeartbeat = lastHeartbeat.Unix()
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+func (self *ClusterConfiguration) UnderReplicatedShards() []*UnderReplicatedShard {
+	up := make(map[uint32]bool)
+	self.serversLock.RLock()
+	for _, server := range self.servers {
+		up[server.Id] = server == self.LocalServer || server.IsUp()
+	}
+	self.serversLock.RUnlock()
+
+	shards := make([]*UnderReplicatedShard, 0)
+	for _, shard := range self.GetAllShards() {
+		replicationFactor := self.shardReplicationFactor(shard)
+		serverIds := shard.ServerIds()
+		downServerIds := make([]uint32, 0)
+		for _, serverId := range serverIds {
+			if !up[serverId] {
+				downServerIds = append(downServerIds, serverId)
+			}
+		}
+		if len(serverIds) >= int(replicationFactor) && len(downServerIds) == 0 {
+			continue
+		}
+		shards = append(shards, &UnderReplicatedShard{
+			ShardId:           shard.Id(),
+			ReplicationFactor: replicationFactor,
+			ServerIds:         serverIds,
+			DownServerIds:     downServerIds,
+		})
+	}
+	return shards
+}
@@ -0,0 +1,536 @@
+package cluster
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"protocol"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	log "code.google.com/p/log4go"
+)
+
+const (
+	// the maximum size of a segment file of a hinted handoff queue
+	MAX_HINT_SEGMENT_SIZE = 16 * 1024 * 1024
+	// a queued request starts with the time it was queued and its length
+	HINT_HEADER_SIZE = 12
+	// the number of queued requests that are replayed by one call to
+	// Replay, the write buffers replay batches until the queue is empty
+	HINT_REPLAY_BATCH_SIZE = 1000
+	// how often the write buffers try to replay the queued requests
+	HINT_REPLAY_INTERVAL = time.Second
+)
+
+// The depth and the counters of the hinted handoff queue of a server. The
+// counters start at 0 when the server starts.
+type HintedHandoffStats struct {
+	ServerId uint32 `json:"serverId"`
+	Requests int    `json:"requests"`
+	Bytes    int64  `json:"bytes"`
+	// the time the oldest request was queued, 0 if the queue is empty
+	Oldest        int64 `json:"oldest"`
+	Queued        int64 `json:"queued"`
+	Replayed      int64 `json:"replayed"`
+	DroppedBySize int64 `json:"droppedBySize"`
+	DroppedByAge  int64 `json:"droppedByAge"`
+	Purged        int64 `json:"purged"`
+}
+
+type hintSegment struct {
+	number   int
+	path     string
+	size     int64
+	requests int
+	// the time the last request was added
+	modified time.Time
+}
+
+// Counts the requests in the segment and cuts off the request at the end
+// that wasn't written completely
+func (self *hintSegment) scan() error {
+	file, err := os.OpenFile(self.path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	self.modified = info.ModTime()
+
+	header := make([]byte, HINT_HEADER_SIZE)
+	var offset int64
+	for {
+		n, err := file.ReadAt(header, offset)
+		if n < HINT_HEADER_SIZE {
+			if err != nil && err != io.EOF {
+				return err
+			}
+			break
+		}
+		length := int64(binary.BigEndian.Uint32(header[8:]))
+		if offset+HINT_HEADER_SIZE+length > info.Size() {
+			break
+		}
+		offset += HINT_HEADER_SIZE + length
+		self.requests++
+	}
+	if offset < info.Size() {
+		log.Warn("Cutting off the incomplete request at the end of %s", self.path)
+		if err := file.Truncate(offset); err != nil {
+			return err
+		}
+	}
+	self.size = offset
+	return nil
+}
+
+// The requests for a server that couldn't be written to it. They're
+// logged to segment files in the directory of the queue and replayed in
+// the order they were queued. The oldest segments are dropped if the queue
+// gets bigger than maxSize and requests older than maxAge are dropped, the
+// anti entropy has to repair the points that were dropped. 0 doesn't limit
+// the size or the age. The position in the first segment isn't persisted,
+// after a restart its requests are replayed again from the start which is
+// harmless since they're replayed in the same order.
+type HintedHandoffQueue struct {
+	serverId    uint32
+	dir         string
+	maxSize     int64
+	maxAge      time.Duration
+	segmentSize int64
+	lock        sync.Mutex
+	// only one replay can run at a time, the queue isn't locked while the
+	// replayed requests are written
+	replayLock sync.Mutex
+	segments   []*hintSegment
+	// the position and the number of the requests in the first segment
+	// that were replayed
+	readOffset   int64
+	readRequests int
+	reader       *os.File
+	writer       *os.File
+	stats        HintedHandoffStats
+}
+
+func openHintedHandoffQueue(serverId uint32, dir string, maxSize int64, maxAge time.Duration) (*HintedHandoffQueue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	segmentSize := int64(MAX_HINT_SEGMENT_SIZE)
+	if maxSize > 0 && maxSize/10 < segmentSize {
+		segmentSize = maxSize / 10
+	}
+	queue := &HintedHandoffQueue{
+		serverId:    serverId,
+		dir:         dir,
+		maxSize:     maxSize,
+		maxAge:      maxAge,
+		segmentSize: segmentSize,
+		stats:       HintedHandoffStats{ServerId: serverId},
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		number, err := strconv.Atoi(info.Name())
+		if err != nil {
+			continue
+		}
+		segment := &hintSegment{number: number, path: filepath.Join(dir, info.Name())}
+		if err := segment.scan(); err != nil {
+			return nil, err
+		}
+		queue.segments = append(queue.segments, segment)
+	}
+	sort.Sort(hintSegmentsByNumber(queue.segments))
+	if requests := queue.requests(); requests > 0 {
+		log.Info("Hinted handoff queue of server %d has %d requests", serverId, requests)
+	}
+	return queue, nil
+}
+
+type hintSegmentsByNumber []*hintSegment
+
+func (self hintSegmentsByNumber) Len() int           { return len(self) }
+func (self hintSegmentsByNumber) Less(i, j int) bool { return self[i].number < self[j].number }
+func (self hintSegmentsByNumber) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+
+func (self *HintedHandoffQueue) requests() int {
+	requests := -self.readRequests
+	for _, segment := range self.segments {
+		requests += segment.requests
+	}
+	return requests
+}
+
+func (self *HintedHandoffQueue) size() int64 {
+	size := -self.readOffset
+	for _, segment := range self.segments {
+		size += segment.size
+	}
+	return size
+}
+
+// Returns the number of requests in the queue
+func (self *HintedHandoffQueue) Len() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.requests()
+}
+
+// Adds the request to the end of the queue. The segment is synced before
+// Append returns so the request can be committed in the WAL.
+func (self *HintedHandoffQueue) Append(request *protocol.Request) error {
+	data, err := request.Encode()
+	if err != nil {
+		return err
+	}
+	record := make([]byte, HINT_HEADER_SIZE, HINT_HEADER_SIZE+len(data))
+	binary.BigEndian.PutUint64(record, uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint32(record[8:], uint32(len(data)))
+	record = append(record, data...)
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	segment := self.lastSegment()
+	if segment == nil || (segment.size > 0 && segment.size+int64(len(record)) > self.segmentSize) {
+		if segment, err = self.newSegment(); err != nil {
+			return err
+		}
+	}
+	if self.writer == nil {
+		self.writer, err = os.OpenFile(segment.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := self.writer.Write(record); err != nil {
+		// don't leave a partial request behind
+		self.writer.Truncate(segment.size)
+		return err
+	}
+	if err := self.writer.Sync(); err != nil {
+		self.writer.Truncate(segment.size)
+		return err
+	}
+	segment.size += int64(len(record))
+	segment.requests++
+	segment.modified = time.Now()
+	self.stats.Queued++
+
+	for self.maxSize > 0 && self.size() > self.maxSize && len(self.segments) > 1 {
+		dropped, err := self.dropFirstSegment()
+		self.stats.DroppedBySize += int64(dropped)
+		log.Warn("Hinted handoff queue of server %d is bigger than %d bytes, dropped %d requests", self.serverId, self.maxSize, dropped)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *HintedHandoffQueue) lastSegment() *hintSegment {
+	if len(self.segments) == 0 {
+		return nil
+	}
+	return self.segments[len(self.segments)-1]
+}
+
+func (self *HintedHandoffQueue) newSegment() (*hintSegment, error) {
+	number := 1
+	if last := self.lastSegment(); last != nil {
+		number = last.number + 1
+	}
+	path := filepath.Join(self.dir, strconv.Itoa(number))
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if self.writer != nil {
+		self.writer.Close()
+	}
+	self.writer = file
+	segment := &hintSegment{number: number, path: path, modified: time.Now()}
+	self.segments = append(self.segments, segment)
+	return segment, nil
+}
+
+// Removes the oldest segment and returns the number of its requests that
+// weren't replayed
+func (self *HintedHandoffQueue) dropFirstSegment() (int, error) {
+	segment := self.segments[0]
+	dropped := segment.requests - self.readRequests
+	if self.reader != nil {
+		self.reader.Close()
+		self.reader = nil
+	}
+	if len(self.segments) == 1 && self.writer != nil {
+		self.writer.Close()
+		self.writer = nil
+	}
+	self.segments = self.segments[1:]
+	self.readOffset = 0
+	self.readRequests = 0
+	return dropped, os.Remove(segment.path)
+}
+
+// Drops the segments that only have requests older than the max age
+func (self *HintedHandoffQueue) dropExpiredSegments() error {
+	if self.maxAge == 0 {
+		return nil
+	}
+	for len(self.segments) > 0 && time.Since(self.segments[0].modified) > self.maxAge {
+		dropped, err := self.dropFirstSegment()
+		self.stats.DroppedByAge += int64(dropped)
+		if dropped > 0 {
+			log.Warn("Dropped %d requests older than %s from the hinted handoff queue of server %d", dropped, self.maxAge, self.serverId)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the time the request at the offset of the segment was queued
+func readHintTimestamp(path string, offset int64) (time.Time, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer file.Close()
+	header := make([]byte, 8)
+	if _, err := file.ReadAt(header, offset); err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(header))), nil
+}
+
+// Reads the next request to replay, returns the time it was queued and
+// the encoded request
+func (self *HintedHandoffQueue) readRequest() (time.Time, []byte, error) {
+	var err error
+	if self.reader == nil {
+		if self.reader, err = os.Open(self.segments[0].path); err != nil {
+			return time.Time{}, nil, err
+		}
+	}
+	header := make([]byte, HINT_HEADER_SIZE)
+	if _, err := self.reader.ReadAt(header, self.readOffset); err != nil {
+		return time.Time{}, nil, err
+	}
+	timestamp := time.Unix(0, int64(binary.BigEndian.Uint64(header)))
+	data := make([]byte, binary.BigEndian.Uint32(header[8:]))
+	if _, err := self.reader.ReadAt(data, self.readOffset+HINT_HEADER_SIZE); err != nil {
+		return time.Time{}, nil, err
+	}
+	return timestamp, data, nil
+}
+
+// Writes up to max of the queued requests in the order they were queued
+// and removes them from the queue. It stops at the first request that
+// can't be written, the request stays in the queue. The queue isn't
+// locked while a request is written so requests can be queued and the
+// stats read in the meantime.
+func (self *HintedHandoffQueue) Replay(max int, write func(request *protocol.Request) error) (int, error) {
+	self.replayLock.Lock()
+	defer self.replayLock.Unlock()
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if err := self.dropExpiredSegments(); err != nil {
+		return 0, err
+	}
+	replayed := 0
+	for replayed < max && len(self.segments) > 0 {
+		segment := self.segments[0]
+		if self.readRequests == segment.requests {
+			if _, err := self.dropFirstSegment(); err != nil {
+				return replayed, err
+			}
+			continue
+		}
+
+		offset := self.readOffset
+		timestamp, data, err := self.readRequest()
+		if err != nil {
+			return replayed, err
+		}
+		request := &protocol.Request{}
+		if err := request.Decode(data); err != nil {
+			log.Error("Dropping a request from the hinted handoff queue of server %d that can't be decoded: %s", self.serverId, err)
+		} else if self.maxAge > 0 && time.Since(timestamp) > self.maxAge {
+			self.stats.DroppedByAge++
+		} else {
+			self.lock.Unlock()
+			err := write(request)
+			self.lock.Lock()
+			if err != nil {
+				return replayed, err
+			}
+			self.stats.Replayed++
+			replayed++
+			// the segment could have been dropped by a purge or because the
+			// queue got too big while the request was written
+			if len(self.segments) == 0 || self.segments[0] != segment || self.readOffset != offset {
+				continue
+			}
+		}
+		self.readOffset += int64(HINT_HEADER_SIZE + len(data))
+		self.readRequests++
+	}
+	return replayed, nil
+}
+
+// Drops all the queued requests and returns how many were dropped
+func (self *HintedHandoffQueue) Purge() (int, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	purged := 0
+	for len(self.segments) > 0 {
+		dropped, err := self.dropFirstSegment()
+		purged += dropped
+		if err != nil {
+			self.stats.Purged += int64(purged)
+			return purged, err
+		}
+	}
+	self.stats.Purged += int64(purged)
+	return purged, nil
+}
+
+func (self *HintedHandoffQueue) Stats() *HintedHandoffStats {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	stats := self.stats
+	stats.Requests = self.requests()
+	stats.Bytes = self.size()
+	// the oldest request is the first one that wasn't replayed, the
+	// replayed segments are dropped by the next replay
+	offset := self.readOffset
+	for i, segment := range self.segments {
+		if i > 0 {
+			offset = 0
+		}
+		if i == 0 && self.readRequests == segment.requests || segment.requests == 0 {
+			continue
+		}
+		if timestamp, err := readHintTimestamp(segment.path, offset); err == nil {
+			stats.Oldest = timestamp.Unix()
+		}
+		break
+	}
+	return &stats
+}
+
+func (self *HintedHandoffQueue) close() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.reader != nil {
+		self.reader.Close()
+		self.reader = nil
+	}
+	if self.writer != nil {
+		self.writer.Close()
+		self.writer = nil
+	}
+}
+
+// The hinted handoff queues of the servers, each queue is in the
+// directory named after the id of its server
+type HintedHandoff struct {
+	dir     string
+	maxSize int64
+	maxAge  time.Duration
+	lock    sync.Mutex
+	queues  map[uint32]*HintedHandoffQueue
+}
+
+func NewHintedHandoff(dir string, maxSize int64, maxAge time.Duration) *HintedHandoff {
+	return &HintedHandoff{
+		dir:     dir,
+		maxSize: maxSize,
+		maxAge:  maxAge,
+		queues:  make(map[uint32]*HintedHandoffQueue),
+	}
+}
+
+// Returns the queue of the server, it's opened the first time
+func (self *HintedHandoff) Queue(serverId uint32) (*HintedHandoffQueue, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if queue := self.queues[serverId]; queue != nil {
+		return queue, nil
+	}
+	queue, err := openHintedHandoffQueue(serverId, self.queueDir(serverId), self.maxSize, self.maxAge)
+	if err != nil {
+		return nil, err
+	}
+	self.queues[serverId] = queue
+	return queue, nil
+}
+
+func (self *HintedHandoff) queueDir(serverId uint32) string {
+	return filepath.Join(self.dir, strconv.FormatUint(uint64(serverId), 10))
+}
+
+// Returns the stats of the queues ordered by server id
+func (self *HintedHandoff) Stats() []*HintedHandoffStats {
+	self.lock.Lock()
+	serverIds := make([]int, 0, len(self.queues))
+	for serverId, _ := range self.queues {
+		serverIds = append(serverIds, int(serverId))
+	}
+	self.lock.Unlock()
+	sort.Ints(serverIds)
+
+	stats := make([]*HintedHandoffStats, 0, len(serverIds))
+	for _, serverId := range serverIds {
+		self.lock.Lock()
+		queue := self.queues[uint32(serverId)]
+		self.lock.Unlock()
+		if queue != nil {
+			stats = append(stats, queue.Stats())
+		}
+	}
+	return stats
+}
+
+// Drops the queued requests of the server, returns how many were dropped
+func (self *HintedHandoff) Purge(serverId uint32) (int, error) {
+	self.lock.Lock()
+	queue := self.queues[serverId]
+	self.lock.Unlock()
+	if queue == nil {
+		return 0, fmt.Errorf("There's no hinted handoff queue for server %d", serverId)
+	}
+	return queue.Purge()
+}
+
+// Drops the queue of a server that was removed from the cluster
+func (self *HintedHandoff) Remove(serverId uint32) error {
+	self.lock.Lock()
+	queue := self.queues[serverId]
+	delete(self.queues, serverId)
+	self.lock.Unlock()
+	if queue != nil {
+		if _, err := queue.Purge(); err != nil {
+			return err
+		}
+		queue.close()
+	}
+	return os.RemoveAll(self.queueDir(serverId))
+}
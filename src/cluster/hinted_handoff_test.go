@@ -0,0 +1,169 @@
+package cluster
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	p "protocol"
+
+	"code.google.com/p/goprotobuf/proto"
+	. "launchpad.net/gocheck"
+)
+
+type HintedHandoffSuite struct {
+	dir string
+}
+
+var _ = Suite(&HintedHandoffSuite{})
+
+func (self *HintedHandoffSuite) SetUpTest(c *C) {
+	dir, err := ioutil.TempDir("", "hinted-handoff")
+	c.Assert(err, IsNil)
+	self.dir = dir
+}
+
+func (self *HintedHandoffSuite) TearDownTest(c *C) {
+	os.RemoveAll(self.dir)
+}
+
+func newHintedRequest(requestNumber uint32) *p.Request {
+	return &p.Request{Id: proto.Uint32(requestNumber), RequestNumber: proto.Uint32(requestNumber)}
+}
+
+func replayAll(queue *HintedHandoffQueue) []uint32 {
+	requestNumbers := []uint32{}
+	queue.Replay(HINT_REPLAY_BATCH_SIZE, func(request *p.Request) error {
+		requestNumbers = append(requestNumbers, request.GetRequestNumber())
+		return nil
+	})
+	return requestNumbers
+}
+
+func (self *HintedHandoffSuite) TestReplayStopsAtTheFirstFailedWrite(c *C) {
+	queue, err := openHintedHandoffQueue(2, self.dir, 0, 0)
+	c.Assert(err, IsNil)
+	for i := uint32(1); i <= 5; i++ {
+		c.Assert(queue.Append(newHintedRequest(i)), IsNil)
+	}
+	c.Assert(queue.Len(), Equals, 5)
+
+	replayed, err := queue.Replay(HINT_REPLAY_BATCH_SIZE, func(request *p.Request) error {
+		if request.GetRequestNumber() == 3 {
+			return fmt.Errorf("server is down")
+		}
+		return nil
+	})
+	c.Assert(err, NotNil)
+	c.Assert(replayed, Equals, 2)
+	c.Assert(queue.Len(), Equals, 3)
+
+	c.Assert(replayAll(queue), DeepEquals, []uint32{3, 4, 5})
+	c.Assert(queue.Len(), Equals, 0)
+	stats := queue.Stats()
+	c.Assert(stats.Queued, Equals, int64(5))
+	c.Assert(stats.Replayed, Equals, int64(5))
+	c.Assert(stats.Bytes, Equals, int64(0))
+}
+
+func (self *HintedHandoffSuite) TestQueueIsKeptOnDisk(c *C) {
+	queue, err := openHintedHandoffQueue(2, self.dir, 0, 0)
+	c.Assert(err, IsNil)
+	for i := uint32(1); i <= 3; i++ {
+		c.Assert(queue.Append(newHintedRequest(i)), IsNil)
+	}
+	queue.close()
+
+	queue, err = openHintedHandoffQueue(2, self.dir, 0, 0)
+	c.Assert(err, IsNil)
+	c.Assert(queue.Len(), Equals, 3)
+	c.Assert(replayAll(queue), DeepEquals, []uint32{1, 2, 3})
+}
+
+func (self *HintedHandoffSuite) TestOldestRequestsAreDroppedWhenTheQueueIsFull(c *C) {
+	queue, err := openHintedHandoffQueue(2, self.dir, 1000, 0)
+	c.Assert(err, IsNil)
+	for i := uint32(1); i <= 100; i++ {
+		c.Assert(queue.Append(newHintedRequest(i)), IsNil)
+	}
+	stats := queue.Stats()
+	c.Assert(stats.Bytes <= 1000, Equals, true)
+	c.Assert(stats.DroppedBySize > 0, Equals, true)
+	c.Assert(int64(stats.Requests)+stats.DroppedBySize, Equals, int64(100))
+
+	requestNumbers := replayAll(queue)
+	c.Assert(requestNumbers[len(requestNumbers)-1], Equals, uint32(100))
+}
+
+func (self *HintedHandoffSuite) TestPurge(c *C) {
+	hintedHandoff := NewHintedHandoff(self.dir, 0, 0)
+	queue, err := hintedHandoff.Queue(2)
+	c.Assert(err, IsNil)
+	c.Assert(queue.Append(newHintedRequest(1)), IsNil)
+	c.Assert(queue.Append(newHintedRequest(2)), IsNil)
+
+	purged, err := hintedHandoff.Purge(2)
+	c.Assert(err, IsNil)
+	c.Assert(purged, Equals, 2)
+	c.Assert(queue.Len(), Equals, 0)
+
+	_, err = hintedHandoff.Purge(3)
+	c.Assert(err, NotNil)
+
+	c.Assert(hintedHandoff.Remove(2), IsNil)
+	c.Assert(hintedHandoff.Stats(), HasLen, 0)
+}
+
+func (self *HintedHandoffSuite) TestQueueIsntLockedWhileRequestsAreReplayed(c *C) {
+	queue, err := openHintedHandoffQueue(2, self.dir, 0, 0)
+	c.Assert(err, IsNil)
+	for i := uint32(1); i <= 3; i++ {
+		c.Assert(queue.Append(newHintedRequest(i)), IsNil)
+	}
+
+	var stats *HintedHandoffStats
+	replayed, err := queue.Replay(HINT_REPLAY_BATCH_SIZE, func(request *p.Request) error {
+		switch request.GetRequestNumber() {
+		case 1:
+			stats = queue.Stats()
+			c.Assert(queue.Append(newHintedRequest(4)), IsNil)
+		case 2:
+			_, err := queue.Purge()
+			c.Assert(err, IsNil)
+		}
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(replayed, Equals, 2)
+	c.Assert(stats.Requests, Equals, 3)
+	c.Assert(stats.Oldest > 0, Equals, true)
+	c.Assert(queue.Len(), Equals, 0)
+
+	// reading the stats doesn't change the queue
+	c.Assert(queue.Append(newHintedRequest(5)), IsNil)
+	c.Assert(queue.Stats().Requests, Equals, 1)
+	c.Assert(replayAll(queue), DeepEquals, []uint32{5})
+}
+
+type countingWriter struct {
+	written int
+}
+
+func (self *countingWriter) Write(request *p.Request) error {
+	self.written++
+	return nil
+}
+
+func (self *HintedHandoffSuite) TestWriteBufferReplaysTheWholeQueue(c *C) {
+	queue, err := openHintedHandoffQueue(2, self.dir, 0, 0)
+	c.Assert(err, IsNil)
+	requests := 2*HINT_REPLAY_BATCH_SIZE + 10
+	for i := 1; i <= requests; i++ {
+		c.Assert(queue.Append(newHintedRequest(uint32(i))), IsNil)
+	}
+
+	writer := &countingWriter{}
+	buffer := &WriteBuffer{writer: writer, hints: queue, stop: make(chan bool), writerInfo: "test"}
+	buffer.replayHints()
+	c.Assert(writer.written, Equals, requests)
+	c.Assert(queue.Len(), Equals, 0)
+}
@@ -8,6 +8,7 @@ import (
 	p "protocol"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 	"wal"
 
@@ -23,6 +24,9 @@ type Shard interface {
 	StartTime() time.Time
 	EndTime() time.Time
 	Write(*p.Request) error
+	// Writes like Write, every copy of the shard sends its server id on
+	// ack once it wrote the request
+	WriteWithAck(request *p.Request, ack chan<- uint32) error
 	SyncWrite(*p.Request) error
 	Query(querySpec *parser.QuerySpec, response chan *p.Response)
 	IsMicrosecondInRange(t int64) bool
@@ -50,6 +54,8 @@ type NewShardData struct {
 	ServerIds     []uint32
 	Type          ShardType
 	DurationSplit bool `json:",omitempty"`
+	// The replication factor of the databases written to the shard
+	ReplicationFactor uint8 `json:",omitempty"`
 }
 
 type ShardType int
@@ -75,7 +81,11 @@ type ShardData struct {
 	shardDuration    time.Duration
 	shardNanoseconds uint64
 	localServerId    uint32
-	IsLocal          bool
+	// guards servers, clusterServers, store and serverIds, they're
+	// replaced rather than modified when the servers of the shard change
+	serversLock sync.RWMutex
+	// 0 for shards created before the replication factor was recorded
+	replicationFactor uint8
 }
 
 func NewShard(id uint32, startTime, endTime time.Time, shardType ShardType, durationIsSplit bool, wal WAL) *ShardData {
@@ -106,6 +116,8 @@ var (
 	accessDeniedResponse = p.Response_ACCESS_DENIED
 	queryRequest         = p.Request_QUERY
 	dropDatabaseRequest  = p.Request_DROP_DATABASE
+	shardStatsRequest    = p.Request_SHARD_STATS
+	compactShardRequest  = p.Request_COMPACT_SHARD
 )
 
 type LocalShardDb interface {
@@ -119,15 +131,89 @@ type LocalShardStore interface {
 	Write(request *p.Request) error
 	SetWriteBuffer(writeBuffer *WriteBuffer)
 	BufferWrite(request *p.Request)
+	BufferWriteWithAck(request *p.Request, ack chan<- uint32)
 	GetOrCreateShard(id uint32) (LocalShardDb, error)
 	ReturnShard(id uint32)
 	DeleteShard(shardId uint32) error
+	// Rewrites the shard with the given storage engine and point block size
+	MigrateShard(id uint32, engine string, pointBlockSize int) (*ShardMigration, error)
+	GetShardStats(id uint32) (*ShardStats, error)
+	// Starts compacting the shard in the background
+	CompactShard(id uint32) error
+	// Deletes all the points of the series matched by the delete query,
+	// drops the shard if the query matches all of its series
+	DeleteAllPoints(id uint32, querySpec *parser.QuerySpec) error
+	// Returns the digests of the series of the shard, the points between
+	// startTime and endTime are split in the given number of ranges
+	GetShardDigests(id uint32, database string, series []string, startTime, endTime int64, ranges int) ([]*SeriesDigest, error)
+	// Calls yield with the points of the series between startTime and
+	// endTime, one column at a time
+	GetShardPoints(id uint32, database, series string, startTime, endTime int64, yield func(*p.Series) error) error
+}
+
+// The disk usage and compaction progress of a copy of a shard
+type ShardStats struct {
+	ServerId uint32 `json:"serverId"`
+	// the size on disk in bytes
+	Size int64 `json:"size"`
+	// the number of keys
+	Keys   int64 `json:"keys"`
+	Series int64 `json:"series"`
+	// set if the shard isn't open, only its size is returned then
+	Closed     bool `json:"closed"`
+	Compacting bool `json:"compacting"`
+	// the progress of the running compaction between 0 and 1
+	CompactionProgress float64 `json:"compactionProgress"`
+	// the time the last compaction finished in seconds since the epoch, 0
+	// if the shard wasn't compacted since the server started
+	LastCompaction int64 `json:"lastCompaction"`
+	// set if the stats couldn't be read from the server
+	Error string `json:"error,omitempty"`
+}
+
+func (self *ShardStats) ToProtobuf() *p.ShardStats {
+	return &p.ShardStats{
+		Size:               &self.Size,
+		Keys:               &self.Keys,
+		Series:             &self.Series,
+		Closed:             &self.Closed,
+		Compacting:         &self.Compacting,
+		CompactionProgress: &self.CompactionProgress,
+		LastCompaction:     &self.LastCompaction,
+	}
+}
+
+func NewShardStatsFromProtobuf(serverId uint32, stats *p.ShardStats) *ShardStats {
+	return &ShardStats{
+		ServerId:           serverId,
+		Size:               stats.GetSize(),
+		Keys:               stats.GetKeys(),
+		Series:             stats.GetSeries(),
+		Closed:             stats.GetClosed(),
+		Compacting:         stats.GetCompacting(),
+		CompactionProgress: stats.GetCompactionProgress(),
+		LastCompaction:     stats.GetLastCompaction(),
+	}
+}
+
+// The result of rewriting a local shard in another storage format
+type ShardMigration struct {
+	ShardId        uint32 `json:"shardId"`
+	Engine         string `json:"engine"`
+	PointBlockSize int    `json:"pointBlockSize"`
+	Series         int    `json:"series"`
+	Columns        int    `json:"columns"`
+	Points         int64  `json:"points"`
 }
 
 func (self *ShardData) Id() uint32 {
 	return self.id
 }
 
+func (self *ShardData) ReplicationFactor() uint8 {
+	return self.replicationFactor
+}
+
 func (self *ShardData) StartMicro() int64 {
 	return self.startMicro
 }
@@ -148,73 +234,168 @@ func (self *ShardData) IsMicrosecondInRange(t int64) bool {
 	return t >= self.startMicro && t < self.endMicro
 }
 
+// Returns true if the time range includes all the points of the shard
+func (self *ShardData) IsCoveredBy(startTime, endTime time.Time) bool {
+	return !startTime.After(self.startTime) && !endTime.Before(self.endTime)
+}
+
 func (self *ShardData) SetServers(servers []*ClusterServer) {
-	self.clusterServers = servers
-	self.servers = make([]wal.Server, len(servers), len(servers))
-	for i, server := range servers {
-		self.serverIds = append(self.serverIds, server.Id)
-		self.servers[i] = server
+	self.serversLock.Lock()
+	defer self.serversLock.Unlock()
+	serverIds := append([]uint32{}, self.serverIds...)
+	for _, server := range servers {
+		serverIds = append(serverIds, server.Id)
 	}
-	self.sortServerIds()
+	self.setServers(servers, serverIds)
 }
 
 func (self *ShardData) SetLocalStore(store LocalShardStore, localServerId uint32) error {
-	self.serverIds = append(self.serverIds, localServerId)
-	self.localServerId = localServerId
-	self.sortServerIds()
-
-	self.store = store
 	// make sure we can open up the shard
-	_, err := self.store.GetOrCreateShard(self.id)
+	_, err := store.GetOrCreateShard(self.id)
 	if err != nil {
 		return err
 	}
-	self.store.ReturnShard(self.id)
-	self.IsLocal = true
+	store.ReturnShard(self.id)
 
+	self.serversLock.Lock()
+	defer self.serversLock.Unlock()
+	self.serverIds = sortServerIds(append(append([]uint32{}, self.serverIds...), localServerId))
+	self.localServerId = localServerId
+	self.store = store
 	return nil
 }
 
+// Replaces the servers that have a copy of the shard, store is nil if
+// the shard isn't stored on this server anymore. Returns true if the
+// shard was stored on this server before.
+func (self *ShardData) replaceServers(servers []*ClusterServer, store LocalShardStore, localServerId uint32) (bool, error) {
+	serverIds := make([]uint32, 0, len(servers)+1)
+	if store != nil {
+		if _, err := store.GetOrCreateShard(self.id); err != nil {
+			return false, err
+		}
+		store.ReturnShard(self.id)
+		serverIds = append(serverIds, localServerId)
+	}
+	for _, server := range servers {
+		serverIds = append(serverIds, server.Id)
+	}
+
+	self.serversLock.Lock()
+	defer self.serversLock.Unlock()
+	wasLocal := self.store != nil
+	if store != nil {
+		self.localServerId = localServerId
+	}
+	self.store = store
+	self.setServers(servers, serverIds)
+	return wasLocal, nil
+}
+
+// Should be called with the servers lock held
+func (self *ShardData) setServers(servers []*ClusterServer, serverIds []uint32) {
+	self.clusterServers = servers
+	self.servers = make([]wal.Server, len(servers), len(servers))
+	for i, server := range servers {
+		self.servers[i] = server
+	}
+	self.serverIds = sortServerIds(serverIds)
+}
+
+// Removes the given servers from the server ids of the shard
+func (self *ShardData) removeServerIds(serverIds []uint32) {
+	self.serversLock.Lock()
+	defer self.serversLock.Unlock()
+	newIds := make([]uint32, 0)
+	for _, oldId := range self.serverIds {
+		include := true
+		for _, removeId := range serverIds {
+			if oldId == removeId {
+				include = false
+				break
+			}
+		}
+		if include {
+			newIds = append(newIds, oldId)
+		}
+	}
+	self.serverIds = newIds
+}
+
 func (self *ShardData) ServerIds() []uint32 {
+	self.serversLock.RLock()
+	defer self.serversLock.RUnlock()
 	return self.serverIds
 }
 
+// Returns true if the shard is stored on this server
+func (self *ShardData) IsLocal() bool {
+	return self.localStore() != nil
+}
+
+// Returns the store of the shard, nil if the shard isn't stored on this
+// server
+func (self *ShardData) localStore() LocalShardStore {
+	self.serversLock.RLock()
+	defer self.serversLock.RUnlock()
+	return self.store
+}
+
+// Returns the other servers that have a copy of the shard and the local
+// store, the store is nil if the shard isn't stored on this server. The
+// servers of the shard can change, callers should use the returned ones
+// for the whole request.
+func (self *ShardData) serversAndStore() ([]*ClusterServer, LocalShardStore) {
+	self.serversLock.RLock()
+	defer self.serversLock.RUnlock()
+	return self.clusterServers, self.store
+}
+
 func (self *ShardData) SyncWrite(request *p.Request) error {
 	request.ShardId = &self.id
-	for _, server := range self.clusterServers {
+	servers, store := self.serversAndStore()
+	for _, server := range servers {
 		if err := server.Write(request); err != nil {
 			return err
 		}
 	}
 
-	if self.store == nil {
+	if store == nil {
 		return nil
 	}
 
-	return self.store.Write(request)
+	return store.Write(request)
 }
 
 func (self *ShardData) Write(request *p.Request) error {
+	return self.WriteWithAck(request, nil)
+}
+
+func (self *ShardData) WriteWithAck(request *p.Request, ack chan<- uint32) error {
 	request.ShardId = &self.id
 	requestNumber, err := self.wal.AssignSequenceNumbersAndLog(request, self)
 	if err != nil {
 		return err
 	}
 	request.RequestNumber = &requestNumber
-	if self.store != nil {
-		self.store.BufferWrite(request)
+	servers, store := self.serversAndStore()
+	if store != nil {
+		store.BufferWriteWithAck(request, ack)
 	}
-	for _, server := range self.clusterServers {
+	for _, server := range servers {
 		// we have to create a new reqeust object because the ID gets assigned on each server.
 		requestWithoutId := &p.Request{Type: request.Type, Database: request.Database, MultiSeries: request.MultiSeries, ShardId: &self.id, RequestNumber: request.RequestNumber}
-		server.BufferWrite(requestWithoutId)
+		server.BufferWriteWithAck(requestWithoutId, ack)
 	}
 	return nil
 }
 
 func (self *ShardData) WriteLocalOnly(request *p.Request) error {
-	self.store.Write(request)
-	return nil
+	store := self.localStore()
+	if store == nil {
+		return fmt.Errorf("Shard %d isn't stored on this server", self.id)
+	}
+	return store.Write(request)
 }
 
 func (self *ShardData) Query(querySpec *parser.QuerySpec, response chan *p.Response) {
@@ -225,6 +406,7 @@ func (self *ShardData) Query(querySpec *parser.QuerySpec, response chan *p.Respo
 
 	// This is only for queries that are deletes or drops. They need to be sent everywhere as opposed to just the local or one of the remote shards.
 	// But this boolean should only be set to true on the server that receives the initial query.
+	servers, store := self.serversAndStore()
 	if querySpec.RunAgainstAllServersInShard {
 		if querySpec.IsDeleteFromSeriesQuery() {
 			self.logAndHandleDeleteQuery(querySpec, response)
@@ -233,7 +415,7 @@ func (self *ShardData) Query(querySpec *parser.QuerySpec, response chan *p.Respo
 		}
 	}
 
-	if self.IsLocal {
+	if store != nil {
 		var processor QueryProcessor
 		var err error
 
@@ -246,13 +428,13 @@ func (self *ShardData) Query(querySpec *parser.QuerySpec, response chan *p.Respo
 			query := querySpec.SelectQuery()
 			if self.ShouldAggregateLocally(querySpec) {
 				log.Debug("creating a query engine")
-				processor, err = engine.NewQueryEngine(query, response)
+				processor, err = engine.NewQueryEngine(querySpec, response)
 				if err != nil {
 					response <- &p.Response{Type: &endStreamResponse, ErrorMessage: p.String(err.Error())}
 					log.Error("Error while creating engine: %s", err)
 					return
 				}
-				processor.SetShardInfo(int(self.Id()), self.IsLocal)
+				processor.SetShardInfo(int(self.Id()), true)
 			} else if query.HasAggregates() {
 				maxPointsToBufferBeforeSending := 1000
 				log.Debug("creating a passthrough engine")
@@ -275,13 +457,13 @@ func (self *ShardData) Query(querySpec *parser.QuerySpec, response chan *p.Respo
 				processor = engine.NewFilteringEngine(query, processor)
 			}
 		}
-		shard, err := self.store.GetOrCreateShard(self.id)
+		shard, err := store.GetOrCreateShard(self.id)
 		if err != nil {
 			response <- &p.Response{Type: &endStreamResponse, ErrorMessage: p.String(err.Error())}
 			log.Error("Error while getting shards: %s", err)
 			return
 		}
-		defer self.store.ReturnShard(self.id)
+		defer store.ReturnShard(self.id)
 		err = shard.Query(querySpec, processor)
 		processor.Close()
 		if err != nil {
@@ -291,13 +473,7 @@ func (self *ShardData) Query(querySpec *parser.QuerySpec, response chan *p.Respo
 		return
 	}
 
-	healthyServers := make([]*ClusterServer, 0, len(self.clusterServers))
-	for _, s := range self.clusterServers {
-		if !s.IsUp() {
-			continue
-		}
-		healthyServers = append(healthyServers, s)
-	}
+	healthyServers := healthyServers(servers)
 	healthyCount := len(healthyServers)
 	if healthyCount == 0 {
 		message := fmt.Sprintf("No servers up to query shard %d", self.id)
@@ -305,18 +481,46 @@ func (self *ShardData) Query(querySpec *parser.QuerySpec, response chan *p.Respo
 		log.Error(message)
 		return
 	}
+	// start with a random server and fail over to the others in order
 	randServerIndex := int(time.Now().UnixNano() % int64(healthyCount))
-	server := healthyServers[randServerIndex]
-	log.Debug("Querying server %d for shard %d", server.GetId(), self.Id())
-	request := self.createRequest(querySpec)
+	servers = make([]*ClusterServer, 0, healthyCount)
+	servers = append(servers, healthyServers[randServerIndex:]...)
+	servers = append(servers, healthyServers[:randServerIndex]...)
+	self.queryServers(querySpec, servers, response)
+}
 
-	server.MakeRequest(request, response)
+func healthyServers(servers []*ClusterServer) []*ClusterServer {
+	healthyServers := make([]*ClusterServer, 0, len(servers))
+	for _, s := range servers {
+		if !s.IsUp() {
+			continue
+		}
+		healthyServers = append(healthyServers, s)
+	}
+	return healthyServers
+}
+
+// Returns the servers a query for this shard can be sent to. If the
+// shard is local that's only the local server, otherwise a random one
+// of the healthy servers is picked when the query runs and the query
+// fails over to the others.
+func (self *ShardData) QueryServerIds() []uint32 {
+	servers, store := self.serversAndStore()
+	if store != nil {
+		return []uint32{self.localServerId}
+	}
+	ids := []uint32{}
+	for _, server := range healthyServers(servers) {
+		ids = append(ids, server.Id)
+	}
+	return ids
 }
 
 func (self *ShardData) DropDatabase(database string, sendToServers bool) {
-	if self.IsLocal {
-		if shard, err := self.store.GetOrCreateShard(self.id); err == nil {
-			defer self.store.ReturnShard(self.id)
+	servers, store := self.serversAndStore()
+	if store != nil {
+		if shard, err := store.GetOrCreateShard(self.id); err == nil {
+			defer store.ReturnShard(self.id)
 			shard.DropDatabase(database)
 		}
 	}
@@ -325,8 +529,8 @@ func (self *ShardData) DropDatabase(database string, sendToServers bool) {
 		return
 	}
 
-	responses := make([]chan *p.Response, len(self.clusterServers), len(self.clusterServers))
-	for i, server := range self.clusterServers {
+	responses := make([]chan *p.Response, len(servers), len(servers))
+	for i, server := range servers {
 		responseChan := make(chan *p.Response, 1)
 		responses[i] = responseChan
 		request := &p.Request{Type: &dropDatabaseRequest, Database: &database, ShardId: &self.id}
@@ -338,13 +542,93 @@ func (self *ShardData) DropDatabase(database string, sendToServers bool) {
 	}
 }
 
+// Returns the stats of every copy of the shard
+func (self *ShardData) Stats() []*ShardStats {
+	servers, store := self.serversAndStore()
+	stats := make([]*ShardStats, 0, len(servers)+1)
+	if store != nil {
+		s, err := store.GetShardStats(self.id)
+		if err != nil {
+			s = &ShardStats{Error: err.Error()}
+		}
+		s.ServerId = self.localServerId
+		stats = append(stats, s)
+	}
+
+	responses := self.sendToServers(servers, shardStatsRequest)
+	for i, server := range servers {
+		response := <-responses[i]
+		if response.ErrorMessage != nil {
+			stats = append(stats, &ShardStats{ServerId: server.Id, Error: response.GetErrorMessage()})
+			continue
+		}
+		if response.ShardStats == nil {
+			stats = append(stats, &ShardStats{ServerId: server.Id, Error: "the server didn't return the stats of the shard"})
+			continue
+		}
+		stats = append(stats, NewShardStatsFromProtobuf(server.Id, response.ShardStats))
+	}
+	return stats
+}
+
+// Starts compacting every copy of the shard in the background, the
+// progress is reported in the stats of the shard
+func (self *ShardData) Compact() error {
+	var err error
+	servers, store := self.serversAndStore()
+	if store != nil {
+		err = store.CompactShard(self.id)
+	}
+
+	responses := self.sendToServers(servers, compactShardRequest)
+	for i, server := range servers {
+		response := <-responses[i]
+		if response.ErrorMessage != nil && err == nil {
+			err = fmt.Errorf("Cannot compact shard %d on server %d: %s", self.id, server.Id, response.GetErrorMessage())
+		}
+	}
+	return err
+}
+
+// Returns the stats of the copy of the shard on this server
+func (self *ShardData) LocalStats() (*ShardStats, error) {
+	store := self.localStore()
+	if store == nil {
+		return nil, fmt.Errorf("Shard %d isn't stored on this server", self.id)
+	}
+	return store.GetShardStats(self.id)
+}
+
+// Starts compacting the copy of the shard on this server
+func (self *ShardData) CompactLocal() error {
+	store := self.localStore()
+	if store == nil {
+		return fmt.Errorf("Shard %d isn't stored on this server", self.id)
+	}
+	return store.CompactShard(self.id)
+}
+
+// Sends a request for the shard to the given servers
+func (self *ShardData) sendToServers(servers []*ClusterServer, requestType p.Request_Type) []chan *p.Response {
+	responses := make([]chan *p.Response, len(servers), len(servers))
+	database := ""
+	for i, server := range servers {
+		responseChan := make(chan *p.Response, 1)
+		responses[i] = responseChan
+		request := &p.Request{Type: &requestType, Database: &database, ShardId: &self.id}
+		go server.MakeRequest(request, responseChan)
+	}
+	return responses
+}
+
 func (self *ShardData) String() string {
+	servers, store := self.serversAndStore()
 	serversString := make([]string, 0)
-	for _, s := range self.servers {
+	for _, s := range servers {
 		serversString = append(serversString, fmt.Sprintf("%d", s.GetId()))
 	}
 	local := "false"
-	if self.IsLocal {
+	if store != nil {
 		local = "true"
 	}
 
@@ -411,26 +695,32 @@ func (self *ShardData) LogAndHandleDestructiveQuery(querySpec *parser.QuerySpec,
 	self.HandleDestructiveQuery(querySpec, request, response, runLocalOnly)
 }
 
-func (self *ShardData) deleteDataLocally(querySpec *parser.QuerySpec) (<-chan *p.Response, error) {
+func (self *ShardData) deleteDataLocally(store LocalShardStore, querySpec *parser.QuerySpec) (<-chan *p.Response, error) {
 	localResponses := make(chan *p.Response, 1)
 
 	// this doesn't really apply at this point since destructive queries don't output anything, but it may later
 	maxPointsFromDestructiveQuery := 1000
 	processor := engine.NewPassthroughEngine(localResponses, maxPointsFromDestructiveQuery)
-	shard, err := self.store.GetOrCreateShard(self.id)
+	if querySpec.DeleteQuery() != nil && self.IsCoveredBy(querySpec.GetStartTime(), querySpec.GetEndTime()) {
+		log.Info("Delete covers shard %d, dropping all the points of the series", self.id)
+		err := store.DeleteAllPoints(self.id, querySpec)
+		processor.Close()
+		return localResponses, err
+	}
+	shard, err := store.GetOrCreateShard(self.id)
 	if err != nil {
 		return nil, err
 	}
-	defer self.store.ReturnShard(self.id)
+	defer store.ReturnShard(self.id)
 	err = shard.Query(querySpec, processor)
 	processor.Close()
 	return localResponses, err
 }
 
-func (self *ShardData) forwardRequest(request *p.Request) ([]<-chan *p.Response, []uint32, error) {
+func (self *ShardData) forwardRequest(servers []*ClusterServer, request *p.Request) ([]<-chan *p.Response, []uint32, error) {
 	ids := []uint32{}
 	responses := []<-chan *p.Response{}
-	for _, server := range self.clusterServers {
+	for _, server := range servers {
 		responseChan := make(chan *p.Response, 1)
 		// do this so that a new id will get assigned
 		request.Id = nil
@@ -443,15 +733,16 @@ func (self *ShardData) forwardRequest(request *p.Request) ([]<-chan *p.Response,
 }
 
 func (self *ShardData) HandleDestructiveQuery(querySpec *parser.QuerySpec, request *p.Request, response chan *p.Response, runLocalOnly bool) {
-	if !self.IsLocal && runLocalOnly {
+	servers, store := self.serversAndStore()
+	if store == nil && runLocalOnly {
 		panic("WTF islocal is false and runLocalOnly is true")
 	}
 
 	responseCahnnels := []<-chan *p.Response{}
 	serverIds := []uint32{}
 
-	if self.IsLocal {
-		channel, err := self.deleteDataLocally(querySpec)
+	if store != nil {
+		channel, err := self.deleteDataLocally(store, querySpec)
 		if err != nil {
 			msg := err.Error()
 			response <- &p.Response{Type: &endStreamResponse, ErrorMessage: &msg}
@@ -464,7 +755,7 @@ func (self *ShardData) HandleDestructiveQuery(querySpec *parser.QuerySpec, reque
 
 	log.Debug("request %s, runLocalOnly: %v", request.GetDescription(), runLocalOnly)
 	if !runLocalOnly {
-		responses, ids, _ := self.forwardRequest(request)
+		responses, ids, _ := self.forwardRequest(servers, request)
 		serverIds = append(serverIds, ids...)
 		responseCahnnels = append(responseCahnnels, responses...)
 	}
@@ -502,14 +793,18 @@ func (self *ShardData) createRequest(querySpec *parser.QuerySpec) *p.Request {
 	userName := user.GetName()
 	database := querySpec.Database()
 	isDbUser := !user.IsClusterAdmin()
+	queryId := querySpec.QueryId()
+	collectStats := querySpec.CollectStats()
 
 	return &p.Request{
-		Type:     &queryRequest,
-		ShardId:  &self.id,
-		Query:    &queryString,
-		UserName: &userName,
-		Database: &database,
-		IsDbUser: &isDbUser,
+		Type:         &queryRequest,
+		ShardId:      &self.id,
+		Query:        &queryString,
+		UserName:     &userName,
+		Database:     &database,
+		IsDbUser:     &isDbUser,
+		QueryId:      &queryId,
+		CollectStats: &collectStats,
 	}
 }
 
@@ -520,20 +815,23 @@ func (self *ShardData) ToNewShardData() *NewShardData {
 		StartTime: self.startTime,
 		EndTime:   self.endTime,
 		Type:      self.shardType,
-		ServerIds: self.serverIds,
+		ServerIds: self.ServerIds(),
+
+		ReplicationFactor: self.replicationFactor,
 	}
 }
 
 // server ids should always be returned in sorted order
-func (self *ShardData) sortServerIds() {
-	serverIdInts := make([]int, len(self.serverIds), len(self.serverIds))
-	for i, id := range self.serverIds {
+func sortServerIds(serverIds []uint32) []uint32 {
+	serverIdInts := make([]int, len(serverIds), len(serverIds))
+	for i, id := range serverIds {
 		serverIdInts[i] = int(id)
 	}
 	sort.Ints(serverIdInts)
 	for i, id := range serverIdInts {
-		self.serverIds[i] = uint32(id)
+		serverIds[i] = uint32(id)
 	}
+	return serverIds
 }
 
 func SortShardsByTimeAscending(shards []*ShardData) {
@@ -0,0 +1,125 @@
+package cluster
+
+import (
+	"fmt"
+	p "protocol"
+
+	log "code.google.com/p/log4go"
+)
+
+// Changes the servers that have a copy of the shard. If the local
+// server isn't one of them anymore its copy of the shard is deleted.
+// This is called when a copy of the shard is added or moved to another
+// server.
+func (self *ClusterConfiguration) SetShardServers(id uint32, serverIds []uint32) error {
+	shard := self.GetShardById(id)
+	if shard == nil {
+		return fmt.Errorf("Shard %d doesn't exist", id)
+	}
+	if len(serverIds) == 0 {
+		return fmt.Errorf("Shard %d needs at least one server", id)
+	}
+
+	isLocal := false
+	servers := make([]*ClusterServer, 0, len(serverIds))
+	for _, serverId := range serverIds {
+		if self.LocalServer != nil && serverId == self.LocalServer.Id {
+			isLocal = true
+			continue
+		}
+		server := self.GetServerById(&serverId)
+		if server == nil {
+			return fmt.Errorf("Server %d doesn't exist", serverId)
+		}
+		servers = append(servers, server)
+	}
+
+	var store LocalShardStore
+	localServerId := uint32(0)
+	if isLocal {
+		store = self.shardStore
+		localServerId = self.LocalServer.Id
+	}
+	wasLocal, err := shard.replaceServers(servers, store, localServerId)
+	if err != nil {
+		return err
+	}
+	log.Info("Shard %d is now stored on servers %v", id, shard.ServerIds())
+
+	if wasLocal && !isLocal {
+		log.Info("Deleting the local copy of shard %d", id)
+		return self.shardStore.DeleteShard(id)
+	}
+	return nil
+}
+
+// Returns the copy of the shard on the server, the server doesn't have
+// to be one of the servers of the shard
+func (self *ClusterConfiguration) replicaOnServer(shard *ShardData, serverId uint32) (shardReplica, error) {
+	if serverId == self.LocalServer.Id {
+		return self.localReplica(shard), nil
+	}
+	server := self.GetServerById(&serverId)
+	if server == nil {
+		return nil, fmt.Errorf("Server %d doesn't exist", serverId)
+	}
+	return &remoteReplica{shard, server}, nil
+}
+
+// Copies all the points of the shard from one server to another, throttle
+// is called with the number of points before they're written. Returns the
+// number of copied points.
+func (self *ClusterConfiguration) CopyShardReplica(shard *ShardData, from, to uint32, throttle func(points int)) (int64, error) {
+	source, err := self.replicaOnServer(shard, from)
+	if err != nil {
+		return 0, err
+	}
+	destination, err := self.replicaOnServer(shard, to)
+	if err != nil {
+		return 0, err
+	}
+
+	digests, err := source.digests("", nil)
+	if err != nil {
+		return 0, fmt.Errorf("Cannot read the series of shard %d on server %d: %s", shard.id, from, err)
+	}
+	copied := int64(0)
+	for _, digest := range digests {
+		err := source.points(digest.Database, digest.Name, shard.startMicro, shard.endMicro, func(series *p.Series) error {
+			throttle(len(series.Points))
+			if err := destination.write(digest.Database, series); err != nil {
+				return err
+			}
+			copied += int64(len(series.Points))
+			return nil
+		})
+		if err != nil {
+			return copied, fmt.Errorf("Cannot copy %s of shard %d from server %d to server %d: %s", digest.Name, shard.id, from, to, err)
+		}
+	}
+	log.Info("Copied %d points of shard %d from server %d to server %d", copied, shard.id, from, to)
+	return copied, nil
+}
+
+// Copies the points that are missing on one of the servers from the
+// other one. Returns true if the copies of the shard on both servers
+// match afterwards.
+func (self *ClusterConfiguration) SyncShardReplicas(shard *ShardData, from, to uint32) (bool, error) {
+	replicas := make([]shardReplica, 0, 2)
+	for _, serverId := range []uint32{from, to} {
+		replica, err := self.replicaOnServer(shard, serverId)
+		if err != nil {
+			return false, err
+		}
+		replicas = append(replicas, replica)
+	}
+
+	if _, err := shard.verifyReplicas(replicas, true); err != nil {
+		return false, err
+	}
+	verification, err := shard.verifyReplicas(replicas, false)
+	if err != nil {
+		return false, err
+	}
+	return verification.Consistent, nil
+}
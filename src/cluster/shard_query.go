@@ -0,0 +1,141 @@
+package cluster
+
+import (
+	"fmt"
+	"parser"
+	p "protocol"
+
+	log "code.google.com/p/log4go"
+)
+
+// The position in a series up to which the points were sent, the points
+// of a series come in the order of the query
+type seriesPosition struct {
+	timestamp       int64
+	sequenceNumbers map[uint64]bool
+}
+
+// Keeps track of the points of a query that were already sent so they
+// can be skipped when the query fails over to another server
+type sentPoints struct {
+	ascending bool
+	positions map[string]*seriesPosition
+}
+
+func newSentPoints(ascending bool) *sentPoints {
+	return &sentPoints{ascending, make(map[string]*seriesPosition)}
+}
+
+func (self *sentPoints) wasSent(name string, point *p.Point) bool {
+	position := self.positions[name]
+	if position == nil {
+		return false
+	}
+	timestamp := point.GetTimestamp()
+	if timestamp == position.timestamp {
+		return position.sequenceNumbers[point.GetSequenceNumber()]
+	}
+	return (timestamp < position.timestamp) == self.ascending
+}
+
+// Moves the position of the series past its points. If skipSent is set
+// the points that were already sent are removed from the series first.
+func (self *sentPoints) add(series *p.Series, skipSent bool) {
+	name := series.GetName()
+	if skipSent {
+		points := make([]*p.Point, 0, len(series.Points))
+		for _, point := range series.Points {
+			if !self.wasSent(name, point) {
+				points = append(points, point)
+			}
+		}
+		series.Points = points
+	}
+	for _, point := range series.Points {
+		position := self.positions[name]
+		if position == nil || position.timestamp != point.GetTimestamp() {
+			position = &seriesPosition{point.GetTimestamp(), make(map[uint64]bool)}
+			self.positions[name] = position
+		}
+		position.sequenceNumbers[point.GetSequenceNumber()] = true
+	}
+}
+
+func (self *sentPoints) addResponse(response *p.Response, skipSent bool) {
+	if response.Series != nil {
+		self.add(response.Series, skipSent)
+	}
+	for _, series := range response.MultiSeries {
+		self.add(series, skipSent)
+	}
+}
+
+// Sends the query to the servers one after the other until one of them
+// answers it. If a server goes down before it's done the query fails over
+// to the next server and the points that were already sent are skipped.
+// A server that doesn't answer the heartbeats in time is marked as down
+// and its requests fail, that's how servers that hang are detected.
+func (self *ShardData) queryServers(querySpec *parser.QuerySpec, servers []*ClusterServer, response chan *p.Response) {
+	ascending := false
+	if query := querySpec.SelectQuery(); query != nil {
+		ascending = query.Ascending
+	}
+	sent := newSentPoints(ascending)
+	// the points of queries without aggregates come in the order of the
+	// query so the query can be resumed on another server. The series of
+	// list series queries are deduplicated by the coordinator.
+	resumable := querySpec.IsListSeriesQuery() || !querySpec.HasAggregates()
+	anySent := false
+
+	var errorMessage *string
+	for _, server := range servers {
+		failedOver := errorMessage != nil
+		if failedOver {
+			log.Warn("Query of shard %d failed, retrying on server %d: %s", self.id, server.Id, *errorMessage)
+		}
+		bufferSize := cap(response)
+		if bufferSize < 1 {
+			bufferSize = 1
+		}
+		serverResponse := make(chan *p.Response, bufferSize)
+		log.Debug("Querying server %d for shard %d", server.GetId(), self.Id())
+		server.MakeRequest(self.createRequest(querySpec), serverResponse)
+
+		for {
+			r := <-serverResponse
+			if r.GetType() == p.Response_END_STREAM || r.GetType() == p.Response_ACCESS_DENIED {
+				canFailOver := !server.IsUp() && !querySpec.IsKilled() && (resumable || !anySent)
+				if r.ErrorMessage == nil || !canFailOver {
+					response <- r
+					return
+				}
+				errorMessage = r.ErrorMessage
+				break
+			}
+			if resumable {
+				sent.addResponse(r, failedOver)
+			}
+			anySent = true
+			response <- r
+		}
+	}
+	response <- &p.Response{Type: &endStreamResponse, ErrorMessage: errorMessage}
+}
+
+// Copies the points of the series at the timestamp to the copies of the
+// shard that don't have them, returns the number of copied points. This
+// is the read repair of single point queries. Nothing is copied if the
+// points were deleted on any of the copies.
+func (self *ShardData) RepairPoints(database, series string, timestamp int64) (int64, error) {
+	replicas := self.replicas()
+	for _, replica := range replicas {
+		r, err := replica.rangeDigest(database, series, timestamp, timestamp+1)
+		if err != nil {
+			return 0, fmt.Errorf("Cannot read the digest of shard %d on server %d: %s", self.id, replica.serverId(), err)
+		}
+		if r != nil && r.Deleted {
+			return 0, nil
+		}
+	}
+	return self.repairRange(replicas, database, series, timestamp, timestamp+1)
+}
@@ -0,0 +1,65 @@
+package cluster
+
+import (
+	p "protocol"
+	"time"
+
+	"code.google.com/p/goprotobuf/proto"
+	. "launchpad.net/gocheck"
+)
+
+type ShardQuerySuite struct{}
+
+var _ = Suite(&ShardQuerySuite{})
+
+func newTestSeries(timestampsAndSequenceNumbers ...int64) *p.Series {
+	series := &p.Series{Name: proto.String("foo"), Fields: []string{"value"}}
+	for i := 0; i < len(timestampsAndSequenceNumbers); i += 2 {
+		timestamp := timestampsAndSequenceNumbers[i]
+		sequenceNumber := uint64(timestampsAndSequenceNumbers[i+1])
+		series.Points = append(series.Points, &p.Point{Timestamp: &timestamp, SequenceNumber: &sequenceNumber})
+	}
+	return series
+}
+
+func (self *ShardQuerySuite) TestSentPointsAreSkippedAfterFailover(c *C) {
+	sent := newSentPoints(false)
+	sent.add(newTestSeries(30, 1, 20, 2), false)
+	sent.add(newTestSeries(20, 1), false)
+
+	// the other server sends the whole series again
+	series := newTestSeries(30, 1, 20, 2, 20, 3, 20, 1, 10, 5)
+	sent.add(series, true)
+	c.Assert(series, DeepEquals, newTestSeries(20, 3, 10, 5))
+
+	series = newTestSeries(10, 5, 5, 1)
+	sent.add(series, true)
+	c.Assert(series, DeepEquals, newTestSeries(5, 1))
+}
+
+func (self *ShardQuerySuite) TestSentPointsInAscendingOrder(c *C) {
+	sent := newSentPoints(true)
+	sent.add(newTestSeries(10, 1, 20, 1), false)
+	series := newTestSeries(10, 1, 20, 1, 20, 2, 30, 1)
+	sent.add(series, true)
+	c.Assert(series, DeepEquals, newTestSeries(20, 2, 30, 1))
+}
+
+func (self *ShardQuerySuite) TestReplacingServersKeepsTheServersOfRunningRequests(c *C) {
+	shard := NewShard(1, time.Unix(0, 0), time.Unix(3600, 0), LONG_TERM, false, nil)
+	shard.SetServers([]*ClusterServer{{Id: 3}, {Id: 2}})
+	c.Assert(shard.ServerIds(), DeepEquals, []uint32{2, 3})
+	servers, store := shard.serversAndStore()
+
+	wasLocal, err := shard.replaceServers([]*ClusterServer{{Id: 4}}, nil, 0)
+	c.Assert(err, IsNil)
+	c.Assert(wasLocal, Equals, false)
+	c.Assert(shard.IsLocal(), Equals, false)
+	c.Assert(shard.ServerIds(), DeepEquals, []uint32{4})
+
+	// the servers a request got before the change are left untouched
+	c.Assert(store, IsNil)
+	c.Assert(servers, HasLen, 2)
+	c.Assert(servers[0].Id, Equals, uint32(3))
+	c.Assert(servers[1].Id, Equals, uint32(2))
+}
@@ -102,6 +102,8 @@ type DbUser struct {
 	ReadFrom   []*Matcher `json:"read_matchers"`
 	WriteTo    []*Matcher `json:"write_matchers"`
 	IsAdmin    bool       `json:"is_admin"`
+	// overrides the default query limits, nil to use the defaults
+	Limits *common.QueryLimits `json:"limits,omitempty"`
 }
 
 func (self *DbUser) IsDbAdmin(db string) bool {
@@ -33,7 +33,7 @@ func (self *UserSuite) TestProperties(c *C) {
 	c.Assert(u.isValidPwd("foobar"), Equals, true)
 	c.Assert(u.isValidPwd("password"), Equals, false)
 
-	dbUser := DbUser{CommonUser{Name: "db_user"}, "db", nil, nil, true}
+	dbUser := DbUser{CommonUser: CommonUser{Name: "db_user"}, Db: "db", IsAdmin: true}
 	c.Assert(dbUser.IsClusterAdmin(), Equals, false)
 	c.Assert(dbUser.IsDbAdmin("db"), Equals, true)
 	c.Assert(dbUser.GetName(), Equals, "db_user")
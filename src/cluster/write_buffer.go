@@ -1,8 +1,10 @@
 package cluster
 
 import (
+	"fmt"
 	"protocol"
 	"reflect"
+	"sync"
 	"time"
 
 	log "code.google.com/p/log4go"
@@ -15,18 +17,26 @@ type WriteBuffer struct {
 	serverId                   uint32
 	writes                     chan *protocol.Request
 	stoppedWrites              chan uint32
+	stop                       chan bool
 	bufferSize                 int
 	shardIds                   map[uint32]bool
 	shardLastRequestNumber     map[uint32]uint32
 	shardCommitedRequestNumber map[uint32]uint32
 	writerInfo                 string
+	// the channels that get the server id once the request with the
+	// request number is written
+	acks     map[uint32][]chan<- uint32
+	acksLock sync.Mutex
+	// the requests that can't be written go to the hinted handoff queue
+	// if it isn't nil, otherwise the writes are retried until they succeed
+	hints *HintedHandoffQueue
 }
 
 type Writer interface {
 	Write(request *protocol.Request) error
 }
 
-func NewWriteBuffer(writerInfo string, writer Writer, wal WAL, serverId uint32, bufferSize int) *WriteBuffer {
+func NewWriteBuffer(writerInfo string, writer Writer, wal WAL, serverId uint32, bufferSize int, hints *HintedHandoffQueue) *WriteBuffer {
 	log.Info("%s: Initializing write buffer with buffer size of %d", writerInfo, bufferSize)
 	buff := &WriteBuffer{
 		writer:                     writer,
@@ -34,11 +44,14 @@ func NewWriteBuffer(writerInfo string, writer Writer, wal WAL, serverId uint32,
 		serverId:                   serverId,
 		writes:                     make(chan *protocol.Request, bufferSize),
 		stoppedWrites:              make(chan uint32, 1),
+		stop:                       make(chan bool),
 		bufferSize:                 bufferSize,
 		shardIds:                   make(map[uint32]bool),
 		shardLastRequestNumber:     map[uint32]uint32{},
 		shardCommitedRequestNumber: map[uint32]uint32{},
 		writerInfo:                 writerInfo,
+		acks:                       make(map[uint32][]chan<- uint32),
+		hints:                      hints,
 	}
 	go buff.handleWrites()
 	return buff
@@ -69,30 +82,131 @@ func (self *WriteBuffer) Write(request *protocol.Request) {
 	}
 }
 
+// Stops writing the buffered requests, this is called when the server
+// is removed from the cluster
+func (self *WriteBuffer) Stop() {
+	close(self.stop)
+}
+
+func (self *WriteBuffer) isStopped() bool {
+	select {
+	case <-self.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Buffers the write like Write and sends the server id on ack once the
+// request is written. The send doesn't block, ack has to be buffered.
+func (self *WriteBuffer) WriteWithAck(request *protocol.Request, ack chan<- uint32) {
+	if ack != nil {
+		self.acksLock.Lock()
+		self.acks[request.GetRequestNumber()] = append(self.acks[request.GetRequestNumber()], ack)
+		self.acksLock.Unlock()
+	}
+	self.Write(request)
+}
+
+func (self *WriteBuffer) acknowledge(requestNumber uint32) {
+	self.acksLock.Lock()
+	acks := self.acks[requestNumber]
+	delete(self.acks, requestNumber)
+	self.acksLock.Unlock()
+	for _, ack := range acks {
+		select {
+		case ack <- self.serverId:
+		default:
+		}
+	}
+}
+
+// The requests in the hinted handoff queue aren't acknowledged
+func (self *WriteBuffer) forgetAcks(requestNumber uint32) {
+	self.acksLock.Lock()
+	delete(self.acks, requestNumber)
+	self.acksLock.Unlock()
+}
+
 func (self *WriteBuffer) handleWrites() {
+	var replayHints <-chan time.Time
+	if self.hints != nil {
+		ticker := time.NewTicker(HINT_REPLAY_INTERVAL)
+		defer ticker.Stop()
+		replayHints = ticker.C
+	}
+
 	for {
 		select {
+		case <-self.stop:
+			log.Info("%s: Stopped writing", self.writerInfo)
+			return
 		case requestDropped := <-self.stoppedWrites:
 			self.replayAndRecover(requestDropped)
 		case request := <-self.writes:
 			self.write(request)
+		case <-replayHints:
+			self.replayHints()
+		}
+	}
+}
+
+// Replays the queue until it's empty or a request can't be written. New
+// writes go to the queue as long as it isn't empty, replaying only a batch
+// at a time wouldn't empty it while the writes keep coming. The new writes
+// wait in the buffer meanwhile.
+func (self *WriteBuffer) replayHints() {
+	total := 0
+	for self.hints.Len() > 0 && !self.isStopped() {
+		replayed, err := self.hints.Replay(HINT_REPLAY_BATCH_SIZE, self.writer.Write)
+		total += replayed
+		if err != nil {
+			log.Debug("%s: Couldn't replay the hinted handoff queue: %s", self.writerInfo, err)
+			break
 		}
 	}
+	if total > 0 {
+		log.Info("%s: Replayed %d requests from the hinted handoff queue", self.writerInfo, total)
+	}
+}
+
+// Writes the request or adds it to the hinted handoff queue if it can't
+// be written. The requests go to the queue as long as it isn't empty so
+// the server gets them in order. Returns whether the request was queued.
+func writeOrHint(writer Writer, hints *HintedHandoffQueue, request *protocol.Request) (bool, error) {
+	if hints == nil {
+		return false, writer.Write(request)
+	}
+	if hints.Len() == 0 {
+		err := writer.Write(request)
+		if err == nil {
+			return false, nil
+		}
+		log.Debug("Adding request %d to the hinted handoff queue: %s", request.GetRequestNumber(), err)
+	}
+	return true, hints.Append(request)
 }
 
 func (self *WriteBuffer) write(request *protocol.Request) {
 	attempts := 0
-	for {
+	for !self.isStopped() {
 		self.shardIds[*request.ShardId] = true
-		err := self.writer.Write(request)
+		hinted, err := writeOrHint(self.writer, self.hints, request)
 		if err == nil {
 			requestNumber := request.RequestNumber
 			if requestNumber == nil {
 				return
 			}
 
+			// a queued request is synced to the hinted handoff queue
+			// already, it's safe to commit it
 			self.shardCommitedRequestNumber[request.GetShardId()] = *requestNumber
 			self.wal.Commit(*requestNumber, self.serverId)
+			if hinted {
+				self.forgetAcks(*requestNumber)
+			} else {
+				self.acknowledge(*requestNumber)
+			}
 			return
 		}
 		if attempts%100 == 0 {
@@ -134,6 +248,9 @@ func (self *WriteBuffer) replayAndRecover(missedRequest uint32) {
 
 		log.Debug("%s: REPLAY: from request %d. Shards: %v", self.writerInfo, req.GetRequestNumber(), shardIds)
 		self.wal.RecoverServerFromRequestNumber(*req.RequestNumber, shardIds, func(request *protocol.Request, shardId uint32) error {
+			if self.isStopped() {
+				return fmt.Errorf("%s: Stopped writing", self.writerInfo)
+			}
 			log.Debug("%s: REPLAY: writing request number: %d", self.writerInfo, request.GetRequestNumber())
 			req = request
 			request.ShardId = &shardId
@@ -141,6 +258,10 @@ func (self *WriteBuffer) replayAndRecover(missedRequest uint32) {
 			return nil
 		})
 
+		if self.isStopped() {
+			return
+		}
+
 		log.Info("%s: REPLAY: Emptying out reqeusts from buffer that we've already replayed", self.writerInfo)
 	RequestLoop:
 		for {
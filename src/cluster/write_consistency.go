@@ -0,0 +1,84 @@
+package cluster
+
+import (
+	"fmt"
+	"strings"
+)
+
+// How many copies of a shard have to write a request before the write
+// returns. Any returns once the request is logged to the local wal.
+type WriteConsistency int
+
+const (
+	WRITE_CONSISTENCY_ANY WriteConsistency = iota
+	WRITE_CONSISTENCY_ONE
+	WRITE_CONSISTENCY_QUORUM
+	WRITE_CONSISTENCY_ALL
+)
+
+var writeConsistencyNames = map[WriteConsistency]string{
+	WRITE_CONSISTENCY_ANY:    "any",
+	WRITE_CONSISTENCY_ONE:    "one",
+	WRITE_CONSISTENCY_QUORUM: "quorum",
+	WRITE_CONSISTENCY_ALL:    "all",
+}
+
+// An empty string is the same as any
+func ParseWriteConsistency(name string) (WriteConsistency, error) {
+	if name == "" {
+		return WRITE_CONSISTENCY_ANY, nil
+	}
+	for consistency, consistencyName := range writeConsistencyNames {
+		if consistencyName == name {
+			return consistency, nil
+		}
+	}
+	return WRITE_CONSISTENCY_ANY, fmt.Errorf("Unknown write consistency %s, it has to be one of any, one, quorum or all", name)
+}
+
+func (self WriteConsistency) String() string {
+	return writeConsistencyNames[self]
+}
+
+// Returns how many of the copies of a shard have to acknowledge a write
+func (self WriteConsistency) RequiredAcks(copies int) int {
+	switch self {
+	case WRITE_CONSISTENCY_ONE:
+		return 1
+	case WRITE_CONSISTENCY_QUORUM:
+		return copies/2 + 1
+	case WRITE_CONSISTENCY_ALL:
+		return copies
+	default:
+		return 0
+	}
+}
+
+// The copies of a shard that did and didn't acknowledge a write before
+// the timeout
+type ShardWriteError struct {
+	ShardId      uint32   `json:"shardId"`
+	Required     int      `json:"required"`
+	Acknowledged []uint32 `json:"acknowledged"`
+	Missing      []uint32 `json:"missing"`
+}
+
+func (self *ShardWriteError) Error() string {
+	return fmt.Sprintf("%d of the %d required copies of shard %d acknowledged the write, servers %v didn't", len(self.Acknowledged), self.Required, self.ShardId, self.Missing)
+}
+
+// Returned when some of the shards didn't get enough acknowledgements for
+// the consistency level. The write is logged and still gets to the copies
+// that didn't acknowledge it eventually.
+type WriteConsistencyError struct {
+	Consistency WriteConsistency
+	Shards      []*ShardWriteError
+}
+
+func (self *WriteConsistencyError) Error() string {
+	messages := make([]string, 0, len(self.Shards))
+	for _, shard := range self.Shards {
+		messages = append(messages, shard.Error())
+	}
+	return fmt.Sprintf("The write didn't reach consistency %s: %s", self.Consistency, strings.Join(messages, "; "))
+}
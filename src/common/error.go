@@ -2,12 +2,14 @@ package common
 
 import (
 	"fmt"
+	"time"
 )
 
 const (
 	WrongNumberOfArguments = iota
 	InvalidArgument
 	InternalError
+	QueryLimitExceeded
 )
 
 type QueryError struct {
@@ -52,3 +54,18 @@ func (self DatabaseExistsError) Error() string {
 func NewDatabaseExistsError(db string) DatabaseExistsError {
 	return DatabaseExistsError(fmt.Sprintf("database %s exists", db))
 }
+
+// Returned when a write exceeds the write quota of the database or the
+// user. RetryAfter is how long the client should wait before retrying.
+type WriteRateLimitError struct {
+	Message    string
+	RetryAfter time.Duration
+}
+
+func (self *WriteRateLimitError) Error() string {
+	return self.Message
+}
+
+func NewWriteRateLimitError(retryAfter time.Duration, formatStr string, args ...interface{}) *WriteRateLimitError {
+	return &WriteRateLimitError{fmt.Sprintf(formatStr, args...), retryAfter}
+}
@@ -0,0 +1,41 @@
+package common
+
+// Limits on the resources a single query can use. A zero value means
+// that there's no limit. In the limits of a db user a zero value means
+// that the default applies and a negative value removes the default
+// limit.
+type QueryLimits struct {
+	// the maximum number of series a regex in the from clause can match
+	MaxRegexSeries int `json:"max_regex_series"`
+	// the maximum number of points a query can read from a shard
+	MaxPointsScanned int64 `json:"max_points_scanned"`
+	// the maximum number of queries a user can run at the same time
+	MaxConcurrentQueries int `json:"max_concurrent_queries"`
+	// the maximum number of groups a group by can create per series
+	MaxGroupByCardinality int `json:"max_group_by_cardinality"`
+}
+
+// Returns a copy of the limits where the non zero limits of other
+// override the limits of self, negative limits in other remove the
+// limit
+func (self *QueryLimits) Merge(other *QueryLimits) *QueryLimits {
+	limits := *self
+	if other == nil {
+		return &limits
+	}
+	limits.MaxRegexSeries = int(mergeLimit(int64(limits.MaxRegexSeries), int64(other.MaxRegexSeries)))
+	limits.MaxPointsScanned = mergeLimit(limits.MaxPointsScanned, other.MaxPointsScanned)
+	limits.MaxConcurrentQueries = int(mergeLimit(int64(limits.MaxConcurrentQueries), int64(other.MaxConcurrentQueries)))
+	limits.MaxGroupByCardinality = int(mergeLimit(int64(limits.MaxGroupByCardinality), int64(other.MaxGroupByCardinality)))
+	return &limits
+}
+
+func mergeLimit(limit, override int64) int64 {
+	switch {
+	case override < 0:
+		return 0
+	case override > 0:
+		return override
+	}
+	return limit
+}
@@ -18,6 +18,19 @@ type size struct {
 	int64
 }
 
+// The fsync policies of the WAL
+const (
+	WAL_FSYNC_ALWAYS   = "always"
+	WAL_FSYNC_INTERVAL = "interval"
+	WAL_FSYNC_NEVER    = "never"
+)
+
+// The compressions of the WAL entries
+const (
+	WAL_COMPRESSION_NONE   = "none"
+	WAL_COMPRESSION_SNAPPY = "snappy"
+)
+
 const (
 	ONE_MEGABYTE int64 = 1024 * 1024
 	ONE_GIGABYTE       = 1024 * ONE_MEGABYTE
@@ -86,14 +99,21 @@ type UdpInputConfig struct {
 }
 
 type RaftConfig struct {
-	Port    int
-	Dir     string
-	Timeout duration `toml:"election-timeout"`
+	Port        int
+	Dir         string
+	Timeout     duration `toml:"election-timeout"`
+	TlsCaPath   string   `toml:"tls-ca"`
+	TlsCertPath string   `toml:"tls-cert"`
+	TlsKeyPath  string   `toml:"tls-key"`
 }
 
 type StorageConfig struct {
 	Dir             string
 	WriteBufferSize int `toml:"write-buffer-size"`
+	Engine          string
+	PointBlockSize  int      `toml:"point-block-size"`
+	PurgeInterval   duration `toml:"purge-interval"`
+	PurgeRate       int      `toml:"purge-rate"`
 }
 
 type ClusterConfig struct {
@@ -106,6 +126,34 @@ type ClusterConfig struct {
 	WriteBufferSize           int      `toml:"write-buffer-size"`
 	ConcurrentShardQueryLimit int      `toml:"concurrent-shard-query-limit"`
 	MaxResponseBufferSize     int      `toml:"max-response-buffer-size"`
+	AntiEntropyInterval       duration `toml:"anti-entropy-interval"`
+	ShardCopyPointsPerSecond  int64    `toml:"shard-copy-points-per-second"`
+	WriteConsistencyTimeout   duration `toml:"write-consistency-timeout"`
+	ReadRepair                bool     `toml:"read-repair"`
+	TlsCaPath                 string   `toml:"tls-ca"`
+	TlsCertPath               string   `toml:"tls-cert"`
+	TlsKeyPath                string   `toml:"tls-key"`
+	Secret                    string   `toml:"secret"`
+}
+
+type QueryLimitsConfig struct {
+	MaxRegexSeries        int   `toml:"max-regex-series"`
+	MaxPointsScanned      int64 `toml:"max-points-scanned"`
+	MaxConcurrentQueries  int   `toml:"max-concurrent-queries"`
+	MaxGroupByCardinality int   `toml:"max-group-by-cardinality"`
+}
+
+type WriteLimitsConfig struct {
+	DatabasePointsPerSecond int64 `toml:"database-points-per-second"`
+	DatabaseBytesPerSecond  int64 `toml:"database-bytes-per-second"`
+	UserPointsPerSecond     int64 `toml:"user-points-per-second"`
+	UserBytesPerSecond      int64 `toml:"user-bytes-per-second"`
+}
+
+type SlowQueryLogConfig struct {
+	Threshold duration
+	File      string
+	Database  string
 }
 
 type LoggingConfig struct {
@@ -175,11 +223,21 @@ func (self *ShardConfiguration) SplitRegex() *regexp.Regexp {
 }
 
 type WalConfig struct {
-	Dir                   string `toml:"dir"`
-	FlushAfterRequests    int    `toml:"flush-after"`
-	BookmarkAfterRequests int    `toml:"bookmark-after"`
-	IndexAfterRequests    int    `toml:"index-after"`
-	RequestsPerLogFile    int    `toml:"requests-per-log-file"`
+	Dir                   string   `toml:"dir"`
+	Fsync                 string   `toml:"fsync"`
+	FsyncInterval         duration `toml:"fsync-interval"`
+	Compression           string   `toml:"compression"`
+	MaxLogFileSize        size     `toml:"max-log-file-size"`
+	MaxSize               size     `toml:"max-size"`
+	BookmarkAfterRequests int      `toml:"bookmark-after"`
+	IndexAfterRequests    int      `toml:"index-after"`
+	RequestsPerLogFile    int      `toml:"requests-per-log-file"`
+}
+
+type HintedHandoffConfig struct {
+	Dir     string   `toml:"dir"`
+	MaxSize size     `toml:"max-size"`
+	MaxAge  duration `toml:"max-age"`
 }
 
 type InputPlugins struct {
@@ -188,18 +246,22 @@ type InputPlugins struct {
 }
 
 type TomlConfiguration struct {
-	Admin        AdminConfig
-	HttpApi      ApiConfig    `toml:"api"`
-	InputPlugins InputPlugins `toml:"input_plugins"`
-	Raft         RaftConfig
-	Storage      StorageConfig
-	Cluster      ClusterConfig
-	Logging      LoggingConfig
-	LevelDb      LevelDbConfiguration
-	Hostname     string
-	BindAddress  string             `toml:"bind-address"`
-	Sharding     ShardingDefinition `toml:"sharding"`
-	WalConfig    WalConfig          `toml:"wal"`
+	Admin         AdminConfig
+	HttpApi       ApiConfig    `toml:"api"`
+	InputPlugins  InputPlugins `toml:"input_plugins"`
+	Raft          RaftConfig
+	Storage       StorageConfig
+	Cluster       ClusterConfig
+	QueryLimits   QueryLimitsConfig  `toml:"query-limits"`
+	WriteLimits   WriteLimitsConfig  `toml:"write-limits"`
+	SlowQueryLog  SlowQueryLogConfig `toml:"slow-query-log"`
+	Logging       LoggingConfig
+	LevelDb       LevelDbConfiguration
+	Hostname      string
+	BindAddress   string              `toml:"bind-address"`
+	Sharding      ShardingDefinition  `toml:"sharding"`
+	WalConfig     WalConfig           `toml:"wal"`
+	HintedHandoff HintedHandoffConfig `toml:"hinted-handoff"`
 }
 
 type Configuration struct {
@@ -219,38 +281,71 @@ type Configuration struct {
 	UdpInputPort     int
 	UdpInputDatabase string
 
-	RaftServerPort               int
-	RaftTimeout                  duration
-	SeedServers                  []string
-	DataDir                      string
-	RaftDir                      string
-	ProtobufPort                 int
-	ProtobufTimeout              duration
-	ProtobufHeartbeatInterval    duration
-	ProtobufMinBackoff           duration
-	ProtobufMaxBackoff           duration
-	Hostname                     string
-	LogFile                      string
-	LogLevel                     string
-	BindAddress                  string
-	LevelDbMaxOpenFiles          int
-	LevelDbLruCacheSize          int
-	LevelDbMaxOpenShards         int
-	LevelDbPointBatchSize        int
-	LevelDbWriteBatchSize        int
-	ShortTermShard               *ShardConfiguration
-	LongTermShard                *ShardConfiguration
-	ReplicationFactor            int
-	WalDir                       string
-	WalFlushAfterRequests        int
-	WalBookmarkAfterRequests     int
-	WalIndexAfterRequests        int
-	WalRequestsPerLogFile        int
-	LocalStoreWriteBufferSize    int
-	PerServerWriteBufferSize     int
-	ClusterMaxResponseBufferSize int
-	ConcurrentShardQueryLimit    int
-	Version                      string
+	RaftServerPort                    int
+	RaftTimeout                       duration
+	RaftTlsCaPath                     string
+	RaftTlsCertPath                   string
+	RaftTlsKeyPath                    string
+	SeedServers                       []string
+	DataDir                           string
+	StorageEngine                     string
+	StoragePointBlockSize             int
+	StoragePurgeInterval              duration
+	StoragePurgeRate                  int
+	RaftDir                           string
+	ProtobufPort                      int
+	ProtobufTimeout                   duration
+	ProtobufHeartbeatInterval         duration
+	ProtobufMinBackoff                duration
+	ProtobufMaxBackoff                duration
+	ProtobufTlsCaPath                 string
+	ProtobufTlsCertPath               string
+	ProtobufTlsKeyPath                string
+	ClusterSecret                     string
+	Hostname                          string
+	LogFile                           string
+	LogLevel                          string
+	BindAddress                       string
+	LevelDbMaxOpenFiles               int
+	LevelDbLruCacheSize               int
+	LevelDbMaxOpenShards              int
+	LevelDbPointBatchSize             int
+	LevelDbWriteBatchSize             int
+	ShortTermShard                    *ShardConfiguration
+	LongTermShard                     *ShardConfiguration
+	ReplicationFactor                 int
+	WalDir                            string
+	WalFsync                          string
+	WalFsyncInterval                  time.Duration
+	WalCompression                    string
+	WalMaxLogFileSize                 int64
+	WalMaxSize                        int64
+	WalBookmarkAfterRequests          int
+	WalIndexAfterRequests             int
+	WalRequestsPerLogFile             int
+	HintedHandoffDir                  string
+	HintedHandoffMaxSize              int64
+	HintedHandoffMaxAge               time.Duration
+	LocalStoreWriteBufferSize         int
+	PerServerWriteBufferSize          int
+	ClusterMaxResponseBufferSize      int
+	AntiEntropyInterval               time.Duration
+	ShardCopyPointsPerSecond          int64
+	WriteConsistencyTimeout           time.Duration
+	ReadRepair                        bool
+	ConcurrentShardQueryLimit         int
+	QueryMaxRegexSeries               int
+	QueryMaxPointsScanned             int64
+	QueryMaxConcurrentQueries         int
+	QueryMaxGroupByCardinality        int
+	WriteLimitDatabasePointsPerSecond int64
+	WriteLimitDatabaseBytesPerSecond  int64
+	WriteLimitUserPointsPerSecond     int64
+	WriteLimitUserBytesPerSecond      int64
+	SlowQueryThreshold                time.Duration
+	SlowQueryLogFile                  string
+	SlowQueryDatabase                 string
+	Version                           string
 }
 
 func LoadConfiguration(fileName string) *Configuration {
@@ -290,11 +385,57 @@ func parseTomlConfiguration(filename string) (*Configuration, error) {
 		tomlConfiguration.WalConfig.RequestsPerLogFile = 10 * tomlConfiguration.WalConfig.IndexAfterRequests
 	}
 
+	switch tomlConfiguration.WalConfig.Fsync {
+	case "":
+		tomlConfiguration.WalConfig.Fsync = WAL_FSYNC_ALWAYS
+	case WAL_FSYNC_ALWAYS, WAL_FSYNC_INTERVAL, WAL_FSYNC_NEVER:
+	default:
+		return nil, fmt.Errorf("Unknown wal fsync policy %s, it must be one of always, interval or never", tomlConfiguration.WalConfig.Fsync)
+	}
+
+	switch tomlConfiguration.WalConfig.Compression {
+	case "":
+		tomlConfiguration.WalConfig.Compression = WAL_COMPRESSION_NONE
+	case WAL_COMPRESSION_NONE, WAL_COMPRESSION_SNAPPY:
+	default:
+		return nil, fmt.Errorf("Unknown wal compression %s, it must be none or snappy", tomlConfiguration.WalConfig.Compression)
+	}
+
+	if tomlConfiguration.HintedHandoff.MaxSize.int64 == 0 {
+		tomlConfiguration.HintedHandoff.MaxSize = size{ONE_GIGABYTE}
+	}
+
+	if tomlConfiguration.HintedHandoff.MaxAge.Duration == 0 {
+		tomlConfiguration.HintedHandoff.MaxAge = duration{7 * 24 * time.Hour}
+	}
+
+	if tomlConfiguration.WalConfig.FsyncInterval.Duration == 0 {
+		tomlConfiguration.WalConfig.FsyncInterval = duration{time.Second}
+	}
+
 	defaultConcurrentShardQueryLimit := 10
 	if tomlConfiguration.Cluster.ConcurrentShardQueryLimit != 0 {
 		defaultConcurrentShardQueryLimit = tomlConfiguration.Cluster.ConcurrentShardQueryLimit
 	}
 
+	if tomlConfiguration.Cluster.ShardCopyPointsPerSecond == 0 {
+		tomlConfiguration.Cluster.ShardCopyPointsPerSecond = 10000
+	}
+
+	if tomlConfiguration.Cluster.WriteConsistencyTimeout.Duration == 0 {
+		tomlConfiguration.Cluster.WriteConsistencyTimeout = duration{10 * time.Second}
+	}
+
+	err = validateTlsPaths("raft", tomlConfiguration.Raft.TlsCaPath, tomlConfiguration.Raft.TlsCertPath, tomlConfiguration.Raft.TlsKeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateTlsPaths("cluster", tomlConfiguration.Cluster.TlsCaPath, tomlConfiguration.Cluster.TlsCertPath, tomlConfiguration.Cluster.TlsKeyPath)
+	if err != nil {
+		return nil, err
+	}
+
 	if tomlConfiguration.Raft.Timeout.Duration == 0 {
 		tomlConfiguration.Raft.Timeout = duration{time.Second}
 	}
@@ -333,37 +474,70 @@ func parseTomlConfiguration(filename string) (*Configuration, error) {
 		UdpInputPort:     tomlConfiguration.InputPlugins.UdpInput.Port,
 		UdpInputDatabase: tomlConfiguration.InputPlugins.UdpInput.Database,
 
-		RaftServerPort:               tomlConfiguration.Raft.Port,
-		RaftTimeout:                  tomlConfiguration.Raft.Timeout,
-		RaftDir:                      tomlConfiguration.Raft.Dir,
-		ProtobufPort:                 tomlConfiguration.Cluster.ProtobufPort,
-		ProtobufTimeout:              tomlConfiguration.Cluster.ProtobufTimeout,
-		ProtobufHeartbeatInterval:    tomlConfiguration.Cluster.ProtobufHeartbeatInterval,
-		ProtobufMinBackoff:           tomlConfiguration.Cluster.MinBackoff,
-		ProtobufMaxBackoff:           tomlConfiguration.Cluster.MaxBackoff,
-		SeedServers:                  tomlConfiguration.Cluster.SeedServers,
-		DataDir:                      tomlConfiguration.Storage.Dir,
-		LogFile:                      tomlConfiguration.Logging.File,
-		LogLevel:                     tomlConfiguration.Logging.Level,
-		Hostname:                     tomlConfiguration.Hostname,
-		BindAddress:                  tomlConfiguration.BindAddress,
-		LevelDbMaxOpenFiles:          tomlConfiguration.LevelDb.MaxOpenFiles,
-		LevelDbLruCacheSize:          int(tomlConfiguration.LevelDb.LruCacheSize.int64),
-		LevelDbMaxOpenShards:         tomlConfiguration.LevelDb.MaxOpenShards,
-		LongTermShard:                &tomlConfiguration.Sharding.LongTerm,
-		LevelDbPointBatchSize:        tomlConfiguration.LevelDb.PointBatchSize,
-		LevelDbWriteBatchSize:        tomlConfiguration.LevelDb.WriteBatchSize,
-		ShortTermShard:               &tomlConfiguration.Sharding.ShortTerm,
-		ReplicationFactor:            tomlConfiguration.Sharding.ReplicationFactor,
-		WalDir:                       tomlConfiguration.WalConfig.Dir,
-		WalFlushAfterRequests:        tomlConfiguration.WalConfig.FlushAfterRequests,
-		WalBookmarkAfterRequests:     tomlConfiguration.WalConfig.BookmarkAfterRequests,
-		WalIndexAfterRequests:        tomlConfiguration.WalConfig.IndexAfterRequests,
-		WalRequestsPerLogFile:        tomlConfiguration.WalConfig.RequestsPerLogFile,
-		LocalStoreWriteBufferSize:    tomlConfiguration.Storage.WriteBufferSize,
-		PerServerWriteBufferSize:     tomlConfiguration.Cluster.WriteBufferSize,
-		ClusterMaxResponseBufferSize: tomlConfiguration.Cluster.MaxResponseBufferSize,
-		ConcurrentShardQueryLimit:    defaultConcurrentShardQueryLimit,
+		RaftServerPort:                    tomlConfiguration.Raft.Port,
+		RaftTimeout:                       tomlConfiguration.Raft.Timeout,
+		RaftDir:                           tomlConfiguration.Raft.Dir,
+		RaftTlsCaPath:                     tomlConfiguration.Raft.TlsCaPath,
+		RaftTlsCertPath:                   tomlConfiguration.Raft.TlsCertPath,
+		RaftTlsKeyPath:                    tomlConfiguration.Raft.TlsKeyPath,
+		ProtobufPort:                      tomlConfiguration.Cluster.ProtobufPort,
+		ProtobufTimeout:                   tomlConfiguration.Cluster.ProtobufTimeout,
+		ProtobufHeartbeatInterval:         tomlConfiguration.Cluster.ProtobufHeartbeatInterval,
+		ProtobufMinBackoff:                tomlConfiguration.Cluster.MinBackoff,
+		ProtobufMaxBackoff:                tomlConfiguration.Cluster.MaxBackoff,
+		ProtobufTlsCaPath:                 tomlConfiguration.Cluster.TlsCaPath,
+		ProtobufTlsCertPath:               tomlConfiguration.Cluster.TlsCertPath,
+		ProtobufTlsKeyPath:                tomlConfiguration.Cluster.TlsKeyPath,
+		ClusterSecret:                     tomlConfiguration.Cluster.Secret,
+		SeedServers:                       tomlConfiguration.Cluster.SeedServers,
+		DataDir:                           tomlConfiguration.Storage.Dir,
+		StorageEngine:                     tomlConfiguration.Storage.Engine,
+		StoragePointBlockSize:             tomlConfiguration.Storage.PointBlockSize,
+		StoragePurgeInterval:              tomlConfiguration.Storage.PurgeInterval,
+		StoragePurgeRate:                  tomlConfiguration.Storage.PurgeRate,
+		LogFile:                           tomlConfiguration.Logging.File,
+		LogLevel:                          tomlConfiguration.Logging.Level,
+		Hostname:                          tomlConfiguration.Hostname,
+		BindAddress:                       tomlConfiguration.BindAddress,
+		LevelDbMaxOpenFiles:               tomlConfiguration.LevelDb.MaxOpenFiles,
+		LevelDbLruCacheSize:               int(tomlConfiguration.LevelDb.LruCacheSize.int64),
+		LevelDbMaxOpenShards:              tomlConfiguration.LevelDb.MaxOpenShards,
+		LongTermShard:                     &tomlConfiguration.Sharding.LongTerm,
+		LevelDbPointBatchSize:             tomlConfiguration.LevelDb.PointBatchSize,
+		LevelDbWriteBatchSize:             tomlConfiguration.LevelDb.WriteBatchSize,
+		ShortTermShard:                    &tomlConfiguration.Sharding.ShortTerm,
+		ReplicationFactor:                 tomlConfiguration.Sharding.ReplicationFactor,
+		WalDir:                            tomlConfiguration.WalConfig.Dir,
+		WalFsync:                          tomlConfiguration.WalConfig.Fsync,
+		WalFsyncInterval:                  tomlConfiguration.WalConfig.FsyncInterval.Duration,
+		WalCompression:                    tomlConfiguration.WalConfig.Compression,
+		WalMaxLogFileSize:                 tomlConfiguration.WalConfig.MaxLogFileSize.int64,
+		WalMaxSize:                        tomlConfiguration.WalConfig.MaxSize.int64,
+		WalBookmarkAfterRequests:          tomlConfiguration.WalConfig.BookmarkAfterRequests,
+		WalIndexAfterRequests:             tomlConfiguration.WalConfig.IndexAfterRequests,
+		WalRequestsPerLogFile:             tomlConfiguration.WalConfig.RequestsPerLogFile,
+		HintedHandoffDir:                  tomlConfiguration.HintedHandoff.Dir,
+		HintedHandoffMaxSize:              tomlConfiguration.HintedHandoff.MaxSize.int64,
+		HintedHandoffMaxAge:               tomlConfiguration.HintedHandoff.MaxAge.Duration,
+		LocalStoreWriteBufferSize:         tomlConfiguration.Storage.WriteBufferSize,
+		PerServerWriteBufferSize:          tomlConfiguration.Cluster.WriteBufferSize,
+		ClusterMaxResponseBufferSize:      tomlConfiguration.Cluster.MaxResponseBufferSize,
+		AntiEntropyInterval:               tomlConfiguration.Cluster.AntiEntropyInterval.Duration,
+		ShardCopyPointsPerSecond:          tomlConfiguration.Cluster.ShardCopyPointsPerSecond,
+		WriteConsistencyTimeout:           tomlConfiguration.Cluster.WriteConsistencyTimeout.Duration,
+		ReadRepair:                        tomlConfiguration.Cluster.ReadRepair,
+		ConcurrentShardQueryLimit:         defaultConcurrentShardQueryLimit,
+		QueryMaxRegexSeries:               tomlConfiguration.QueryLimits.MaxRegexSeries,
+		QueryMaxPointsScanned:             tomlConfiguration.QueryLimits.MaxPointsScanned,
+		QueryMaxConcurrentQueries:         tomlConfiguration.QueryLimits.MaxConcurrentQueries,
+		QueryMaxGroupByCardinality:        tomlConfiguration.QueryLimits.MaxGroupByCardinality,
+		WriteLimitDatabasePointsPerSecond: tomlConfiguration.WriteLimits.DatabasePointsPerSecond,
+		WriteLimitDatabaseBytesPerSecond:  tomlConfiguration.WriteLimits.DatabaseBytesPerSecond,
+		WriteLimitUserPointsPerSecond:     tomlConfiguration.WriteLimits.UserPointsPerSecond,
+		WriteLimitUserBytesPerSecond:      tomlConfiguration.WriteLimits.UserBytesPerSecond,
+		SlowQueryThreshold:                tomlConfiguration.SlowQueryLog.Threshold.Duration,
+		SlowQueryLogFile:                  tomlConfiguration.SlowQueryLog.File,
+		SlowQueryDatabase:                 tomlConfiguration.SlowQueryLog.Database,
 	}
 
 	if config.LocalStoreWriteBufferSize == 0 {
@@ -472,7 +646,7 @@ func (self *Configuration) ProtobufConnectionString() string {
 }
 
 func (self *Configuration) RaftConnectionString() string {
-	return fmt.Sprintf("http://%s:%d", self.HostnameOrDetect(), self.RaftServerPort)
+	return fmt.Sprintf("%s://%s:%d", self.RaftScheme(), self.HostnameOrDetect(), self.RaftServerPort)
 }
 
 func (self *Configuration) ProtobufListenString() string {
@@ -46,8 +46,13 @@ func (self *LoadConfigurationSuite) TestConfig(c *C) {
 	c.Assert(config.RaftDir, Equals, "/tmp/influxdb/development/raft")
 	c.Assert(config.RaftServerPort, Equals, 8090)
 	c.Assert(config.RaftTimeout.Duration, Equals, time.Second)
+	c.Assert(config.RaftTlsEnabled(), Equals, false)
 
 	c.Assert(config.DataDir, Equals, "/tmp/influxdb/development/db")
+	c.Assert(config.StorageEngine, Equals, "leveldb")
+	c.Assert(config.StoragePointBlockSize, Equals, 1000)
+	c.Assert(config.StoragePurgeInterval.Duration, Equals, 5*time.Minute)
+	c.Assert(config.StoragePurgeRate, Equals, 10000)
 
 	c.Assert(config.ProtobufPort, Equals, 8099)
 	c.Assert(config.ProtobufHeartbeatInterval.Duration, Equals, 200*time.Millisecond)
@@ -55,14 +60,45 @@ func (self *LoadConfigurationSuite) TestConfig(c *C) {
 	c.Assert(config.ProtobufMaxBackoff.Duration, Equals, time.Second)
 	c.Assert(config.ProtobufTimeout.Duration, Equals, 2*time.Second)
 	c.Assert(config.SeedServers, DeepEquals, []string{"hosta:8090", "hostb:8090"})
+	c.Assert(config.AntiEntropyInterval, Equals, 30*time.Minute)
+	c.Assert(config.ShardCopyPointsPerSecond, Equals, int64(5000))
+	c.Assert(config.WriteConsistencyTimeout, Equals, 5*time.Second)
+	c.Assert(config.ReadRepair, Equals, true)
+	c.Assert(config.ProtobufTlsEnabled(), Equals, true)
+	c.Assert(config.ProtobufTlsCaPath, Equals, "/etc/influxdb/ca.pem")
+	c.Assert(config.ProtobufTlsCertPath, Equals, "/etc/influxdb/server.pem")
+	c.Assert(config.ProtobufTlsKeyPath, Equals, "/etc/influxdb/server.key")
+	c.Assert(config.ClusterSecret, Equals, "the cluster secret")
 
 	c.Assert(config.WalDir, Equals, "/tmp/influxdb/development/wal")
-	c.Assert(config.WalFlushAfterRequests, Equals, 0)
+	c.Assert(config.WalFsync, Equals, WAL_FSYNC_INTERVAL)
+	c.Assert(config.WalFsyncInterval, Equals, 100*time.Millisecond)
 	c.Assert(config.WalBookmarkAfterRequests, Equals, 0)
 	c.Assert(config.WalIndexAfterRequests, Equals, 1000)
 	c.Assert(config.WalRequestsPerLogFile, Equals, 10000)
+	c.Assert(config.WalCompression, Equals, WAL_COMPRESSION_SNAPPY)
+	c.Assert(config.WalMaxLogFileSize, Equals, 64*ONE_MEGABYTE)
+	c.Assert(config.WalMaxSize, Equals, ONE_GIGABYTE)
+
+	c.Assert(config.HintedHandoffDir, Equals, "/tmp/influxdb/development/hinted-handoff")
+	c.Assert(config.HintedHandoffMaxSize, Equals, 100*ONE_MEGABYTE)
+	c.Assert(config.HintedHandoffMaxAge, Equals, 24*time.Hour)
 
 	c.Assert(config.ClusterMaxResponseBufferSize, Equals, 5)
+
+	c.Assert(config.QueryMaxRegexSeries, Equals, 1000)
+	c.Assert(config.QueryMaxPointsScanned, Equals, int64(10000000))
+	c.Assert(config.QueryMaxConcurrentQueries, Equals, 5)
+	c.Assert(config.QueryMaxGroupByCardinality, Equals, 10000)
+
+	c.Assert(config.WriteLimitDatabasePointsPerSecond, Equals, int64(100000))
+	c.Assert(config.WriteLimitDatabaseBytesPerSecond, Equals, int64(10000000))
+	c.Assert(config.WriteLimitUserPointsPerSecond, Equals, int64(50000))
+	c.Assert(config.WriteLimitUserBytesPerSecond, Equals, int64(5000000))
+
+	c.Assert(config.SlowQueryThreshold, Equals, time.Second)
+	c.Assert(config.SlowQueryLogFile, Equals, "/tmp/influxdb/development/slow-queries.log")
+	c.Assert(config.SlowQueryDatabase, Equals, "_influxdb")
 }
 
 func (self *LoadConfigurationSuite) TestSizeParsing(c *C) {
@@ -72,3 +108,10 @@ func (self *LoadConfigurationSuite) TestSizeParsing(c *C) {
 	c.Assert(s.UnmarshalText([]byte("10g")), IsNil)
 	c.Assert(s.int64, Equals, 10*ONE_GIGABYTE)
 }
+
+func (self *LoadConfigurationSuite) TestTlsPathsHaveToBeSetTogether(c *C) {
+	c.Assert(validateTlsPaths("raft", "", "", ""), IsNil)
+	c.Assert(validateTlsPaths("raft", "ca.pem", "server.pem", "server.key"), IsNil)
+	c.Assert(validateTlsPaths("raft", "ca.pem", "server.pem", ""), NotNil)
+	c.Assert(validateTlsPaths("cluster", "", "server.pem", ""), NotNil)
+}
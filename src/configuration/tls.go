@@ -0,0 +1,79 @@
+package configuration
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// TLS is enabled for a port if the ca, cert and key are all set, setting
+// only some of them is an error
+func validateTlsPaths(section, caPath, certPath, keyPath string) error {
+	set := 0
+	for _, path := range []string{caPath, certPath, keyPath} {
+		if path != "" {
+			set++
+		}
+	}
+	if set != 0 && set != 3 {
+		return fmt.Errorf("tls-ca, tls-cert and tls-key in [%s] have to be set together", section)
+	}
+	return nil
+}
+
+// Loads the certificate of the server and the cluster CA. The config is
+// used by both ends of a connection, the servers require the clients to
+// present a certificate signed by the cluster CA and the clients verify
+// the certificate of the servers against the same CA.
+func loadTlsConfig(caPath, certPath, keyPath string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := ioutil.ReadFile(caPath)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("Couldn't find any certificates in %s", caPath)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}, nil
+}
+
+func (self *Configuration) RaftTlsEnabled() bool {
+	return self.RaftTlsCertPath != ""
+}
+
+func (self *Configuration) RaftScheme() string {
+	if self.RaftTlsEnabled() {
+		return "https"
+	}
+	return "http"
+}
+
+// Returns nil if TLS isn't enabled for the raft port
+func (self *Configuration) RaftTlsConfig() (*tls.Config, error) {
+	if !self.RaftTlsEnabled() {
+		return nil, nil
+	}
+	return loadTlsConfig(self.RaftTlsCaPath, self.RaftTlsCertPath, self.RaftTlsKeyPath)
+}
+
+func (self *Configuration) ProtobufTlsEnabled() bool {
+	return self.ProtobufTlsCertPath != ""
+}
+
+// Returns nil if TLS isn't enabled for the protobuf port
+func (self *Configuration) ProtobufTlsConfig() (*tls.Config, error) {
+	if !self.ProtobufTlsEnabled() {
+		return nil, nil
+	}
+	return loadTlsConfig(self.ProtobufTlsCaPath, self.ProtobufTlsCertPath, self.ProtobufTlsKeyPath)
+}
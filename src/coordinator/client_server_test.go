@@ -43,10 +43,10 @@ func (self *MockRequestHandler) HandleRequest(request *protocol.Request, conn ne
 
 func (self *ClientServerSuite) TestClientCanMakeRequests(c *C) {
 	requestHandler := &MockRequestHandler{}
-	protobufServer := NewProtobufServer(":8091", requestHandler)
+	protobufServer := NewProtobufServer(":8091", requestHandler, nil)
 	go protobufServer.ListenAndServe()
 	c.Assert(protobufServer, Not(IsNil))
-	protobufClient := NewProtobufClient("localhost:8091", 0)
+	protobufClient := NewProtobufClient("localhost:8091", 0, nil)
 	protobufClient.Connect()
 	responseStream := make(chan *protocol.Response, 1)
 
@@ -0,0 +1,78 @@
+package coordinator
+
+import (
+	"cluster"
+	"common"
+	"sort"
+)
+
+// The state of the raft server and its peers as seen by the local server
+type RaftStatus struct {
+	Name        string            `json:"name"`
+	State       string            `json:"state"`
+	Leader      string            `json:"leader"`
+	Term        uint64            `json:"term"`
+	CommitIndex uint64            `json:"commitIndex"`
+	Peers       []*RaftPeerStatus `json:"peers"`
+}
+
+type RaftPeerStatus struct {
+	Name             string `json:"name"`
+	ConnectionString string `json:"connectionString"`
+	// the time the last response was received from the peer, only the
+	// leader talks to the other servers, 0 on the other servers
+	LastContact int64 `json:"lastContact"`
+}
+
+type ClusterStatus struct {
+	Raft                  *RaftStatus                     `json:"raft"`
+	Servers               []*cluster.ServerStatus         `json:"servers"`
+	UnderReplicatedShards []*cluster.UnderReplicatedShard `json:"underReplicatedShards"`
+	HintedHandoff         []*cluster.HintedHandoffStats   `json:"hintedHandoff"`
+	// the points the inputs of this server dropped because they exceeded
+	// the write quotas by the name of the input
+	DroppedPoints map[string]int64 `json:"droppedPoints"`
+}
+
+type RaftPeerStatusByName []*RaftPeerStatus
+
+func (self RaftPeerStatusByName) Len() int           { return len(self) }
+func (self RaftPeerStatusByName) Less(i, j int) bool { return self[i].Name < self[j].Name }
+func (self RaftPeerStatusByName) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+
+func (s *RaftServer) RaftStatus() *RaftStatus {
+	status := &RaftStatus{
+		Name:        s.raftServer.Name(),
+		State:       s.raftServer.State(),
+		Leader:      s.raftServer.Leader(),
+		Term:        s.raftServer.Term(),
+		CommitIndex: s.raftServer.CommitIndex(),
+		Peers:       make([]*RaftPeerStatus, 0),
+	}
+	for _, peer := range s.raftServer.Peers() {
+		peerStatus := &RaftPeerStatus{Name: peer.Name, ConnectionString: peer.ConnectionString}
+		if lastActivity := peer.LastActivity(); !lastActivity.IsZero() {
+			peerStatus.LastContact = lastActivity.Unix()
+		}
+		status.Peers = append(status.Peers, peerStatus)
+	}
+	sort.Sort(RaftPeerStatusByName(status.Peers))
+	return status
+}
+
+func (self *CoordinatorImpl) ClusterStatus(user common.User) (*ClusterStatus, error) {
+	if !user.IsClusterAdmin() {
+		return nil, common.NewAuthorizationError("Insufficient permissions to get the cluster status")
+	}
+	return &ClusterStatus{
+		Raft:                  self.raftServer.RaftStatus(),
+		Servers:               self.clusterConfiguration.ServerStatuses(),
+		UnderReplicatedShards: self.clusterConfiguration.UnderReplicatedShards(),
+		HintedHandoff:         self.clusterConfiguration.HintedHandoffStats(),
+		DroppedPoints:         self.writeLimiter.DroppedPoints(),
+	}, nil
+}
+
+func (self *CoordinatorImpl) DroppedPointsCounter(input string) *DroppedPointsCounter {
+	return self.writeLimiter.DroppedPointsCounter(input)
+}
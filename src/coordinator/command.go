@@ -29,6 +29,8 @@ func init() {
 		&SetContinuousQueryTimestampCommand{},
 		&CreateShardsCommand{},
 		&DropShardCommand{},
+		&SetShardServersCommand{},
+		&RemoveServerCommand{},
 	} {
 		internalRaftCommands[command.CommandName()] = command
 	}
@@ -109,11 +111,12 @@ func (c *DropDatabaseCommand) Apply(server raft.Server) (interface{}, error) {
 }
 
 type CreateDatabaseCommand struct {
-	Name string `json:"name"`
+	Name              string `json:"name"`
+	ReplicationFactor uint8  `json:"replicationFactor"`
 }
 
-func NewCreateDatabaseCommand(name string) *CreateDatabaseCommand {
-	return &CreateDatabaseCommand{name}
+func NewCreateDatabaseCommand(name string, replicationFactor uint8) *CreateDatabaseCommand {
+	return &CreateDatabaseCommand{name, replicationFactor}
 }
 
 func (c *CreateDatabaseCommand) CommandName() string {
@@ -122,7 +125,7 @@ func (c *CreateDatabaseCommand) CommandName() string {
 
 func (c *CreateDatabaseCommand) Apply(server raft.Server) (interface{}, error) {
 	config := server.Context().(*cluster.ClusterConfiguration)
-	err := config.CreateDatabase(c.Name)
+	err := config.CreateDatabase(c.Name, c.ReplicationFactor)
 	return nil, err
 }
 
@@ -349,3 +352,46 @@ func (c *DropShardCommand) Apply(server raft.Server) (interface{}, error) {
 	err := config.DropShard(c.ShardId, c.ServerIds)
 	return nil, err
 }
+
+type SetShardServersCommand struct {
+	ShardId   uint32
+	ServerIds []uint32
+}
+
+func NewSetShardServersCommand(id uint32, serverIds []uint32) *SetShardServersCommand {
+	return &SetShardServersCommand{ShardId: id, ServerIds: serverIds}
+}
+
+func (c *SetShardServersCommand) CommandName() string {
+	return "set_shard_servers"
+}
+
+func (c *SetShardServersCommand) Apply(server raft.Server) (interface{}, error) {
+	config := server.Context().(*cluster.ClusterConfiguration)
+	err := config.SetShardServers(c.ShardId, c.ServerIds)
+	return nil, err
+}
+
+type RemoveServerCommand struct {
+	Id uint32 `json:"id"`
+}
+
+func NewRemoveServerCommand(id uint32) *RemoveServerCommand {
+	return &RemoveServerCommand{Id: id}
+}
+
+func (c *RemoveServerCommand) CommandName() string {
+	return "remove_server"
+}
+
+func (c *RemoveServerCommand) Apply(server raft.Server) (interface{}, error) {
+	config := server.Context().(*cluster.ClusterConfiguration)
+	clusterServer := config.GetServerById(&c.Id)
+	if clusterServer == nil {
+		return nil, fmt.Errorf("Server %d doesn't exist", c.Id)
+	}
+	if err := config.RemoveServer(c.Id); err != nil {
+		return nil, err
+	}
+	return nil, server.RemovePeer(clusterServer.RaftName)
+}
@@ -10,6 +10,7 @@ import (
 	"parser"
 	"protocol"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -21,6 +22,14 @@ type CoordinatorImpl struct {
 	clusterConfiguration *cluster.ClusterConfiguration
 	raftServer           ClusterConsensus
 	config               *configuration.Configuration
+	runningQueries       *RunningQueries
+	deleteJobs           *DeleteJobs
+	shardJobs            *ShardJobs
+	writeLimiter         *WriteLimiter
+	slowQueryLog         *SlowQueryLog
+	// set while copies of shards are moved to rebalance the cluster or
+	// to remove a server
+	movingShards int32
 }
 
 const (
@@ -48,6 +57,7 @@ var (
 	heartbeatResponse    = protocol.Response_HEARTBEAT
 	explainQueryResponse = protocol.Response_EXPLAIN_QUERY
 	write                = protocol.Request_WRITE
+	killQueryRequest     = protocol.Request_KILL_QUERY
 )
 
 type SeriesWriter interface {
@@ -60,7 +70,14 @@ func NewCoordinatorImpl(config *configuration.Configuration, raftServer ClusterC
 		config:               config,
 		clusterConfiguration: clusterConfiguration,
 		raftServer:           raftServer,
+		runningQueries:       NewRunningQueries(),
+		deleteJobs:           NewDeleteJobs(),
+		shardJobs:            NewShardJobs(),
+		writeLimiter:         NewWriteLimiter(config),
 	}
+	coordinator.slowQueryLog = NewSlowQueryLog(config, func(db string, series []*protocol.Series) error {
+		return coordinator.CommitSeriesData(db, series, false)
+	})
 
 	return coordinator
 }
@@ -77,6 +94,7 @@ func (self *CoordinatorImpl) RunQuery(user common.User, database string, querySt
 
 	for _, query := range q {
 		querySpec := parser.NewQuerySpec(user, database, query)
+		querySpec.SetLimits(self.clusterConfiguration.GetQueryLimits(user))
 
 		if query.DeleteQuery != nil {
 			if err := self.clusterConfiguration.CreateCheckpoint(); err != nil {
@@ -96,11 +114,24 @@ func (self *CoordinatorImpl) RunQuery(user common.User, database string, querySt
 			continue
 		}
 
+		if query.KillQuery != nil {
+			if err := self.KillQuery(user, query.KillQuery.Id); err != nil {
+				return err
+			}
+			continue
+		}
+
 		if query.IsListQuery() {
 			if query.IsListSeriesQuery() {
 				self.runListSeriesQuery(querySpec, seriesWriter)
-			} else if query.IsListContinuousQueriesQuery() {
-				queries, err := self.ListContinuousQueries(user, database)
+			} else if query.IsListContinuousQueriesQuery() || query.IsListRunningQueriesQuery() {
+				var queries []*protocol.Series
+				var err error
+				if query.IsListContinuousQueriesQuery() {
+					queries, err = self.ListContinuousQueries(user, database)
+				} else {
+					queries, err = self.ListQueries(user, database)
+				}
 				if err != nil {
 					return err
 				}
@@ -123,12 +154,15 @@ func (self *CoordinatorImpl) RunQuery(user common.User, database string, querySt
 
 		selectQuery := query.SelectQuery
 
-		if selectQuery.IsContinuousQuery() {
+		if selectQuery.IsContinuousQuery() && !selectQuery.IsExplainPlanQuery() {
 			return self.CreateContinuousQuery(user, database, queryString)
 		}
 		if err := self.checkPermission(user, querySpec); err != nil {
 			return err
 		}
+		if selectQuery.IsExplainPlanQuery() {
+			return self.runExplainPlan(querySpec, seriesWriter)
+		}
 		return self.runQuery(querySpec, seriesWriter)
 	}
 	seriesWriter.Close()
@@ -204,6 +238,79 @@ func (self *CoordinatorImpl) runDeleteQuery(querySpec *parser.QuerySpec, seriesW
 	return self.runQuerySpec(querySpec, seriesWriter)
 }
 
+// Runs the delete queries in the background, returns the id of the job
+// that can be used to poll its status
+func (self *CoordinatorImpl) RunDeleteQueryAsync(user common.User, db, queryString string) (uint64, error) {
+	q, err := parser.ParseQuery(queryString)
+	if err != nil {
+		return 0, err
+	}
+	for _, query := range q {
+		if query.DeleteQuery == nil {
+			return 0, common.NewQueryError(common.InvalidArgument, "Only delete queries can run in the background")
+		}
+	}
+	if !user.IsClusterAdmin() && !user.IsDbAdmin(db) {
+		return 0, common.NewAuthorizationError("Insufficient permission to write to %s", db)
+	}
+
+	id := self.deleteJobs.Add(db, user.GetName(), queryString, self.clusterConfiguration.ServerId())
+	go func() {
+		err := self.RunQuery(user, db, queryString, discardSeriesWriter{})
+		if err != nil {
+			log.Error("Delete job %d failed: %s", id, err)
+		}
+		self.deleteJobs.Finish(id, err)
+	}()
+	return id, nil
+}
+
+func (self *CoordinatorImpl) GetDeleteJob(user common.User, db string, id uint64) (*DeleteJob, error) {
+	if !user.IsClusterAdmin() && !user.IsDbAdmin(db) {
+		return nil, common.NewAuthorizationError("Insufficient permissions to get the delete jobs of %s", db)
+	}
+	job := self.deleteJobs.Get(id)
+	if job == nil || job.Database != db {
+		return nil, common.NewQueryError(common.InvalidArgument, "Delete job %d doesn't exist", id)
+	}
+	return job, nil
+}
+
+func (self *CoordinatorImpl) ListDeleteJobs(user common.User, db string) ([]*DeleteJob, error) {
+	if !user.IsClusterAdmin() && !user.IsDbAdmin(db) {
+		return nil, common.NewAuthorizationError("Insufficient permissions to list the delete jobs of %s", db)
+	}
+	return self.deleteJobs.List(db), nil
+}
+
+// Copies the point of a single point query to the copies of the shard
+// that don't have it
+func (self *CoordinatorImpl) repairSinglePoint(querySpec *parser.QuerySpec, shards []*cluster.ShardData) {
+	query := querySpec.SelectQuery()
+	names := query.GetFromClause().Names
+	if len(names) != 1 {
+		return
+	}
+	if _, ok := names[0].Name.GetCompiledRegex(); ok {
+		return
+	}
+	series := names[0].Name.Name
+	timestamp := common.TimeToMicroseconds(query.GetStartTime())
+	for _, shard := range shards {
+		if len(shard.ServerIds()) < 2 || !shard.IsMicrosecondInRange(timestamp) {
+			continue
+		}
+		repaired, err := shard.RepairPoints(querySpec.Database(), series, timestamp)
+		if err != nil {
+			log.Error("Read repair of %s in shard %d failed: %s", series, shard.Id(), err)
+			continue
+		}
+		if repaired > 0 {
+			log.Info("Read repair copied %d points of %s to the copies of shard %d", repaired, series, shard.Id())
+		}
+	}
+}
+
 func (self *CoordinatorImpl) runDropSeriesQuery(querySpec *parser.QuerySpec, seriesWriter SeriesWriter) error {
 	user := querySpec.User()
 	db := querySpec.Database()
@@ -272,7 +379,7 @@ func (self *CoordinatorImpl) shouldQuerySequentially(shards []*cluster.ShardData
 	return false
 }
 
-func (self *CoordinatorImpl) getShardsAndProcessor(querySpec *parser.QuerySpec, writer SeriesWriter) ([]*cluster.ShardData, cluster.QueryProcessor, chan bool, error) {
+func (self *CoordinatorImpl) getShardsAndProcessor(querySpec *parser.QuerySpec, writer SeriesWriter, runningQuery *RunningQuery) ([]*cluster.ShardData, cluster.QueryProcessor, chan bool, error) {
 	shards := self.clusterConfiguration.GetShards(querySpec)
 	shouldAggregateLocally := self.shouldAggregateLocally(shards, querySpec)
 
@@ -287,7 +394,7 @@ func (self *CoordinatorImpl) getShardsAndProcessor(querySpec *parser.QuerySpec,
 		if !shouldAggregateLocally {
 			// if we should aggregate in the coordinator (i.e. aggregation
 			// isn't happening locally at the shard level), create an engine
-			processor, err = engine.NewQueryEngine(querySpec.SelectQuery(), responseChan)
+			processor, err = engine.NewQueryEngine(querySpec, responseChan)
 		} else {
 			// if we have a query with limit, then create an engine, or we can
 			// make the passthrough limit aware
@@ -314,6 +421,13 @@ func (self *CoordinatorImpl) getShardsAndProcessor(querySpec *parser.QuerySpec,
 				seriesClosed <- true
 				return
 			}
+			if *response.Type == explainQueryResponse {
+				runningQuery.addQueryStats(response.Series)
+				// the stats were only collected for the slow query log
+				if !querySpec.IsExplainQuery() {
+					continue
+				}
+			}
 			if !(*response.Type == queryResponse && querySpec.IsExplainQuery()) {
 				if response.Series != nil && len(response.Series.Points) > 0 {
 					writer.Write(response.Series)
@@ -328,6 +442,7 @@ func (self *CoordinatorImpl) getShardsAndProcessor(querySpec *parser.QuerySpec,
 func (self *CoordinatorImpl) readFromResponseChannels(processor cluster.QueryProcessor,
 	writer SeriesWriter,
 	isExplainQuery bool,
+	runningQuery *RunningQuery,
 	errors chan<- error,
 	channels <-chan (<-chan *protocol.Response)) {
 
@@ -335,6 +450,10 @@ func (self *CoordinatorImpl) readFromResponseChannels(processor cluster.QueryPro
 
 	for responseChan := range channels {
 		for response := range responseChan {
+			if runningQuery.IsKilled() {
+				errors <- common.NewQueryError(common.InvalidArgument, "Query %d was killed", runningQuery.Id)
+				return
+			}
 
 			//log.Debug("GOT RESPONSE: ", response.Type, response.Series)
 			log.Debug("GOT RESPONSE: ", response.Type)
@@ -354,6 +473,10 @@ func (self *CoordinatorImpl) readFromResponseChannels(processor cluster.QueryPro
 				continue
 			}
 
+			if *response.Type != explainQueryResponse {
+				runningQuery.addPointsRead(len(response.Series.Points))
+			}
+
 			// if we don't have a processor, yield the point to the writer
 			// this happens if shard took care of the query
 			// otherwise client will get points from passthrough engine
@@ -380,6 +503,7 @@ func (self *CoordinatorImpl) readFromResponseChannels(processor cluster.QueryPro
 }
 
 func (self *CoordinatorImpl) queryShards(querySpec *parser.QuerySpec, shards []*cluster.ShardData,
+	runningQuery *RunningQuery,
 	errors <-chan error,
 	responseChannels chan<- (<-chan *protocol.Response)) error {
 	defer close(responseChannels)
@@ -400,6 +524,7 @@ func (self *CoordinatorImpl) queryShards(querySpec *parser.QuerySpec, shards []*
 		responseChan := make(chan *protocol.Response, bufferSize)
 		// We query shards for data and stream them to query processor
 		log.Debug("QUERYING: shard: ", i, shard.String())
+		runningQuery.addShard(shard)
 		go shard.Query(querySpec, responseChan)
 		responseChannels <- responseChan
 	}
@@ -408,10 +533,23 @@ func (self *CoordinatorImpl) queryShards(querySpec *parser.QuerySpec, shards []*
 }
 
 func (self *CoordinatorImpl) runQuerySpec(querySpec *parser.QuerySpec, seriesWriter SeriesWriter) error {
-	shards, processor, seriesClosed, err := self.getShardsAndProcessor(querySpec, seriesWriter)
+	runningQuery, err := self.runningQueries.Add(querySpec, self.clusterConfiguration.ServerId())
 	if err != nil {
 		return err
 	}
+	defer self.runningQueries.Remove(runningQuery.Id)
+	// log the query after the writer is closed so the client doesn't wait for it
+	defer self.slowQueryLog.Log(runningQuery)
+	querySpec.SetCollectStats(self.slowQueryLog.isEnabled())
+
+	shards, processor, seriesClosed, err := self.getShardsAndProcessor(querySpec, seriesWriter, runningQuery)
+	if err != nil {
+		return err
+	}
+
+	if self.config.ReadRepair && querySpec.IsSinglePointQuery() {
+		go self.repairSinglePoint(querySpec, shards)
+	}
 
 	defer func() {
 		if processor != nil {
@@ -435,9 +573,9 @@ func (self *CoordinatorImpl) runQuerySpec(querySpec *parser.QuerySpec, seriesWri
 	}
 	responseChannels := make(chan (<-chan *protocol.Response), shardConcurrentLimit)
 
-	go self.readFromResponseChannels(processor, seriesWriter, querySpec.IsExplainQuery(), errors, responseChannels)
+	go self.readFromResponseChannels(processor, seriesWriter, querySpec.IsExplainQuery(), runningQuery, errors, responseChannels)
 
-	err = self.queryShards(querySpec, shards, errors, responseChannels)
+	err = self.queryShards(querySpec, shards, runningQuery, errors, responseChannels)
 
 	// make sure we read the rest of the errors and responses
 	for _err := range errors {
@@ -469,6 +607,10 @@ func (self *CoordinatorImpl) ForceCompaction(user common.User) error {
 }
 
 func (self *CoordinatorImpl) WriteSeriesData(user common.User, db string, series []*protocol.Series) error {
+	return self.WriteSeriesDataWithConsistency(user, db, series, cluster.WRITE_CONSISTENCY_ANY)
+}
+
+func (self *CoordinatorImpl) WriteSeriesDataWithConsistency(user common.User, db string, series []*protocol.Series, consistency cluster.WriteConsistency) error {
 	for _, s := range series {
 		seriesName := s.GetName()
 		if user.HasWriteAccess(seriesName) {
@@ -477,11 +619,19 @@ func (self *CoordinatorImpl) WriteSeriesData(user common.User, db string, series
 		return common.NewAuthorizationError("User %s doesn't have write permissions for %s", user.GetName(), seriesName)
 	}
 
-	err := self.CommitSeriesData(db, series, false)
-	if err != nil {
+	if err := self.writeLimiter.Take(user, db, series); err != nil {
 		return err
 	}
 
+	err := self.commitSeriesData(db, series, false, consistency)
+	if err != nil {
+		if _, ok := err.(*cluster.WriteConsistencyError); !ok {
+			return err
+		}
+	}
+
+	// the points were written even if some copies of the shards didn't
+	// acknowledge them in time
 	for _, s := range series {
 		self.ProcessContinuousQueries(db, s)
 	}
@@ -620,6 +770,10 @@ nextfield:
 }
 
 func (self *CoordinatorImpl) CommitSeriesData(db string, serieses []*protocol.Series, sync bool) error {
+	return self.commitSeriesData(db, serieses, sync, cluster.WRITE_CONSISTENCY_ANY)
+}
+
+func (self *CoordinatorImpl) commitSeriesData(db string, serieses []*protocol.Series, sync bool, consistency cluster.WriteConsistency) error {
 	now := common.CurrentTime()
 
 	shardToSerieses := map[uint32]map[string]*protocol.Series{}
@@ -672,6 +826,7 @@ func (self *CoordinatorImpl) CommitSeriesData(db string, serieses []*protocol.Se
 		}
 	}
 
+	acks := map[uint32]chan uint32{}
 	for id, serieses := range shardToSerieses {
 		shard := shardIdToShard[id]
 
@@ -680,22 +835,87 @@ func (self *CoordinatorImpl) CommitSeriesData(db string, serieses []*protocol.Se
 			seriesesSlice = append(seriesesSlice, s)
 		}
 
-		err := self.write(db, seriesesSlice, shard, sync)
+		var ack chan uint32
+		if !sync && consistency != cluster.WRITE_CONSISTENCY_ANY {
+			ack = make(chan uint32, len(shard.ServerIds()))
+			acks[id] = ack
+		}
+		err := self.write(db, seriesesSlice, shard, sync, ack)
 		if err != nil {
 			log.Error("COORD error writing: ", err)
 			return err
 		}
 	}
 
-	return nil
+	return self.waitForAcks(shardIdToShard, acks, consistency)
 }
 
-func (self *CoordinatorImpl) write(db string, series []*protocol.Series, shard cluster.Shard, sync bool) error {
+func (self *CoordinatorImpl) write(db string, series []*protocol.Series, shard cluster.Shard, sync bool, ack chan<- uint32) error {
 	request := &protocol.Request{Type: &write, Database: &db, MultiSeries: series}
 	if sync {
 		return shard.SyncWrite(request)
 	}
-	return shard.Write(request)
+	return shard.WriteWithAck(request, ack)
+}
+
+// Waits until enough copies of the shards acknowledged the write for the
+// consistency level or the write consistency timeout expires
+func (self *CoordinatorImpl) waitForAcks(shards map[uint32]*cluster.ShardData, acks map[uint32]chan uint32, consistency cluster.WriteConsistency) error {
+	if len(acks) == 0 {
+		return nil
+	}
+	deadline := make(chan bool)
+	timer := time.AfterFunc(self.config.WriteConsistencyTimeout, func() { close(deadline) })
+	defer timer.Stop()
+
+	shardIds := make(uint32Slice, 0, len(acks))
+	for id := range acks {
+		shardIds = append(shardIds, id)
+	}
+	sort.Sort(shardIds)
+
+	shardErrors := []*cluster.ShardWriteError{}
+	for _, id := range shardIds {
+		serverIds := shards[id].ServerIds()
+		required := consistency.RequiredAcks(len(serverIds))
+		acknowledged := map[uint32]bool{}
+	receive:
+		for len(acknowledged) < required {
+			// take the acks that are in before looking at the deadline
+			select {
+			case serverId := <-acks[id]:
+				acknowledged[serverId] = true
+				continue
+			default:
+			}
+			select {
+			case serverId := <-acks[id]:
+				acknowledged[serverId] = true
+			case <-deadline:
+				break receive
+			}
+		}
+		if len(acknowledged) >= required {
+			continue
+		}
+
+		shardError := &cluster.ShardWriteError{ShardId: id, Required: required, Acknowledged: []uint32{}, Missing: []uint32{}}
+		for _, serverId := range serverIds {
+			if acknowledged[serverId] {
+				shardError.Acknowledged = append(shardError.Acknowledged, serverId)
+			} else {
+				shardError.Missing = append(shardError.Missing, serverId)
+			}
+		}
+		shardErrors = append(shardErrors, shardError)
+	}
+
+	if len(shardErrors) == 0 {
+		return nil
+	}
+	err := &cluster.WriteConsistencyError{Consistency: consistency, Shards: shardErrors}
+	log.Warn(err.Error())
+	return err
 }
 
 func (self *CoordinatorImpl) CreateContinuousQuery(user common.User, db string, query string) error {
@@ -753,7 +973,104 @@ func (self *CoordinatorImpl) ListContinuousQueries(user common.User, db string)
 	return series, nil
 }
 
-func (self *CoordinatorImpl) CreateDatabase(user common.User, db string) error {
+func (self *CoordinatorImpl) ListQueries(user common.User, db string) ([]*protocol.Series, error) {
+	points := []*protocol.Point{}
+
+	for _, query := range self.runningQueries.List() {
+		if !user.IsClusterAdmin() && query.Database != db {
+			continue
+		}
+		if !user.IsClusterAdmin() && !user.IsDbAdmin(db) && query.User != user.GetName() {
+			continue
+		}
+
+		shardIds := []string{}
+		for _, shard := range query.Shards() {
+			shardIds = append(shardIds, fmt.Sprintf("%d", shard.Id()))
+		}
+
+		queryId := int64(query.Id)
+		database := query.Database
+		userName := query.User
+		queryString := query.Query
+		startTime := query.StartTime.Unix()
+		duration := time.Now().Sub(query.StartTime).Seconds()
+		shards := strings.Join(shardIds, ",")
+		pointsRead := query.PointsRead()
+		timestamp := time.Now().Unix()
+		sequenceNumber := uint64(1)
+		points = append(points, &protocol.Point{
+			Values: []*protocol.FieldValue{
+				&protocol.FieldValue{Int64Value: &queryId},
+				&protocol.FieldValue{StringValue: &database},
+				&protocol.FieldValue{StringValue: &userName},
+				&protocol.FieldValue{StringValue: &queryString},
+				&protocol.FieldValue{Int64Value: &startTime},
+				&protocol.FieldValue{DoubleValue: &duration},
+				&protocol.FieldValue{StringValue: &shards},
+				&protocol.FieldValue{Int64Value: &pointsRead},
+			},
+			Timestamp:      &timestamp,
+			SequenceNumber: &sequenceNumber,
+		})
+	}
+	seriesName := "queries"
+	series := []*protocol.Series{&protocol.Series{
+		Name:   &seriesName,
+		Fields: []string{"id", "database", "user", "query", "start_time", "duration", "shards", "points_read"},
+		Points: points,
+	}}
+	return series, nil
+}
+
+// Kills a query that is running on this coordinator. The query is
+// marked as killed locally, which stops the local shards, and the
+// servers that own the shards touched by the query are asked to stop
+// sending back data.
+func (self *CoordinatorImpl) KillQuery(user common.User, id uint64) error {
+	query := self.runningQueries.Get(id)
+	if query == nil {
+		return common.NewQueryError(common.InvalidArgument, "Query %d isn't running", id)
+	}
+
+	if !user.IsClusterAdmin() && !user.IsDbAdmin(query.Database) && query.User != user.GetName() {
+		return common.NewAuthorizationError("Insufficient permissions to kill query %d", id)
+	}
+
+	log.Info("Killing query %d: %s", id, query.Query)
+	query.querySpec.Kill()
+
+	localServerId := self.clusterConfiguration.ServerId()
+	serverIds := map[uint32]bool{}
+	for _, shard := range query.Shards() {
+		for _, serverId := range shard.ServerIds() {
+			if serverId != localServerId {
+				serverIds[serverId] = true
+			}
+		}
+	}
+
+	responses := make([]chan *protocol.Response, 0, len(serverIds))
+	for serverId, _ := range serverIds {
+		server := self.clusterConfiguration.GetServerById(&serverId)
+		if server == nil {
+			continue
+		}
+		responseChan := make(chan *protocol.Response, 1)
+		responses = append(responses, responseChan)
+		request := &protocol.Request{Type: &killQueryRequest, Database: &query.Database, QueryId: &id}
+		go server.MakeRequest(request, responseChan)
+	}
+	for _, responseChan := range responses {
+		response := <-responseChan
+		if response.ErrorMessage != nil {
+			log.Error("Error while killing query %d: %s", id, *response.ErrorMessage)
+		}
+	}
+	return nil
+}
+
+func (self *CoordinatorImpl) CreateDatabase(user common.User, db string, replicationFactor uint8) error {
 	if !user.IsClusterAdmin() {
 		return common.NewAuthorizationError("Insufficient permissions to create database")
 	}
@@ -762,7 +1079,16 @@ func (self *CoordinatorImpl) CreateDatabase(user common.User, db string) error {
 		return fmt.Errorf("%s isn't a valid db name", db)
 	}
 
-	err := self.raftServer.CreateDatabase(db)
+	// record the replication factor so all the servers create the
+	// shards of the database with the same one
+	if replicationFactor == 0 {
+		replicationFactor = uint8(self.config.ReplicationFactor)
+	}
+	if servers := len(self.clusterConfiguration.Servers()); int(replicationFactor) > servers {
+		log.Warn("Database %s has a replication factor of %d but the cluster has only %d servers", db, replicationFactor, servers)
+	}
+
+	err := self.raftServer.CreateDatabase(db, replicationFactor)
 	if err != nil {
 		return err
 	}
@@ -911,11 +1237,16 @@ func (self *CoordinatorImpl) CreateDbUser(requester common.User, db, username, p
 		writeMatcher[0].Name = permissions[1]
 	}
 	log.Debug("(raft:%s) Creating user %s:%s", self.raftServer.(*RaftServer).raftServer.Name(), db, username)
-	return self.raftServer.SaveDbUser(&cluster.DbUser{cluster.CommonUser{
-		Name:     username,
-		Hash:     string(hash),
-		CacheKey: db + "%" + username,
-	}, db, readMatcher, writeMatcher, false})
+	return self.raftServer.SaveDbUser(&cluster.DbUser{
+		CommonUser: cluster.CommonUser{
+			Name:     username,
+			Hash:     string(hash),
+			CacheKey: db + "%" + username,
+		},
+		Db:       db,
+		ReadFrom: readMatcher,
+		WriteTo:  writeMatcher,
+	})
 }
 
 func (self *CoordinatorImpl) DeleteDbUser(requester common.User, db, username string) error {
@@ -986,6 +1317,21 @@ func (self *CoordinatorImpl) SetDbAdmin(requester common.User, db, username stri
 	return nil
 }
 
+func (self *CoordinatorImpl) SetDbUserQueryLimits(requester common.User, db, username string, limits *common.QueryLimits) error {
+	if !requester.IsClusterAdmin() {
+		return common.NewAuthorizationError("Insufficient permissions to change query limits")
+	}
+
+	user := self.clusterConfiguration.GetDbUser(db, username)
+	if user == nil {
+		return fmt.Errorf("Invalid username %s", username)
+	}
+	// save a copy, the user is shared with the queries that are running
+	updatedUser := *user
+	updatedUser.Limits = limits
+	return self.raftServer.SaveDbUser(&updatedUser)
+}
+
 func (self *CoordinatorImpl) ConnectToProtobufServers(localRaftName string) error {
 	log.Info("Connecting to other nodes in the cluster")
 
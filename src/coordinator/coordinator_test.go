@@ -2,10 +2,15 @@ package coordinator
 
 import (
 	"cluster"
+	"common"
 	"configuration"
+	"engine"
 	"fmt"
 	"parser"
+	"protocol"
 	"time"
+
+	"code.google.com/p/goprotobuf/proto"
 	. "launchpad.net/gocheck"
 )
 
@@ -40,3 +45,235 @@ func (self *CoordinatorSuite) TestShouldQuerySequentially(c *C) {
 		c.Assert(coordinator.shouldQuerySequentially(shards, querySpec), Equals, result)
 	}
 }
+
+type collectingSeriesWriter struct {
+	series []*protocol.Series
+	closed bool
+}
+
+func (self *collectingSeriesWriter) Write(series *protocol.Series) error {
+	self.series = append(self.series, series)
+	return nil
+}
+
+func (self *collectingSeriesWriter) Close() {
+	self.closed = true
+}
+
+func (self *CoordinatorSuite) TestExplainPlan(c *C) {
+	config := &configuration.Configuration{
+		ClusterMaxResponseBufferSize: 1000,
+		ConcurrentShardQueryLimit:    10,
+		LevelDbPointBatchSize:        100,
+	}
+	clusterConfiguration := cluster.NewClusterConfiguration(config, nil, nil, nil)
+	now := time.Now()
+	_, err := clusterConfiguration.AddShards([]*cluster.NewShardData{
+		&cluster.NewShardData{StartTime: now.Add(-time.Hour), EndTime: now.Add(time.Hour), Type: cluster.SHORT_TERM},
+	})
+	c.Assert(err, IsNil)
+	coordinator := NewCoordinatorImpl(config, nil, clusterConfiguration)
+
+	parsedQuery, err := parser.ParseQuery("explain plan select count(value) from foo group by time(1h) where time > now() - 1h")
+	c.Assert(err, IsNil)
+	querySpec := parser.NewQuerySpec(&cluster.ClusterAdmin{CommonUser: cluster.CommonUser{Name: "root"}}, "db1", parsedQuery[0])
+	writer := &collectingSeriesWriter{}
+	c.Assert(coordinator.runExplainPlan(querySpec, writer), IsNil)
+	c.Assert(writer.closed, Equals, true)
+	c.Assert(writer.series, HasLen, 2)
+
+	plan := writer.series[0]
+	c.Assert(plan.GetName(), Equals, "explain plan")
+	c.Assert(plan.Fields, DeepEquals, []string{"shards", "aggregate_locally", "query_sequentially", "shard_concurrency", "series", "columns"})
+	c.Assert(plan.Points, HasLen, 1)
+	values := plan.Points[0].Values
+	c.Assert(values[0].GetInt64Value(), Equals, int64(1))
+	c.Assert(values[1].GetBoolValue(), Equals, true)
+	c.Assert(values[2].GetBoolValue(), Equals, false)
+	c.Assert(values[3].GetInt64Value(), Equals, int64(10))
+	c.Assert(values[4].GetStringValue(), Equals, "foo")
+
+	shards := writer.series[1]
+	c.Assert(shards.GetName(), Equals, "explain plan shards")
+	c.Assert(shards.Points, HasLen, 1)
+	c.Assert(shards.Points[0].Values[0].GetInt64Value(), Equals, int64(1))
+	// no servers are up to query the shard
+	c.Assert(shards.Points[0].Values[4].GetStringValue(), Equals, "")
+}
+
+func (self *CoordinatorSuite) TestRunningQueriesConcurrencyLimit(c *C) {
+	db1User := &cluster.DbUser{CommonUser: cluster.CommonUser{Name: "paul"}, Db: "db1"}
+	db2User := &cluster.DbUser{CommonUser: cluster.CommonUser{Name: "paul"}, Db: "db2"}
+	admin := &cluster.ClusterAdmin{CommonUser: cluster.CommonUser{Name: "paul"}}
+	parsedQuery, err := parser.ParseQuery("select * from foo")
+	c.Assert(err, IsNil)
+	newQuerySpec := func(user common.User, db string) *parser.QuerySpec {
+		querySpec := parser.NewQuerySpec(user, db, parsedQuery[0])
+		querySpec.SetLimits(&common.QueryLimits{MaxConcurrentQueries: 2})
+		return querySpec
+	}
+
+	runningQueries := NewRunningQueries()
+	first, err := runningQueries.Add(newQuerySpec(db1User, "db1"), 1)
+	c.Assert(err, IsNil)
+	c.Assert(first.Id, Equals, HOST_ID_OFFSET+1)
+	_, err = runningQueries.Add(newQuerySpec(db1User, "db1"), 1)
+	c.Assert(err, IsNil)
+	_, err = runningQueries.Add(newQuerySpec(db1User, "db1"), 1)
+	c.Assert(err, NotNil)
+	// the db users with the same name in other databases and the cluster
+	// admins with the same name have their own limits
+	_, err = runningQueries.Add(newQuerySpec(db2User, "db2"), 1)
+	c.Assert(err, IsNil)
+	_, err = runningQueries.Add(newQuerySpec(admin, "db1"), 1)
+	c.Assert(err, IsNil)
+	_, err = runningQueries.Add(newQuerySpec(admin, "db2"), 1)
+	c.Assert(err, IsNil)
+	_, err = runningQueries.Add(newQuerySpec(admin, "db2"), 1)
+	c.Assert(err, NotNil)
+	c.Assert(runningQueries.List(), HasLen, 5)
+
+	runningQueries.Remove(first.Id)
+	_, err = runningQueries.Add(newQuerySpec(db1User, "db1"), 1)
+	c.Assert(err, IsNil)
+}
+
+func (self *CoordinatorSuite) TestRunningQueryStatsComeFromTheQueryEngine(c *C) {
+	user := &cluster.DbUser{CommonUser: cluster.CommonUser{Name: "paul"}, Db: "db1"}
+	parsedQuery, err := parser.ParseQuery("select value from foo limit 1")
+	c.Assert(err, IsNil)
+	querySpec := parser.NewQuerySpec(user, "db1", parsedQuery[0])
+	querySpec.SetCollectStats(true)
+	runningQuery, err := NewRunningQueries().Add(querySpec, 1)
+	c.Assert(err, IsNil)
+
+	responses := make(chan *protocol.Response, 10)
+	queryEngine, err := engine.NewQueryEngine(querySpec, responses)
+	c.Assert(err, IsNil)
+	series := &protocol.Series{Name: proto.String("foo"), Fields: []string{"value"}}
+	for i := 0; i < 3; i++ {
+		series.Points = append(series.Points, &protocol.Point{
+			Values: []*protocol.FieldValue{&protocol.FieldValue{Int64Value: proto.Int64(int64(i))}},
+		})
+	}
+	queryEngine.YieldSeries(series)
+	queryEngine.Close()
+
+	explained := 0
+	for response := range responses {
+		if response.GetType() == protocol.Response_EXPLAIN_QUERY {
+			runningQuery.addQueryStats(response.Series)
+			explained++
+		}
+		if response.GetType() == protocol.Response_END_STREAM {
+			break
+		}
+	}
+	c.Assert(explained, Equals, 1)
+	c.Assert(runningQuery.Stats(), Equals, QueryStats{PointsRead: 3, PointsWritten: 1})
+}
+
+func (self *CoordinatorSuite) TestQueryLimitsMerge(c *C) {
+	defaults := &common.QueryLimits{MaxRegexSeries: 10, MaxPointsScanned: 1000, MaxConcurrentQueries: 2}
+	limits := defaults.Merge(&common.QueryLimits{MaxRegexSeries: 20, MaxPointsScanned: -1})
+	c.Assert(limits, DeepEquals, &common.QueryLimits{MaxRegexSeries: 20, MaxConcurrentQueries: 2})
+	c.Assert(defaults.Merge(nil), DeepEquals, defaults)
+}
+
+func (self *CoordinatorSuite) TestWriteLimiter(c *C) {
+	limiter := NewWriteLimiter(&configuration.Configuration{
+		WriteLimitDatabasePointsPerSecond: 100,
+		WriteLimitUserPointsPerSecond:     10,
+	})
+	paul := &cluster.DbUser{CommonUser: cluster.CommonUser{Name: "paul"}, Db: "db1"}
+	todd := &cluster.DbUser{CommonUser: cluster.CommonUser{Name: "todd"}, Db: "db1"}
+	newSeries := func(numberOfPoints int) []*protocol.Series {
+		series := &protocol.Series{Name: proto.String("foo"), Fields: []string{"value"}}
+		for i := 0; i < numberOfPoints; i++ {
+			series.Points = append(series.Points, &protocol.Point{
+				Values: []*protocol.FieldValue{&protocol.FieldValue{Int64Value: proto.Int64(int64(i))}},
+			})
+		}
+		return []*protocol.Series{series}
+	}
+
+	// the user quota is exhausted after the first write
+	c.Assert(limiter.Take(paul, "db1", newSeries(10)), IsNil)
+	err := limiter.Take(paul, "db1", newSeries(1))
+	c.Assert(err, FitsTypeOf, &common.WriteRateLimitError{})
+	c.Assert(err.(*common.WriteRateLimitError).RetryAfter > 0, Equals, true)
+
+	// other users and databases have their own quotas
+	c.Assert(limiter.Take(todd, "db1", newSeries(5)), IsNil)
+	c.Assert(limiter.Take(paul, "db2", newSeries(5)), IsNil)
+
+	// a disabled limiter doesn't limit anything
+	limiter = NewWriteLimiter(&configuration.Configuration{})
+	for i := 0; i < 10; i++ {
+		c.Assert(limiter.Take(paul, "db1", newSeries(1000)), IsNil)
+	}
+
+	// the inputs share the counters of the dropped points by name
+	limiter.DroppedPointsCounter("UDP").Add("db1", newSeries(3))
+	limiter.DroppedPointsCounter("UDP").Add("db1", newSeries(2))
+	c.Assert(limiter.DroppedPoints(), DeepEquals, map[string]int64{"UDP": 5})
+}
+
+func (self *CoordinatorSuite) TestPlanRebalance(c *C) {
+	// server 3 just joined the cluster
+	shards := map[uint32][]uint32{1: {1, 2}, 2: {1, 2}, 3: {1, 2}, 4: {1, 2}}
+	moves := planRebalance([]uint32{1, 2, 3}, shards)
+	c.Assert(moves, DeepEquals, []*ShardMove{
+		&ShardMove{ShardId: 1, From: 2, To: 3},
+		&ShardMove{ShardId: 2, From: 1, To: 3},
+	})
+
+	// the moves leave the servers balanced
+	shards = map[uint32][]uint32{1: {1, 2}, 2: {1, 2}, 3: {1, 3}, 4: {2, 3}}
+	c.Assert(planRebalance([]uint32{1, 2, 3}, shards), HasLen, 0)
+	c.Assert(planRebalance([]uint32{1}, map[uint32][]uint32{1: {1}, 2: {1}}), HasLen, 0)
+
+	// a shard is never moved to a server that already has a copy of it
+	shards = map[uint32][]uint32{1: {1, 2, 3}, 2: {1, 2, 3}}
+	c.Assert(planRebalance([]uint32{1, 2, 3, 4}, shards), DeepEquals, []*ShardMove{
+		&ShardMove{ShardId: 1, From: 3, To: 4},
+	})
+}
+
+func (self *CoordinatorSuite) TestPlanServerRemoval(c *C) {
+	shards := map[uint32][]uint32{1: {1, 2}, 2: {2, 3}, 3: {2, 4}, 4: {1, 3}}
+	moves, err := planServerRemoval(2, []uint32{1, 2, 3, 4}, shards)
+	c.Assert(err, IsNil)
+	c.Assert(moves, DeepEquals, []*ShardMove{
+		&ShardMove{ShardId: 1, From: 2, To: 4},
+		&ShardMove{ShardId: 2, From: 2, To: 4},
+		&ShardMove{ShardId: 3, From: 2, To: 1},
+	})
+
+	// the shard can't keep its copies without the server
+	shards = map[uint32][]uint32{1: {1, 2, 3}}
+	_, err = planServerRemoval(2, []uint32{1, 2, 3}, shards)
+	c.Assert(err, NotNil)
+}
+
+func (self *CoordinatorSuite) TestShardJobs(c *C) {
+	jobs := NewShardJobs()
+	id, err := jobs.Add(SHARD_JOB_MOVE, &ShardMove{ShardId: 1, From: 1, To: 2}, "root", 1)
+	c.Assert(err, IsNil)
+	// a shard is copied by one job at a time
+	_, err = jobs.Add(SHARD_JOB_COPY, &ShardMove{ShardId: 1, From: 2, To: 3}, "root", 1)
+	c.Assert(err, NotNil)
+	c.Assert(jobs.IsRunning(), Equals, true)
+
+	jobs.AddCopiedPoints(id, 10)
+	jobs.AddCopiedPoints(id, 5)
+	jobs.Finish(id, nil)
+	job := jobs.Get(id)
+	c.Assert(job.PointsCopied, Equals, int64(15))
+	c.Assert(job.Done, Equals, true)
+	c.Assert(jobs.IsRunning(), Equals, false)
+
+	_, err = jobs.Add(SHARD_JOB_COPY, &ShardMove{ShardId: 1, From: 2, To: 3}, "root", 1)
+	c.Assert(err, IsNil)
+	c.Assert(jobs.List(), HasLen, 2)
+}
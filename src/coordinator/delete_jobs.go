@@ -0,0 +1,117 @@
+package coordinator
+
+import (
+	"protocol"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The number of finished delete jobs that are kept around so their
+// status can be polled
+const MAX_FINISHED_DELETE_JOBS = 100
+
+// A delete query that runs in the background. End time is zero while
+// the job is running.
+type DeleteJob struct {
+	Id        uint64 `json:"id"`
+	Database  string `json:"database"`
+	User      string `json:"user"`
+	Query     string `json:"query"`
+	StartTime int64  `json:"startTime"`
+	EndTime   int64  `json:"endTime"`
+	Done      bool   `json:"done"`
+	Error     string `json:"error,omitempty"`
+}
+
+type DeleteJobsById []*DeleteJob
+
+func (self DeleteJobsById) Len() int           { return len(self) }
+func (self DeleteJobsById) Less(i, j int) bool { return self[i].Id < self[j].Id }
+func (self DeleteJobsById) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+
+// Keeps track of the delete jobs started on this coordinator, the ids
+// are assigned like the ids of the running queries
+type DeleteJobs struct {
+	lock   sync.Mutex
+	lastId uint64
+	jobs   map[uint64]*DeleteJob
+}
+
+func NewDeleteJobs() *DeleteJobs {
+	return &DeleteJobs{jobs: make(map[uint64]*DeleteJob)}
+}
+
+func (self *DeleteJobs) Add(database, user, query string, localServerId uint32) uint64 {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.lastId++
+	id := self.lastId*HOST_ID_OFFSET + uint64(localServerId)
+	self.jobs[id] = &DeleteJob{
+		Id:        id,
+		Database:  database,
+		User:      user,
+		Query:     query,
+		StartTime: time.Now().Unix(),
+	}
+	return id
+}
+
+// Marks the job as done and forgets the oldest finished jobs
+func (self *DeleteJobs) Finish(id uint64, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	job := self.jobs[id]
+	if job == nil {
+		return
+	}
+	job.Done = true
+	job.EndTime = time.Now().Unix()
+	if err != nil {
+		job.Error = err.Error()
+	}
+
+	finished := DeleteJobsById{}
+	for _, job := range self.jobs {
+		if job.Done {
+			finished = append(finished, job)
+		}
+	}
+	sort.Sort(finished)
+	for i := 0; i < len(finished)-MAX_FINISHED_DELETE_JOBS; i++ {
+		delete(self.jobs, finished[i].Id)
+	}
+}
+
+// Returns a copy of the job or nil if it doesn't exist
+func (self *DeleteJobs) Get(id uint64) *DeleteJob {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	job := self.jobs[id]
+	if job == nil {
+		return nil
+	}
+	jobCopy := *job
+	return &jobCopy
+}
+
+// Returns a copy of the jobs of the database
+func (self *DeleteJobs) List(database string) []*DeleteJob {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	jobs := DeleteJobsById{}
+	for _, job := range self.jobs {
+		if job.Database == database {
+			jobCopy := *job
+			jobs = append(jobs, &jobCopy)
+		}
+	}
+	sort.Sort(jobs)
+	return jobs
+}
+
+// delete queries don't return any series
+type discardSeriesWriter struct{}
+
+func (self discardSeriesWriter) Write(series *protocol.Series) error { return nil }
+func (self discardSeriesWriter) Close()                              {}
@@ -0,0 +1,172 @@
+package coordinator
+
+import (
+	"cluster"
+	"common"
+	"fmt"
+	"parser"
+	"protocol"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Returns the plan of an `explain plan` query without running it. The
+// plan is returned in two series, `explain plan` has the query wide
+// decisions and `explain plan shards` has a point per shard that would
+// be queried.
+func (self *CoordinatorImpl) runExplainPlan(querySpec *parser.QuerySpec, seriesWriter SeriesWriter) error {
+	defer seriesWriter.Close()
+
+	shards := self.clusterConfiguration.GetShards(querySpec)
+	seriesNames, err := self.resolveSeriesNames(querySpec, shards)
+	if err != nil {
+		return err
+	}
+
+	aggregateLocally := self.shouldAggregateLocally(shards, querySpec)
+	querySequentially := self.shouldQuerySequentially(shards, querySpec)
+	shardConcurrency := int64(self.config.ConcurrentShardQueryLimit)
+	if querySequentially {
+		shardConcurrency = 1
+	}
+	numberOfShards := int64(len(shards))
+	series := strings.Join(seriesNames, ",")
+	columns := parser.Values(querySpec.SelectQuery().GetColumnNames()).GetString()
+
+	timestamp := time.Now().UnixNano() / int64(time.Microsecond)
+	planSeries := &protocol.Series{
+		Name:   protocol.String("explain plan"),
+		Fields: []string{"shards", "aggregate_locally", "query_sequentially", "shard_concurrency", "series", "columns"},
+		Points: []*protocol.Point{
+			&protocol.Point{
+				Timestamp: &timestamp,
+				Values: []*protocol.FieldValue{
+					&protocol.FieldValue{Int64Value: &numberOfShards},
+					&protocol.FieldValue{BoolValue: &aggregateLocally},
+					&protocol.FieldValue{BoolValue: &querySequentially},
+					&protocol.FieldValue{Int64Value: &shardConcurrency},
+					&protocol.FieldValue{StringValue: &series},
+					&protocol.FieldValue{StringValue: &columns},
+				},
+			},
+		},
+	}
+	if err := seriesWriter.Write(planSeries); err != nil {
+		return err
+	}
+
+	if len(shards) == 0 {
+		return nil
+	}
+
+	shardsSeries := &protocol.Series{
+		Name:   protocol.String("explain plan shards"),
+		Fields: []string{"shard_id", "start_time", "end_time", "local", "servers", "aggregate_locally", "buffer_size"},
+	}
+	for _, shard := range shards {
+		shardId := int64(shard.Id())
+		startTime := shard.StartMicro()
+		endTime := shard.EndMicro()
+		local := shard.IsLocal()
+		servers := joinServerIds(shard.QueryServerIds())
+		shardAggregatesLocally := shard.ShouldAggregateLocally(querySpec)
+		bufferSize := shard.QueryResponseBufferSize(querySpec, self.config.LevelDbPointBatchSize)
+		if bufferSize > self.config.ClusterMaxResponseBufferSize {
+			bufferSize = self.config.ClusterMaxResponseBufferSize
+		}
+		bufferSize64 := int64(bufferSize)
+
+		shardsSeries.Points = append(shardsSeries.Points, &protocol.Point{
+			Timestamp: &timestamp,
+			Values: []*protocol.FieldValue{
+				&protocol.FieldValue{Int64Value: &shardId},
+				&protocol.FieldValue{Int64Value: &startTime},
+				&protocol.FieldValue{Int64Value: &endTime},
+				&protocol.FieldValue{BoolValue: &local},
+				&protocol.FieldValue{StringValue: &servers},
+				&protocol.FieldValue{BoolValue: &shardAggregatesLocally},
+				&protocol.FieldValue{Int64Value: &bufferSize64},
+			},
+		})
+	}
+	return seriesWriter.Write(shardsSeries)
+}
+
+// Returns the names of the series the query would read from. Regexes
+// are resolved against the series of the given shards and only series
+// the user can read are returned.
+func (self *CoordinatorImpl) resolveSeriesNames(querySpec *parser.QuerySpec, shards []*cluster.ShardData) ([]string, error) {
+	names := []string{}
+	var existingSeries []string
+	user := querySpec.User()
+
+	for _, tableName := range querySpec.SelectQuery().GetFromClause().Names {
+		regex, ok := tableName.Name.GetCompiledRegex()
+		if !ok {
+			names = append(names, tableName.Name.Name)
+			continue
+		}
+
+		if existingSeries == nil {
+			var err error
+			existingSeries, err = self.listShardsSeries(querySpec, shards)
+			if err != nil {
+				return nil, err
+			}
+		}
+		for _, name := range existingSeries {
+			if regex.MatchString(name) && user.HasReadAccess(name) {
+				names = append(names, name)
+			}
+		}
+	}
+	return names, nil
+}
+
+func (self *CoordinatorImpl) listShardsSeries(querySpec *parser.QuerySpec, shards []*cluster.ShardData) ([]string, error) {
+	queries, err := parser.ParseQuery("list series")
+	if err != nil {
+		return nil, err
+	}
+	listQuerySpec := parser.NewQuerySpec(querySpec.User(), querySpec.Database(), queries[0])
+
+	seen := make(map[string]bool)
+	names := []string{}
+	for _, shard := range shards {
+		responseChan := make(chan *protocol.Response, shard.QueryResponseBufferSize(listQuerySpec, self.config.LevelDbPointBatchSize))
+		// the shard can send more than one end of stream response, read
+		// everything it sends so it doesn't block on a full channel
+		go func(shard *cluster.ShardData) {
+			shard.Query(listQuerySpec, responseChan)
+			close(responseChan)
+		}(shard)
+		for response := range responseChan {
+			if *response.Type == endStreamResponse || *response.Type == accessDeniedResponse {
+				if response.ErrorMessage != nil && err == nil {
+					err = common.NewQueryError(common.InvalidArgument, *response.ErrorMessage)
+				}
+				continue
+			}
+			for _, series := range response.MultiSeries {
+				if name := series.GetName(); !seen[name] {
+					seen[name] = true
+					names = append(names, name)
+				}
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func joinServerIds(ids []uint32) string {
+	servers := make([]string, 0, len(ids))
+	for _, id := range ids {
+		servers = append(servers, fmt.Sprintf("%d", id))
+	}
+	return strings.Join(servers, ",")
+}
@@ -17,20 +17,50 @@ type Coordinator interface {
 	//   4. The end of a time series is signaled by returning a series with no data points
 	//   5. TODO: Aggregation on the nodes
 	WriteSeriesData(user common.User, db string, series []*protocol.Series) error
+	// Waits until enough copies of the shards wrote the series for the
+	// consistency level, returns a *cluster.WriteConsistencyError if they
+	// didn't before the write consistency timeout
+	WriteSeriesDataWithConsistency(user common.User, db string, series []*protocol.Series, consistency cluster.WriteConsistency) error
 	DropDatabase(user common.User, db string) error
-	CreateDatabase(user common.User, db string) error
+	// A replication factor of 0 uses the one in the configuration
+	CreateDatabase(user common.User, db string, replicationFactor uint8) error
 	ForceCompaction(user common.User) error
 	ListDatabases(user common.User) ([]*cluster.Database, error)
 	DeleteContinuousQuery(user common.User, db string, id uint32) error
 	CreateContinuousQuery(user common.User, db string, query string) error
 	ListContinuousQueries(user common.User, db string) ([]*protocol.Series, error)
+	ListQueries(user common.User, db string) ([]*protocol.Series, error)
+	KillQuery(user common.User, id uint64) error
+	// Runs the delete queries in the background, returns the job id
+	RunDeleteQueryAsync(user common.User, db string, query string) (uint64, error)
+	GetDeleteJob(user common.User, db string, id uint64) (*DeleteJob, error)
+	ListDeleteJobs(user common.User, db string) ([]*DeleteJob, error)
+	// Moves copies of shards so all the servers have the same number of
+	// shards, the moves run in the background unless dryRun is set
+	Rebalance(user common.User, dryRun bool) ([]*ShardMove, error)
+	// Moves the copies of the shards on the server to the other servers
+	// in the background and removes the server from the cluster afterwards
+	RemoveServer(user common.User, id uint32) ([]*ShardMove, error)
+	// Copies the shard from one server to another in the background and
+	// removes the copy on the first server afterwards if move is set,
+	// returns the job id
+	CopyShardAsync(user common.User, shardId, from, to uint32, move bool) (uint64, error)
+	GetShardJob(user common.User, id uint64) (*ShardJob, error)
+	ListShardJobs(user common.User) ([]*ShardJob, error)
+	// Returns the raft state, the state of the connections to the other
+	// servers and the shards that don't have enough copies that are up
+	ClusterStatus(user common.User) (*ClusterStatus, error)
+	// Returns the counter of the points the input (i.e. graphite or udp)
+	// dropped because of the write quotas, the counts are in the cluster
+	// status
+	DroppedPointsCounter(input string) *DroppedPointsCounter
 
 	// v2 clustering, based on sharding instead of the circular hash ring
 	RunQuery(user common.User, db, query string, seriesWriter SeriesWriter) error
 }
 
 type ClusterConsensus interface {
-	CreateDatabase(name string) error
+	CreateDatabase(name string, replicationFactor uint8) error
 	DropDatabase(name string) error
 	CreateContinuousQuery(db string, query string) error
 	DeleteContinuousQuery(db string, id uint32) error
@@ -38,6 +68,10 @@ type ClusterConsensus interface {
 	SaveDbUser(user *cluster.DbUser) error
 	ChangeDbUserPassword(db, username string, hash []byte) error
 	ChangeDbUserPermissions(db, username, readPermissions, writePermissions string) error
+	SetShardServers(id uint32, serverIds []uint32) error
+	CheckServerRemoval(id uint32) error
+	RemoveServer(id uint32) error
+	RaftStatus() *RaftStatus
 	AssignCoordinator(coordinator *CoordinatorImpl) error
 	// When a cluster is turned on for the first time.
 	CreateRootUser() error
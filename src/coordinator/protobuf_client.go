@@ -2,6 +2,7 @@ package coordinator
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -26,6 +27,7 @@ type ProtobufClient struct {
 	writeTimeout      time.Duration
 	attempts          int
 	stopped           bool
+	tlsConfig         *tls.Config
 }
 
 type runningRequest struct {
@@ -41,13 +43,15 @@ const (
 	RECONNECT_RETRY_WAIT   = time.Millisecond * 100
 )
 
-func NewProtobufClient(hostAndPort string, writeTimeout time.Duration) *ProtobufClient {
+// The connection uses TLS if tlsConfig isn't nil
+func NewProtobufClient(hostAndPort string, writeTimeout time.Duration, tlsConfig *tls.Config) *ProtobufClient {
 	log.Debug("NewProtobufClient: ", hostAndPort)
 	return &ProtobufClient{
 		hostAndPort:   hostAndPort,
 		requestBuffer: make(map[uint32]*runningRequest),
 		writeTimeout:  writeTimeout,
 		stopped:       false,
+		tlsConfig:     tlsConfig,
 	}
 }
 
@@ -68,9 +72,9 @@ func (self *ProtobufClient) Connect() {
 func (self *ProtobufClient) Close() {
 	self.connLock.Lock()
 	defer self.connLock.Unlock()
+	self.stopped = true
 	if self.conn != nil {
 		self.conn.Close()
-		self.stopped = true
 		self.conn = nil
 	}
 	self.ClearRequests()
@@ -98,6 +102,18 @@ func (self *ProtobufClient) ClearRequests() {
 	self.requestBuffer = map[uint32]*runningRequest{}
 }
 
+// Stops sending the responses of the requests with the response stream,
+// for callers that stop reading the responses before the end
+func (self *ProtobufClient) CancelRequest(responseStream chan *protocol.Response) {
+	self.requestBufferLock.Lock()
+	defer self.requestBufferLock.Unlock()
+	for id, req := range self.requestBuffer {
+		if req.responseChan == responseStream {
+			delete(self.requestBuffer, id)
+		}
+	}
+}
+
 // Makes a request to the server. If the responseStream chan is not nil it will expect a response from the server
 // with a matching request.Id. The REQUEST_RETRY_ATTEMPTS constant of 3 and the RECONNECT_RETRY_WAIT of 100ms means
 // that an attempt to make a request to a downed server will take 300ms to time out.
@@ -209,7 +225,10 @@ func (self *ProtobufClient) reconnect() net.Conn {
 	if self.conn != nil {
 		self.conn.Close()
 	}
-	conn, err := net.DialTimeout("tcp", self.hostAndPort, self.writeTimeout)
+	if self.stopped {
+		return nil
+	}
+	conn, err := self.dial()
 	if err == nil {
 		self.conn = conn
 		log.Info("connected to %s", self.hostAndPort)
@@ -223,6 +242,17 @@ func (self *ProtobufClient) reconnect() net.Conn {
 	return nil
 }
 
+func (self *ProtobufClient) dial() (net.Conn, error) {
+	if self.tlsConfig == nil {
+		return net.DialTimeout("tcp", self.hostAndPort, self.writeTimeout)
+	}
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: self.writeTimeout}, "tcp", self.hostAndPort, self.tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
 func (self *ProtobufClient) peridicallySweepTimedOutRequests() {
 	for {
 		time.Sleep(time.Minute)
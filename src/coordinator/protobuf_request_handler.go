@@ -10,6 +10,7 @@ import (
 	"net"
 	"parser"
 	"protocol"
+	"sync"
 
 	log "code.google.com/p/log4go"
 )
@@ -18,6 +19,10 @@ type ProtobufRequestHandler struct {
 	coordinator   Coordinator
 	clusterConfig *cluster.ClusterConfiguration
 	writeOk       protocol.Response_Type
+	// queries that are running on this server on behalf of another
+	// coordinator, keyed by the query id assigned by the coordinator
+	runningQueries     map[uint64][]*parser.QuerySpec
+	runningQueriesLock sync.Mutex
 }
 
 var (
@@ -26,7 +31,12 @@ var (
 )
 
 func NewProtobufRequestHandler(coordinator Coordinator, clusterConfig *cluster.ClusterConfiguration) *ProtobufRequestHandler {
-	return &ProtobufRequestHandler{coordinator: coordinator, writeOk: protocol.Response_WRITE_OK, clusterConfig: clusterConfig}
+	return &ProtobufRequestHandler{
+		coordinator:    coordinator,
+		writeOk:        protocol.Response_WRITE_OK,
+		clusterConfig:  clusterConfig,
+		runningQueries: make(map[uint64][]*parser.QuerySpec),
+	}
 }
 
 func (self *ProtobufRequestHandler) HandleRequest(request *protocol.Request, conn net.Conn) error {
@@ -37,6 +47,18 @@ func (self *ProtobufRequestHandler) HandleRequest(request *protocol.Request, con
 		return nil
 	} else if *request.Type == protocol.Request_QUERY {
 		go self.handleQuery(request, conn)
+	} else if *request.Type == protocol.Request_KILL_QUERY {
+		go self.handleKillQuery(request, conn)
+	} else if *request.Type == protocol.Request_SHARD_STATS {
+		go self.handleShardStats(request, conn)
+	} else if *request.Type == protocol.Request_COMPACT_SHARD {
+		go self.handleCompactShard(request, conn)
+	} else if *request.Type == protocol.Request_SHARD_DIGEST {
+		go self.handleShardDigest(request, conn)
+	} else if *request.Type == protocol.Request_SHARD_POINTS {
+		go self.handleShardPoints(request, conn)
+	} else if *request.Type == protocol.Request_SHARD_WRITE {
+		go self.handleShardWrite(request, conn)
 	} else if *request.Type == protocol.Request_HEARTBEAT {
 		response := &protocol.Response{RequestId: request.Id, Type: &heartbeatResponse}
 		return self.WriteResponse(conn, response)
@@ -90,6 +112,13 @@ func (self *ProtobufRequestHandler) handleQuery(request *protocol.Request, conn
 	shard := self.clusterConfig.GetLocalShardById(*request.ShardId)
 
 	querySpec := parser.NewQuerySpec(user, *request.Database, query)
+	querySpec.SetLimits(self.clusterConfig.GetQueryLimits(user))
+	querySpec.SetCollectStats(request.GetCollectStats())
+	if queryId := request.GetQueryId(); queryId != 0 {
+		querySpec.SetQueryId(queryId)
+		self.addRunningQuery(querySpec)
+		defer self.removeRunningQuery(querySpec)
+	}
 
 	responseChan := make(chan *protocol.Response)
 	if querySpec.IsDestructiveQuery() {
@@ -107,6 +136,45 @@ func (self *ProtobufRequestHandler) handleQuery(request *protocol.Request, conn
 	}
 }
 
+func (self *ProtobufRequestHandler) handleKillQuery(request *protocol.Request, conn net.Conn) {
+	self.runningQueriesLock.Lock()
+	for _, querySpec := range self.runningQueries[request.GetQueryId()] {
+		querySpec.Kill()
+	}
+	self.runningQueriesLock.Unlock()
+	response := &protocol.Response{Type: &endStreamResponse, RequestId: request.Id}
+	self.WriteResponse(conn, response)
+}
+
+func (self *ProtobufRequestHandler) addRunningQuery(querySpec *parser.QuerySpec) {
+	self.runningQueriesLock.Lock()
+	defer self.runningQueriesLock.Unlock()
+	id := querySpec.QueryId()
+	// the shards of the query on this server share the points scanned
+	if querySpecs := self.runningQueries[id]; len(querySpecs) > 0 {
+		querySpec.SharePointsScanned(querySpecs[0])
+	}
+	self.runningQueries[id] = append(self.runningQueries[id], querySpec)
+}
+
+func (self *ProtobufRequestHandler) removeRunningQuery(querySpec *parser.QuerySpec) {
+	self.runningQueriesLock.Lock()
+	defer self.runningQueriesLock.Unlock()
+	id := querySpec.QueryId()
+	querySpecs := self.runningQueries[id]
+	for i, q := range querySpecs {
+		if q == querySpec {
+			querySpecs = append(querySpecs[:i], querySpecs[i+1:]...)
+			break
+		}
+	}
+	if len(querySpecs) == 0 {
+		delete(self.runningQueries, id)
+		return
+	}
+	self.runningQueries[id] = querySpecs
+}
+
 func (self *ProtobufRequestHandler) handleDropDatabase(request *protocol.Request, conn net.Conn) {
 	shard := self.clusterConfig.GetLocalShardById(*request.ShardId)
 	shard.DropDatabase(*request.Database, false)
@@ -114,6 +182,124 @@ func (self *ProtobufRequestHandler) handleDropDatabase(request *protocol.Request
 	self.WriteResponse(conn, response)
 }
 
+func (self *ProtobufRequestHandler) handleShardStats(request *protocol.Request, conn net.Conn) {
+	response := &protocol.Response{Type: &endStreamResponse, RequestId: request.Id}
+	// don't use GetLocalShardById, it creates the shard if it doesn't exist
+	if shard := self.clusterConfig.GetShardById(*request.ShardId); shard == nil {
+		response.ErrorMessage = protocol.String(fmt.Sprintf("Shard %d doesn't exist", *request.ShardId))
+	} else if stats, err := shard.LocalStats(); err != nil {
+		response.ErrorMessage = protocol.String(err.Error())
+	} else {
+		response.ShardStats = stats.ToProtobuf()
+	}
+	self.WriteResponse(conn, response)
+}
+
+func (self *ProtobufRequestHandler) handleCompactShard(request *protocol.Request, conn net.Conn) {
+	response := &protocol.Response{Type: &endStreamResponse, RequestId: request.Id}
+	if shard := self.clusterConfig.GetShardById(*request.ShardId); shard == nil {
+		response.ErrorMessage = protocol.String(fmt.Sprintf("Shard %d doesn't exist", *request.ShardId))
+	} else if err := shard.CompactLocal(); err != nil {
+		response.ErrorMessage = protocol.String(err.Error())
+	}
+	self.WriteResponse(conn, response)
+}
+
+// Sends the digests of the series of the local copy of the shard, a
+// chunk at a time
+func (self *ProtobufRequestHandler) handleShardDigest(request *protocol.Request, conn net.Conn) {
+	response := &protocol.Response{Type: &endStreamResponse, RequestId: request.Id}
+	defer func() { self.WriteResponse(conn, response) }()
+
+	shard := self.clusterConfig.GetShardById(*request.ShardId)
+	if shard == nil {
+		response.ErrorMessage = protocol.String(fmt.Sprintf("Shard %d doesn't exist", *request.ShardId))
+		return
+	}
+	// the digest of one series in a time range for the read repair
+	if request.StartTime != nil && request.EndTime != nil && len(request.SeriesNames) == 1 {
+		r, err := self.clusterConfig.LocalShardRangeDigest(shard, request.GetDatabase(), request.SeriesNames[0], *request.StartTime, *request.EndTime)
+		if err != nil {
+			response.ErrorMessage = protocol.String(err.Error())
+			return
+		}
+		if r != nil {
+			digest := &cluster.SeriesDigest{Database: request.GetDatabase(), Name: request.SeriesNames[0], Points: r.Points, Hash: r.Hash, Ranges: []*cluster.RangeDigest{r}}
+			chunk := &protocol.Response{Type: &queryResponse, RequestId: request.Id, SeriesDigests: []*protocol.SeriesDigest{digest.ToProtobuf(true)}}
+			if err := self.WriteResponse(conn, chunk); err != nil {
+				log.Error("Cannot send the digest of shard %d: %s", *request.ShardId, err)
+			}
+		}
+		return
+	}
+
+	digests, err := self.clusterConfig.LocalShardDigests(shard, request.GetDatabase(), request.SeriesNames)
+	if err != nil {
+		response.ErrorMessage = protocol.String(err.Error())
+		return
+	}
+
+	withRanges := len(request.SeriesNames) > 0
+	for start := 0; start < len(digests); start += cluster.ANTI_ENTROPY_CHUNK_SIZE {
+		end := start + cluster.ANTI_ENTROPY_CHUNK_SIZE
+		if end > len(digests) {
+			end = len(digests)
+		}
+		chunk := &protocol.Response{Type: &queryResponse, RequestId: request.Id}
+		for _, digest := range digests[start:end] {
+			chunk.SeriesDigests = append(chunk.SeriesDigests, digest.ToProtobuf(withRanges))
+		}
+		if err := self.WriteResponse(conn, chunk); err != nil {
+			log.Error("Cannot send the digests of shard %d: %s", *request.ShardId, err)
+			return
+		}
+	}
+}
+
+// Sends the points of a series in a time range of the local copy of
+// the shard
+func (self *ProtobufRequestHandler) handleShardPoints(request *protocol.Request, conn net.Conn) {
+	response := &protocol.Response{Type: &endStreamResponse, RequestId: request.Id}
+	defer func() { self.WriteResponse(conn, response) }()
+
+	shard := self.clusterConfig.GetShardById(*request.ShardId)
+	if shard == nil {
+		response.ErrorMessage = protocol.String(fmt.Sprintf("Shard %d doesn't exist", *request.ShardId))
+		return
+	}
+	if len(request.SeriesNames) != 1 {
+		response.ErrorMessage = protocol.String("The points of exactly one series can be requested")
+		return
+	}
+	err := self.clusterConfig.LocalShardPoints(shard, request.GetDatabase(), request.SeriesNames[0], request.GetStartTime(), request.GetEndTime(), func(series *protocol.Series) error {
+		chunk := &protocol.Response{Type: &queryResponse, RequestId: request.Id, MultiSeries: []*protocol.Series{series}}
+		return self.WriteResponse(conn, chunk)
+	})
+	if err != nil {
+		response.ErrorMessage = protocol.String(err.Error())
+	}
+}
+
+// Writes the points of a shard that is copied to this server, the
+// server isn't one of the servers of the shard before the copy is done
+func (self *ProtobufRequestHandler) handleShardWrite(request *protocol.Request, conn net.Conn) {
+	response := &protocol.Response{Type: &self.writeOk, RequestId: request.Id}
+	defer func() { self.WriteResponse(conn, response) }()
+
+	shard := self.clusterConfig.GetShardById(*request.ShardId)
+	if shard == nil {
+		response.ErrorMessage = protocol.String(fmt.Sprintf("Shard %d doesn't exist", *request.ShardId))
+		return
+	}
+	for _, series := range request.MultiSeries {
+		if err := self.clusterConfig.LocalShardWrite(shard, request.GetDatabase(), series); err != nil {
+			log.Error("ProtobufRequestHandler: error writing to the copy of shard %d: %s", shard.Id(), err)
+			response.ErrorMessage = protocol.String(err.Error())
+			return
+		}
+	}
+}
+
 func (self *ProtobufRequestHandler) WriteResponse(conn net.Conn, response *protocol.Response) error {
 	data, err := response.Encode()
 	if err != nil {
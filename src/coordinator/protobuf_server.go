@@ -2,6 +2,7 @@ package coordinator
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/binary"
 	"io"
 	"io/ioutil"
@@ -19,14 +20,16 @@ type ProtobufServer struct {
 	requestHandler    RequestHandler
 	connectionMapLock sync.Mutex
 	connectionMap     map[net.Conn]bool
+	tlsConfig         *tls.Config
 }
 
 const KILOBYTE = 1024
 const MEGABYTE = 1024 * KILOBYTE
 const MAX_REQUEST_SIZE = MEGABYTE * 2
 
-func NewProtobufServer(port string, requestHandler RequestHandler) *ProtobufServer {
-	server := &ProtobufServer{port: port, requestHandler: requestHandler, connectionMap: make(map[net.Conn]bool)}
+// The connections use TLS if tlsConfig isn't nil
+func NewProtobufServer(port string, requestHandler RequestHandler, tlsConfig *tls.Config) *ProtobufServer {
+	server := &ProtobufServer{port: port, requestHandler: requestHandler, connectionMap: make(map[net.Conn]bool), tlsConfig: tlsConfig}
 	return server
 }
 
@@ -58,6 +61,9 @@ func (self *ProtobufServer) ListenAndServe() {
 	if err != nil {
 		panic(err)
 	}
+	if self.tlsConfig != nil {
+		ln = tls.NewListener(ln, self.tlsConfig)
+	}
 	self.listener = ln
 	log.Info("ProtobufServer listening on %s", self.port)
 	for {
@@ -76,6 +82,17 @@ func (self *ProtobufServer) ListenAndServe() {
 func (self *ProtobufServer) handleConnection(conn net.Conn) {
 	log.Info("ProtobufServer: client connected: %s", conn.RemoteAddr().String())
 
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			log.Error("Rejecting connection from %s: %s", conn.RemoteAddr().String(), err)
+			self.connectionMapLock.Lock()
+			delete(self.connectionMap, conn)
+			self.connectionMapLock.Unlock()
+			conn.Close()
+			return
+		}
+	}
+
 	message := make([]byte, 0, MAX_REQUEST_SIZE)
 	buff := bytes.NewBuffer(message)
 	var messageSizeU uint32
@@ -0,0 +1,286 @@
+package coordinator
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "code.google.com/p/log4go"
+	"github.com/goraft/raft"
+)
+
+const (
+	RAFT_SIGNATURE_HEADER = "X-Influxdb-Signature"
+	RAFT_TIMESTAMP_HEADER = "X-Influxdb-Timestamp"
+	RAFT_NONCE_HEADER     = "X-Influxdb-Nonce"
+	// how far the clocks of the servers can be apart
+	MAX_RAFT_REQUEST_AGE = 5 * time.Minute
+)
+
+// Signs the requests to the raft port with an HMAC of the cluster secret
+// and verifies the signatures of the incoming requests. The responses are
+// signed too so servers don't join a cluster with a different secret. An
+// empty secret disables the signatures. Every request carries a random
+// nonce that is remembered until its timestamp expires, so a captured
+// request can't be replayed.
+type raftSigner struct {
+	secret     []byte
+	nonces     map[string]time.Time
+	noncesLock sync.Mutex
+	lastPrune  time.Time
+}
+
+func newRaftSigner(secret string) *raftSigner {
+	return &raftSigner{
+		secret:    []byte(secret),
+		nonces:    make(map[string]time.Time),
+		lastPrune: time.Now(),
+	}
+}
+
+func (self *raftSigner) enabled() bool {
+	return len(self.secret) > 0
+}
+
+func (self *raftSigner) sign(parts ...[]byte) string {
+	mac := hmac.New(sha256.New, self.secret)
+	for _, part := range parts {
+		mac.Write(part)
+		mac.Write([]byte{'\n'})
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (self *raftSigner) requestSignature(req *http.Request, timestamp, nonce string, body []byte) string {
+	return self.sign([]byte(req.Method), []byte(req.URL.RequestURI()), []byte(timestamp), []byte(nonce), body)
+}
+
+func newNonce() (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(nonce), nil
+}
+
+// Returns false if the nonce was already used. The nonce is remembered
+// until the request with the given timestamp is too old to be accepted.
+func (self *raftSigner) useNonce(nonce string, timestamp time.Time) bool {
+	self.noncesLock.Lock()
+	defer self.noncesLock.Unlock()
+
+	now := time.Now()
+	if now.Sub(self.lastPrune) > MAX_RAFT_REQUEST_AGE {
+		for n, expires := range self.nonces {
+			if now.After(expires) {
+				delete(self.nonces, n)
+			}
+		}
+		self.lastPrune = now
+	}
+
+	if _, ok := self.nonces[nonce]; ok {
+		return false
+	}
+	self.nonces[nonce] = timestamp.Add(MAX_RAFT_REQUEST_AGE)
+	return true
+}
+
+func (self *raftSigner) responseSignature(requestSignature string) string {
+	return self.sign([]byte("response"), []byte(requestSignature))
+}
+
+func readBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil {
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// Returns the signature of the request if it's valid
+func (self *raftSigner) verifyRequest(req *http.Request) (string, error) {
+	signature := req.Header.Get(RAFT_SIGNATURE_HEADER)
+	if signature == "" {
+		return "", fmt.Errorf("The request isn't signed")
+	}
+	timestamp := req.Header.Get(RAFT_TIMESTAMP_HEADER)
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("Invalid timestamp %s", timestamp)
+	}
+	requestTime := time.Unix(seconds, 0)
+	if age := time.Since(requestTime); age > MAX_RAFT_REQUEST_AGE || age < -MAX_RAFT_REQUEST_AGE {
+		return "", fmt.Errorf("The request timestamp is off by %s", age)
+	}
+	nonce := req.Header.Get(RAFT_NONCE_HEADER)
+	if nonce == "" {
+		return "", fmt.Errorf("The request doesn't have a nonce")
+	}
+	body, err := readBody(req)
+	if err != nil {
+		return "", err
+	}
+	if !hmac.Equal([]byte(signature), []byte(self.requestSignature(req, timestamp, nonce, body))) {
+		return "", fmt.Errorf("Invalid signature, the cluster secrets don't match")
+	}
+	// only valid signatures use up a nonce
+	if !self.useNonce(nonce, requestTime) {
+		return "", fmt.Errorf("The request was replayed, nonce %s was already used", nonce)
+	}
+	return signature, nil
+}
+
+// Rejects the requests that aren't signed with the cluster secret
+func (self *raftSigner) authenticate(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !self.enabled() {
+			handler.ServeHTTP(w, req)
+			return
+		}
+		signature, err := self.verifyRequest(req)
+		if err != nil {
+			log.Warn("Rejecting raft request %s from %s: %s", req.URL.Path, req.RemoteAddr, err)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set(RAFT_SIGNATURE_HEADER, self.responseSignature(signature))
+		handler.ServeHTTP(w, req)
+	})
+}
+
+// An http.RoundTripper that signs the requests and verifies the
+// signatures of the responses
+type signingTransport struct {
+	signer    *raftSigner
+	transport http.RoundTripper
+}
+
+func (self *signingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !self.signer.enabled() {
+		return self.transport.RoundTrip(req)
+	}
+
+	// round trippers shouldn't modify the request
+	signed := *req
+	signed.Header = make(http.Header, len(req.Header)+3)
+	for key, values := range req.Header {
+		signed.Header[key] = values
+	}
+	body, err := readBody(&signed)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	signature := self.signer.requestSignature(&signed, timestamp, nonce, body)
+	signed.Header.Set(RAFT_TIMESTAMP_HEADER, timestamp)
+	signed.Header.Set(RAFT_NONCE_HEADER, nonce)
+	signed.Header.Set(RAFT_SIGNATURE_HEADER, signature)
+
+	resp, err := self.transport.RoundTrip(&signed)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal([]byte(resp.Header.Get(RAFT_SIGNATURE_HEADER)), []byte(self.signer.responseSignature(signature))) {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s didn't sign the response with the cluster secret, the cluster secrets don't match", req.URL.Host)
+	}
+	return resp, nil
+}
+
+func newRaftHttpClient(signer *raftSigner, transport *http.Transport) *http.Client {
+	return &http.Client{Transport: &signingTransport{signer, transport}}
+}
+
+// The raft http transporter with signed requests. The handlers of the
+// embedded transporter are used as they are.
+type raftTransporter struct {
+	*raft.HTTPTransporter
+	client              *http.Client
+	appendEntriesClient *http.Client
+}
+
+func newRaftTransporter(signer *raftSigner, transport, appendEntriesTransport *http.Transport) *raftTransporter {
+	return &raftTransporter{
+		HTTPTransporter:     raft.NewHTTPTransporter("/raft"),
+		client:              newRaftHttpClient(signer, transport),
+		appendEntriesClient: newRaftHttpClient(signer, appendEntriesTransport),
+	}
+}
+
+type raftEncoder interface {
+	Encode(w io.Writer) (int, error)
+}
+
+type raftDecoder interface {
+	Decode(r io.Reader) (int, error)
+}
+
+func (self *raftTransporter) post(client *http.Client, url string, req raftEncoder, resp raftDecoder) bool {
+	var b bytes.Buffer
+	if _, err := req.Encode(&b); err != nil {
+		log.Error("Cannot encode raft request to %s: %s", url, err)
+		return false
+	}
+	httpResp, err := client.Post(url, "application/protobuf", &b)
+	if err != nil {
+		log.Debug("Raft request to %s failed: %s", url, err)
+		return false
+	}
+	defer httpResp.Body.Close()
+	if _, err := resp.Decode(httpResp.Body); err != nil && err != io.EOF {
+		log.Error("Cannot decode raft response from %s: %s", url, err)
+		return false
+	}
+	return true
+}
+
+func (self *raftTransporter) SendAppendEntriesRequest(server raft.Server, peer *raft.Peer, req *raft.AppendEntriesRequest) *raft.AppendEntriesResponse {
+	resp := &raft.AppendEntriesResponse{}
+	if !self.post(self.appendEntriesClient, peer.ConnectionString+self.AppendEntriesPath(), req, resp) {
+		return nil
+	}
+	return resp
+}
+
+func (self *raftTransporter) SendVoteRequest(server raft.Server, peer *raft.Peer, req *raft.RequestVoteRequest) *raft.RequestVoteResponse {
+	resp := &raft.RequestVoteResponse{}
+	if !self.post(self.client, peer.ConnectionString+self.RequestVotePath(), req, resp) {
+		return nil
+	}
+	return resp
+}
+
+func (self *raftTransporter) SendSnapshotRequest(server raft.Server, peer *raft.Peer, req *raft.SnapshotRequest) *raft.SnapshotResponse {
+	resp := &raft.SnapshotResponse{}
+	if !self.post(self.client, peer.ConnectionString+self.SnapshotPath(), req, resp) {
+		return nil
+	}
+	return resp
+}
+
+func (self *raftTransporter) SendSnapshotRecoveryRequest(server raft.Server, peer *raft.Peer, req *raft.SnapshotRecoveryRequest) *raft.SnapshotRecoveryResponse {
+	resp := &raft.SnapshotRecoveryResponse{}
+	if !self.post(self.client, peer.ConnectionString+self.SnapshotRecoveryPath(), req, resp) {
+		return nil
+	}
+	return resp
+}
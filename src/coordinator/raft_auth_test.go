@@ -0,0 +1,72 @@
+package coordinator
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"time"
+
+	. "launchpad.net/gocheck"
+)
+
+type RaftAuthSuite struct{}
+
+var _ = Suite(&RaftAuthSuite{})
+
+func (self *RaftAuthSuite) TestRequestsHaveToBeSignedWithTheClusterSecret(c *C) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	server := httptest.NewServer(newRaftSigner("secret").authenticate(handler))
+	defer server.Close()
+
+	client := newRaftHttpClient(newRaftSigner("secret"), &http.Transport{})
+	resp, err := client.Post(server.URL+"/process_command/drop_db", "application/json", strings.NewReader("{}"))
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+	resp, err = http.Post(server.URL+"/process_command/drop_db", "application/json", strings.NewReader("{}"))
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusUnauthorized)
+
+	client = newRaftHttpClient(newRaftSigner("other secret"), &http.Transport{})
+	_, err = client.Post(server.URL+"/process_command/drop_db", "application/json", strings.NewReader("{}"))
+	c.Assert(err, NotNil)
+}
+
+func (self *RaftAuthSuite) TestServersWithASecretDontTrustServersWithout(c *C) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	server := httptest.NewServer(newRaftSigner("").authenticate(handler))
+	defer server.Close()
+
+	client := newRaftHttpClient(newRaftSigner("secret"), &http.Transport{})
+	_, err := client.Post(server.URL+"/join", "application/json", strings.NewReader("{}"))
+	c.Assert(err, NotNil)
+}
+
+func (self *RaftAuthSuite) TestReplayedRequestsAreRejected(c *C) {
+	signer := newRaftSigner("secret")
+	newRequest := func(nonce string) *http.Request {
+		req, err := http.NewRequest("POST", "http://localhost:8090/process_command/drop_db", strings.NewReader("{}"))
+		c.Assert(err, IsNil)
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(RAFT_TIMESTAMP_HEADER, timestamp)
+		req.Header.Set(RAFT_NONCE_HEADER, nonce)
+		req.Header.Set(RAFT_SIGNATURE_HEADER, signer.requestSignature(req, timestamp, nonce, []byte("{}")))
+		return req
+	}
+
+	_, err := signer.verifyRequest(newRequest("nonce1"))
+	c.Assert(err, IsNil)
+	_, err = signer.verifyRequest(newRequest("nonce1"))
+	c.Assert(err, NotNil)
+	_, err = signer.verifyRequest(newRequest("nonce2"))
+	c.Assert(err, IsNil)
+	_, err = signer.verifyRequest(newRequest(""))
+	c.Assert(err, NotNil)
+}
@@ -5,6 +5,7 @@ import (
 	"cluster"
 	"common"
 	"configuration"
+	"crypto/tls"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
@@ -48,12 +49,15 @@ type RaftServer struct {
 	notLeader                chan bool
 	coordinator              *CoordinatorImpl
 	processContinuousQueries bool
+	tlsConfig                *tls.Config
+	signer                   *raftSigner
+	httpClient               *http.Client
 }
 
 var registeredCommands bool
 
-// Creates a new server.
-func NewRaftServer(config *configuration.Configuration, clusterConfig *cluster.ClusterConfiguration) *RaftServer {
+// Creates a new server. The raft traffic uses https if tlsConfig isn't nil.
+func NewRaftServer(config *configuration.Configuration, clusterConfig *cluster.ClusterConfiguration, tlsConfig *tls.Config) *RaftServer {
 	// raft.SetLogLevel(raft.Debug)
 	if !registeredCommands {
 		registeredCommands = true
@@ -62,12 +66,20 @@ func NewRaftServer(config *configuration.Configuration, clusterConfig *cluster.C
 		}
 	}
 
+	signer := newRaftSigner(config.ClusterSecret)
+	if !signer.enabled() {
+		log.Warn("The cluster secret isn't set, the raft port accepts commands from anyone who can connect to it")
+	}
+
 	s := &RaftServer{
 		path:          config.RaftDir,
 		clusterConfig: clusterConfig,
 		notLeader:     make(chan bool, 1),
 		router:        mux.NewRouter(),
 		config:        config,
+		tlsConfig:     tlsConfig,
+		signer:        signer,
+		httpClient:    newRaftHttpClient(signer, &http.Transport{TLSClientConfig: tlsConfig}),
 	}
 	// Read existing name or generate a new one.
 	if b, err := ioutil.ReadFile(filepath.Join(s.path, "name")); err == nil {
@@ -151,18 +163,18 @@ func (s *RaftServer) doOrProxyCommandOnce(command raft.Command) (interface{}, er
 		if leader, ok := s.leaderConnectString(); !ok {
 			return nil, errors.New("Couldn't connect to the cluster leader...")
 		} else {
-			return SendCommandToServer(leader, command)
+			return s.SendCommandToServer(leader, command)
 		}
 	}
 	return nil, nil
 }
 
-func SendCommandToServer(url string, command raft.Command) (interface{}, error) {
+func (s *RaftServer) SendCommandToServer(url string, command raft.Command) (interface{}, error) {
 	var b bytes.Buffer
 	if err := json.NewEncoder(&b).Encode(command); err != nil {
 		return nil, err
 	}
-	resp, err := http.Post(url+"/process_command/"+command.CommandName(), "application/json", &b)
+	resp, err := s.httpClient.Post(url+"/process_command/"+command.CommandName(), "application/json", &b)
 	if err != nil {
 		return nil, err
 	}
@@ -179,8 +191,8 @@ func SendCommandToServer(url string, command raft.Command) (interface{}, error)
 
 }
 
-func (s *RaftServer) CreateDatabase(name string) error {
-	command := NewCreateDatabaseCommand(name)
+func (s *RaftServer) CreateDatabase(name string, replicationFactor uint8) error {
+	command := NewCreateDatabaseCommand(name, replicationFactor)
 	_, err := s.doOrProxyCommand(command)
 	return err
 }
@@ -278,9 +290,9 @@ func (s *RaftServer) ChangeConnectionString(raftName, protobufConnectionString,
 		ConnectionString:         raftConnectionString,
 		ProtobufConnectionString: protobufConnectionString,
 	}
-	for _, s := range s.raftServer.Peers() {
+	for _, peer := range s.raftServer.Peers() {
 		// send the command and ignore errors in case a server is down
-		SendCommandToServer(s.ConnectionString, command)
+		s.SendCommandToServer(peer.ConnectionString, command)
 	}
 
 	// make the change permament
@@ -352,7 +364,11 @@ func (s *RaftServer) startRaft() error {
 	log.Info("Initializing Raft Server: %s", s.config.RaftConnectionString())
 
 	// Initialize and start Raft server.
-	transporter := raft.NewHTTPTransporter("/raft")
+	transporter := newRaftTransporter(
+		s.signer,
+		&http.Transport{TLSClientConfig: s.tlsConfig},
+		&http.Transport{TLSClientConfig: s.tlsConfig, ResponseHeaderTimeout: s.config.RaftTimeout.Duration},
+	)
 	var err error
 	s.raftServer, err = raft.NewServer(s.name, s.path, transporter, s.clusterConfig, s.clusterConfig, "")
 	if err != nil {
@@ -507,13 +523,16 @@ func (s *RaftServer) ListenAndServe() error {
 }
 
 func (s *RaftServer) Serve(l net.Listener) error {
+	if s.tlsConfig != nil {
+		l = tls.NewListener(l, s.tlsConfig)
+	}
 	s.listener = l
 
 	log.Info("Initializing Raft HTTP server")
 
 	// Initialize and start HTTP server.
 	s.httpServer = &http.Server{
-		Handler: s.router,
+		Handler: s.signer.authenticate(s.router),
 	}
 
 	s.router.HandleFunc("/cluster_config", s.configHandler).Methods("GET")
@@ -560,8 +579,8 @@ func (s *RaftServer) Join(leader string) error {
 		ProtobufConnectionString: s.config.ProtobufConnectionString(),
 	}
 	connectUrl := leader
-	if !strings.HasPrefix(connectUrl, "http://") {
-		connectUrl = "http://" + connectUrl
+	if !strings.HasPrefix(connectUrl, "http://") && !strings.HasPrefix(connectUrl, "https://") {
+		connectUrl = s.config.RaftScheme() + "://" + connectUrl
 	}
 	if !strings.HasSuffix(connectUrl, "/join") {
 		connectUrl = connectUrl + "/join"
@@ -572,14 +591,21 @@ func (s *RaftServer) Join(leader string) error {
 	log.Debug("(raft:%s) Posting to seed server %s", s.raftServer.Name(), connectUrl)
 	tr := &http.Transport{
 		ResponseHeaderTimeout: time.Second,
+		TLSClientConfig:       s.tlsConfig,
 	}
-	client := &http.Client{Transport: tr}
+	client := newRaftHttpClient(s.signer, tr)
 	resp, err := client.Post(connectUrl, "application/json", &b)
 	if err != nil {
 		log.Error(err)
 		return err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		body, _ := ioutil.ReadAll(resp.Body)
+		err := fmt.Errorf("%s refused the join request: %s", leader, strings.TrimSpace(string(body)))
+		log.Error(err)
+		return err
+	}
 	if resp.StatusCode == http.StatusTemporaryRedirect {
 		address := resp.Header.Get("Location")
 		log.Debug("Redirected to %s to join leader", address)
@@ -698,3 +724,47 @@ func (self *RaftServer) DropShard(id uint32, serverIds []uint32) error {
 	_, err := self.doOrProxyCommand(command)
 	return err
 }
+
+func (self *RaftServer) SetShardServers(id uint32, serverIds []uint32) error {
+	command := NewSetShardServersCommand(id, serverIds)
+	_, err := self.doOrProxyCommand(command)
+	return err
+}
+
+// Returns an error if the server can't be removed from the cluster. The
+// raft leader can't be removed and the servers that are left and up have
+// to make a quorum.
+func (self *RaftServer) CheckServerRemoval(id uint32) error {
+	server := self.clusterConfig.GetServerById(&id)
+	if server == nil {
+		return fmt.Errorf("Server %d doesn't exist", id)
+	}
+	if server.RaftName == self.raftServer.Leader() {
+		return fmt.Errorf("Server %d is the raft leader, it has to be stopped so another leader is elected before it's removed", id)
+	}
+	members := self.raftServer.MemberCount() - 1
+	if members < 1 {
+		return fmt.Errorf("Cannot remove the last server of the cluster")
+	}
+	up := 0
+	for _, s := range self.clusterConfig.Servers() {
+		if s.Id != id && (s == self.clusterConfig.LocalServer || s.IsUp()) {
+			up++
+		}
+	}
+	if quorum := members/2 + 1; up < quorum {
+		return fmt.Errorf("Only %d of the %d servers that would be left are up, %d are needed for a quorum", up, members, quorum)
+	}
+	return nil
+}
+
+// Removes a server that doesn't have a copy of any shard from the cluster
+// and the raft peers
+func (self *RaftServer) RemoveServer(id uint32) error {
+	if err := self.CheckServerRemoval(id); err != nil {
+		return err
+	}
+	command := NewRemoveServerCommand(id)
+	_, err := self.doOrProxyCommand(command)
+	return err
+}
@@ -0,0 +1,431 @@
+package coordinator
+
+import (
+	"cluster"
+	"common"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	log "code.google.com/p/log4go"
+)
+
+const (
+	// How many times the copies of a shard are compared after the new
+	// server was added to the shard before the move is given up
+	SHARD_MOVE_SYNC_ATTEMPTS = 5
+	// How long to wait for the other servers to apply the new servers of
+	// the shard and flush their write buffers before the copies of the
+	// shard are compared
+	SHARD_MOVE_SETTLE_TIME = 2 * time.Second
+)
+
+// A copy of a shard that's moved from one server to another
+type ShardMove struct {
+	ShardId uint32 `json:"shardId"`
+	From    uint32 `json:"from"`
+	To      uint32 `json:"to"`
+}
+
+type uint32Slice []uint32
+
+func (self uint32Slice) Len() int           { return len(self) }
+func (self uint32Slice) Less(i, j int) bool { return self[i] < self[j] }
+func (self uint32Slice) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+
+// Returns the moves that leave every server with the same number of
+// shards, give or take one. Shards are moved from the servers with the
+// most shards to the servers with the fewest, older shards first since
+// they don't get written to anymore.
+func planRebalance(serverIds []uint32, shardServers map[uint32][]uint32) []*ShardMove {
+	shardIds := make(uint32Slice, 0, len(shardServers))
+	placement := make(map[uint32]map[uint32]bool, len(shardServers))
+	for id, servers := range shardServers {
+		shardIds = append(shardIds, id)
+		placement[id] = make(map[uint32]bool, len(servers))
+		for _, serverId := range servers {
+			placement[id][serverId] = true
+		}
+	}
+	sort.Sort(shardIds)
+
+	servers := make(uint32Slice, len(serverIds))
+	copy(servers, serverIds)
+	sort.Sort(servers)
+	shardsOnServer := make(map[uint32][]uint32, len(servers))
+	for _, serverId := range servers {
+		shardsOnServer[serverId] = []uint32{}
+	}
+	for _, id := range shardIds {
+		for _, serverId := range servers {
+			if placement[id][serverId] {
+				shardsOnServer[serverId] = append(shardsOnServer[serverId], id)
+			}
+		}
+	}
+
+	moves := []*ShardMove{}
+	for len(servers) > 1 {
+		sort.Stable(&serversByShards{servers, shardsOnServer})
+		least := servers[0]
+		var move *ShardMove
+		for i := len(servers) - 1; i > 0 && move == nil; i-- {
+			most := servers[i]
+			if len(shardsOnServer[most])-len(shardsOnServer[least]) <= 1 {
+				break
+			}
+			for j, id := range shardsOnServer[most] {
+				if placement[id][least] {
+					continue
+				}
+				move = &ShardMove{ShardId: id, From: most, To: least}
+				shardsOnServer[most] = append(append([]uint32{}, shardsOnServer[most][:j]...), shardsOnServer[most][j+1:]...)
+				break
+			}
+		}
+		if move == nil {
+			break
+		}
+		delete(placement[move.ShardId], move.From)
+		placement[move.ShardId][move.To] = true
+		shardsOnServer[move.To] = append(shardsOnServer[move.To], move.ShardId)
+		moves = append(moves, move)
+	}
+	return moves
+}
+
+type serversByShards struct {
+	servers        uint32Slice
+	shardsOnServer map[uint32][]uint32
+}
+
+func (self *serversByShards) Len() int      { return len(self.servers) }
+func (self *serversByShards) Swap(i, j int) { self.servers.Swap(i, j) }
+func (self *serversByShards) Less(i, j int) bool {
+	return len(self.shardsOnServer[self.servers[i]]) < len(self.shardsOnServer[self.servers[j]])
+}
+
+// Returns a function that blocks until the given number of points can be
+// copied without going over pointsPerSecond
+func newCopyThrottle(pointsPerSecond int64) func(points int) {
+	bucket := newTokenBucket(pointsPerSecond, time.Now())
+	return func(points int) {
+		for {
+			bucket.refill(time.Now())
+			wait := bucket.wait()
+			if wait == 0 {
+				break
+			}
+			time.Sleep(wait)
+		}
+		bucket.take(int64(points))
+	}
+}
+
+func (self *CoordinatorImpl) Rebalance(user common.User, dryRun bool) ([]*ShardMove, error) {
+	if !user.IsClusterAdmin() {
+		return nil, common.NewAuthorizationError("Insufficient permissions to rebalance the cluster")
+	}
+
+	serverIds := []uint32{}
+	for _, server := range self.clusterConfiguration.Servers() {
+		serverIds = append(serverIds, server.Id)
+	}
+	shardServers := make(map[uint32][]uint32)
+	for _, shard := range self.clusterConfiguration.GetAllShards() {
+		shardServers[shard.Id()] = shard.ServerIds()
+	}
+	moves := planRebalance(serverIds, shardServers)
+	if dryRun || len(moves) == 0 {
+		return moves, nil
+	}
+
+	if self.shardJobs.IsRunning() || !atomic.CompareAndSwapInt32(&self.movingShards, 0, 1) {
+		return nil, fmt.Errorf("Shards are already being moved")
+	}
+	go func() {
+		defer atomic.StoreInt32(&self.movingShards, 0)
+		log.Info("Rebalancing the cluster, moving %d copies of shards", len(moves))
+		throttle := newCopyThrottle(self.config.ShardCopyPointsPerSecond)
+		for _, move := range moves {
+			if err := self.moveShardReplica(move, throttle); err != nil {
+				log.Error("Cannot move shard %d from server %d to server %d: %s", move.ShardId, move.From, move.To, err)
+			}
+		}
+		log.Info("Finished rebalancing the cluster")
+	}()
+	return moves, nil
+}
+
+// Returns the moves that put the copies of the shards on the removed
+// server on the servers with the fewest shards that don't have a copy of
+// the shard yet
+func planServerRemoval(id uint32, serverIds []uint32, shardServers map[uint32][]uint32) ([]*ShardMove, error) {
+	servers := make(uint32Slice, 0, len(serverIds))
+	shardsOnServer := make(map[uint32][]uint32, len(serverIds))
+	for _, serverId := range serverIds {
+		if serverId != id {
+			servers = append(servers, serverId)
+			shardsOnServer[serverId] = []uint32{}
+		}
+	}
+	sort.Sort(servers)
+
+	shardIds := make(uint32Slice, 0, len(shardServers))
+	for shardId, serverIds := range shardServers {
+		shardIds = append(shardIds, shardId)
+		for _, serverId := range serverIds {
+			if serverId != id {
+				shardsOnServer[serverId] = append(shardsOnServer[serverId], shardId)
+			}
+		}
+	}
+	sort.Sort(shardIds)
+
+	moves := []*ShardMove{}
+	for _, shardId := range shardIds {
+		placement := make(map[uint32]bool, len(shardServers[shardId]))
+		for _, serverId := range shardServers[shardId] {
+			placement[serverId] = true
+		}
+		if !placement[id] {
+			continue
+		}
+
+		sort.Stable(&serversByShards{servers, shardsOnServer})
+		var move *ShardMove
+		for _, serverId := range servers {
+			if !placement[serverId] {
+				move = &ShardMove{ShardId: shardId, From: id, To: serverId}
+				break
+			}
+		}
+		if move == nil {
+			return nil, fmt.Errorf("Every other server has a copy of shard %d, it can't keep %d copies without server %d", shardId, len(placement), id)
+		}
+		shardsOnServer[move.To] = append(shardsOnServer[move.To], shardId)
+		moves = append(moves, move)
+	}
+	return moves, nil
+}
+
+func (self *CoordinatorImpl) RemoveServer(user common.User, id uint32) ([]*ShardMove, error) {
+	if !user.IsClusterAdmin() {
+		return nil, common.NewAuthorizationError("Insufficient permissions to remove servers")
+	}
+	if err := self.raftServer.CheckServerRemoval(id); err != nil {
+		return nil, err
+	}
+
+	serverIds := []uint32{}
+	for _, server := range self.clusterConfiguration.Servers() {
+		serverIds = append(serverIds, server.Id)
+	}
+	shardServers := make(map[uint32][]uint32)
+	for _, shard := range self.clusterConfiguration.GetAllShards() {
+		shardServers[shard.Id()] = shard.ServerIds()
+	}
+	moves, err := planServerRemoval(id, serverIds, shardServers)
+	if err != nil {
+		return nil, err
+	}
+
+	if self.shardJobs.IsRunning() || !atomic.CompareAndSwapInt32(&self.movingShards, 0, 1) {
+		return nil, fmt.Errorf("Shards are already being moved")
+	}
+	go func() {
+		defer atomic.StoreInt32(&self.movingShards, 0)
+		log.Info("Removing server %d, moving %d copies of shards", id, len(moves))
+		throttle := newCopyThrottle(self.config.ShardCopyPointsPerSecond)
+		for _, move := range moves {
+			if err := self.moveShardReplica(move, throttle); err != nil {
+				log.Error("Cannot move shard %d from server %d to server %d, server %d isn't removed: %s", move.ShardId, move.From, move.To, id, err)
+				return
+			}
+		}
+		if err := self.raftServer.RemoveServer(id); err != nil {
+			log.Error("Cannot remove server %d: %s", id, err)
+			return
+		}
+		log.Info("Removed server %d from the cluster", id)
+	}()
+	return moves, nil
+}
+
+// Copies or moves the copy of the shard on one server to another in the
+// background, returns the job id
+func (self *CoordinatorImpl) CopyShardAsync(user common.User, shardId, from, to uint32, move bool) (uint64, error) {
+	if !user.IsClusterAdmin() {
+		return 0, common.NewAuthorizationError("Insufficient permissions to copy shards")
+	}
+	if atomic.LoadInt32(&self.movingShards) == 1 {
+		return 0, fmt.Errorf("Shards are already being moved")
+	}
+	shardMove := &ShardMove{ShardId: shardId, From: from, To: to}
+	if _, err := self.checkShardMove(shardMove); err != nil {
+		return 0, err
+	}
+
+	jobType := SHARD_JOB_COPY
+	if move {
+		jobType = SHARD_JOB_MOVE
+	}
+	id, err := self.shardJobs.Add(jobType, shardMove, user.GetName(), self.clusterConfiguration.ServerId())
+	if err != nil {
+		return 0, err
+	}
+	go func() {
+		copyThrottle := newCopyThrottle(self.config.ShardCopyPointsPerSecond)
+		throttle := func(points int) {
+			copyThrottle(points)
+			self.shardJobs.AddCopiedPoints(id, points)
+		}
+		var err error
+		if move {
+			err = self.moveShardReplica(shardMove, throttle)
+		} else {
+			err = self.addShardReplica(shardMove, throttle)
+		}
+		if err != nil {
+			log.Error("Shard job %d failed: %s", id, err)
+		}
+		self.shardJobs.Finish(id, err)
+	}()
+	return id, nil
+}
+
+func (self *CoordinatorImpl) GetShardJob(user common.User, id uint64) (*ShardJob, error) {
+	if !user.IsClusterAdmin() {
+		return nil, common.NewAuthorizationError("Insufficient permissions to get the shard jobs")
+	}
+	job := self.shardJobs.Get(id)
+	if job == nil {
+		return nil, common.NewQueryError(common.InvalidArgument, "Shard job %d doesn't exist", id)
+	}
+	return job, nil
+}
+
+func (self *CoordinatorImpl) ListShardJobs(user common.User) ([]*ShardJob, error) {
+	if !user.IsClusterAdmin() {
+		return nil, common.NewAuthorizationError("Insufficient permissions to list the shard jobs")
+	}
+	return self.shardJobs.List(), nil
+}
+
+// Returns the shard if the server the shard is copied from has a copy of
+// it and the server it's copied to exists and doesn't
+func (self *CoordinatorImpl) checkShardMove(move *ShardMove) (*cluster.ShardData, error) {
+	shard := self.clusterConfiguration.GetShardById(move.ShardId)
+	if shard == nil {
+		return nil, fmt.Errorf("Shard %d doesn't exist", move.ShardId)
+	}
+	if self.clusterConfiguration.GetServerById(&move.To) == nil {
+		return nil, fmt.Errorf("Server %d doesn't exist", move.To)
+	}
+	serverIds := shard.ServerIds()
+	hasFrom, hasTo := false, false
+	for _, id := range serverIds {
+		hasFrom = hasFrom || id == move.From
+		hasTo = hasTo || id == move.To
+	}
+	if !hasFrom || hasTo {
+		return nil, fmt.Errorf("Shard %d is stored on servers %v", move.ShardId, serverIds)
+	}
+	return shard, nil
+}
+
+// Copies the shard to the new server and verifies the copy before the
+// new server is added to the shard. The new server gets all the writes
+// from then on and the copies are compared again to pick up the writes
+// that were made in the meantime.
+func (self *CoordinatorImpl) addShardReplica(move *ShardMove, throttle func(points int)) error {
+	shard, err := self.checkShardMove(move)
+	if err != nil {
+		return err
+	}
+	serverIds := shard.ServerIds()
+
+	source := self.copySource(shard, move.From)
+	if _, err := self.clusterConfiguration.CopyShardReplica(shard, source, move.To, throttle); err != nil {
+		return err
+	}
+	if err := self.syncShardReplicas(shard, source, move.To); err != nil {
+		return err
+	}
+
+	withTo := append(append([]uint32{}, serverIds...), move.To)
+	if err := self.raftServer.SetShardServers(move.ShardId, withTo); err != nil {
+		return err
+	}
+	if err := self.syncShardReplicas(shard, source, move.To); err != nil {
+		if err := self.raftServer.SetShardServers(move.ShardId, serverIds); err != nil {
+			log.Error("Cannot remove server %d from shard %d: %s", move.To, move.ShardId, err)
+		}
+		return err
+	}
+	log.Info("Copied shard %d from server %d to server %d", move.ShardId, source, move.To)
+	return nil
+}
+
+// Adds a copy of the shard on the new server and removes the old server
+// from the shard once the copies match
+func (self *CoordinatorImpl) moveShardReplica(move *ShardMove, throttle func(points int)) error {
+	if err := self.addShardReplica(move, throttle); err != nil {
+		return err
+	}
+
+	shard := self.clusterConfiguration.GetShardById(move.ShardId)
+	if shard == nil {
+		return fmt.Errorf("Shard %d doesn't exist", move.ShardId)
+	}
+	withoutFrom := []uint32{}
+	for _, id := range shard.ServerIds() {
+		if id != move.From {
+			withoutFrom = append(withoutFrom, id)
+		}
+	}
+	if err := self.raftServer.SetShardServers(move.ShardId, withoutFrom); err != nil {
+		return err
+	}
+	log.Info("Moved shard %d from server %d to server %d", move.ShardId, move.From, move.To)
+	return nil
+}
+
+// Returns the server the shard is copied from. If the server the shard is
+// moved from is down the copy on another server that's up is used.
+func (self *CoordinatorImpl) copySource(shard *cluster.ShardData, from uint32) uint32 {
+	isUp := func(id uint32) bool {
+		if id == self.clusterConfiguration.LocalServer.Id {
+			return true
+		}
+		server := self.clusterConfiguration.GetServerById(&id)
+		return server != nil && server.IsUp()
+	}
+	if isUp(from) {
+		return from
+	}
+	for _, id := range shard.ServerIds() {
+		if id != from && isUp(id) {
+			log.Info("Server %d is down, copying shard %d from server %d", from, shard.Id(), id)
+			return id
+		}
+	}
+	return from
+}
+
+// Copies the points that were written to the shard while it was copied
+// until the copies on both servers match
+func (self *CoordinatorImpl) syncShardReplicas(shard *cluster.ShardData, from, to uint32) error {
+	for i := 0; i < SHARD_MOVE_SYNC_ATTEMPTS; i++ {
+		time.Sleep(SHARD_MOVE_SETTLE_TIME)
+		consistent, err := self.clusterConfiguration.SyncShardReplicas(shard, from, to)
+		if err != nil {
+			return err
+		}
+		if consistent {
+			return nil
+		}
+	}
+	return fmt.Errorf("The copies of shard %d on servers %d and %d don't match", shard.Id(), from, to)
+}
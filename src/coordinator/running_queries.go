@@ -0,0 +1,180 @@
+package coordinator
+
+import (
+	"cluster"
+	"common"
+	"parser"
+	"protocol"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A query that is currently being run by this coordinator. Points read
+// is the number of points that the shards returned to the coordinator
+// so far.
+type RunningQuery struct {
+	Id        uint64
+	Database  string
+	User      string
+	Query     string
+	StartTime time.Time
+
+	querySpec *parser.QuerySpec
+	// the users of the queries are counted by the database of the user,
+	// cluster admins have an empty database
+	userDb     string
+	lock       sync.Mutex
+	shards     []*cluster.ShardData
+	pointsRead int64
+	// the totals of the explain query stats of the query engines
+	stats QueryStats
+}
+
+type QueryStats struct {
+	PointsRead    int64
+	PointsWritten int64
+}
+
+func (self *RunningQuery) addShard(shard *cluster.ShardData) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.shards = append(self.shards, shard)
+}
+
+func (self *RunningQuery) addPointsRead(count int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.pointsRead += int64(count)
+}
+
+// Adds the stats sent by QueryEngine.SendQueryStats. Only one level of
+// query engines sends stats, either the shards if they aggregate
+// locally or the engine of the coordinator.
+func (self *RunningQuery) addQueryStats(series *protocol.Series) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for i, field := range series.Fields {
+		for _, point := range series.Points {
+			if i >= len(point.Values) {
+				continue
+			}
+			switch field {
+			case "points_read":
+				self.stats.PointsRead += point.Values[i].GetInt64Value()
+			case "points_written":
+				self.stats.PointsWritten += point.Values[i].GetInt64Value()
+			}
+		}
+	}
+}
+
+func (self *RunningQuery) Shards() []*cluster.ShardData {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	shards := make([]*cluster.ShardData, len(self.shards))
+	copy(shards, self.shards)
+	return shards
+}
+
+func (self *RunningQuery) PointsRead() int64 {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.pointsRead
+}
+
+func (self *RunningQuery) Stats() QueryStats {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.stats
+}
+
+func (self *RunningQuery) IsKilled() bool {
+	return self.querySpec.IsKilled()
+}
+
+type RunningQueriesById []*RunningQuery
+
+func (self RunningQueriesById) Len() int           { return len(self) }
+func (self RunningQueriesById) Less(i, j int) bool { return self[i].Id < self[j].Id }
+func (self RunningQueriesById) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+
+// Keeps track of the queries that are running on this coordinator.
+// Query ids have the local server id in the lower part of the number
+// (like point sequence numbers) so they are unique across the cluster.
+type RunningQueries struct {
+	lock    sync.Mutex
+	lastId  uint64
+	queries map[uint64]*RunningQuery
+}
+
+func NewRunningQueries() *RunningQueries {
+	return &RunningQueries{queries: make(map[uint64]*RunningQuery)}
+}
+
+// Registers the query, returns an error if the user is already running
+// the maximum number of concurrent queries allowed by the query limits.
+// Db users are counted by their database and name, cluster admins by
+// their name only, so users with the same name in different databases
+// don't share the limit.
+func (self *RunningQueries) Add(querySpec *parser.QuerySpec, localServerId uint32) (*RunningQuery, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	database := querySpec.Database()
+	user := querySpec.User()
+	userName := user.GetName()
+	userDb := ""
+	if !user.IsClusterAdmin() {
+		userDb = user.GetDb()
+	}
+	if max := querySpec.Limits().MaxConcurrentQueries; max > 0 {
+		running := 0
+		for _, query := range self.queries {
+			if query.User == userName && query.userDb == userDb {
+				running++
+			}
+		}
+		if running >= max {
+			return nil, common.NewQueryError(common.QueryLimitExceeded, "User %s is already running %d queries, the limit is %d", userName, running, max)
+		}
+	}
+
+	self.lastId++
+	id := self.lastId*HOST_ID_OFFSET + uint64(localServerId)
+	querySpec.SetQueryId(id)
+	query := &RunningQuery{
+		Id:        id,
+		Database:  database,
+		User:      userName,
+		Query:     querySpec.GetQueryString(),
+		StartTime: time.Now(),
+		querySpec: querySpec,
+		userDb:    userDb,
+	}
+	self.queries[id] = query
+	return query, nil
+}
+
+func (self *RunningQueries) Remove(id uint64) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.queries, id)
+}
+
+func (self *RunningQueries) Get(id uint64) *RunningQuery {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.queries[id]
+}
+
+func (self *RunningQueries) List() []*RunningQuery {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	queries := make([]*RunningQuery, 0, len(self.queries))
+	for _, query := range self.queries {
+		queries = append(queries, query)
+	}
+	sort.Sort(RunningQueriesById(queries))
+	return queries
+}
@@ -0,0 +1,145 @@
+package coordinator
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The number of finished shard jobs that are kept around so their status
+// can be polled
+const MAX_FINISHED_SHARD_JOBS = 100
+
+const (
+	SHARD_JOB_COPY = "copy"
+	SHARD_JOB_MOVE = "move"
+)
+
+// A copy or a move of a shard from one server to another that runs in the
+// background. End time is zero while the job is running.
+type ShardJob struct {
+	Id           uint64 `json:"id"`
+	Type         string `json:"type"`
+	ShardId      uint32 `json:"shardId"`
+	From         uint32 `json:"from"`
+	To           uint32 `json:"to"`
+	User         string `json:"user"`
+	PointsCopied int64  `json:"pointsCopied"`
+	StartTime    int64  `json:"startTime"`
+	EndTime      int64  `json:"endTime"`
+	Done         bool   `json:"done"`
+	Error        string `json:"error,omitempty"`
+}
+
+type ShardJobsById []*ShardJob
+
+func (self ShardJobsById) Len() int           { return len(self) }
+func (self ShardJobsById) Less(i, j int) bool { return self[i].Id < self[j].Id }
+func (self ShardJobsById) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+
+// Keeps track of the shard jobs started on this coordinator, the ids are
+// assigned like the ids of the delete jobs
+type ShardJobs struct {
+	lock   sync.Mutex
+	lastId uint64
+	jobs   map[uint64]*ShardJob
+}
+
+func NewShardJobs() *ShardJobs {
+	return &ShardJobs{jobs: make(map[uint64]*ShardJob)}
+}
+
+// Returns an error if another job is already copying the shard
+func (self *ShardJobs) Add(jobType string, move *ShardMove, user string, localServerId uint32) (uint64, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, job := range self.jobs {
+		if !job.Done && job.ShardId == move.ShardId {
+			return 0, fmt.Errorf("Shard %d is already being copied by job %d", move.ShardId, job.Id)
+		}
+	}
+	self.lastId++
+	id := self.lastId*HOST_ID_OFFSET + uint64(localServerId)
+	self.jobs[id] = &ShardJob{
+		Id:        id,
+		Type:      jobType,
+		ShardId:   move.ShardId,
+		From:      move.From,
+		To:        move.To,
+		User:      user,
+		StartTime: time.Now().Unix(),
+	}
+	return id, nil
+}
+
+func (self *ShardJobs) AddCopiedPoints(id uint64, points int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if job := self.jobs[id]; job != nil {
+		job.PointsCopied += int64(points)
+	}
+}
+
+// Returns true if any of the jobs is still running
+func (self *ShardJobs) IsRunning() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, job := range self.jobs {
+		if !job.Done {
+			return true
+		}
+	}
+	return false
+}
+
+// Marks the job as done and forgets the oldest finished jobs
+func (self *ShardJobs) Finish(id uint64, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	job := self.jobs[id]
+	if job == nil {
+		return
+	}
+	job.Done = true
+	job.EndTime = time.Now().Unix()
+	if err != nil {
+		job.Error = err.Error()
+	}
+
+	finished := ShardJobsById{}
+	for _, job := range self.jobs {
+		if job.Done {
+			finished = append(finished, job)
+		}
+	}
+	sort.Sort(finished)
+	for i := 0; i < len(finished)-MAX_FINISHED_SHARD_JOBS; i++ {
+		delete(self.jobs, finished[i].Id)
+	}
+}
+
+// Returns a copy of the job or nil if it doesn't exist
+func (self *ShardJobs) Get(id uint64) *ShardJob {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	job := self.jobs[id]
+	if job == nil {
+		return nil
+	}
+	jobCopy := *job
+	return &jobCopy
+}
+
+// Returns a copy of all the jobs
+func (self *ShardJobs) List() []*ShardJob {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	jobs := make(ShardJobsById, 0, len(self.jobs))
+	for _, job := range self.jobs {
+		jobCopy := *job
+		jobs = append(jobs, &jobCopy)
+	}
+	sort.Sort(jobs)
+	return jobs
+}
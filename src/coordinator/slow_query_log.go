@@ -0,0 +1,97 @@
+package coordinator
+
+import (
+	"configuration"
+	"os"
+	"path/filepath"
+	"protocol"
+	"time"
+
+	log "code.google.com/p/log4go"
+)
+
+const SLOW_QUERIES_SERIES = "slow_queries"
+
+// Logs the queries that took longer than the configured threshold to a
+// dedicated file and/or to a series in the configured database.
+type SlowQueryLog struct {
+	threshold   time.Duration
+	logger      log.Logger
+	database    string
+	writeSeries func(db string, series []*protocol.Series) error
+}
+
+// writeSeries is used to write the slow queries series, it's only
+// called if a database is configured.
+func NewSlowQueryLog(config *configuration.Configuration, writeSeries func(string, []*protocol.Series) error) *SlowQueryLog {
+	slowQueryLog := &SlowQueryLog{
+		threshold:   config.SlowQueryThreshold,
+		database:    config.SlowQueryDatabase,
+		writeSeries: writeSeries,
+	}
+
+	if config.SlowQueryLogFile != "" && slowQueryLog.threshold > 0 {
+		os.MkdirAll(filepath.Dir(config.SlowQueryLogFile), 0744)
+		flw := log.NewFileLogWriter(config.SlowQueryLogFile, false)
+		flw.SetFormat("[%D %T] %M")
+		slowQueryLog.logger = make(log.Logger)
+		slowQueryLog.logger.AddFilter("slow-queries", log.INFO, flw)
+	}
+	return slowQueryLog
+}
+
+func (self *SlowQueryLog) isEnabled() bool {
+	return self.threshold > 0 && (self.logger != nil || self.database != "")
+}
+
+// Logs the query if it ran for longer than the threshold. Should be
+// called once the query is done.
+func (self *SlowQueryLog) Log(query *RunningQuery) {
+	if !self.isEnabled() {
+		return
+	}
+
+	duration := time.Now().Sub(query.StartTime)
+	if duration < self.threshold {
+		return
+	}
+
+	// same units and names used by the explain query stats
+	runTime := float64(duration) / float64(time.Millisecond)
+	shards := int64(len(query.Shards()))
+	stats := query.Stats()
+	pointsRead := stats.PointsRead
+	pointsWritten := stats.PointsWritten
+
+	if self.logger != nil {
+		self.logger.Info("db: %s, u: %s, run_time: %.3fms, shards: %d, points_read: %d, points_written: %d, q: %s",
+			query.Database, query.User, runTime, shards, pointsRead, pointsWritten, query.Query)
+	}
+
+	if self.database == "" {
+		return
+	}
+
+	timestamp := query.StartTime.UnixNano() / int64(time.Microsecond)
+	series := &protocol.Series{
+		Name:   protocol.String(SLOW_QUERIES_SERIES),
+		Fields: []string{"query", "user", "database", "run_time", "shards", "points_read", "points_written"},
+		Points: []*protocol.Point{
+			&protocol.Point{
+				Timestamp: &timestamp,
+				Values: []*protocol.FieldValue{
+					&protocol.FieldValue{StringValue: &query.Query},
+					&protocol.FieldValue{StringValue: &query.User},
+					&protocol.FieldValue{StringValue: &query.Database},
+					&protocol.FieldValue{DoubleValue: &runTime},
+					&protocol.FieldValue{Int64Value: &shards},
+					&protocol.FieldValue{Int64Value: &pointsRead},
+					&protocol.FieldValue{Int64Value: &pointsWritten},
+				},
+			},
+		},
+	}
+	if err := self.writeSeries(self.database, []*protocol.Series{series}); err != nil {
+		log.Error("Cannot write slow query to %s: %s", self.database, err)
+	}
+}
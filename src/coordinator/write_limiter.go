@@ -0,0 +1,225 @@
+package coordinator
+
+import (
+	"common"
+	"configuration"
+	"math"
+	"protocol"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "code.google.com/p/log4go"
+)
+
+// A token bucket that refills at rate tokens per second and holds at
+// most one second worth of tokens. A request is allowed as long as
+// the bucket isn't empty, large requests can take the bucket below
+// zero and the following requests have to wait until that debt is
+// paid back.
+type tokenBucket struct {
+	rate       float64
+	tokens     float64
+	lastRefill time.Time
+}
+
+func newTokenBucket(rate int64, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: float64(rate), tokens: float64(rate), lastRefill: now}
+}
+
+func (self *tokenBucket) refill(now time.Time) {
+	self.tokens += now.Sub(self.lastRefill).Seconds() * self.rate
+	if self.tokens > self.rate {
+		self.tokens = self.rate
+	}
+	self.lastRefill = now
+}
+
+// returns how long the caller has to wait before the bucket has tokens
+// again, 0 if there are tokens available
+func (self *tokenBucket) wait() time.Duration {
+	if self.tokens > 0 {
+		return 0
+	}
+	seconds := (1 - self.tokens) / self.rate
+	return time.Duration(math.Ceil(seconds * float64(time.Second)))
+}
+
+func (self *tokenBucket) take(count int64) {
+	self.tokens -= float64(count)
+}
+
+// Enforces the write quotas (points and bytes per second) of every
+// database and every user. A quota of 0 means there's no limit.
+type WriteLimiter struct {
+	databasePointsPerSecond int64
+	databaseBytesPerSecond  int64
+	userPointsPerSecond     int64
+	userBytesPerSecond      int64
+
+	lock    sync.Mutex
+	buckets map[string]*tokenBucket
+	// the points the inputs dropped by the name of the input
+	droppedPoints map[string]*DroppedPointsCounter
+}
+
+func NewWriteLimiter(config *configuration.Configuration) *WriteLimiter {
+	return &WriteLimiter{
+		databasePointsPerSecond: config.WriteLimitDatabasePointsPerSecond,
+		databaseBytesPerSecond:  config.WriteLimitDatabaseBytesPerSecond,
+		userPointsPerSecond:     config.WriteLimitUserPointsPerSecond,
+		userBytesPerSecond:      config.WriteLimitUserBytesPerSecond,
+		buckets:                 make(map[string]*tokenBucket),
+		droppedPoints:           make(map[string]*DroppedPointsCounter),
+	}
+}
+
+// Returns the counter of the points the input dropped, the counter is
+// created the first time
+func (self *WriteLimiter) DroppedPointsCounter(input string) *DroppedPointsCounter {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	counter := self.droppedPoints[input]
+	if counter == nil {
+		counter = NewDroppedPointsCounter(input)
+		self.droppedPoints[input] = counter
+	}
+	return counter
+}
+
+// Returns the number of points every input dropped by the name of the
+// input
+func (self *WriteLimiter) DroppedPoints() map[string]int64 {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	dropped := make(map[string]int64, len(self.droppedPoints))
+	for input, counter := range self.droppedPoints {
+		dropped[input] = counter.Count()
+	}
+	return dropped
+}
+
+func (self *WriteLimiter) isEnabled() bool {
+	return self.databasePointsPerSecond > 0 || self.databaseBytesPerSecond > 0 ||
+		self.userPointsPerSecond > 0 || self.userBytesPerSecond > 0
+}
+
+func (self *WriteLimiter) getBucket(key string, rate int64, now time.Time) *tokenBucket {
+	bucket := self.buckets[key]
+	if bucket == nil {
+		bucket = newTokenBucket(rate, now)
+		self.buckets[key] = bucket
+	}
+	bucket.refill(now)
+	return bucket
+}
+
+// Checks the write against the quotas of the database and the user
+// and consumes the quotas if the write is allowed. Returns a
+// WriteRateLimitError if any of the quotas is exhausted.
+func (self *WriteLimiter) Take(user common.User, db string, series []*protocol.Series) error {
+	if !self.isEnabled() {
+		return nil
+	}
+
+	points := int64(0)
+	bytes := int64(0)
+	for _, s := range series {
+		points += int64(len(s.Points))
+		bytes += seriesSize(s)
+	}
+
+	type quota struct {
+		key    string
+		rate   int64
+		amount int64
+	}
+	userName := user.GetName()
+	quotas := []quota{
+		{"db-points:" + db, self.databasePointsPerSecond, points},
+		{"db-bytes:" + db, self.databaseBytesPerSecond, bytes},
+		{"user-points:" + db + ":" + userName, self.userPointsPerSecond, points},
+		{"user-bytes:" + db + ":" + userName, self.userBytesPerSecond, bytes},
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	now := time.Now()
+	buckets := make([]*tokenBucket, 0, len(quotas))
+	amounts := make([]int64, 0, len(quotas))
+	for _, q := range quotas {
+		if q.rate <= 0 {
+			continue
+		}
+		bucket := self.getBucket(q.key, q.rate, now)
+		if wait := bucket.wait(); wait > 0 {
+			return common.NewWriteRateLimitError(wait, "Write quota exceeded for database %s (user %s)", db, userName)
+		}
+		buckets = append(buckets, bucket)
+		amounts = append(amounts, q.amount)
+	}
+
+	for i, bucket := range buckets {
+		bucket.take(amounts[i])
+	}
+	return nil
+}
+
+// an estimate of the size of the series on the wire
+func seriesSize(series *protocol.Series) int64 {
+	size := int64(len(series.GetName()))
+	for _, field := range series.Fields {
+		size += int64(len(field))
+	}
+	for _, point := range series.Points {
+		// timestamp and sequence number
+		size += 16
+		for _, value := range point.Values {
+			if value == nil {
+				continue
+			}
+			if value.StringValue != nil {
+				size += int64(len(*value.StringValue))
+			} else {
+				size += 8
+			}
+		}
+	}
+	return size
+}
+
+// Counts the points that an input plugin (i.e. graphite or udp)
+// dropped because they exceeded the write quota, inputs that don't
+// have a way to push back on the client drop the excess points.
+type DroppedPointsCounter struct {
+	name        string
+	count       int64
+	lastWarning int64
+}
+
+const DROPPED_POINTS_WARNING_INTERVAL = 10 * time.Second
+
+func NewDroppedPointsCounter(name string) *DroppedPointsCounter {
+	return &DroppedPointsCounter{name: name}
+}
+
+func (self *DroppedPointsCounter) Add(db string, series []*protocol.Series) {
+	points := int64(0)
+	for _, s := range series {
+		points += int64(len(s.Points))
+	}
+	total := atomic.AddInt64(&self.count, points)
+
+	// don't flood the log, warn at most once every interval
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&self.lastWarning)
+	if now-last < int64(DROPPED_POINTS_WARNING_INTERVAL) || !atomic.CompareAndSwapInt64(&self.lastWarning, last, now) {
+		return
+	}
+	log.Warn("%s: write quota exceeded for database %s, %d points dropped so far", self.name, db, total)
+}
+
+func (self *DroppedPointsCounter) Count() int64 {
+	return atomic.LoadInt64(&self.count)
+}
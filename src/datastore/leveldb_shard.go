@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"cluster"
 	"common"
+	"datastore/storage"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -17,23 +18,36 @@ import (
 
 	"code.google.com/p/goprotobuf/proto"
 	log "code.google.com/p/log4go"
-	"github.com/jmhodges/levigo"
 )
 
 type LevelDbShard struct {
-	db             *levigo.DB
-	readOptions    *levigo.ReadOptions
-	writeOptions   *levigo.WriteOptions
+	db             storage.Engine
 	lastIdUsed     uint64
 	columnIdMutex  sync.Mutex
 	closed         bool
 	pointBatchSize int
 	writeBatchSize int
+	// the number of points in a block, 0 if the points aren't stored in blocks
+	blockSize int
+	// serializes writes and flushes when the points are stored in blocks
+	blockLock sync.Mutex
+	// the number of points written to each field since the last flush
+	bufferedPoints map[string]int
+	// the deleted ranges of every field that weren't purged yet
+	tombstones     map[string][]rangeTombstone
+	tombstonesLock sync.RWMutex
+	// serializes purging the tombstones and splitting them when their
+	// range is written to
+	purgeLock sync.Mutex
+	// the changes made while the shard is being migrated, nil if it
+	// isn't. They're replayed on the migrated shard before it replaces
+	// this one.
+	changes     []func(*LevelDbShard) error
+	changesLock sync.RWMutex
 }
 
-func NewLevelDbShard(db *levigo.DB, pointBatchSize, writeBatchSize int) (*LevelDbShard, error) {
-	ro := levigo.NewReadOptions()
-	lastIdBytes, err2 := db.Get(ro, NEXT_ID_KEY)
+func NewLevelDbShard(db storage.Engine, pointBatchSize, writeBatchSize, blockSize int) (*LevelDbShard, error) {
+	lastIdBytes, err2 := db.Get(NEXT_ID_KEY)
 	if err2 != nil {
 		return nil, err2
 	}
@@ -46,19 +60,39 @@ func NewLevelDbShard(db *levigo.DB, pointBatchSize, writeBatchSize int) (*LevelD
 		}
 	}
 
-	return &LevelDbShard{
+	shard := &LevelDbShard{
 		db:             db,
-		writeOptions:   levigo.NewWriteOptions(),
-		readOptions:    ro,
 		lastIdUsed:     lastId,
 		pointBatchSize: pointBatchSize,
 		writeBatchSize: writeBatchSize,
-	}, nil
+		blockSize:      blockSize,
+		bufferedPoints: make(map[string]int),
+		tombstones:     make(map[string][]rangeTombstone),
+	}
+	if err := shard.loadTombstones(); err != nil {
+		return nil, err
+	}
+	return shard, nil
 }
 
 func (self *LevelDbShard) Write(database string, series []*protocol.Series) error {
-	wb := levigo.NewWriteBatch()
-	defer wb.Close()
+	return self.change(func(shard *LevelDbShard) error {
+		return shard.write(database, series)
+	})
+}
+
+func (self *LevelDbShard) write(database string, series []*protocol.Series) error {
+	if err := self.splitOverwrittenTombstones(database, series); err != nil {
+		return err
+	}
+
+	if self.blockSize > 0 {
+		self.blockLock.Lock()
+		defer self.blockLock.Unlock()
+	}
+
+	wb := make([]storage.Write, 0, self.writeBatchSize)
+	fieldIds := [][]byte{}
 
 	for _, s := range series {
 		if len(s.Points) == 0 {
@@ -72,6 +106,10 @@ func (self *LevelDbShard) Write(database string, series []*protocol.Series) erro
 			if err != nil {
 				return err
 			}
+			if self.blockSize > 0 {
+				self.bufferedPoints[string(id)] += len(s.Points)
+				fieldIds = append(fieldIds, id)
+			}
 			keyBuffer := bytes.NewBuffer(make([]byte, 0, 24))
 			dataBuffer := proto.NewBuffer(nil)
 			for _, point := range s.Points {
@@ -84,10 +122,15 @@ func (self *LevelDbShard) Write(database string, series []*protocol.Series) erro
 				// see the source code for intDataSize() in binary.go
 				binary.Write(keyBuffer, binary.BigEndian, &timestamp)
 				binary.Write(keyBuffer, binary.BigEndian, point.SequenceNumber)
-				pointKey := keyBuffer.Bytes()
+				// the buffers are reused for the next point, copy them
+				pointKey := append([]byte{}, keyBuffer.Bytes()...)
 
 				if point.Values[fieldIndex].GetIsNull() {
-					wb.Delete(pointKey)
+					var value []byte
+					if self.blockSize > 0 {
+						value = TOMBSTONE
+					}
+					wb = append(wb, storage.Write{Key: pointKey, Value: value})
 					goto check
 				}
 
@@ -95,31 +138,48 @@ func (self *LevelDbShard) Write(database string, series []*protocol.Series) erro
 				if err != nil {
 					return err
 				}
-				wb.Put(pointKey, dataBuffer.Bytes())
+				wb = append(wb, storage.Write{Key: pointKey, Value: append([]byte{}, dataBuffer.Bytes()...)})
 			check:
 				count++
 				if count >= self.writeBatchSize {
-					err = self.db.Write(self.writeOptions, wb)
+					err = self.db.BatchPut(wb)
 					if err != nil {
 						return err
 					}
 					count = 0
-					wb.Clear()
+					wb = make([]storage.Write, 0, self.writeBatchSize)
 				}
 			}
 		}
 	}
 
-	return self.db.Write(self.writeOptions, wb)
+	if err := self.db.BatchPut(wb); err != nil {
+		return err
+	}
+
+	for _, id := range fieldIds {
+		// the field might have been flushed already if it's in more than one series
+		if self.bufferedPoints[string(id)] < self.blockSize {
+			continue
+		}
+		if err := self.flushPointsToBlocks(id); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (self *LevelDbShard) Query(querySpec *parser.QuerySpec, processor cluster.QueryProcessor) error {
 	if querySpec.IsListSeriesQuery() {
 		return self.executeListSeriesQuery(querySpec, processor)
 	} else if querySpec.IsDeleteFromSeriesQuery() {
-		return self.executeDeleteQuery(querySpec, processor)
+		return self.change(func(shard *LevelDbShard) error {
+			return shard.executeDeleteQuery(querySpec, processor)
+		})
 	} else if querySpec.IsDropSeriesQuery() {
-		return self.executeDropSeriesQuery(querySpec, processor)
+		return self.change(func(shard *LevelDbShard) error {
+			return shard.executeDropSeriesQuery(querySpec, processor)
+		})
 	}
 
 	seriesAndColumns := querySpec.SelectQuery().GetReferencedColumns()
@@ -130,10 +190,18 @@ func (self *LevelDbShard) Query(querySpec *parser.QuerySpec, processor cluster.Q
 
 	for series, columns := range seriesAndColumns {
 		if regex, ok := series.GetCompiledRegex(); ok {
-			seriesNames := self.getSeriesForDbAndRegex(querySpec.Database(), regex)
+			seriesNames := []string{}
+			for _, name := range self.getSeriesForDbAndRegex(querySpec.Database(), regex) {
+				if querySpec.HasReadAccess(name) {
+					seriesNames = append(seriesNames, name)
+				}
+			}
+			if max := querySpec.Limits().MaxRegexSeries; max > 0 && len(seriesNames) > max {
+				return common.NewQueryError(common.QueryLimitExceeded, "Regex /%s/ matches %d series, the limit is %d", series.Name, len(seriesNames), max)
+			}
 			for _, name := range seriesNames {
-				if !querySpec.HasReadAccess(name) {
-					continue
+				if querySpec.IsKilled() {
+					return nil
 				}
 				err := self.executeQueryForSeries(querySpec, name, columns, processor)
 				if err != nil {
@@ -151,6 +219,12 @@ func (self *LevelDbShard) Query(querySpec *parser.QuerySpec, processor cluster.Q
 }
 
 func (self *LevelDbShard) DropDatabase(database string) error {
+	return self.change(func(shard *LevelDbShard) error {
+		return shard.dropDatabase(database)
+	})
+}
+
+func (self *LevelDbShard) dropDatabase(database string) error {
 	seriesNames := self.getSeriesForDatabase(database)
 	for _, name := range seriesNames {
 		if err := self.dropSeries(database, name); err != nil {
@@ -166,6 +240,11 @@ func (self *LevelDbShard) IsClosed() bool {
 	return self.closed
 }
 
+// Returns true if the data of the shard is lost when it's closed
+func (self *LevelDbShard) isVolatile() bool {
+	return self.db.Name() == storage.MEMORY_NAME
+}
+
 func (self *LevelDbShard) executeQueryForSeries(querySpec *parser.QuerySpec, seriesName string, columns []string, processor cluster.QueryProcessor) error {
 	startTimeBytes := self.byteArrayForTime(querySpec.GetStartTime())
 	endTimeBytes := self.byteArrayForTime(querySpec.GetEndTime())
@@ -268,11 +347,7 @@ func (self *LevelDbShard) executeQueryForSeries(querySpec *parser.QuerySpec, ser
 			isValid = true
 
 			// advance the iterator to read a new value in the next iteration
-			if query.Ascending {
-				iterator.Next()
-			} else {
-				iterator.Prev()
-			}
+			iterator.Next()
 
 			fv := &protocol.FieldValue{}
 			valueBuffer.SetBuf(rawColumnValues[i].value)
@@ -305,6 +380,10 @@ func (self *LevelDbShard) executeQueryForSeries(querySpec *parser.QuerySpec, ser
 			break
 		}
 
+		if err := querySpec.ScanPoint(); err != nil {
+			return err
+		}
+
 		shouldContinue := true
 
 		seriesOutgoing.Points = append(seriesOutgoing.Points, point)
@@ -324,11 +403,18 @@ func (self *LevelDbShard) executeQueryForSeries(querySpec *parser.QuerySpec, ser
 			seriesOutgoing = &protocol.Series{Name: protocol.String(seriesName), Fields: fieldNames, Points: make([]*protocol.Point, 0, self.pointBatchSize)}
 		}
 
-		if !shouldContinue {
+		if !shouldContinue || querySpec.IsKilled() {
 			break
 		}
 	}
 
+	for _, it := range iterators {
+		if err := it.Error(); err != nil {
+			log.Error("Error while running query: %s", err)
+			return err
+		}
+	}
+
 	//Yield remaining data
 	for _, alias := range aliases {
 		log.Debug("Final Flush %s", alias)
@@ -343,7 +429,7 @@ func (self *LevelDbShard) executeQueryForSeries(querySpec *parser.QuerySpec, ser
 }
 
 func (self *LevelDbShard) executeListSeriesQuery(querySpec *parser.QuerySpec, processor cluster.QueryProcessor) error {
-	it := self.db.NewIterator(self.readOptions)
+	it := self.db.Iterator()
 	defer it.Close()
 
 	database := querySpec.Database()
@@ -406,25 +492,21 @@ func (self *LevelDbShard) executeDropSeriesQuery(querySpec *parser.QuerySpec, pr
 }
 
 func (self *LevelDbShard) dropSeries(database, series string) error {
-	startTimeBytes := []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
-	endTimeBytes := []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+	wb := []storage.Write{}
 
-	wb := levigo.NewWriteBatch()
-	defer wb.Close()
-
-	if err := self.deleteRangeOfSeriesCommon(database, series, startTimeBytes, endTimeBytes); err != nil {
+	if err := self.deleteAllPointsOfSeries(database, []string{series}); err != nil {
 		return err
 	}
 
 	for _, name := range self.getColumnNamesForSeries(database, series) {
 		indexKey := append(SERIES_COLUMN_INDEX_PREFIX, []byte(database+"~"+series+"~"+name)...)
-		wb.Delete(indexKey)
+		wb = append(wb, storage.Write{Key: indexKey, Value: nil})
 	}
 
-	wb.Delete(append(DATABASE_SERIES_INDEX_PREFIX, []byte(database+"~"+series)...))
+	wb = append(wb, storage.Write{Key: append(DATABASE_SERIES_INDEX_PREFIX, []byte(database+"~"+series)...), Value: nil})
 
 	// remove the column indeces for this time series
-	return self.db.Write(self.writeOptions, wb)
+	return self.db.BatchPut(wb)
 }
 
 func (self *LevelDbShard) byteArrayForTimeInt(time int64) []byte {
@@ -450,49 +532,23 @@ func (self *LevelDbShard) deleteRangeOfSeriesCommon(database, series string, sta
 			return err
 		}
 	}
-	ro := levigo.NewReadOptions()
-	defer ro.Close()
-	ro.SetFillCache(false)
-	wb := levigo.NewWriteBatch()
-	count := 0
-	defer wb.Close()
+	// the points are purged in the background
 	for _, field := range fields {
-		it := self.db.NewIterator(ro)
-		defer it.Close()
-
-		startKey := append(field.Id, startTimeBytes...)
-		it.Seek(startKey)
-		if it.Valid() {
-			if !bytes.Equal(it.Key()[:8], field.Id) {
-				it.Next()
-				if it.Valid() {
-					startKey = it.Key()
-				}
-			}
-		}
-		for it = it; it.Valid(); it.Next() {
-			k := it.Key()
-			if len(k) < 16 || !bytes.Equal(k[:8], field.Id) || bytes.Compare(k[8:16], endTimeBytes) == 1 {
-				break
-			}
-			wb.Delete(k)
-			count++
-			if count >= self.writeBatchSize {
-				err = self.db.Write(self.writeOptions, wb)
-				if err != nil {
-					return err
-				}
-				count = 0
-				wb.Clear()
-			}
+		start := append(append([]byte{}, startTimeBytes...), 0, 0, 0, 0, 0, 0, 0, 0)
+		end := append(append([]byte{}, endTimeBytes...), MAX_SEQUENCE...)
+		if err := self.addTombstone(field.Id, start, end); err != nil {
+			return err
 		}
 	}
-	return self.db.Write(self.writeOptions, wb)
+	return nil
 }
 
 func (self *LevelDbShard) compact() {
+	if err := self.flushAllPointsToBlocks(); err != nil {
+		log.Error("Error flushing points to blocks: %s", err)
+	}
 	log.Info("Compacting shard")
-	self.db.CompactRange(levigo.Range{})
+	self.db.Compact()
 	log.Info("Shard compaction is done")
 }
 
@@ -547,7 +603,7 @@ func (self *LevelDbShard) getFieldsForSeries(db, series string, columns []string
 }
 
 func (self *LevelDbShard) getColumnNamesForSeries(db, series string) []string {
-	it := self.db.NewIterator(self.readOptions)
+	it := self.db.Iterator()
 	defer it.Close()
 
 	seekKey := append(SERIES_COLUMN_INDEX_PREFIX, []byte(db+"~"+series+"~")...)
@@ -601,7 +657,7 @@ func (self *LevelDbShard) getSeriesForDbAndRegex(database string, regex *regexp.
 }
 
 func (self *LevelDbShard) getSeriesForDatabase(database string) []string {
-	it := self.db.NewIterator(self.readOptions)
+	it := self.db.Iterator()
 	defer it.Close()
 
 	seekKey := append(DATABASE_SERIES_INDEX_PREFIX, []byte(database+"~")...)
@@ -643,7 +699,7 @@ func (self *LevelDbShard) createIdForDbSeriesColumn(db, series, column *string)
 	s := fmt.Sprintf("%s~%s~%s", *db, *series, *column)
 	b := []byte(s)
 	key := append(SERIES_COLUMN_INDEX_PREFIX, b...)
-	err = self.db.Put(self.writeOptions, key, ret)
+	err = self.db.Put(key, ret)
 	return
 }
 
@@ -651,7 +707,7 @@ func (self *LevelDbShard) getIdForDbSeriesColumn(db, series, column *string) (re
 	s := fmt.Sprintf("%s~%s~%s", *db, *series, *column)
 	b := []byte(s)
 	key := append(SERIES_COLUMN_INDEX_PREFIX, b...)
-	if ret, err = self.db.Get(self.readOptions, key); err != nil {
+	if ret, err = self.db.Get(key); err != nil {
 		return nil, err
 	}
 	return ret, nil
@@ -664,23 +720,74 @@ func (self *LevelDbShard) getNextIdForColumn(db, series, column *string) (ret []
 	self.lastIdUsed += 1
 	idBytes := make([]byte, 8, 8)
 	binary.PutUvarint(idBytes, id)
-	wb := levigo.NewWriteBatch()
-	defer wb.Close()
-	wb.Put(NEXT_ID_KEY, idBytes)
 	databaseSeriesIndexKey := append(DATABASE_SERIES_INDEX_PREFIX, []byte(*db+"~"+*series)...)
-	wb.Put(databaseSeriesIndexKey, []byte{})
 	seriesColumnIndexKey := append(SERIES_COLUMN_INDEX_PREFIX, []byte(*db+"~"+*series+"~"+*column)...)
-	wb.Put(seriesColumnIndexKey, idBytes)
-	if err = self.db.Write(self.writeOptions, wb); err != nil {
+	wb := []storage.Write{
+		{Key: NEXT_ID_KEY, Value: idBytes},
+		{Key: databaseSeriesIndexKey, Value: []byte{}},
+		{Key: seriesColumnIndexKey, Value: idBytes},
+	}
+	if err = self.db.BatchPut(wb); err != nil {
 		return nil, err
 	}
 	return idBytes, nil
 }
 
+// Flushes the points of all the fields that were written since the last
+// flush into blocks
+func (self *LevelDbShard) flushAllPointsToBlocks() error {
+	if self.blockSize == 0 {
+		return nil
+	}
+	self.blockLock.Lock()
+	defer self.blockLock.Unlock()
+	for id, _ := range self.bufferedPoints {
+		if err := self.flushPointsToBlocks([]byte(id)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Applies the change to the shard and records it if the shard is being
+// migrated. The changes are serialized during a migration so they're
+// replayed in the order they were applied.
+func (self *LevelDbShard) change(apply func(*LevelDbShard) error) error {
+	self.changesLock.RLock()
+	if self.changes == nil {
+		defer self.changesLock.RUnlock()
+		return apply(self)
+	}
+	self.changesLock.RUnlock()
+
+	self.changesLock.Lock()
+	defer self.changesLock.Unlock()
+	if err := apply(self); err != nil || self.changes == nil {
+		return err
+	}
+	self.changes = append(self.changes, apply)
+	return nil
+}
+
+// Starts recording the changes, waits for the changes that are being
+// applied without being recorded
+func (self *LevelDbShard) recordChanges() {
+	self.changesLock.Lock()
+	defer self.changesLock.Unlock()
+	self.changes = []func(*LevelDbShard) error{}
+}
+
+// Stops recording the changes and returns the recorded ones
+func (self *LevelDbShard) recordedChanges() []func(*LevelDbShard) error {
+	self.changesLock.Lock()
+	defer self.changesLock.Unlock()
+	changes := self.changes
+	self.changes = nil
+	return changes
+}
+
 func (self *LevelDbShard) close() {
 	self.closed = true
-	self.readOptions.Close()
-	self.writeOptions.Close()
 	self.db.Close()
 }
 
@@ -711,9 +818,7 @@ func (self *LevelDbShard) fetchSinglePoint(querySpec *parser.QuerySpec, series s
 
 	timeAndSequenceBytes := timeAndSequenceBuffer.Bytes()
 	for _, field := range fields {
-		pointKey := append(field.Id, timeAndSequenceBytes...)
-
-		if data, err := self.db.Get(self.readOptions, pointKey); err != nil {
+		if data, err := self.getPoint(field.Id, timeAndSequenceBytes); err != nil {
 			return nil, err
 		} else {
 			fieldValue := &protocol.FieldValue{}
@@ -733,22 +838,34 @@ func (self *LevelDbShard) fetchSinglePoint(querySpec *parser.QuerySpec, series s
 	return result, nil
 }
 
-func (self *LevelDbShard) getIterators(fields []*Field, start, end []byte, isAscendingQuery bool) (fieldNames []string, iterators []*levigo.Iterator) {
-	iterators = make([]*levigo.Iterator, len(fields))
+// Returns the marshaled value of the point, nil if the point doesn't
+// exist or was deleted
+func (self *LevelDbShard) getPoint(fieldId, timeAndSequence []byte) ([]byte, error) {
+	point := newBlockPoint(timeAndSequence, nil)
+	if isDeleted(self.getTombstones(fieldId), &point) {
+		return nil, nil
+	}
+	data, err := self.db.Get(append(append([]byte{}, fieldId...), timeAndSequence...))
+	if err != nil {
+		return nil, err
+	}
+	if data != nil {
+		if bytes.Equal(data, TOMBSTONE) {
+			return nil, nil
+		}
+		return data, nil
+	}
+	return self.getPointFromBlocks(fieldId, timeAndSequence)
+}
+
+func (self *LevelDbShard) getIterators(fields []*Field, start, end []byte, isAscendingQuery bool) (fieldNames []string, iterators []*pointIterator) {
+	iterators = make([]*pointIterator, len(fields))
 	fieldNames = make([]string, len(fields))
 
 	// start the iterators to go through the series data
 	for i, field := range fields {
 		fieldNames[i] = field.Name
-		iterators[i] = self.db.NewIterator(self.readOptions)
-		if isAscendingQuery {
-			iterators[i].Seek(append(field.Id, start...))
-		} else {
-			iterators[i].Seek(append(append(field.Id, end...), MAX_SEQUENCE...))
-			if iterators[i].Valid() {
-				iterators[i].Prev()
-			}
-		}
+		iterators[i] = newPointIterator(self.db, field.Id, self.getTombstones(field.Id), start, end, isAscendingQuery)
 	}
 	return
 }
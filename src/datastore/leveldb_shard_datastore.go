@@ -4,16 +4,18 @@ import (
 	"bytes"
 	"cluster"
 	"configuration"
+	"datastore/storage"
 	"fmt"
+	"io/ioutil"
 	"math"
 	"os"
 	"path/filepath"
 	"protocol"
+	"strings"
 	"sync"
 	"time"
 
 	log "code.google.com/p/log4go"
-	"github.com/jmhodges/levigo"
 )
 
 type LevelDbShardDatastore struct {
@@ -24,18 +26,35 @@ type LevelDbShardDatastore struct {
 	shardRefCounts map[uint32]int
 	shardsToClose  map[uint32]bool
 	shardsLock     sync.RWMutex
-	levelDbOptions *levigo.Options
-	writeBuffer    *cluster.WriteBuffer
-	maxOpenShards  int
-	pointBatchSize int
-	writeBatchSize int
+	// signaled when a shard is returned or a migration is done
+	shardsChanged *sync.Cond
+	// the shards that are being swapped by a migration or dropped by a
+	// delete, the requests for them wait
+	migrating map[uint32]bool
+	// the shards that are being copied by a migration, they stay online
+	migrations map[uint32]bool
+	// the running and last compaction of every shard
+	compactions     map[uint32]*shardCompaction
+	compactionsLock sync.Mutex
+	engine          string
+	openers         map[string]storage.Opener
+	writeBuffer     *cluster.WriteBuffer
+	maxOpenShards   int
+	pointBatchSize  int
+	writeBatchSize  int
+	blockSize       int
+	// the number of keys per second the deleted points are purged at
+	purgeRate   int
+	stopPurging chan bool
 }
 
 const (
-	ONE_KILOBYTE                    = 1024
-	ONE_MEGABYTE                    = 1024 * 1024
-	SHARD_BLOOM_FILTER_BITS_PER_KEY = 10
-	SHARD_DATABASE_DIR              = "shard_db"
+	ONE_MEGABYTE       = 1024 * 1024
+	SHARD_DATABASE_DIR = "shard_db"
+	// the file in the shard directory that has the name of the storage
+	// engine the shard was created with
+	SHARD_TYPE_FILE = "type"
+	DEFAULT_ENGINE  = storage.LEVELDB_NAME
 )
 
 var (
@@ -49,7 +68,13 @@ var (
 	SERIES_COLUMN_INDEX_PREFIX = []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFE}
 	// DATABASE_SERIES_INDEX_PREFIX is the prefix of the database to series names index
 	DATABASE_SERIES_INDEX_PREFIX = []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
-	MAX_SEQUENCE                 = []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+	// POINT_BLOCK_PREFIX is the prefix of the point blocks, followed by the field id and the
+	// time and sequence number of the last point in the block
+	POINT_BLOCK_PREFIX = []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFC}
+	// RANGE_TOMBSTONE_PREFIX is the prefix of the deleted ranges, followed by the field id and
+	// the time and sequence number of the first and last point of the range
+	RANGE_TOMBSTONE_PREFIX = []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFB}
+	MAX_SEQUENCE           = []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
 
 	// replicateWrite = protocol.Request_REPLICATION_WRITE
 
@@ -73,29 +98,45 @@ func NewLevelDbShardDatastore(config *configuration.Configuration) (*LevelDbShar
 	if err != nil {
 		return nil, err
 	}
-	opts := levigo.NewOptions()
-	opts.SetCache(levigo.NewLRUCache(config.LevelDbLruCacheSize))
-	opts.SetCreateIfMissing(true)
-	opts.SetBlockSize(64 * ONE_KILOBYTE)
-	filter := levigo.NewBloomFilter(SHARD_BLOOM_FILTER_BITS_PER_KEY)
-	opts.SetFilterPolicy(filter)
-	opts.SetMaxOpenFiles(config.LevelDbMaxOpenFiles)
 
-	return &LevelDbShardDatastore{
+	engine := config.StorageEngine
+	if engine == "" {
+		engine = DEFAULT_ENGINE
+	}
+	// fail early if the engine doesn't exist
+	if _, err := storage.GetInitializer(engine); err != nil {
+		return nil, err
+	}
+	if engine == storage.MEMORY_NAME {
+		log.Warn("New shards are created with the memory storage engine, their data will be lost when the server restarts")
+	}
+
+	store := &LevelDbShardDatastore{
 		baseDbDir:      baseDbDir,
 		config:         config,
 		shards:         make(map[uint32]*LevelDbShard),
-		levelDbOptions: opts,
+		engine:         engine,
+		openers:        make(map[string]storage.Opener),
 		maxOpenShards:  config.LevelDbMaxOpenShards,
 		lastAccess:     make(map[uint32]int64),
 		shardRefCounts: make(map[uint32]int),
 		shardsToClose:  make(map[uint32]bool),
 		pointBatchSize: config.LevelDbPointBatchSize,
 		writeBatchSize: config.LevelDbWriteBatchSize,
-	}, nil
+		blockSize:      config.StoragePointBlockSize,
+		migrating:      make(map[uint32]bool),
+		migrations:     make(map[uint32]bool),
+		compactions:    make(map[uint32]*shardCompaction),
+		purgeRate:      config.StoragePurgeRate,
+		stopPurging:    make(chan bool),
+	}
+	store.shardsChanged = sync.NewCond(&store.shardsLock)
+	go store.purgeTombstonesPeriodically(config.StoragePurgeInterval.Duration)
+	return store, nil
 }
 
 func (self *LevelDbShardDatastore) Close() {
+	close(self.stopPurging)
 	self.shardsLock.Lock()
 	defer self.shardsLock.Unlock()
 	for _, shard := range self.shards {
@@ -107,6 +148,9 @@ func (self *LevelDbShardDatastore) GetOrCreateShard(id uint32) (cluster.LocalSha
 	now := time.Now().Unix()
 	self.shardsLock.Lock()
 	defer self.shardsLock.Unlock()
+	for self.migrating[id] {
+		self.shardsChanged.Wait()
+	}
 	db := self.shards[id]
 	self.lastAccess[id] = now
 
@@ -115,32 +159,108 @@ func (self *LevelDbShardDatastore) GetOrCreateShard(id uint32) (cluster.LocalSha
 		return db, nil
 	}
 
+	db, err := self.openShard(id)
+	if err != nil {
+		return nil, err
+	}
+	self.incrementShardRefCountAndCloseOldestIfNeeded(id)
+	return db, nil
+}
+
+// Opens or creates the shard and adds it to the open shards. Should be
+// called with the shards lock held.
+func (self *LevelDbShardDatastore) openShard(id uint32) (*LevelDbShard, error) {
 	dbDir := self.shardDir(id)
+	if err := recoverShardDir(dbDir); err != nil {
+		log.Error("Error recovering shard directory: ", err)
+		return nil, err
+	}
 
 	log.Info("DATASTORE: opening or creating shard %s", dbDir)
-	ldb, err := levigo.Open(dbDir, self.levelDbOptions)
+	engine, err := self.openEngine(dbDir)
 	if err != nil {
 		log.Error("Error opening shard: ", err)
 		return nil, err
 	}
 
-	db, err = NewLevelDbShard(ldb, self.pointBatchSize, self.writeBatchSize)
+	db, err := NewLevelDbShard(engine, self.pointBatchSize, self.writeBatchSize, self.blockSize)
 	if err != nil {
 		log.Error("Error creating shard: ", err)
-		ldb.Close()
+		engine.Close()
 		return nil, err
 	}
 	self.shards[id] = db
-	self.incrementShardRefCountAndCloseOldestIfNeeded(id)
 	return db, nil
 }
 
+// Opens the storage engine of the shard. Existing shards are opened
+// with the engine they were created with, new shards use the
+// configured engine. Should be called with the shards lock held.
+func (self *LevelDbShardDatastore) openEngine(dbDir string) (storage.Engine, error) {
+	engine, err := self.shardEngineName(dbDir)
+	if err != nil {
+		return nil, err
+	}
+
+	opener, err := self.getOpener(engine)
+	if err != nil {
+		return nil, err
+	}
+	return opener(dbDir)
+}
+
+// Should be called with the shards lock held.
+func (self *LevelDbShardDatastore) getOpener(engine string) (storage.Opener, error) {
+	if opener := self.openers[engine]; opener != nil {
+		return opener, nil
+	}
+	initializer, err := storage.GetInitializer(engine)
+	if err != nil {
+		return nil, err
+	}
+	opener, err := initializer(self.config)
+	if err != nil {
+		return nil, err
+	}
+	self.openers[engine] = opener
+	return opener, nil
+}
+
+// Returns the name of the engine of the shard stored in the directory,
+// creating the directory and tagging it with the configured engine if
+// it doesn't exist yet.
+func (self *LevelDbShardDatastore) shardEngineName(dbDir string) (string, error) {
+	typeFile := filepath.Join(dbDir, SHARD_TYPE_FILE)
+	content, err := ioutil.ReadFile(typeFile)
+	if err == nil {
+		return strings.TrimSpace(string(content)), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	// shards created before the engines were pluggable don't have a type
+	if _, err := os.Stat(dbDir); err == nil {
+		return storage.LEVELDB_NAME, nil
+	}
+
+	if err := os.MkdirAll(dbDir, 0744); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(typeFile, []byte(self.engine), 0644); err != nil {
+		return "", err
+	}
+	return self.engine, nil
+}
+
 func (self *LevelDbShardDatastore) incrementShardRefCountAndCloseOldestIfNeeded(id uint32) {
 	self.shardRefCounts[id] += 1
 	delete(self.shardsToClose, id)
 	if self.maxOpenShards > 0 && len(self.shards) > self.maxOpenShards {
 		for i := len(self.shards) - self.maxOpenShards; i > 0; i-- {
-			self.closeOldestShard()
+			if !self.closeOldestShard() {
+				break
+			}
 		}
 	}
 }
@@ -152,6 +272,7 @@ func (self *LevelDbShardDatastore) ReturnShard(id uint32) {
 	if self.shardsToClose[id] && self.shardRefCounts[id] == 0 {
 		self.closeShard(id)
 	}
+	self.shardsChanged.Broadcast()
 }
 
 func (self *LevelDbShardDatastore) Write(request *protocol.Request) error {
@@ -167,12 +288,19 @@ func (self *LevelDbShardDatastore) BufferWrite(request *protocol.Request) {
 	self.writeBuffer.Write(request)
 }
 
+func (self *LevelDbShardDatastore) BufferWriteWithAck(request *protocol.Request, ack chan<- uint32) {
+	self.writeBuffer.WriteWithAck(request, ack)
+}
+
 func (self *LevelDbShardDatastore) SetWriteBuffer(writeBuffer *cluster.WriteBuffer) {
 	self.writeBuffer = writeBuffer
 }
 
 func (self *LevelDbShardDatastore) DeleteShard(shardId uint32) error {
 	self.shardsLock.Lock()
+	for self.migrating[shardId] || self.migrations[shardId] {
+		self.shardsChanged.Wait()
+	}
 	shardDb := self.shards[shardId]
 	delete(self.shards, shardId)
 	delete(self.lastAccess, shardId)
@@ -191,20 +319,33 @@ func (self *LevelDbShardDatastore) shardDir(id uint32) string {
 	return filepath.Join(self.baseDbDir, fmt.Sprintf("%.5d", id))
 }
 
-func (self *LevelDbShardDatastore) closeOldestShard() {
+// Closes the least recently used shard, or marks it to be closed once
+// it's returned. Shards of the memory engine are never closed since
+// they would lose their data. Returns false if there's no shard that
+// can be closed.
+func (self *LevelDbShardDatastore) closeOldestShard() bool {
 	var oldestId uint32
+	found := false
 	oldestAccess := int64(math.MaxInt64)
 	for id, lastAccess := range self.lastAccess {
+		if shard := self.shards[id]; shard != nil && shard.isVolatile() {
+			continue
+		}
 		if lastAccess < oldestAccess && self.shardsToClose[id] == false {
 			oldestId = id
 			oldestAccess = lastAccess
+			found = true
 		}
 	}
+	if !found {
+		return false
+	}
 	if self.shardRefCounts[oldestId] == 0 {
 		self.closeShard(oldestId)
 	} else {
 		self.shardsToClose[oldestId] = true
 	}
+	return true
 }
 
 func (self *LevelDbShardDatastore) closeShard(id uint32) {
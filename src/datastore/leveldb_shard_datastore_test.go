@@ -1,9 +1,17 @@
 package datastore
 
 import (
+	"bytes"
 	"configuration"
-	. "launchpad.net/gocheck"
+	"io/ioutil"
 	"os"
+	"parser"
+	"path/filepath"
+	"protocol"
+	"time"
+
+	"code.google.com/p/goprotobuf/proto"
+	. "launchpad.net/gocheck"
 )
 
 const TEST_DATASTORE_SHARD_DIR = "/tmp/influxdb/leveldb_shard_datastore_test"
@@ -37,3 +45,355 @@ func (self *LevelDbShardDatastoreSuite) TestWillEnforceMaxOpenShards(c *C) {
 	store.ReturnShard(uint32(2))
 	c.Assert(shard.IsClosed(), Equals, true)
 }
+
+func (self *LevelDbShardDatastoreSuite) TestShardsKeepTheirEngine(c *C) {
+	config := &configuration.Configuration{}
+	config.DataDir = TEST_DATASTORE_SHARD_DIR
+	config.StorageEngine = "memory"
+
+	store, err := NewLevelDbShardDatastore(config)
+	c.Assert(err, IsNil)
+
+	// shards created before the engines were pluggable are leveldb shards
+	c.Assert(os.MkdirAll(store.shardDir(10), 0744), IsNil)
+	engine, err := store.shardEngineName(store.shardDir(10))
+	c.Assert(err, IsNil)
+	c.Assert(engine, Equals, "leveldb")
+
+	_, err = store.GetOrCreateShard(uint32(11))
+	c.Assert(err, IsNil)
+	store.ReturnShard(uint32(11))
+	content, err := ioutil.ReadFile(filepath.Join(store.shardDir(11), SHARD_TYPE_FILE))
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, "memory")
+
+	// changing the configured engine doesn't change existing shards
+	config.StorageEngine = "leveldb"
+	store, err = NewLevelDbShardDatastore(config)
+	c.Assert(err, IsNil)
+	engine, err = store.shardEngineName(store.shardDir(11))
+	c.Assert(err, IsNil)
+	c.Assert(engine, Equals, "memory")
+}
+
+func (self *LevelDbShardDatastoreSuite) TestMemoryShardsAreNeverClosed(c *C) {
+	config := &configuration.Configuration{}
+	config.DataDir = TEST_DATASTORE_SHARD_DIR
+	config.StorageEngine = "memory"
+	config.LevelDbMaxOpenShards = 1
+
+	store, err := NewLevelDbShardDatastore(config)
+	c.Assert(err, IsNil)
+
+	shard, err := store.GetOrCreateShard(uint32(21))
+	c.Assert(err, IsNil)
+	store.ReturnShard(uint32(21))
+	_, err = store.GetOrCreateShard(uint32(22))
+	c.Assert(err, IsNil)
+	store.ReturnShard(uint32(22))
+	c.Assert(shard.IsClosed(), Equals, false)
+}
+
+func (self *LevelDbShardDatastoreSuite) TestUnknownEngine(c *C) {
+	config := &configuration.Configuration{}
+	config.DataDir = TEST_DATASTORE_SHARD_DIR
+	config.StorageEngine = "foo"
+
+	_, err := NewLevelDbShardDatastore(config)
+	c.Assert(err, NotNil)
+}
+
+func (self *LevelDbShardDatastoreSuite) TestMigrateShard(c *C) {
+	config := &configuration.Configuration{}
+	config.DataDir = TEST_DATASTORE_SHARD_DIR
+	config.StorageEngine = "leveldb"
+	config.LevelDbWriteBatchSize = 3
+
+	store, err := NewLevelDbShardDatastore(config)
+	c.Assert(err, IsNil)
+	localShard, err := store.GetOrCreateShard(uint32(20))
+	c.Assert(err, IsNil)
+	points := map[int64]*int64{}
+	for i := int64(0); i < 10; i++ {
+		points[i] = proto.Int64(i)
+	}
+	writeInts(c, localShard.(*LevelDbShard), points)
+	store.ReturnShard(uint32(20))
+
+	_, err = store.MigrateShard(uint32(20), "memory", 0)
+	c.Assert(err, NotNil)
+	_, err = store.MigrateShard(uint32(21), "leveldb", 0)
+	c.Assert(err, NotNil)
+
+	migration, err := store.MigrateShard(uint32(20), "leveldb", 4)
+	c.Assert(err, IsNil)
+	c.Assert(migration.Series, Equals, 1)
+	c.Assert(migration.Columns, Equals, 1)
+	c.Assert(migration.Points, Equals, int64(10))
+	_, err = os.Stat(store.shardDir(20) + OLD_SHARD_DIR_SUFFIX)
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	localShard, err = store.GetOrCreateShard(uint32(20))
+	c.Assert(err, IsNil)
+	defer store.ReturnShard(uint32(20))
+	times, values := readInts(c, localShard.(*LevelDbShard), 0, 100, true)
+	c.Assert(times, DeepEquals, []int64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9})
+	c.Assert(values, DeepEquals, []int64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9})
+	ids, err := store.LocalShardIds()
+	c.Assert(err, IsNil)
+	found := false
+	for _, id := range ids {
+		found = found || id == 20
+	}
+	c.Assert(found, Equals, true)
+}
+
+func (self *LevelDbShardDatastoreSuite) TestChangesDuringMigrationAreReplayed(c *C) {
+	config := &configuration.Configuration{}
+	config.DataDir = TEST_DATASTORE_SHARD_DIR
+	config.StorageEngine = "leveldb"
+	config.LevelDbWriteBatchSize = 3
+
+	store, err := NewLevelDbShardDatastore(config)
+	c.Assert(err, IsNil)
+	localShard, err := store.GetOrCreateShard(uint32(23))
+	c.Assert(err, IsNil)
+	defer store.ReturnShard(uint32(23))
+	src := localShard.(*LevelDbShard)
+	localShard, err = store.GetOrCreateShard(uint32(24))
+	c.Assert(err, IsNil)
+	defer store.ReturnShard(uint32(24))
+	dst := localShard.(*LevelDbShard)
+
+	writeInts(c, src, map[int64]*int64{1: proto.Int64(1)})
+	src.recordChanges()
+	writeInts(c, src, map[int64]*int64{2: proto.Int64(2), 3: proto.Int64(3)})
+	changes := src.recordedChanges()
+	c.Assert(changes, HasLen, 1)
+	writeInts(c, src, map[int64]*int64{4: proto.Int64(4)})
+	c.Assert(src.recordedChanges(), IsNil)
+
+	for _, change := range changes {
+		c.Assert(change(dst), IsNil)
+	}
+	times, values := readInts(c, dst, 0, 100, true)
+	c.Assert(times, DeepEquals, []int64{2, 3})
+	c.Assert(values, DeepEquals, []int64{2, 3})
+}
+
+func (self *LevelDbShardDatastoreSuite) TestRecoverInterruptedMigration(c *C) {
+	dir := filepath.Join(TEST_DATASTORE_SHARD_DIR, "recover")
+	c.Assert(os.MkdirAll(dir+OLD_SHARD_DIR_SUFFIX, 0744), IsNil)
+	c.Assert(os.MkdirAll(dir+MIGRATION_DIR_SUFFIX, 0744), IsNil)
+	c.Assert(recoverShardDir(dir), IsNil)
+	_, err := os.Stat(dir)
+	c.Assert(err, IsNil)
+	_, err = os.Stat(dir + OLD_SHARD_DIR_SUFFIX)
+	c.Assert(os.IsNotExist(err), Equals, true)
+	_, err = os.Stat(dir + MIGRATION_DIR_SUFFIX)
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (self *LevelDbShardDatastoreSuite) TestCompactShardAndStats(c *C) {
+	config := &configuration.Configuration{}
+	config.DataDir = TEST_DATASTORE_SHARD_DIR
+	config.StorageEngine = "memory"
+
+	store, err := NewLevelDbShardDatastore(config)
+	c.Assert(err, IsNil)
+	_, err = store.GetShardStats(uint32(30))
+	c.Assert(err, NotNil)
+	c.Assert(store.CompactShard(uint32(30)), NotNil)
+
+	localShard, err := store.GetOrCreateShard(uint32(30))
+	c.Assert(err, IsNil)
+	writeInts(c, localShard.(*LevelDbShard), map[int64]*int64{1: proto.Int64(1), 2: proto.Int64(2)})
+	store.ReturnShard(uint32(30))
+
+	stats, err := store.GetShardStats(uint32(30))
+	c.Assert(err, IsNil)
+	c.Assert(stats.Series, Equals, int64(1))
+	// the 2 points, the next id and the 2 index keys
+	c.Assert(stats.Keys, Equals, int64(5))
+	c.Assert(stats.LastCompaction, Equals, int64(0))
+
+	c.Assert(store.CompactShard(uint32(30)), IsNil)
+	for i := 0; i < 100 && stats.LastCompaction == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		stats, err = store.GetShardStats(uint32(30))
+		c.Assert(err, IsNil)
+	}
+	c.Assert(stats.Compacting, Equals, false)
+	c.Assert(stats.CompactionProgress, Equals, 1.0)
+	c.Assert(stats.LastCompaction > 0, Equals, true)
+}
+
+func (self *LevelDbShardDatastoreSuite) TestShardDigestsMarkDeletedRanges(c *C) {
+	config := &configuration.Configuration{}
+	config.DataDir = TEST_DATASTORE_SHARD_DIR
+	config.StorageEngine = "memory"
+
+	store, err := NewLevelDbShardDatastore(config)
+	c.Assert(err, IsNil)
+	localShard, err := store.GetOrCreateShard(uint32(42))
+	c.Assert(err, IsNil)
+	defer store.ReturnShard(uint32(42))
+	shard := localShard.(*LevelDbShard)
+	points := map[int64]*int64{}
+	for i := int64(0); i < 10; i++ {
+		points[i*10] = proto.Int64(i)
+	}
+	writeInts(c, shard, points)
+
+	startTime, endTime := shard.byteArraysForStartAndEndTimes(50, 60)
+	c.Assert(shard.deleteRangeOfSeriesCommon("db", "foo", startTime, endTime), IsNil)
+	digests, err := store.GetShardDigests(uint32(42), "db", []string{"foo"}, 0, 100, 4)
+	c.Assert(err, IsNil)
+	c.Assert(digests, HasLen, 1)
+	c.Assert(digests[0].Points, Equals, int64(8))
+	for i, r := range digests[0].Ranges {
+		c.Assert(r.Deleted, Equals, i == 2)
+	}
+
+	// the series is only left out of the digests of all the series
+	startTime, endTime = shard.byteArraysForStartAndEndTimes(0, 99)
+	c.Assert(shard.deleteRangeOfSeriesCommon("db", "foo", startTime, endTime), IsNil)
+	digests, err = store.GetShardDigests(uint32(42), "", nil, 0, 100, 4)
+	c.Assert(err, IsNil)
+	c.Assert(digests, HasLen, 0)
+	digests, err = store.GetShardDigests(uint32(42), "db", []string{"foo"}, 0, 100, 4)
+	c.Assert(err, IsNil)
+	c.Assert(digests, HasLen, 1)
+	c.Assert(digests[0].Points, Equals, int64(0))
+	c.Assert(digests[0].Ranges, HasLen, 4)
+	for _, r := range digests[0].Ranges {
+		c.Assert(r.Deleted, Equals, true)
+		c.Assert(r.Hash, IsNil)
+	}
+}
+
+func (self *LevelDbShardDatastoreSuite) TestStatsDontOpenClosedShards(c *C) {
+	config := &configuration.Configuration{}
+	config.DataDir = TEST_DATASTORE_SHARD_DIR
+	config.StorageEngine = "leveldb"
+
+	store, err := NewLevelDbShardDatastore(config)
+	c.Assert(err, IsNil)
+	localShard, err := store.GetOrCreateShard(uint32(33))
+	c.Assert(err, IsNil)
+	writeInts(c, localShard.(*LevelDbShard), map[int64]*int64{1: proto.Int64(1), 2: proto.Int64(2)})
+	store.ReturnShard(uint32(33))
+
+	stats, err := store.GetShardStats(uint32(33))
+	c.Assert(err, IsNil)
+	c.Assert(stats.Closed, Equals, false)
+	c.Assert(stats.Keys, Equals, int64(5))
+
+	store.shardsLock.Lock()
+	store.closeShard(uint32(33))
+	store.shardsLock.Unlock()
+	stats, err = store.GetShardStats(uint32(33))
+	c.Assert(err, IsNil)
+	c.Assert(stats.Closed, Equals, true)
+	c.Assert(stats.Size > 0, Equals, true)
+	c.Assert(store.shards[uint32(33)], IsNil)
+}
+
+func (self *LevelDbShardDatastoreSuite) TestDeleteAllPoints(c *C) {
+	config := &configuration.Configuration{}
+	config.DataDir = TEST_DATASTORE_SHARD_DIR
+	config.StorageEngine = "memory"
+	config.StoragePointBlockSize = 2
+
+	store, err := NewLevelDbShardDatastore(config)
+	c.Assert(err, IsNil)
+	localShard, err := store.GetOrCreateShard(uint32(31))
+	c.Assert(err, IsNil)
+	shard := localShard.(*LevelDbShard)
+	writeInts(c, shard, map[int64]*int64{1: proto.Int64(1), 2: proto.Int64(2), 3: proto.Int64(3)})
+	point := &protocol.Point{Values: []*protocol.FieldValue{&protocol.FieldValue{Int64Value: proto.Int64(1)}}, SequenceNumber: proto.Uint64(1)}
+	point.SetTimestampInMicroseconds(1)
+	series := &protocol.Series{Name: proto.String("bar"), Fields: []string{"value"}, Points: []*protocol.Point{point}}
+	c.Assert(shard.Write("db", []*protocol.Series{series}), IsNil)
+	store.ReturnShard(uint32(31))
+
+	deleteQuery := func(query string) *parser.QuerySpec {
+		q, err := parser.ParseQuery(query)
+		c.Assert(err, IsNil)
+		return parser.NewQuerySpec(nil, "db", q[0])
+	}
+
+	// the other series is still there, only the points are deleted
+	c.Assert(store.DeleteAllPoints(uint32(31), deleteQuery("delete from foo")), IsNil)
+	times, _ := readInts(c, shard, 0, 10, true)
+	c.Assert(times, HasLen, 0)
+	c.Assert(shard.getAllSeries()["db"], HasLen, 2)
+	_, err = os.Stat(store.shardDir(uint32(31)))
+	c.Assert(err, IsNil)
+
+	c.Assert(store.DeleteAllPoints(uint32(31), deleteQuery("delete from /.*/")), IsNil)
+	_, err = os.Stat(store.shardDir(uint32(31)))
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (self *LevelDbShardDatastoreSuite) TestShardDigestsAndPoints(c *C) {
+	config := &configuration.Configuration{}
+	config.DataDir = TEST_DATASTORE_SHARD_DIR
+	config.StorageEngine = "memory"
+
+	plainStore, err := NewLevelDbShardDatastore(config)
+	c.Assert(err, IsNil)
+	config.StoragePointBlockSize = 2
+	blockStore, err := NewLevelDbShardDatastore(config)
+	c.Assert(err, IsNil)
+
+	digests, err := plainStore.GetShardDigests(uint32(40), "", nil, 0, 100, 4)
+	c.Assert(err, IsNil)
+	c.Assert(digests, HasLen, 0)
+
+	points := map[int64]*int64{}
+	for i := int64(0); i < 10; i++ {
+		points[i*10] = proto.Int64(i)
+	}
+	for i, store := range []*LevelDbShardDatastore{plainStore, blockStore} {
+		id := uint32(40 + i)
+		localShard, err := store.GetOrCreateShard(id)
+		c.Assert(err, IsNil)
+		writeInts(c, localShard.(*LevelDbShard), points)
+		store.ReturnShard(id)
+	}
+
+	// the hashes don't depend on how the points are stored
+	plain, err := plainStore.GetShardDigests(uint32(40), "", nil, 0, 100, 4)
+	c.Assert(err, IsNil)
+	block, err := blockStore.GetShardDigests(uint32(41), "", nil, 0, 100, 4)
+	c.Assert(err, IsNil)
+	c.Assert(plain, HasLen, 1)
+	c.Assert(plain[0].Name, Equals, "foo")
+	c.Assert(plain[0].Points, Equals, int64(10))
+	c.Assert(plain[0].Ranges, HasLen, 4)
+	c.Assert(plain[0].Hash, DeepEquals, block[0].Hash)
+
+	localShard, err := blockStore.GetOrCreateShard(uint32(41))
+	c.Assert(err, IsNil)
+	writeInts(c, localShard.(*LevelDbShard), map[int64]*int64{55: proto.Int64(55)})
+	blockStore.ReturnShard(uint32(41))
+	block, err = blockStore.GetShardDigests(uint32(41), "db", []string{"foo"}, 0, 100, 4)
+	c.Assert(err, IsNil)
+	c.Assert(block[0].Hash, Not(DeepEquals), plain[0].Hash)
+	// only the range with the new point differs
+	for i, r := range block[0].Ranges {
+		c.Assert(r.StartTime, Equals, int64(i*25))
+		c.Assert(bytes.Equal(r.Hash, plain[0].Ranges[i].Hash), Equals, i != 2)
+	}
+
+	yielded := []int64{}
+	err = blockStore.GetShardPoints(uint32(41), "db", "foo", 50, 70, func(series *protocol.Series) error {
+		for _, point := range series.Points {
+			yielded = append(yielded, point.GetTimestamp())
+		}
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(yielded, DeepEquals, []int64{50, 55, 60})
+}
@@ -0,0 +1,552 @@
+package datastore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"protocol"
+)
+
+// A point block holds consecutive values of one column compressed
+// together instead of storing every value in its own key. Timestamps are
+// delta-of-delta encoded, sequence numbers are delta encoded, floats are
+// xor encoded like in Facebook's gorilla paper, integers are delta
+// encoded varints, strings are dictionary encoded and booleans are bit
+// packed.
+//
+// The layout of the block is:
+//
+//   version | count | timestamps | sequence numbers | value types | values
+//
+// value types are run length encoded, a column can have values of
+// different types. The values are stored in one section per type
+// (integers, floats, the string dictionary followed by the references
+// to it and booleans) in the order of the points.
+
+const POINT_BLOCK_VERSION = 1
+
+type blockValueType byte
+
+const (
+	blockEmpty blockValueType = iota
+	blockInt64
+	blockDouble
+	blockString
+	blockBool
+)
+
+// A point of a single column, time is the timestamp as it's stored in
+// the keys (see convertTimestampToUint) so the points sort the same way
+// the keys do
+type blockPoint struct {
+	time     uint64
+	sequence uint64
+	value    *protocol.FieldValue
+}
+
+// returns -1, 0 or 1 like bytes.Compare would return for the keys of
+// the points
+func (self *blockPoint) compare(other *blockPoint) int {
+	switch {
+	case self.time < other.time:
+		return -1
+	case self.time > other.time:
+		return 1
+	case self.sequence < other.sequence:
+		return -1
+	case self.sequence > other.sequence:
+		return 1
+	}
+	return 0
+}
+
+// the time and sequence part of the key of the point
+func (self *blockPoint) key() []byte {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key, self.time)
+	binary.BigEndian.PutUint64(key[8:], self.sequence)
+	return key
+}
+
+// the point right before this one in the key order, the point can't be
+// the first possible one
+func (self *blockPoint) previous() blockPoint {
+	if self.sequence == 0 {
+		return blockPoint{time: self.time - 1, sequence: math.MaxUint64}
+	}
+	return blockPoint{time: self.time, sequence: self.sequence - 1}
+}
+
+// the point right after this one in the key order, the point can't be
+// the last possible one
+func (self *blockPoint) next() blockPoint {
+	if self.sequence == math.MaxUint64 {
+		return blockPoint{time: self.time + 1}
+	}
+	return blockPoint{time: self.time, sequence: self.sequence + 1}
+}
+
+type blockPointsByKey []blockPoint
+
+func (self blockPointsByKey) Len() int           { return len(self) }
+func (self blockPointsByKey) Less(i, j int) bool { return self[i].compare(&self[j]) < 0 }
+func (self blockPointsByKey) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+
+func newBlockPoint(timeAndSequence []byte, value *protocol.FieldValue) blockPoint {
+	return blockPoint{
+		time:     binary.BigEndian.Uint64(timeAndSequence[:8]),
+		sequence: binary.BigEndian.Uint64(timeAndSequence[8:16]),
+		value:    value,
+	}
+}
+
+func valueType(value *protocol.FieldValue) blockValueType {
+	switch {
+	case value.Int64Value != nil:
+		return blockInt64
+	case value.DoubleValue != nil:
+		return blockDouble
+	case value.StringValue != nil:
+		return blockString
+	case value.BoolValue != nil:
+		return blockBool
+	}
+	return blockEmpty
+}
+
+func putUvarint(buffer *bytes.Buffer, v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	buffer.Write(b[:binary.PutUvarint(b[:], v)])
+}
+
+func putVarint(buffer *bytes.Buffer, v int64) {
+	var b [binary.MaxVarintLen64]byte
+	buffer.Write(b[:binary.PutVarint(b[:], v)])
+}
+
+// the points have to be sorted by time and sequence number
+func encodePointBlock(points []blockPoint) []byte {
+	buffer := bytes.NewBuffer(nil)
+	putUvarint(buffer, POINT_BLOCK_VERSION)
+	putUvarint(buffer, uint64(len(points)))
+	if len(points) == 0 {
+		return buffer.Bytes()
+	}
+
+	// timestamps
+	binary.Write(buffer, binary.BigEndian, points[0].time)
+	prevDelta := uint64(0)
+	for i := 1; i < len(points); i++ {
+		delta := points[i].time - points[i-1].time
+		// the arithmetic wraps around, decoding wraps back
+		putVarint(buffer, int64(delta-prevDelta))
+		prevDelta = delta
+	}
+
+	// sequence numbers
+	putUvarint(buffer, points[0].sequence)
+	for i := 1; i < len(points); i++ {
+		putVarint(buffer, int64(points[i].sequence-points[i-1].sequence))
+	}
+
+	// value types
+	runs := bytes.NewBuffer(nil)
+	numberOfRuns := 0
+	for i := 0; i < len(points); {
+		t := valueType(points[i].value)
+		j := i + 1
+		for j < len(points) && valueType(points[j].value) == t {
+			j++
+		}
+		runs.WriteByte(byte(t))
+		putUvarint(runs, uint64(j-i))
+		numberOfRuns++
+		i = j
+	}
+	putUvarint(buffer, uint64(numberOfRuns))
+	buffer.Write(runs.Bytes())
+
+	// values
+	ints := bytes.NewBuffer(nil)
+	floats := newBitWriter()
+	bools := newBitWriter()
+	strings := []string{}
+	stringIds := map[string]uint64{}
+	stringRefs := bytes.NewBuffer(nil)
+	prevInt := int64(0)
+	prevFloat := uint64(0)
+	floatsCount := 0
+	prevLeading, prevTrailing := -1, 0
+
+	for _, point := range points {
+		switch valueType(point.value) {
+		case blockInt64:
+			v := *point.value.Int64Value
+			putVarint(ints, v-prevInt)
+			prevInt = v
+		case blockDouble:
+			v := math.Float64bits(*point.value.DoubleValue)
+			if floatsCount == 0 {
+				floats.writeBits(v, 64)
+			} else {
+				prevLeading, prevTrailing = floats.writeXor(prevFloat, v, prevLeading, prevTrailing)
+			}
+			prevFloat = v
+			floatsCount++
+		case blockString:
+			v := *point.value.StringValue
+			id, ok := stringIds[v]
+			if !ok {
+				id = uint64(len(strings))
+				stringIds[v] = id
+				strings = append(strings, v)
+			}
+			putUvarint(stringRefs, id)
+		case blockBool:
+			bools.writeBit(*point.value.BoolValue)
+		}
+	}
+
+	putUvarint(buffer, uint64(ints.Len()))
+	buffer.Write(ints.Bytes())
+	putUvarint(buffer, uint64(len(floats.bytes)))
+	buffer.Write(floats.bytes)
+	putUvarint(buffer, uint64(len(strings)))
+	for _, s := range strings {
+		putUvarint(buffer, uint64(len(s)))
+		buffer.WriteString(s)
+	}
+	buffer.Write(stringRefs.Bytes())
+	putUvarint(buffer, uint64(len(bools.bytes)))
+	buffer.Write(bools.bytes)
+	return buffer.Bytes()
+}
+
+func decodePointBlock(data []byte) ([]blockPoint, error) {
+	reader := bytes.NewReader(data)
+	version, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, err
+	}
+	if version != POINT_BLOCK_VERSION {
+		return nil, fmt.Errorf("Unknown point block version %d", version)
+	}
+	count, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, err
+	}
+	// every point takes at least a byte, don't trust the count of a
+	// corrupted block
+	if count > uint64(reader.Len()) {
+		return nil, fmt.Errorf("Corrupted point block, %d points with %d bytes left", count, reader.Len())
+	}
+	points := make([]blockPoint, count)
+	if count == 0 {
+		return points, nil
+	}
+
+	// timestamps
+	if err := binary.Read(reader, binary.BigEndian, &points[0].time); err != nil {
+		return nil, err
+	}
+	prevDelta := uint64(0)
+	for i := 1; i < len(points); i++ {
+		dod, err := binary.ReadVarint(reader)
+		if err != nil {
+			return nil, err
+		}
+		delta := prevDelta + uint64(dod)
+		points[i].time = points[i-1].time + delta
+		prevDelta = delta
+	}
+
+	// sequence numbers
+	if points[0].sequence, err = binary.ReadUvarint(reader); err != nil {
+		return nil, err
+	}
+	for i := 1; i < len(points); i++ {
+		delta, err := binary.ReadVarint(reader)
+		if err != nil {
+			return nil, err
+		}
+		points[i].sequence = points[i-1].sequence + uint64(delta)
+	}
+
+	// value types
+	types := make([]blockValueType, 0, count)
+	numberOfRuns, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < numberOfRuns; i++ {
+		t, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		length, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return nil, err
+		}
+		if length > count-uint64(len(types)) {
+			return nil, fmt.Errorf("Corrupted point block, expected %d values found more", count)
+		}
+		for j := uint64(0); j < length; j++ {
+			types = append(types, blockValueType(t))
+		}
+	}
+	if uint64(len(types)) != count {
+		return nil, fmt.Errorf("Corrupted point block, expected %d values found %d", count, len(types))
+	}
+
+	// values
+	ints, err := readSection(reader)
+	if err != nil {
+		return nil, err
+	}
+	intsReader := bytes.NewReader(ints)
+	floatsData, err := readSection(reader)
+	if err != nil {
+		return nil, err
+	}
+	floats := newBitReader(floatsData)
+	numberOfStrings, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, err
+	}
+	if numberOfStrings > uint64(reader.Len()) {
+		return nil, fmt.Errorf("Corrupted point block, %d strings with %d bytes left", numberOfStrings, reader.Len())
+	}
+	strings := make([]string, numberOfStrings)
+	for i := range strings {
+		s, err := readSection(reader)
+		if err != nil {
+			return nil, err
+		}
+		strings[i] = string(s)
+	}
+	// the string references follow the dictionary
+	stringRefs := make([]uint64, 0)
+	for _, t := range types {
+		if t != blockString {
+			continue
+		}
+		id, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return nil, err
+		}
+		if id >= numberOfStrings {
+			return nil, fmt.Errorf("Corrupted point block, unknown string %d", id)
+		}
+		stringRefs = append(stringRefs, id)
+	}
+	boolsData, err := readSection(reader)
+	if err != nil {
+		return nil, err
+	}
+	bools := newBitReader(boolsData)
+
+	prevInt := int64(0)
+	prevFloat := uint64(0)
+	floatsCount := 0
+	prevLeading, prevTrailing := 0, 0
+	for i, t := range types {
+		value := &protocol.FieldValue{}
+		switch t {
+		case blockInt64:
+			delta, err := binary.ReadVarint(intsReader)
+			if err != nil {
+				return nil, err
+			}
+			v := prevInt + delta
+			value.Int64Value = &v
+			prevInt = v
+		case blockDouble:
+			var bits uint64
+			if floatsCount == 0 {
+				bits, err = floats.readBits(64)
+			} else {
+				bits, prevLeading, prevTrailing, err = floats.readXor(prevFloat, prevLeading, prevTrailing)
+			}
+			if err != nil {
+				return nil, err
+			}
+			v := math.Float64frombits(bits)
+			value.DoubleValue = &v
+			prevFloat = bits
+			floatsCount++
+		case blockString:
+			v := strings[stringRefs[0]]
+			stringRefs = stringRefs[1:]
+			value.StringValue = &v
+		case blockBool:
+			v, err := bools.readBit()
+			if err != nil {
+				return nil, err
+			}
+			value.BoolValue = &v
+		}
+		points[i].value = value
+	}
+	return points, nil
+}
+
+func readSection(reader *bytes.Reader) ([]byte, error) {
+	length, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, err
+	}
+	if length > uint64(reader.Len()) {
+		return nil, fmt.Errorf("Corrupted point block, section of %d bytes with %d bytes left", length, reader.Len())
+	}
+	section := make([]byte, length)
+	_, err = io.ReadFull(reader, section)
+	return section, err
+}
+
+type bitWriter struct {
+	bytes []byte
+	// the number of bits used in the last byte
+	used uint
+}
+
+func newBitWriter() *bitWriter {
+	return &bitWriter{used: 8}
+}
+
+func (self *bitWriter) writeBit(bit bool) {
+	if self.used == 8 {
+		self.bytes = append(self.bytes, 0)
+		self.used = 0
+	}
+	if bit {
+		self.bytes[len(self.bytes)-1] |= 1 << (7 - self.used)
+	}
+	self.used++
+}
+
+// writes the lowest n bits of v, most significant first
+func (self *bitWriter) writeBits(v uint64, n int) {
+	for i := n - 1; i >= 0; i-- {
+		self.writeBit((v>>uint(i))&1 == 1)
+	}
+}
+
+// Writes the xor of the value with the previous one. If the meaningful
+// bits of the xor fit in the window of the previous value only those
+// bits are written, otherwise the number of leading zeros (5 bits) and
+// the length of the meaningful bits (6 bits) are written first. Returns
+// the new window.
+func (self *bitWriter) writeXor(prev, v uint64, prevLeading, prevTrailing int) (int, int) {
+	xor := prev ^ v
+	if xor == 0 {
+		self.writeBit(false)
+		return prevLeading, prevTrailing
+	}
+	self.writeBit(true)
+
+	leading := leadingZeros(xor)
+	trailing := trailingZeros(xor)
+	// the number of leading zeros has to fit in 5 bits
+	if leading > 31 {
+		leading = 31
+	}
+
+	if prevLeading != -1 && leading >= prevLeading && trailing >= prevTrailing {
+		self.writeBit(false)
+		self.writeBits(xor>>uint(prevTrailing), 64-prevLeading-prevTrailing)
+		return prevLeading, prevTrailing
+	}
+
+	self.writeBit(true)
+	meaningful := 64 - leading - trailing
+	self.writeBits(uint64(leading), 5)
+	// 64 meaningful bits don't fit in 6 bits, 0 isn't possible so it's used instead
+	self.writeBits(uint64(meaningful&63), 6)
+	self.writeBits(xor>>uint(trailing), meaningful)
+	return leading, trailing
+}
+
+type bitReader struct {
+	bytes []byte
+	// the position in bits
+	position uint
+}
+
+func newBitReader(bytes []byte) *bitReader {
+	return &bitReader{bytes: bytes}
+}
+
+func (self *bitReader) readBit() (bool, error) {
+	idx := self.position / 8
+	if idx >= uint(len(self.bytes)) {
+		return false, fmt.Errorf("Corrupted point block, not enough bits")
+	}
+	bit := (self.bytes[idx]>>(7-self.position%8))&1 == 1
+	self.position++
+	return bit, nil
+}
+
+func (self *bitReader) readBits(n int) (uint64, error) {
+	v := uint64(0)
+	for i := 0; i < n; i++ {
+		bit, err := self.readBit()
+		if err != nil {
+			return 0, err
+		}
+		v <<= 1
+		if bit {
+			v |= 1
+		}
+	}
+	return v, nil
+}
+
+func (self *bitReader) readXor(prev uint64, prevLeading, prevTrailing int) (uint64, int, int, error) {
+	nonZero, err := self.readBit()
+	if err != nil || !nonZero {
+		return prev, prevLeading, prevTrailing, err
+	}
+	newWindow, err := self.readBit()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	leading, trailing := prevLeading, prevTrailing
+	if newWindow {
+		l, err := self.readBits(5)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		meaningful, err := self.readBits(6)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		if meaningful == 0 {
+			meaningful = 64
+		}
+		leading = int(l)
+		trailing = 64 - leading - int(meaningful)
+	}
+	bits, err := self.readBits(64 - leading - trailing)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return prev ^ (bits << uint(trailing)), leading, trailing, nil
+}
+
+func leadingZeros(v uint64) int {
+	n := 0
+	for i := 63; i >= 0 && (v>>uint(i))&1 == 0; i-- {
+		n++
+	}
+	return n
+}
+
+func trailingZeros(v uint64) int {
+	n := 0
+	for i := 0; i < 64 && (v>>uint(i))&1 == 0; i++ {
+		n++
+	}
+	return n
+}
@@ -0,0 +1,167 @@
+package datastore
+
+import (
+	"datastore/storage"
+	"encoding/binary"
+	"math"
+	"protocol"
+
+	"code.google.com/p/goprotobuf/proto"
+	. "launchpad.net/gocheck"
+)
+
+type PointBlockSuite struct{}
+
+var _ = Suite(&PointBlockSuite{})
+
+func blockPoints(values ...*protocol.FieldValue) []blockPoint {
+	points := make([]blockPoint, 0, len(values))
+	for i, value := range values {
+		// irregular timestamps and sequence numbers
+		t := uint64(math.MaxInt64) + uint64(i*i*1000) - uint64(i%3)
+		points = append(points, blockPoint{time: t, sequence: uint64(100 - i), value: value})
+	}
+	return points
+}
+
+func (self *PointBlockSuite) TestEncodeDecodeMixedTypes(c *C) {
+	points := blockPoints(
+		&protocol.FieldValue{Int64Value: proto.Int64(-5)},
+		&protocol.FieldValue{Int64Value: proto.Int64(math.MaxInt64)},
+		&protocol.FieldValue{DoubleValue: proto.Float64(1.5)},
+		&protocol.FieldValue{DoubleValue: proto.Float64(1.5)},
+		&protocol.FieldValue{DoubleValue: proto.Float64(-math.MaxFloat64)},
+		&protocol.FieldValue{StringValue: proto.String("foo")},
+		&protocol.FieldValue{StringValue: proto.String("")},
+		&protocol.FieldValue{StringValue: proto.String("foo")},
+		&protocol.FieldValue{BoolValue: proto.Bool(true)},
+		&protocol.FieldValue{BoolValue: proto.Bool(false)},
+		&protocol.FieldValue{},
+		&protocol.FieldValue{Int64Value: proto.Int64(math.MinInt64)},
+	)
+
+	decoded, err := decodePointBlock(encodePointBlock(points))
+	c.Assert(err, IsNil)
+	c.Assert(decoded, HasLen, len(points))
+	for i := range points {
+		c.Assert(decoded[i].time, Equals, points[i].time)
+		c.Assert(decoded[i].sequence, Equals, points[i].sequence)
+		c.Assert(decoded[i].value.String(), Equals, points[i].value.String())
+	}
+}
+
+func (self *PointBlockSuite) TestFloatsAreCompressed(c *C) {
+	values := []*protocol.FieldValue{}
+	for i := 0; i < 1000; i++ {
+		values = append(values, &protocol.FieldValue{DoubleValue: proto.Float64(float64(i % 10))})
+	}
+	points := blockPoints(values...)
+	data := encodePointBlock(points)
+
+	uncompressed := 0
+	for _, point := range points {
+		value, _ := proto.Marshal(point.value)
+		uncompressed += len(value) + 24
+	}
+	c.Assert(len(data) < uncompressed/3, Equals, true)
+
+	decoded, err := decodePointBlock(data)
+	c.Assert(err, IsNil)
+	for i := range points {
+		c.Assert(decoded[i].value.GetDoubleValue(), Equals, points[i].value.GetDoubleValue())
+	}
+}
+
+func (self *PointBlockSuite) TestDecodeCorruptBlock(c *C) {
+	data := encodePointBlock(blockPoints(&protocol.FieldValue{Int64Value: proto.Int64(1)}))
+	_, err := decodePointBlock(data[:len(data)-1])
+	c.Assert(err, NotNil)
+	_, err = decodePointBlock(append([]byte{POINT_BLOCK_VERSION + 1}, data[1:]...))
+	c.Assert(err, NotNil)
+
+	// a count that doesn't fit in the block isn't allocated
+	header := make([]byte, 2*binary.MaxVarintLen64)
+	n := binary.PutUvarint(header, POINT_BLOCK_VERSION)
+	n += binary.PutUvarint(header[n:], 1<<40)
+	_, err = decodePointBlock(header[:n])
+	c.Assert(err, NotNil)
+}
+
+func writeInts(c *C, shard *LevelDbShard, values map[int64]*int64) {
+	series := &protocol.Series{Name: proto.String("foo"), Fields: []string{"value"}}
+	for t, value := range values {
+		point := &protocol.Point{SequenceNumber: proto.Uint64(1)}
+		point.SetTimestampInMicroseconds(t)
+		if value == nil {
+			point.Values = []*protocol.FieldValue{&protocol.FieldValue{IsNull: &TRUE}}
+		} else {
+			point.Values = []*protocol.FieldValue{&protocol.FieldValue{Int64Value: value}}
+		}
+		series.Points = append(series.Points, point)
+	}
+	c.Assert(shard.Write("db", []*protocol.Series{series}), IsNil)
+}
+
+// returns the timestamps and values of the points in the order of the iterator
+func readInts(c *C, shard *LevelDbShard, start, end int64, ascending bool) ([]int64, []int64) {
+	fields, err := shard.getFieldsForSeries("db", "foo", []string{"value"})
+	c.Assert(err, IsNil)
+	_, iterators := shard.getIterators(fields, shard.byteArrayForTimeInt(start), shard.byteArrayForTimeInt(end), ascending)
+	it := iterators[0]
+	defer it.Close()
+
+	times, values := []int64{}, []int64{}
+	for ; it.Valid(); it.Next() {
+		t := binary.BigEndian.Uint64(it.Key()[8:16])
+		times = append(times, shard.convertUintTimestampToInt64(&t))
+		value := &protocol.FieldValue{}
+		c.Assert(proto.Unmarshal(it.Value(), value), IsNil)
+		values = append(values, value.GetInt64Value())
+	}
+	c.Assert(it.Error(), IsNil)
+	return times, values
+}
+
+func (self *PointBlockSuite) TestShardReadsBlocksAndBufferedPoints(c *C) {
+	shard, err := NewLevelDbShard(storage.NewMemory(""), 10, 10, 4)
+	c.Assert(err, IsNil)
+
+	// the first 8 points are flushed into 2 blocks
+	points := map[int64]*int64{}
+	for i := int64(0); i < 8; i++ {
+		points[i*10] = proto.Int64(i)
+	}
+	writeInts(c, shard, points)
+	// overwrite a point in a block, delete another one and buffer a new one
+	writeInts(c, shard, map[int64]*int64{-10: proto.Int64(-1), 20: proto.Int64(20), 50: nil})
+
+	times, values := readInts(c, shard, -100, 100, true)
+	c.Assert(times, DeepEquals, []int64{-10, 0, 10, 20, 30, 40, 60, 70})
+	c.Assert(values, DeepEquals, []int64{-1, 0, 1, 20, 3, 4, 6, 7})
+
+	times, _ = readInts(c, shard, 15, 60, false)
+	c.Assert(times, DeepEquals, []int64{60, 40, 30, 20})
+
+	// flushing doesn't change the result
+	c.Assert(shard.flushAllPointsToBlocks(), IsNil)
+	c.Assert(shard.bufferedPoints, HasLen, 0)
+	times, values = readInts(c, shard, -100, 100, true)
+	c.Assert(times, DeepEquals, []int64{-10, 0, 10, 20, 30, 40, 60, 70})
+	c.Assert(values, DeepEquals, []int64{-1, 0, 1, 20, 3, 4, 6, 7})
+
+	startTime, endTime := shard.byteArraysForStartAndEndTimes(5, 45)
+	c.Assert(shard.deleteRangeOfSeriesCommon("db", "foo", startTime, endTime), IsNil)
+	times, _ = readInts(c, shard, -100, 100, false)
+	c.Assert(times, DeepEquals, []int64{70, 60, 0, -10})
+
+	fields, err := shard.getFieldsForSeries("db", "foo", []string{"value"})
+	c.Assert(err, IsNil)
+	key := append(shard.byteArrayForTimeInt(60), 0, 0, 0, 0, 0, 0, 0, 1)
+	data, err := shard.getPoint(fields[0].Id, key)
+	c.Assert(err, IsNil)
+	c.Assert(data, NotNil)
+	key = append(shard.byteArrayForTimeInt(30), 0, 0, 0, 0, 0, 0, 0, 1)
+	data, err = shard.getPoint(fields[0].Id, key)
+	c.Assert(err, IsNil)
+	c.Assert(data, IsNil)
+}
@@ -0,0 +1,281 @@
+package datastore
+
+import (
+	"bytes"
+	"datastore/storage"
+	"protocol"
+
+	"code.google.com/p/goprotobuf/proto"
+)
+
+// Iterates over the points of a field in the given time range in the
+// order of the query. The points are read from the keys that weren't
+// flushed to blocks yet and from the point blocks, if both have a point
+// with the same time and sequence number the key wins since it was
+// written last. Tombstones and the points in deleted ranges are skipped.
+type pointIterator struct {
+	fieldId    []byte
+	tombstones []rangeTombstone
+	start      blockPoint
+	end        blockPoint
+	ascending  bool
+
+	raw       storage.Iterator
+	rawPoint  []byte
+	rawValue  []byte
+	blocks    storage.Iterator
+	block     []blockPoint
+	blockIdx  int
+	useRaw    bool
+	useBlock  bool
+	valid     bool
+	key       []byte
+	value     *protocol.FieldValue
+	valueData []byte
+	err       error
+}
+
+// start and end are the time part of the keys
+func newPointIterator(db storage.Engine, fieldId []byte, tombstones []rangeTombstone, start, end []byte, ascending bool) *pointIterator {
+	self := &pointIterator{
+		fieldId:    fieldId,
+		tombstones: tombstones,
+		start:      newBlockPoint(append(append([]byte{}, start...), 0, 0, 0, 0, 0, 0, 0, 0), nil),
+		end:        newBlockPoint(append(append([]byte{}, end...), MAX_SEQUENCE...), nil),
+		ascending:  ascending,
+		// create the raw iterator first, a flush that happens between
+		// creating the two iterators will only add the points to the blocks
+		raw:    db.Iterator(),
+		blocks: db.Iterator(),
+	}
+
+	if ascending {
+		self.raw.Seek(append(append([]byte{}, fieldId...), self.start.key()...))
+		self.blocks.Seek(pointBlockKey(fieldId, &self.start))
+	} else {
+		endKey := append(append([]byte{}, fieldId...), self.end.key()...)
+		seekBack(self.raw, endKey)
+		// the first block that ends after the end of the range can have
+		// points in the range
+		self.blocks.Seek(pointBlockKey(fieldId, &self.end))
+		if !self.blocks.Valid() {
+			self.blocks.SeekToLast()
+		} else if !bytes.HasPrefix(self.blocks.Key(), pointBlocksPrefix(fieldId)) {
+			self.blocks.Prev()
+		}
+	}
+	self.readRaw()
+	self.loadBlock()
+	self.update()
+	return self
+}
+
+// positions the iterator at the last key <= key
+func seekBack(it storage.Iterator, key []byte) {
+	it.Seek(key)
+	if !it.Valid() {
+		it.SeekToLast()
+		return
+	}
+	if bytes.Compare(it.Key(), key) > 0 {
+		it.Prev()
+	}
+}
+
+func (self *pointIterator) inRange(point *blockPoint) bool {
+	return point.compare(&self.start) >= 0 && point.compare(&self.end) <= 0
+}
+
+func (self *pointIterator) readRaw() {
+	self.rawPoint = nil
+	if !self.raw.Valid() {
+		return
+	}
+	key := self.raw.Key()
+	if len(key) != 24 || !bytes.Equal(key[:8], self.fieldId) {
+		return
+	}
+	point := newBlockPoint(key[8:], nil)
+	if !self.inRange(&point) {
+		return
+	}
+	self.rawPoint = key[8:]
+	self.rawValue = self.raw.Value()
+}
+
+// decodes the block the block iterator is positioned at and skips the
+// points that aren't in the range, moves to the next block if the block
+// doesn't have any point in the range
+func (self *pointIterator) loadBlock() {
+	self.block = nil
+	prefix := pointBlocksPrefix(self.fieldId)
+	for self.err == nil && self.blocks.Valid() && bytes.HasPrefix(self.blocks.Key(), prefix) {
+		points, err := decodePointBlock(self.blocks.Value())
+		if err != nil {
+			self.err = err
+			return
+		}
+		if self.ascending {
+			idx := 0
+			for idx < len(points) && points[idx].compare(&self.start) < 0 {
+				idx++
+			}
+			if idx < len(points) {
+				self.block, self.blockIdx = points, idx
+				return
+			}
+			self.blocks.Next()
+		} else {
+			idx := len(points) - 1
+			for idx >= 0 && points[idx].compare(&self.end) > 0 {
+				idx--
+			}
+			if idx >= 0 {
+				self.block, self.blockIdx = points, idx
+				return
+			}
+			self.blocks.Prev()
+		}
+	}
+}
+
+func (self *pointIterator) blockPoint() *blockPoint {
+	if self.block == nil {
+		return nil
+	}
+	point := &self.block[self.blockIdx]
+	if !self.inRange(point) {
+		return nil
+	}
+	return point
+}
+
+func (self *pointIterator) nextRaw() {
+	if self.ascending {
+		self.raw.Next()
+	} else {
+		self.raw.Prev()
+	}
+	self.readRaw()
+}
+
+func (self *pointIterator) nextBlockPoint() {
+	if self.ascending {
+		self.blockIdx++
+		if self.blockIdx < len(self.block) {
+			return
+		}
+		self.blocks.Next()
+	} else {
+		self.blockIdx--
+		if self.blockIdx >= 0 {
+			return
+		}
+		self.blocks.Prev()
+	}
+	self.loadBlock()
+}
+
+// picks the next point from the raw keys and the blocks
+func (self *pointIterator) update() {
+	for {
+		self.valid, self.useRaw, self.useBlock = false, false, false
+		if self.err != nil {
+			return
+		}
+		blockPoint := self.blockPoint()
+		if self.rawPoint == nil && blockPoint == nil {
+			return
+		}
+
+		cmp := 0
+		switch {
+		case self.rawPoint == nil:
+			cmp = 1
+		case blockPoint == nil:
+			cmp = -1
+		default:
+			rawPoint := newBlockPoint(self.rawPoint, nil)
+			cmp = rawPoint.compare(blockPoint)
+			if !self.ascending {
+				cmp = -cmp
+			}
+		}
+		self.useRaw = cmp <= 0
+		self.useBlock = cmp >= 0
+
+		if self.useRaw && bytes.Equal(self.rawValue, TOMBSTONE) {
+			self.advance()
+			continue
+		}
+		if len(self.tombstones) > 0 {
+			point := blockPoint
+			if self.useRaw {
+				rawPoint := newBlockPoint(self.rawPoint, nil)
+				point = &rawPoint
+			}
+			if isDeleted(self.tombstones, point) {
+				self.advance()
+				continue
+			}
+		}
+
+		self.valid = true
+		if self.useRaw {
+			self.key = append(append([]byte{}, self.fieldId...), self.rawPoint...)
+			self.value, self.valueData = nil, self.rawValue
+		} else {
+			self.key = append(append([]byte{}, self.fieldId...), blockPoint.key()...)
+			self.value, self.valueData = blockPoint.value, nil
+		}
+		return
+	}
+}
+
+func (self *pointIterator) advance() {
+	if self.useRaw {
+		self.nextRaw()
+	}
+	if self.useBlock {
+		self.nextBlockPoint()
+	}
+}
+
+func (self *pointIterator) Valid() bool {
+	return self.valid
+}
+
+// Moves to the next point in the order of the query
+func (self *pointIterator) Next() {
+	self.advance()
+	self.update()
+}
+
+// The key of the current point, the field id followed by the time and
+// the sequence number
+func (self *pointIterator) Key() []byte {
+	return self.key
+}
+
+// The marshaled value of the current point
+func (self *pointIterator) Value() []byte {
+	if self.valueData == nil {
+		self.valueData, self.err = proto.Marshal(self.value)
+	}
+	return self.valueData
+}
+
+func (self *pointIterator) Error() error {
+	if self.err != nil {
+		return self.err
+	}
+	if err := self.raw.Error(); err != nil {
+		return err
+	}
+	return self.blocks.Error()
+}
+
+func (self *pointIterator) Close() {
+	self.raw.Close()
+	self.blocks.Close()
+}
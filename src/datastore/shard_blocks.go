@@ -0,0 +1,200 @@
+package datastore
+
+import (
+	"bytes"
+	"datastore/storage"
+	"protocol"
+
+	"code.google.com/p/goprotobuf/proto"
+	log "code.google.com/p/log4go"
+)
+
+// Written instead of deleting the point when a null value is written to
+// a shard with point blocks, the point could be in a block
+var TOMBSTONE, _ = proto.Marshal(&protocol.FieldValue{IsNull: &TRUE})
+
+func pointBlockKey(fieldId []byte, last *blockPoint) []byte {
+	key := make([]byte, 0, len(POINT_BLOCK_PREFIX)+len(fieldId)+16)
+	key = append(key, POINT_BLOCK_PREFIX...)
+	key = append(key, fieldId...)
+	return append(key, last.key()...)
+}
+
+func pointBlocksPrefix(fieldId []byte) []byte {
+	return append(append([]byte{}, POINT_BLOCK_PREFIX...), fieldId...)
+}
+
+// Compresses the points of the field that were written since the last
+// flush into blocks. The blocks that overlap with the new points are
+// merged with them and rewritten. Should be called with the block lock
+// held.
+func (self *LevelDbShard) flushPointsToBlocks(fieldId []byte) error {
+	delete(self.bufferedPoints, string(fieldId))
+
+	writes := []storage.Write{}
+	rawPoints := []blockPoint{}
+	it := self.db.Iterator()
+	for it.Seek(fieldId); it.Valid(); it.Next() {
+		key := it.Key()
+		if len(key) != 24 || !bytes.Equal(key[:8], fieldId) {
+			break
+		}
+		var value *protocol.FieldValue
+		if data := it.Value(); !bytes.Equal(data, TOMBSTONE) {
+			value = &protocol.FieldValue{}
+			if err := proto.Unmarshal(data, value); err != nil {
+				it.Close()
+				return err
+			}
+		}
+		rawPoints = append(rawPoints, newBlockPoint(key[8:], value))
+		writes = append(writes, storage.Write{Key: key, Value: nil})
+	}
+	err := it.Error()
+	it.Close()
+	if err != nil || len(rawPoints) == 0 {
+		return err
+	}
+
+	// the blocks that overlap with the new points
+	blockPoints := []blockPoint{}
+	prefix := pointBlocksPrefix(fieldId)
+	last := &rawPoints[len(rawPoints)-1]
+	it = self.db.Iterator()
+	defer it.Close()
+	for it.Seek(pointBlockKey(fieldId, &rawPoints[0])); it.Valid(); it.Next() {
+		key := it.Key()
+		if !bytes.HasPrefix(key, prefix) {
+			break
+		}
+		points, err := decodePointBlock(it.Value())
+		if err != nil {
+			return err
+		}
+		if len(points) > 0 && points[0].compare(last) > 0 {
+			break
+		}
+		blockPoints = append(blockPoints, points...)
+		writes = append(writes, storage.Write{Key: key, Value: nil})
+	}
+	if err := it.Error(); err != nil {
+		return err
+	}
+
+	merged := mergeBlockPoints(blockPoints, rawPoints)
+	for len(merged) > 0 {
+		size := self.blockSize
+		if size > len(merged) {
+			size = len(merged)
+		}
+		block := merged[:size]
+		merged = merged[size:]
+		writes = append(writes, storage.Write{Key: pointBlockKey(fieldId, &block[len(block)-1]), Value: encodePointBlock(block)})
+	}
+	log.Debug("Flushed %d points of field %v into blocks", len(rawPoints), fieldId)
+	return self.db.BatchPut(writes)
+}
+
+// Merges the new points into the old ones, both have to be sorted. The
+// new points win if both have a point with the same time and sequence
+// number and new points without a value (i.e. tombstones) remove the
+// old point.
+func mergeBlockPoints(old, new []blockPoint) []blockPoint {
+	merged := make([]blockPoint, 0, len(old)+len(new))
+	i, j := 0, 0
+	for i < len(old) || j < len(new) {
+		var point blockPoint
+		switch {
+		case j == len(new):
+			point = old[i]
+			i++
+		case i == len(old):
+			point = new[j]
+			j++
+		default:
+			switch old[i].compare(&new[j]) {
+			case -1:
+				point = old[i]
+				i++
+			case 1:
+				point = new[j]
+				j++
+			default:
+				point = new[j]
+				i++
+				j++
+			}
+		}
+		if point.value != nil {
+			merged = append(merged, point)
+		}
+	}
+	return merged
+}
+
+// Removes the points in the range [start, end] from the blocks of the
+// field. start and end are the time and sequence part of the keys.
+func (self *LevelDbShard) deletePointsFromBlocks(fieldId, start, end []byte) error {
+	self.blockLock.Lock()
+	defer self.blockLock.Unlock()
+
+	startPoint := newBlockPoint(start, nil)
+	endPoint := newBlockPoint(end, nil)
+	prefix := pointBlocksPrefix(fieldId)
+
+	writes := []storage.Write{}
+	it := self.db.Iterator()
+	defer it.Close()
+	for it.Seek(pointBlockKey(fieldId, &startPoint)); it.Valid(); it.Next() {
+		key := it.Key()
+		if !bytes.HasPrefix(key, prefix) {
+			break
+		}
+		points, err := decodePointBlock(it.Value())
+		if err != nil {
+			return err
+		}
+		if len(points) > 0 && points[0].compare(&endPoint) > 0 {
+			break
+		}
+		remaining := make([]blockPoint, 0, len(points))
+		for _, point := range points {
+			if point.compare(&startPoint) < 0 || point.compare(&endPoint) > 0 {
+				remaining = append(remaining, point)
+			}
+		}
+		writes = append(writes, storage.Write{Key: key, Value: nil})
+		if len(remaining) > 0 {
+			writes = append(writes, storage.Write{Key: pointBlockKey(fieldId, &remaining[len(remaining)-1]), Value: encodePointBlock(remaining)})
+		}
+	}
+	if err := it.Error(); err != nil {
+		return err
+	}
+	if len(writes) == 0 {
+		return nil
+	}
+	return self.db.BatchPut(writes)
+}
+
+// Returns the value of the point with the given time and sequence number
+// looking in the blocks of the field, nil if the point doesn't exist
+func (self *LevelDbShard) getPointFromBlocks(fieldId, timeAndSequence []byte) ([]byte, error) {
+	point := newBlockPoint(timeAndSequence, nil)
+	it := self.db.Iterator()
+	defer it.Close()
+	it.Seek(pointBlockKey(fieldId, &point))
+	if !it.Valid() || !bytes.HasPrefix(it.Key(), pointBlocksPrefix(fieldId)) {
+		return nil, it.Error()
+	}
+	points, err := decodePointBlock(it.Value())
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range points {
+		if p.compare(&point) == 0 {
+			return proto.Marshal(p.value)
+		}
+	}
+	return nil, nil
+}
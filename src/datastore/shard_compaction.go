@@ -0,0 +1,203 @@
+package datastore
+
+import (
+	"bytes"
+	"cluster"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	log "code.google.com/p/log4go"
+)
+
+// The key space is compacted in this many ranges to report progress
+const SHARD_COMPACTION_STEPS = 16
+
+type shardCompaction struct {
+	running  bool
+	done     int
+	finished time.Time
+}
+
+// Starts compacting the shard in the background, does nothing if the
+// shard is already being compacted
+func (self *LevelDbShardDatastore) CompactShard(id uint32) error {
+	if _, err := os.Stat(self.shardDir(id)); err != nil {
+		return fmt.Errorf("Shard %d doesn't exist on this server", id)
+	}
+
+	self.compactionsLock.Lock()
+	defer self.compactionsLock.Unlock()
+	compaction := self.compactions[id]
+	if compaction != nil && compaction.running {
+		return nil
+	}
+	compaction = &shardCompaction{running: true}
+	self.compactions[id] = compaction
+
+	go func() {
+		defer func() {
+			self.compactionsLock.Lock()
+			compaction.running = false
+			compaction.finished = time.Now()
+			self.compactionsLock.Unlock()
+		}()
+
+		// keep a reference to the shard so it isn't closed while it's
+		// being compacted
+		shard, err := self.GetOrCreateShard(id)
+		if err != nil {
+			log.Error("DATASTORE: cannot compact shard %d: %s", id, err)
+			return
+		}
+		defer self.ReturnShard(id)
+
+		log.Info("DATASTORE: compacting shard %d", id)
+		if err := shard.(*LevelDbShard).purgeAllTombstones(self.purgeRate); err != nil {
+			log.Error("DATASTORE: cannot purge the deleted points of shard %d: %s", id, err)
+		}
+		shard.(*LevelDbShard).compactInSteps(func(done int) {
+			self.compactionsLock.Lock()
+			compaction.done = done
+			self.compactionsLock.Unlock()
+		})
+		log.Info("DATASTORE: shard %d compaction is done", id)
+	}()
+	return nil
+}
+
+// Returns the stats of the shard. The shard isn't opened if it's
+// closed, only its size on disk is returned then.
+func (self *LevelDbShardDatastore) GetShardStats(id uint32) (*cluster.ShardStats, error) {
+	dir := self.shardDir(id)
+	if _, err := os.Stat(dir); err != nil {
+		return nil, fmt.Errorf("Shard %d doesn't exist on this server", id)
+	}
+
+	self.shardsLock.Lock()
+	shard := self.shards[id]
+	if shard != nil && !self.migrating[id] {
+		self.incrementShardRefCountAndCloseOldestIfNeeded(id)
+	} else {
+		shard = nil
+	}
+	self.shardsLock.Unlock()
+
+	stats := &cluster.ShardStats{}
+	if shard == nil {
+		size, err := dirSize(dir)
+		if err != nil {
+			return nil, err
+		}
+		stats.Size = size
+		stats.Closed = true
+	} else {
+		engineStats := shard.db.Stats()
+		series := shard.countSeries()
+		self.ReturnShard(id)
+		stats.Size = engineStats.Size
+		stats.Keys = engineStats.Keys
+		stats.Series = series
+	}
+
+	self.compactionsLock.Lock()
+	defer self.compactionsLock.Unlock()
+	if compaction := self.compactions[id]; compaction != nil {
+		stats.Compacting = compaction.running
+		stats.CompactionProgress = float64(compaction.done) / SHARD_COMPACTION_STEPS
+		if !compaction.finished.IsZero() {
+			stats.LastCompaction = compaction.finished.Unix()
+		}
+	}
+	return stats, nil
+}
+
+// Returns the size of the files in the directory
+func dirSize(dir string) (int64, error) {
+	size := int64(0)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// Compacts the shard one range of fields at a time, the raw points and
+// the point blocks of the fields in a range are compacted together and
+// the indexes with the last range. Calls progress with the number of
+// ranges that are done.
+func (self *LevelDbShard) compactInSteps(progress func(done int)) {
+	if err := self.flushAllPointsToBlocks(); err != nil {
+		log.Error("Error flushing points to blocks: %s", err)
+	}
+	ids := self.getAllFieldIds()
+	if len(ids) == 0 {
+		self.db.CompactRange(nil, nil)
+		progress(SHARD_COMPACTION_STEPS)
+		return
+	}
+	for i := 0; i < SHARD_COMPACTION_STEPS; i++ {
+		// the range goes from its first field to the first field of the
+		// next range, nil is the beginning or the end of the key space
+		var first, last []byte
+		blocksFirst, blocksLast := POINT_BLOCK_PREFIX, []byte(nil)
+		if i > 0 {
+			first = ids[i*len(ids)/SHARD_COMPACTION_STEPS]
+			blocksFirst = pointBlocksPrefix(first)
+		}
+		if i < SHARD_COMPACTION_STEPS-1 {
+			last = ids[(i+1)*len(ids)/SHARD_COMPACTION_STEPS]
+			blocksLast = pointBlocksPrefix(last)
+		} else {
+			last = POINT_BLOCK_PREFIX
+		}
+		self.db.CompactRange(first, last)
+		self.db.CompactRange(blocksFirst, blocksLast)
+		progress(i + 1)
+	}
+}
+
+// Returns the ids of the fields of all the series in the order of their
+// keys
+func (self *LevelDbShard) getAllFieldIds() [][]byte {
+	it := self.db.Iterator()
+	defer it.Close()
+
+	ids := [][]byte{}
+	for it.Seek(SERIES_COLUMN_INDEX_PREFIX); it.Valid(); it.Next() {
+		if !bytes.HasPrefix(it.Key(), SERIES_COLUMN_INDEX_PREFIX) {
+			break
+		}
+		ids = append(ids, append([]byte{}, it.Value()...))
+	}
+	sort.Sort(byteSlices(ids))
+	return ids
+}
+
+type byteSlices [][]byte
+
+func (self byteSlices) Len() int           { return len(self) }
+func (self byteSlices) Less(i, j int) bool { return bytes.Compare(self[i], self[j]) < 0 }
+func (self byteSlices) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+
+// Returns the number of series in all the databases
+func (self *LevelDbShard) countSeries() int64 {
+	it := self.db.Iterator()
+	defer it.Close()
+
+	count := int64(0)
+	for it.Seek(DATABASE_SERIES_INDEX_PREFIX); it.Valid(); it.Next() {
+		if !bytes.HasPrefix(it.Key(), DATABASE_SERIES_INDEX_PREFIX) {
+			break
+		}
+		count++
+	}
+	return count
+}
@@ -0,0 +1,176 @@
+package datastore
+
+import (
+	"fmt"
+	"os"
+	"parser"
+
+	log "code.google.com/p/log4go"
+)
+
+// Deletes all the points of the series matched by the delete query
+// without looking at their timestamps, the time range of the query has
+// to cover the whole shard. The key ranges of the series are dropped
+// instead of deleting the points one range at a time. If the query
+// matches every series in the shard the shard itself is dropped.
+func (self *LevelDbShardDatastore) DeleteAllPoints(id uint32, querySpec *parser.QuerySpec) error {
+	localShard, err := self.GetOrCreateShard(id)
+	if err != nil {
+		return err
+	}
+	shard := localShard.(*LevelDbShard)
+	database := querySpec.Database()
+	series, err := shard.seriesForDeleteQuery(querySpec)
+	if err != nil || !shard.hasOnlySeries(database, series) {
+		if err == nil {
+			err = shard.change(func(shard *LevelDbShard) error {
+				return shard.deleteAllPointsOfSeries(database, series)
+			})
+		}
+		self.ReturnShard(id)
+		return err
+	}
+	self.ReturnShard(id)
+
+	// wait until nothing else is using the shard and check again, the
+	// shard could have been written to in the meantime
+	shard, err = self.lockShard(id)
+	if err != nil {
+		return err
+	}
+	defer self.unlockShard(id)
+
+	if !shard.hasOnlySeries(database, series) {
+		return shard.deleteAllPointsOfSeries(database, series)
+	}
+
+	self.shardsLock.Lock()
+	self.closeShard(id)
+	self.shardsLock.Unlock()
+	dir := self.shardDir(id)
+	log.Info("DATASTORE: dropping shard %s, the delete covers all of its data", dir)
+	return os.RemoveAll(dir)
+}
+
+// Waits until the shard isn't used or migrated and keeps the other
+// requests from using it until unlockShard is called. Returns the open
+// shard.
+func (self *LevelDbShardDatastore) lockShard(id uint32) (*LevelDbShard, error) {
+	self.shardsLock.Lock()
+	defer self.shardsLock.Unlock()
+	for self.migrating[id] || self.migrations[id] {
+		self.shardsChanged.Wait()
+	}
+	self.migrating[id] = true
+	for self.shardRefCounts[id] > 0 {
+		self.shardsChanged.Wait()
+	}
+
+	shard := self.shards[id]
+	if shard == nil {
+		var err error
+		if shard, err = self.openShard(id); err != nil {
+			delete(self.migrating, id)
+			self.shardsChanged.Broadcast()
+			return nil, err
+		}
+	}
+	// keep the shard from being closed if too many shards are open
+	self.shardRefCounts[id] += 1
+	return shard, nil
+}
+
+func (self *LevelDbShardDatastore) unlockShard(id uint32) {
+	self.shardsLock.Lock()
+	defer self.shardsLock.Unlock()
+	delete(self.migrating, id)
+	if self.shards[id] != nil {
+		self.shardRefCounts[id] -= 1
+		if self.shardsToClose[id] && self.shardRefCounts[id] == 0 {
+			self.closeShard(id)
+		}
+	}
+	self.shardsChanged.Broadcast()
+}
+
+// Returns the names of the series in the shard that are matched by the
+// from clause of the delete query
+func (self *LevelDbShard) seriesForDeleteQuery(querySpec *parser.QuerySpec) ([]string, error) {
+	from := querySpec.DeleteQuery().GetFromClause()
+	if from.Type != parser.FromClauseArray {
+		return nil, fmt.Errorf("Merge and Inner joins can't be used with a delete query")
+	}
+
+	series := []string{}
+	for _, name := range from.Names {
+		if regex, ok := name.Name.GetCompiledRegex(); ok {
+			series = append(series, self.getSeriesForDbAndRegex(querySpec.Database(), regex)...)
+		} else {
+			series = append(series, name.Name.Name)
+		}
+	}
+	return series, nil
+}
+
+// Returns true if the shard doesn't have any series other than the
+// given series of the database
+func (self *LevelDbShard) hasOnlySeries(database string, series []string) bool {
+	names := make(map[string]bool, len(series))
+	for _, name := range series {
+		names[name] = true
+	}
+	for db, seriesNames := range self.getAllSeries() {
+		if db != database {
+			return false
+		}
+		for _, name := range seriesNames {
+			if !names[name] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Deletes all the points of the series, the series and their columns
+// stay in the index
+func (self *LevelDbShard) deleteAllPointsOfSeries(database string, series []string) error {
+	for _, name := range series {
+		fields, err := self.getFieldsForSeries(database, name, self.getColumnNamesForSeries(database, name))
+		if err != nil {
+			if _, ok := err.(FieldLookupError); ok {
+				continue
+			}
+			return err
+		}
+		for _, field := range fields {
+			if err := self.deleteAllPointsOfField(field.Id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Drops the key ranges of the points, the point blocks and the
+// tombstones of the field, the blocks are deleted without being decoded
+func (self *LevelDbShard) deleteAllPointsOfField(fieldId []byte) error {
+	self.purgeLock.Lock()
+	defer self.purgeLock.Unlock()
+	self.blockLock.Lock()
+	defer self.blockLock.Unlock()
+
+	if err := self.dropTombstones(fieldId); err != nil {
+		return err
+	}
+
+	first := append(append([]byte{}, fieldId...), 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+	last := append(append(append([]byte{}, fieldId...), maxTimeBytes...), MAX_SEQUENCE...)
+	if err := self.db.Del(first, last); err != nil {
+		return err
+	}
+	delete(self.bufferedPoints, string(fieldId))
+
+	prefix := pointBlocksPrefix(fieldId)
+	return self.db.Del(prefix, append(append(prefix, maxTimeBytes...), MAX_SEQUENCE...))
+}
@@ -0,0 +1,214 @@
+package datastore
+
+import (
+	"cluster"
+	"crypto/sha1"
+	"encoding/binary"
+	"hash"
+	"os"
+	"protocol"
+	"sort"
+
+	"code.google.com/p/goprotobuf/proto"
+)
+
+// The maximum number of points of a column that are yielded at a time
+// by GetShardPoints
+const SHARD_POINTS_CHUNK_SIZE = 1000
+
+// A shard that doesn't exist on this server doesn't have any points, e.g.
+// when it's copied to this server
+func (self *LevelDbShardDatastore) GetShardDigests(id uint32, database string, series []string, startTime, endTime int64, ranges int) ([]*cluster.SeriesDigest, error) {
+	shard, err := self.getExistingShard(id)
+	if err != nil || shard == nil {
+		return nil, err
+	}
+	defer self.ReturnShard(id)
+	return shard.digests(database, series, startTime, endTime, ranges)
+}
+
+func (self *LevelDbShardDatastore) GetShardPoints(id uint32, database, series string, startTime, endTime int64, yield func(*protocol.Series) error) error {
+	shard, err := self.getExistingShard(id)
+	if err != nil || shard == nil {
+		return err
+	}
+	defer self.ReturnShard(id)
+	return shard.points(database, series, startTime, endTime, yield)
+}
+
+// Returns nil if the shard doesn't exist instead of creating it,
+// otherwise the shard has to be returned
+func (self *LevelDbShardDatastore) getExistingShard(id uint32) (*LevelDbShard, error) {
+	if _, err := os.Stat(self.shardDir(id)); os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	shard, err := self.GetOrCreateShard(id)
+	if err != nil {
+		return nil, err
+	}
+	return shard.(*LevelDbShard), nil
+}
+
+type seriesDigests []*cluster.SeriesDigest
+
+func (self seriesDigests) Len() int      { return len(self) }
+func (self seriesDigests) Swap(i, j int) { self[i], self[j] = self[j], self[i] }
+func (self seriesDigests) Less(i, j int) bool {
+	if self[i].Database != self[j].Database {
+		return self[i].Database < self[j].Database
+	}
+	return self[i].Name < self[j].Name
+}
+
+// Returns the digests of the given series of the database or of all the
+// series of the shard if database is empty. The series without points
+// are left out, unless the series are given and have deleted points.
+func (self *LevelDbShard) digests(database string, series []string, startTime, endTime int64, ranges int) ([]*cluster.SeriesDigest, error) {
+	allSeries := map[string][]string{database: series}
+	if database == "" {
+		allSeries = self.getAllSeries()
+	}
+
+	digests := seriesDigests{}
+	for database, names := range allSeries {
+		for _, name := range names {
+			digest, err := self.seriesDigest(database, name, startTime, endTime, ranges)
+			if err != nil {
+				return nil, err
+			}
+			if digest.Points > 0 || (len(series) > 0 && len(digest.Ranges) > 0) {
+				digests = append(digests, digest)
+			}
+		}
+	}
+	sort.Sort(digests)
+	return digests, nil
+}
+
+// Hashes the column, time, sequence number and value of the points
+// between startTime (inclusive) and endTime (exclusive) of every range.
+// The points are read one column at a time in time order, so the hashes
+// only depend on the points and not on how they're stored. The ranges
+// with deleted points that weren't purged yet are marked as deleted,
+// the deleted points aren't part of the hashes.
+func (self *LevelDbShard) seriesDigest(database, series string, startTime, endTime int64, ranges int) (*cluster.SeriesDigest, error) {
+	rangeSize := (endTime - startTime) / int64(ranges)
+	if rangeSize <= 0 {
+		rangeSize = 1
+	}
+	rangeIndex := func(t int64) int64 {
+		i := (t - startTime) / rangeSize
+		if i < 0 {
+			return 0
+		} else if i >= int64(ranges) {
+			return int64(ranges) - 1
+		}
+		return i
+	}
+	hashes := make([]hash.Hash, ranges)
+	counts := make([]int64, ranges)
+	deleted := make([]bool, ranges)
+
+	start, end := self.byteArraysForStartAndEndTimes(startTime, endTime-1)
+	for _, column := range self.getColumnNamesForSeries(database, series) {
+		fields, err := self.getFieldsForSeries(database, series, []string{column})
+		if err == nil {
+			for _, tombstone := range self.getTombstones(fields[0].Id) {
+				first := self.convertUintTimestampToInt64(&tombstone.start.time)
+				last := self.convertUintTimestampToInt64(&tombstone.end.time)
+				if last < startTime || first >= endTime {
+					continue
+				}
+				for i := rangeIndex(first); i <= rangeIndex(last); i++ {
+					deleted[i] = true
+				}
+			}
+		}
+
+		err = self.forEachPointInRange(database, series, column, start, end, func(t, sequence uint64, value []byte) error {
+			i := rangeIndex(self.convertUintTimestampToInt64(&t))
+			if hashes[i] == nil {
+				hashes[i] = sha1.New()
+			}
+			h := hashes[i]
+			h.Write([]byte(column))
+			h.Write([]byte{0})
+			binary.Write(h, binary.BigEndian, t)
+			binary.Write(h, binary.BigEndian, sequence)
+			h.Write(value)
+			counts[i]++
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	digest := &cluster.SeriesDigest{Database: database, Name: series}
+	seriesHash := sha1.New()
+	for i, h := range hashes {
+		if h == nil && !deleted[i] {
+			continue
+		}
+		r := &cluster.RangeDigest{
+			StartTime: startTime + int64(i)*rangeSize,
+			EndTime:   startTime + int64(i+1)*rangeSize,
+			Points:    counts[i],
+			Deleted:   deleted[i],
+		}
+		if i == ranges-1 {
+			r.EndTime = endTime
+		}
+		// the hash of the series doesn't depend on the deletes that
+		// weren't purged yet
+		if h != nil {
+			r.Hash = h.Sum(nil)
+			binary.Write(seriesHash, binary.BigEndian, r.StartTime)
+			seriesHash.Write(r.Hash)
+		}
+		digest.Points += r.Points
+		digest.Ranges = append(digest.Ranges, r)
+	}
+	digest.Hash = seriesHash.Sum(nil)
+	return digest, nil
+}
+
+// Calls yield with the points of every column of the series between
+// startTime (inclusive) and endTime (exclusive)
+func (self *LevelDbShard) points(database, series string, startTime, endTime int64, yield func(*protocol.Series) error) error {
+	start, end := self.byteArraysForStartAndEndTimes(startTime, endTime-1)
+	for _, column := range self.getColumnNamesForSeries(database, series) {
+		points := make([]*protocol.Point, 0, SHARD_POINTS_CHUNK_SIZE)
+		flush := func() error {
+			if len(points) == 0 {
+				return nil
+			}
+			s := &protocol.Series{Name: proto.String(series), Fields: []string{column}, Points: points}
+			points = make([]*protocol.Point, 0, SHARD_POINTS_CHUNK_SIZE)
+			return yield(s)
+		}
+
+		err := self.forEachPointInRange(database, series, column, start, end, func(t, sequence uint64, value []byte) error {
+			fieldValue := &protocol.FieldValue{}
+			if err := proto.Unmarshal(value, fieldValue); err != nil {
+				return err
+			}
+			point := &protocol.Point{Values: []*protocol.FieldValue{fieldValue}, SequenceNumber: proto.Uint64(sequence)}
+			point.SetTimestampInMicroseconds(self.convertUintTimestampToInt64(&t))
+			points = append(points, point)
+			if len(points) >= SHARD_POINTS_CHUNK_SIZE {
+				return flush()
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if err := flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,341 @@
+package datastore
+
+import (
+	"bytes"
+	"cluster"
+	"datastore/storage"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"protocol"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.google.com/p/goprotobuf/proto"
+	log "code.google.com/p/log4go"
+)
+
+const (
+	// the migrated shard is written to the shard directory with this suffix
+	MIGRATION_DIR_SUFFIX = ".migrating"
+	// the shard directory is renamed to this while the migrated shard is
+	// moved in place
+	OLD_SHARD_DIR_SUFFIX = ".old"
+)
+
+var (
+	minTimeBytes = []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	maxTimeBytes = []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+)
+
+// Cleans up after a migration that didn't finish. If the server died
+// while the directories were swapped the old shard is moved back.
+func recoverShardDir(dir string) error {
+	oldDir := dir + OLD_SHARD_DIR_SUFFIX
+	if _, err := os.Stat(oldDir); err == nil {
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			log.Warn("DATASTORE: restoring %s, the migration of the shard didn't finish", dir)
+			if err := os.Rename(oldDir, dir); err != nil {
+				return err
+			}
+		} else if err := os.RemoveAll(oldDir); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(dir + MIGRATION_DIR_SUFFIX)
+}
+
+// Returns the ids of the shards stored on this server
+func (self *LevelDbShardDatastore) LocalShardIds() ([]uint32, error) {
+	infos, err := ioutil.ReadDir(self.baseDbDir)
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[uint32]bool)
+	ids := []uint32{}
+	for _, info := range infos {
+		id, err := strconv.ParseUint(strings.TrimSuffix(info.Name(), OLD_SHARD_DIR_SUFFIX), 10, 32)
+		if err != nil || !info.IsDir() || found[uint32(id)] {
+			continue
+		}
+		found[uint32(id)] = true
+		ids = append(ids, uint32(id))
+	}
+	sort.Sort(uint32Slice(ids))
+	return ids, nil
+}
+
+type uint32Slice []uint32
+
+func (self uint32Slice) Len() int           { return len(self) }
+func (self uint32Slice) Less(i, j int) bool { return self[i] < self[j] }
+func (self uint32Slice) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+
+// Rewrites the shard with the given engine and point block size. The
+// points are read through the shard iterators so any format can be
+// converted to any other. The shard stays online while it's copied, the
+// changes made in the meantime are recorded and replayed on the migrated
+// shard once the number of points of every column is verified. Requests
+// for the shard only wait while the changes are replayed and the
+// directories are swapped.
+func (self *LevelDbShardDatastore) MigrateShard(id uint32, engine string, pointBlockSize int) (*cluster.ShardMigration, error) {
+	if engine == storage.MEMORY_NAME {
+		return nil, fmt.Errorf("Can't migrate shards to the %s engine, it doesn't persist the data", engine)
+	}
+
+	self.shardsLock.Lock()
+	for self.migrating[id] {
+		self.shardsChanged.Wait()
+	}
+	if self.migrations[id] {
+		self.shardsLock.Unlock()
+		return nil, fmt.Errorf("Shard %d is already being migrated", id)
+	}
+	dir := self.shardDir(id)
+	if _, err := os.Stat(dir); err != nil {
+		self.shardsLock.Unlock()
+		return nil, fmt.Errorf("Shard %s doesn't exist on this server", dir)
+	}
+	self.migrations[id] = true
+	self.shardsLock.Unlock()
+	defer func() {
+		self.shardsLock.Lock()
+		delete(self.migrations, id)
+		self.shardsChanged.Broadcast()
+		self.shardsLock.Unlock()
+	}()
+
+	localShard, err := self.GetOrCreateShard(id)
+	if err != nil {
+		return nil, err
+	}
+	src := localShard.(*LevelDbShard)
+	dst, err := self.openMigrationShard(dir, engine, pointBlockSize)
+	if err != nil {
+		self.ReturnShard(id)
+		return nil, err
+	}
+
+	log.Info("DATASTORE: migrating shard %s to %s with point blocks of %d", dir, engine, pointBlockSize)
+	start := time.Now()
+	src.recordChanges()
+	migration, err := src.migrateTo(dst)
+	if err != nil {
+		src.recordedChanges()
+		self.ReturnShard(id)
+		dst.close()
+		os.RemoveAll(dir + MIGRATION_DIR_SUFFIX)
+		return nil, err
+	}
+	migration.ShardId = id
+	migration.Engine = engine
+	migration.PointBlockSize = pointBlockSize
+
+	// wait until the migration is the only one using the shard, the
+	// other requests wait until the directories are swapped
+	self.shardsLock.Lock()
+	for self.migrating[id] {
+		self.shardsChanged.Wait()
+	}
+	self.migrating[id] = true
+	for self.shardRefCounts[id] > 1 {
+		self.shardsChanged.Wait()
+	}
+	self.shardsLock.Unlock()
+	defer func() {
+		self.shardsLock.Lock()
+		delete(self.migrating, id)
+		self.shardsChanged.Broadcast()
+		self.shardsLock.Unlock()
+	}()
+
+	changes := src.recordedChanges()
+	for _, change := range changes {
+		if err = change(dst); err != nil {
+			break
+		}
+	}
+	self.shardsLock.Lock()
+	self.closeShard(id)
+	self.shardsLock.Unlock()
+	dst.close()
+	if err != nil {
+		os.RemoveAll(dir + MIGRATION_DIR_SUFFIX)
+		return nil, err
+	}
+
+	// swap the directories, recoverShardDir cleans up if we die in between
+	oldDir := dir + OLD_SHARD_DIR_SUFFIX
+	if err := os.Rename(dir, oldDir); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(dir+MIGRATION_DIR_SUFFIX, dir); err != nil {
+		os.Rename(oldDir, dir)
+		return nil, err
+	}
+	if err := os.RemoveAll(oldDir); err != nil {
+		log.Error("DATASTORE: couldn't remove %s: %s", oldDir, err)
+	}
+	log.Info("DATASTORE: migrated %d points of shard %s in %s, replayed %d changes made during the migration",
+		migration.Points, dir, time.Now().Sub(start), len(changes))
+	return migration, nil
+}
+
+// Creates the migrated shard next to the shard directory
+func (self *LevelDbShardDatastore) openMigrationShard(dir, engine string, pointBlockSize int) (*LevelDbShard, error) {
+	opener, err := self.getOpener(engine)
+	if err != nil {
+		return nil, err
+	}
+
+	dstDir := dir + MIGRATION_DIR_SUFFIX
+	if err := os.RemoveAll(dstDir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dstDir, 0744); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dstDir, SHARD_TYPE_FILE), []byte(engine), 0644); err != nil {
+		return nil, err
+	}
+	dstEngine, err := opener(dstDir)
+	if err != nil {
+		return nil, err
+	}
+	dst, err := NewLevelDbShard(dstEngine, self.pointBatchSize, self.writeBatchSize, pointBlockSize)
+	if err != nil {
+		dstEngine.Close()
+		return nil, err
+	}
+	return dst, nil
+}
+
+// Copies every column of every series to the other shard and verifies
+// that both shards have the same number of points
+func (self *LevelDbShard) migrateTo(other *LevelDbShard) (*cluster.ShardMigration, error) {
+	migration := &cluster.ShardMigration{}
+	type column struct{ database, series, name string }
+	counts := make(map[column]int64)
+	for database, seriesNames := range self.getAllSeries() {
+		for _, series := range seriesNames {
+			migration.Series++
+			for _, name := range self.getColumnNamesForSeries(database, series) {
+				migration.Columns++
+				count, err := self.copyColumn(other, database, series, name)
+				if err != nil {
+					return nil, err
+				}
+				counts[column{database, series, name}] = count
+				migration.Points += count
+			}
+		}
+	}
+	// move the points to blocks before counting them
+	other.compact()
+
+	for c, expected := range counts {
+		actual, err := other.countPoints(c.database, c.series, c.name)
+		if err != nil {
+			return nil, err
+		}
+		if actual != expected {
+			return nil, fmt.Errorf("Column %s of series %s in database %s has %d points after the migration, expected %d",
+				c.name, c.series, c.database, actual, expected)
+		}
+	}
+	return migration, nil
+}
+
+// Returns the names of the series of every database
+func (self *LevelDbShard) getAllSeries() map[string][]string {
+	it := self.db.Iterator()
+	defer it.Close()
+
+	series := make(map[string][]string)
+	dbNameStart := len(DATABASE_SERIES_INDEX_PREFIX)
+	for it.Seek(DATABASE_SERIES_INDEX_PREFIX); it.Valid(); it.Next() {
+		key := it.Key()
+		if len(key) < dbNameStart || !bytes.Equal(key[:dbNameStart], DATABASE_SERIES_INDEX_PREFIX) {
+			break
+		}
+		parts := strings.Split(string(key[dbNameStart:]), "~")
+		if len(parts) > 1 {
+			series[parts[0]] = append(series[parts[0]], parts[1])
+		}
+	}
+	return series
+}
+
+// calls yield with the time, sequence number and marshaled value of
+// every point of the column
+func (self *LevelDbShard) forEachPoint(database, series, column string, yield func(t, sequence uint64, value []byte) error) error {
+	return self.forEachPointInRange(database, series, column, minTimeBytes, maxTimeBytes, yield)
+}
+
+// same as forEachPoint for the points between start and end (inclusive)
+func (self *LevelDbShard) forEachPointInRange(database, series, column string, start, end []byte, yield func(t, sequence uint64, value []byte) error) error {
+	fields, err := self.getFieldsForSeries(database, series, []string{column})
+	if err != nil {
+		if _, ok := err.(FieldLookupError); ok {
+			return nil
+		}
+		return err
+	}
+
+	it := newPointIterator(self.db, fields[0].Id, self.getTombstones(fields[0].Id), start, end, true)
+	defer it.Close()
+	for ; it.Valid(); it.Next() {
+		key := it.Key()
+		t := binary.BigEndian.Uint64(key[8:16])
+		sequence := binary.BigEndian.Uint64(key[16:24])
+		if err := yield(t, sequence, it.Value()); err != nil {
+			return err
+		}
+	}
+	return it.Error()
+}
+
+func (self *LevelDbShard) countPoints(database, series, column string) (int64, error) {
+	count := int64(0)
+	err := self.forEachPoint(database, series, column, func(t, sequence uint64, value []byte) error {
+		count++
+		return nil
+	})
+	return count, err
+}
+
+func (self *LevelDbShard) copyColumn(other *LevelDbShard, database, series, column string) (int64, error) {
+	count := int64(0)
+	points := make([]*protocol.Point, 0, self.writeBatchSize)
+	flush := func() error {
+		if len(points) == 0 {
+			return nil
+		}
+		s := &protocol.Series{Name: proto.String(series), Fields: []string{column}, Points: points}
+		points = make([]*protocol.Point, 0, self.writeBatchSize)
+		return other.Write(database, []*protocol.Series{s})
+	}
+
+	err := self.forEachPoint(database, series, column, func(t, sequence uint64, value []byte) error {
+		fieldValue := &protocol.FieldValue{}
+		if err := proto.Unmarshal(value, fieldValue); err != nil {
+			return err
+		}
+		point := &protocol.Point{Values: []*protocol.FieldValue{fieldValue}, SequenceNumber: proto.Uint64(sequence)}
+		point.SetTimestampInMicroseconds(self.convertUintTimestampToInt64(&t))
+		points = append(points, point)
+		count++
+		if len(points) >= self.writeBatchSize {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, flush()
+}
@@ -0,0 +1,371 @@
+package datastore
+
+import (
+	"bytes"
+	"datastore/storage"
+	"protocol"
+	"sort"
+	"time"
+
+	log "code.google.com/p/log4go"
+)
+
+const (
+	// The number of keys deleted at a time when a tombstone is purged
+	PURGE_BATCH_SIZE = 1000
+	// How often the deleted points are purged if it isn't configured
+	DEFAULT_PURGE_INTERVAL = time.Minute
+)
+
+// A deleted range of the points of a field. The points stay in the
+// shard until the tombstone is purged, the iterators skip them.
+type rangeTombstone struct {
+	start blockPoint
+	end   blockPoint
+}
+
+func (self *rangeTombstone) covers(point *blockPoint) bool {
+	return point.compare(&self.start) >= 0 && point.compare(&self.end) <= 0
+}
+
+// Returns the ranges of the tombstone that don't cover the points and
+// whether it covers any of them. The points have to be sorted.
+func (self *rangeTombstone) split(points []blockPoint) ([]rangeTombstone, bool) {
+	parts := []rangeTombstone{}
+	start := self.start
+	covers := false
+	for i := range points {
+		point := &points[i]
+		if point.compare(&start) < 0 || point.compare(&self.end) > 0 {
+			continue
+		}
+		covers = true
+		if point.compare(&start) > 0 {
+			parts = append(parts, rangeTombstone{start: start, end: point.previous()})
+		}
+		if point.compare(&self.end) == 0 {
+			return parts, true
+		}
+		start = point.next()
+	}
+	return append(parts, rangeTombstone{start: start, end: self.end}), covers
+}
+
+func rangeTombstoneKey(fieldId []byte, tombstone *rangeTombstone) []byte {
+	key := make([]byte, 0, len(RANGE_TOMBSTONE_PREFIX)+len(fieldId)+32)
+	key = append(key, RANGE_TOMBSTONE_PREFIX...)
+	key = append(key, fieldId...)
+	key = append(key, tombstone.start.key()...)
+	return append(key, tombstone.end.key()...)
+}
+
+func isDeleted(tombstones []rangeTombstone, point *blockPoint) bool {
+	for i := range tombstones {
+		if tombstones[i].covers(point) {
+			return true
+		}
+	}
+	return false
+}
+
+// Purges the deleted points of the open shards every interval until the
+// datastore is closed
+func (self *LevelDbShardDatastore) purgeTombstonesPeriodically(interval time.Duration) {
+	if interval <= 0 {
+		interval = DEFAULT_PURGE_INTERVAL
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			self.purgeTombstones()
+		case <-self.stopPurging:
+			return
+		}
+	}
+}
+
+func (self *LevelDbShardDatastore) purgeTombstones() {
+	self.shardsLock.Lock()
+	ids := []uint32{}
+	for id, shard := range self.shards {
+		if shard.hasTombstones() {
+			ids = append(ids, id)
+		}
+	}
+	self.shardsLock.Unlock()
+
+	for _, id := range ids {
+		// skip the shards that were closed or dropped in the meantime
+		self.shardsLock.Lock()
+		shard := self.shards[id]
+		if shard == nil || self.migrating[id] {
+			self.shardsLock.Unlock()
+			continue
+		}
+		self.incrementShardRefCountAndCloseOldestIfNeeded(id)
+		self.shardsLock.Unlock()
+
+		if err := shard.purgeAllTombstones(self.purgeRate); err != nil {
+			log.Error("DATASTORE: cannot purge the deleted points of shard %d: %s", id, err)
+		}
+		self.ReturnShard(id)
+	}
+}
+
+// Reads the tombstones of all the fields, called when the shard is opened
+func (self *LevelDbShard) loadTombstones() error {
+	it := self.db.Iterator()
+	defer it.Close()
+
+	prefixLength := len(RANGE_TOMBSTONE_PREFIX)
+	for it.Seek(RANGE_TOMBSTONE_PREFIX); it.Valid(); it.Next() {
+		key := it.Key()
+		if !bytes.HasPrefix(key, RANGE_TOMBSTONE_PREFIX) {
+			break
+		}
+		if len(key) != prefixLength+40 {
+			continue
+		}
+		fieldId := string(key[prefixLength : prefixLength+8])
+		tombstone := rangeTombstone{
+			start: newBlockPoint(key[prefixLength+8:prefixLength+24], nil),
+			end:   newBlockPoint(key[prefixLength+24:], nil),
+		}
+		self.tombstones[fieldId] = append(self.tombstones[fieldId], tombstone)
+	}
+	return it.Error()
+}
+
+// Returns a copy of the tombstones of the field
+func (self *LevelDbShard) getTombstones(fieldId []byte) []rangeTombstone {
+	self.tombstonesLock.RLock()
+	defer self.tombstonesLock.RUnlock()
+	tombstones := self.tombstones[string(fieldId)]
+	if len(tombstones) == 0 {
+		return nil
+	}
+	return append([]rangeTombstone{}, tombstones...)
+}
+
+func (self *LevelDbShard) hasTombstones() bool {
+	self.tombstonesLock.RLock()
+	defer self.tombstonesLock.RUnlock()
+	return len(self.tombstones) > 0
+}
+
+// Marks the points of the field between start and end (time and
+// sequence number) as deleted
+func (self *LevelDbShard) addTombstone(fieldId, start, end []byte) error {
+	tombstone := rangeTombstone{start: newBlockPoint(start, nil), end: newBlockPoint(end, nil)}
+
+	self.tombstonesLock.Lock()
+	defer self.tombstonesLock.Unlock()
+	if err := self.db.Put(rangeTombstoneKey(fieldId, &tombstone), []byte{}); err != nil {
+		return err
+	}
+	self.tombstones[string(fieldId)] = append(self.tombstones[string(fieldId)], tombstone)
+	return nil
+}
+
+func (self *LevelDbShard) removeTombstone(fieldId []byte, tombstone *rangeTombstone) error {
+	self.tombstonesLock.Lock()
+	defer self.tombstonesLock.Unlock()
+	if err := self.db.BatchPut([]storage.Write{{Key: rangeTombstoneKey(fieldId, tombstone), Value: nil}}); err != nil {
+		return err
+	}
+	tombstones := self.tombstones[string(fieldId)]
+	remaining := make([]rangeTombstone, 0, len(tombstones))
+	for _, t := range tombstones {
+		if t.start.compare(&tombstone.start) != 0 || t.end.compare(&tombstone.end) != 0 {
+			remaining = append(remaining, t)
+		}
+	}
+	if len(remaining) == 0 {
+		delete(self.tombstones, string(fieldId))
+	} else {
+		self.tombstones[string(fieldId)] = remaining
+	}
+	return nil
+}
+
+// Drops the tombstones of the field without purging them, used when all
+// the points of the field are deleted
+func (self *LevelDbShard) dropTombstones(fieldId []byte) error {
+	self.tombstonesLock.Lock()
+	defer self.tombstonesLock.Unlock()
+	delete(self.tombstones, string(fieldId))
+	prefix := append(append([]byte{}, RANGE_TOMBSTONE_PREFIX...), fieldId...)
+	return self.db.Del(prefix, append(append([]byte{}, prefix...), bytes.Repeat([]byte{0xFF}, 32)...))
+}
+
+// Points that are written to a deleted range would be hidden by the
+// tombstone, the tombstone is split around them. The points in the rest
+// of the range are left to the background purge.
+func (self *LevelDbShard) splitOverwrittenTombstones(database string, series []*protocol.Series) error {
+	if !self.hasTombstones() {
+		return nil
+	}
+
+	for _, s := range series {
+		var points []blockPoint
+		for _, field := range s.Fields {
+			temp := field
+			id, err := self.getIdForDbSeriesColumn(&database, s.Name, &temp)
+			if err != nil {
+				return err
+			}
+			if id == nil || len(self.getTombstones(id)) == 0 {
+				continue
+			}
+
+			if points == nil {
+				points = make([]blockPoint, 0, len(s.Points))
+				for _, point := range s.Points {
+					timestamp := self.convertTimestampToUint(point.GetTimestampInMicroseconds())
+					points = append(points, blockPoint{time: timestamp, sequence: point.GetSequenceNumber()})
+				}
+				sort.Sort(blockPointsByKey(points))
+			}
+			if err := self.splitTombstones(id, points); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Replaces the tombstones of the field that cover any of the points with
+// the ranges around the points
+func (self *LevelDbShard) splitTombstones(fieldId []byte, points []blockPoint) error {
+	// a purge that's running can't delete the points once the tombstone
+	// is split, see purgeRange
+	self.purgeLock.Lock()
+	defer self.purgeLock.Unlock()
+	self.tombstonesLock.Lock()
+	defer self.tombstonesLock.Unlock()
+
+	tombstones := self.tombstones[string(fieldId)]
+	remaining := make([]rangeTombstone, 0, len(tombstones))
+	writes := []storage.Write{}
+	for i := range tombstones {
+		tombstone := &tombstones[i]
+		parts, covers := tombstone.split(points)
+		if !covers {
+			remaining = append(remaining, *tombstone)
+			continue
+		}
+		writes = append(writes, storage.Write{Key: rangeTombstoneKey(fieldId, tombstone), Value: nil})
+		for j := range parts {
+			writes = append(writes, storage.Write{Key: rangeTombstoneKey(fieldId, &parts[j]), Value: []byte{}})
+		}
+		remaining = append(remaining, parts...)
+	}
+	if len(writes) == 0 {
+		return nil
+	}
+	if err := self.db.BatchPut(writes); err != nil {
+		return err
+	}
+	if len(remaining) == 0 {
+		delete(self.tombstones, string(fieldId))
+	} else {
+		self.tombstones[string(fieldId)] = remaining
+	}
+	return nil
+}
+
+// Purges the tombstones of every field, rate is the maximum number of
+// keys deleted per second, 0 doesn't limit the rate
+func (self *LevelDbShard) purgeAllTombstones(rate int) error {
+	self.tombstonesLock.RLock()
+	fields := make(map[string][]rangeTombstone, len(self.tombstones))
+	for fieldId, tombstones := range self.tombstones {
+		fields[fieldId] = append([]rangeTombstone{}, tombstones...)
+	}
+	self.tombstonesLock.RUnlock()
+
+	for fieldId, tombstones := range fields {
+		if err := self.purgeTombstones([]byte(fieldId), tombstones, rate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Deletes the points covered by the tombstones and removes the
+// tombstones. The tombstones that were purged or split by someone else
+// in the meantime are skipped.
+func (self *LevelDbShard) purgeTombstones(fieldId []byte, tombstones []rangeTombstone, rate int) error {
+	for i := range tombstones {
+		if err := self.purgeRange(fieldId, &tombstones[i], rate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *LevelDbShard) hasTombstone(fieldId []byte, tombstone *rangeTombstone) bool {
+	for _, t := range self.getTombstones(fieldId) {
+		if t.start.compare(&tombstone.start) == 0 && t.end.compare(&tombstone.end) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Deletes the keys in the range a batch at a time, sleeps between the
+// batches to keep the rate. The points in blocks are deleted after the
+// keys and the tombstone is removed. The purge lock is held for one
+// batch at a time, the purge stops if the tombstone was split by a
+// write in between.
+func (self *LevelDbShard) purgeRange(fieldId []byte, tombstone *rangeTombstone, rate int) error {
+	startKey := append(append([]byte{}, fieldId...), tombstone.start.key()...)
+	endKey := append(append([]byte{}, fieldId...), tombstone.end.key()...)
+	for {
+		self.purgeLock.Lock()
+		if !self.hasTombstone(fieldId, tombstone) {
+			self.purgeLock.Unlock()
+			return nil
+		}
+		writes := make([]storage.Write, 0, PURGE_BATCH_SIZE)
+		it := self.db.Iterator()
+		for it.Seek(startKey); it.Valid() && len(writes) < PURGE_BATCH_SIZE; it.Next() {
+			key := it.Key()
+			if bytes.Compare(key, endKey) > 0 {
+				break
+			}
+			writes = append(writes, storage.Write{Key: key, Value: nil})
+		}
+		err := it.Error()
+		it.Close()
+		if err == nil && len(writes) > 0 {
+			err = self.db.BatchPut(writes)
+		}
+		self.purgeLock.Unlock()
+		if err != nil {
+			return err
+		}
+		if len(writes) == 0 {
+			break
+		}
+		if rate > 0 {
+			time.Sleep(time.Duration(len(writes)) * time.Second / time.Duration(rate))
+		}
+	}
+
+	self.purgeLock.Lock()
+	defer self.purgeLock.Unlock()
+	if !self.hasTombstone(fieldId, tombstone) {
+		return nil
+	}
+	if err := self.deletePointsFromBlocks(fieldId, tombstone.start.key(), tombstone.end.key()); err != nil {
+		return err
+	}
+	if err := self.removeTombstone(fieldId, tombstone); err != nil {
+		return err
+	}
+	log.Debug("Purged the deleted points of field %v", fieldId)
+	return nil
+}
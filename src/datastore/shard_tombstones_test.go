@@ -0,0 +1,86 @@
+package datastore
+
+import (
+	"datastore/storage"
+
+	"code.google.com/p/goprotobuf/proto"
+	. "launchpad.net/gocheck"
+)
+
+type TombstoneSuite struct{}
+
+var _ = Suite(&TombstoneSuite{})
+
+func (self *TombstoneSuite) TestDeletedPointsArePurgedInTheBackground(c *C) {
+	shard, err := NewLevelDbShard(storage.NewMemory(""), 10, 10, 0)
+	c.Assert(err, IsNil)
+	points := map[int64]*int64{}
+	for i := int64(0); i < 10; i++ {
+		points[i] = proto.Int64(i)
+	}
+	writeInts(c, shard, points)
+
+	startTime, endTime := shard.byteArraysForStartAndEndTimes(2, 5)
+	c.Assert(shard.deleteRangeOfSeriesCommon("db", "foo", startTime, endTime), IsNil)
+	times, _ := readInts(c, shard, 0, 10, true)
+	c.Assert(times, DeepEquals, []int64{0, 1, 6, 7, 8, 9})
+
+	// the points are still on disk
+	fields, err := shard.getFieldsForSeries("db", "foo", []string{"value"})
+	c.Assert(err, IsNil)
+	key := append(shard.byteArrayForTimeInt(3), 0, 0, 0, 0, 0, 0, 0, 1)
+	data, err := shard.db.Get(append(append([]byte{}, fields[0].Id...), key...))
+	c.Assert(err, IsNil)
+	c.Assert(data, NotNil)
+	data, err = shard.getPoint(fields[0].Id, key)
+	c.Assert(err, IsNil)
+	c.Assert(data, IsNil)
+
+	// writing to a deleted range splits the tombstone around the point,
+	// the rest of the range isn't purged
+	writeInts(c, shard, map[int64]*int64{3: proto.Int64(30)})
+	times, values := readInts(c, shard, 0, 10, true)
+	c.Assert(times, DeepEquals, []int64{0, 1, 3, 6, 7, 8, 9})
+	c.Assert(values, DeepEquals, []int64{0, 1, 30, 6, 7, 8, 9})
+	c.Assert(shard.getTombstones(fields[0].Id), HasLen, 2)
+	key = append(shard.byteArrayForTimeInt(4), 0, 0, 0, 0, 0, 0, 0, 1)
+	data, err = shard.db.Get(append(append([]byte{}, fields[0].Id...), key...))
+	c.Assert(err, IsNil)
+	c.Assert(data, NotNil)
+
+	// the tombstones are still there after the shard is reopened
+	startTime, endTime = shard.byteArraysForStartAndEndTimes(7, 8)
+	c.Assert(shard.deleteRangeOfSeriesCommon("db", "foo", startTime, endTime), IsNil)
+	shard, err = NewLevelDbShard(shard.db, 10, 10, 0)
+	c.Assert(err, IsNil)
+	times, _ = readInts(c, shard, 0, 10, true)
+	c.Assert(times, DeepEquals, []int64{0, 1, 3, 6, 9})
+	c.Assert(shard.getTombstones(fields[0].Id), HasLen, 3)
+
+	c.Assert(shard.purgeAllTombstones(0), IsNil)
+	c.Assert(shard.hasTombstones(), Equals, false)
+	times, _ = readInts(c, shard, 0, 10, true)
+	c.Assert(times, DeepEquals, []int64{0, 1, 3, 6, 9})
+	stats := shard.db.Stats()
+	// the 5 points, the next id and the 2 index keys
+	c.Assert(stats.Keys, Equals, int64(8))
+}
+
+func (self *TombstoneSuite) TestSplitTombstone(c *C) {
+	tombstone := rangeTombstone{start: blockPoint{time: 2}, end: blockPoint{time: 5, sequence: 10}}
+	parts, covers := tombstone.split([]blockPoint{{time: 1}, {time: 2}, {time: 3, sequence: 4}, {time: 6}})
+	c.Assert(covers, Equals, true)
+	c.Assert(parts, DeepEquals, []rangeTombstone{
+		{start: blockPoint{time: 2, sequence: 1}, end: blockPoint{time: 3, sequence: 3}},
+		{start: blockPoint{time: 3, sequence: 5}, end: blockPoint{time: 5, sequence: 10}},
+	})
+
+	parts, covers = tombstone.split([]blockPoint{{time: 5, sequence: 10}})
+	c.Assert(covers, Equals, true)
+	c.Assert(parts, DeepEquals, []rangeTombstone{
+		{start: blockPoint{time: 2}, end: blockPoint{time: 5, sequence: 9}},
+	})
+
+	_, covers = tombstone.split([]blockPoint{{time: 6}})
+	c.Assert(covers, Equals, false)
+}
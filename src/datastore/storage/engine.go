@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"configuration"
+	"fmt"
+	"sort"
+)
+
+// A key/value pair to write, a nil value deletes the key
+type Write struct {
+	Key   []byte
+	Value []byte
+}
+
+// The interface every storage engine has to implement. Keys are sorted
+// lexicographically.
+type Engine interface {
+	Name() string
+	Path() string
+	// Returns nil if the key doesn't exist
+	Get(key []byte) ([]byte, error)
+	Put(key, value []byte) error
+	// Writes all the key/value pairs atomically
+	BatchPut(writes []Write) error
+	// Deletes all the keys in the range [first, last]
+	Del(first, last []byte) error
+	Iterator() Iterator
+	Compact()
+	// Compacts the keys in the range [first, last], nil means the
+	// beginning or the end of the key space
+	CompactRange(first, last []byte)
+	// Returns the size and the number of keys, the keys are counted so
+	// it reads the whole key space
+	Stats() Stats
+	Close()
+}
+
+type Iterator interface {
+	Seek(key []byte)
+	SeekToFirst()
+	SeekToLast()
+	Next()
+	Prev()
+	Valid() bool
+	Key() []byte
+	Value() []byte
+	Error() error
+	Close()
+}
+
+type Stats struct {
+	// approximate size of the data in bytes
+	Size int64
+	// number of keys
+	Keys int64
+	// engine specific information in a human readable form
+	Info string
+}
+
+// Opens (or creates if it doesn't exist) the engine stored in the
+// given directory
+type Opener func(path string) (Engine, error)
+
+// Called once with the server configuration, returns the function
+// that's used to open the engine of every shard
+type Initializer func(config *configuration.Configuration) (Opener, error)
+
+var engines = make(map[string]Initializer)
+
+// Should be called by the engine implementations from an init function
+func registerEngine(name string, initializer Initializer) {
+	if _, ok := engines[name]; ok {
+		panic(fmt.Errorf("Storage engine %s is already registered", name))
+	}
+	engines[name] = initializer
+}
+
+func GetInitializer(name string) (Initializer, error) {
+	initializer, ok := engines[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown storage engine %s, valid engines: %v", name, GetRegisteredEngines())
+	}
+	return initializer, nil
+}
+
+func GetRegisteredEngines() []string {
+	names := make([]string, 0, len(engines))
+	for name, _ := range engines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
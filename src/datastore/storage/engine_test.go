@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"configuration"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "launchpad.net/gocheck"
+)
+
+// Hook up gocheck into the gotest runner.
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+const TEST_STORAGE_DIR = "/tmp/influxdb/storage_test"
+
+type EngineSuite struct{}
+
+var _ = Suite(&EngineSuite{})
+
+func (self *EngineSuite) SetUpTest(c *C) {
+	c.Assert(os.RemoveAll(TEST_STORAGE_DIR), IsNil)
+	c.Assert(os.MkdirAll(TEST_STORAGE_DIR, 0755), IsNil)
+}
+
+// runs the given function against every registered engine
+func (self *EngineSuite) forEachEngine(c *C, f func(engine Engine)) {
+	config := &configuration.Configuration{LevelDbLruCacheSize: 1024 * 1024, LevelDbMaxOpenFiles: 10}
+	for _, name := range GetRegisteredEngines() {
+		initializer, err := GetInitializer(name)
+		c.Assert(err, IsNil)
+		opener, err := initializer(config)
+		c.Assert(err, IsNil)
+		engine, err := opener(filepath.Join(TEST_STORAGE_DIR, name))
+		c.Assert(err, IsNil)
+		c.Assert(engine.Name(), Equals, name)
+		f(engine)
+		engine.Close()
+	}
+}
+
+func keys(it Iterator) []string {
+	keys := []string{}
+	for ; it.Valid(); it.Next() {
+		keys = append(keys, string(it.Key()))
+	}
+	return keys
+}
+
+func (self *EngineSuite) TestUnknownEngine(c *C) {
+	_, err := GetInitializer("foo")
+	c.Assert(err, NotNil)
+}
+
+func (self *EngineSuite) TestGetAndPut(c *C) {
+	self.forEachEngine(c, func(engine Engine) {
+		value, err := engine.Get([]byte("foo"))
+		c.Assert(err, IsNil)
+		c.Assert(value, IsNil)
+
+		c.Assert(engine.Put([]byte("foo"), []byte("bar")), IsNil)
+		value, err = engine.Get([]byte("foo"))
+		c.Assert(err, IsNil)
+		c.Assert(string(value), Equals, "bar")
+	})
+}
+
+func (self *EngineSuite) TestBatchPutAndIterate(c *C) {
+	self.forEachEngine(c, func(engine Engine) {
+		writes := []Write{}
+		for i := 9; i >= 0; i-- {
+			writes = append(writes, Write{[]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i))})
+		}
+		c.Assert(engine.BatchPut(writes), IsNil)
+		// a nil value deletes the key
+		c.Assert(engine.BatchPut([]Write{{[]byte("key5"), nil}}), IsNil)
+
+		it := engine.Iterator()
+		it.Seek([]byte("key3"))
+		c.Assert(keys(it), DeepEquals, []string{"key3", "key4", "key6", "key7", "key8", "key9"})
+		c.Assert(it.Error(), IsNil)
+		it.Close()
+
+		it = engine.Iterator()
+		it.SeekToLast()
+		c.Assert(it.Valid(), Equals, true)
+		c.Assert(string(it.Key()), Equals, "key9")
+		c.Assert(string(it.Value()), Equals, "value9")
+		it.Prev()
+		c.Assert(string(it.Key()), Equals, "key8")
+		it.Close()
+	})
+}
+
+func (self *EngineSuite) TestDeleteRange(c *C) {
+	self.forEachEngine(c, func(engine Engine) {
+		writes := []Write{}
+		for i := 0; i < 10; i++ {
+			writes = append(writes, Write{[]byte(fmt.Sprintf("key%d", i)), []byte{}})
+		}
+		c.Assert(engine.BatchPut(writes), IsNil)
+		c.Assert(engine.Del([]byte("key2"), []byte("key7")), IsNil)
+
+		it := engine.Iterator()
+		it.SeekToFirst()
+		c.Assert(keys(it), DeepEquals, []string{"key0", "key1", "key8", "key9"})
+		it.Close()
+	})
+}
+
+func (self *EngineSuite) TestStats(c *C) {
+	self.forEachEngine(c, func(engine Engine) {
+		writes := []Write{}
+		for i := 0; i < 10; i++ {
+			writes = append(writes, Write{[]byte(fmt.Sprintf("key%d", i)), []byte("value")})
+		}
+		c.Assert(engine.BatchPut(writes), IsNil)
+		engine.CompactRange(nil, []byte("key5"))
+		c.Assert(engine.Stats().Keys, Equals, int64(10))
+	})
+}
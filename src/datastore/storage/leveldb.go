@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"bytes"
+	"configuration"
+
+	"github.com/jmhodges/levigo"
+)
+
+const (
+	LEVELDB_NAME = "leveldb"
+
+	ONE_KILOBYTE                    = 1024
+	SHARD_BLOOM_FILTER_BITS_PER_KEY = 10
+	LEVELDB_DELETE_BATCH_SIZE       = 10000
+)
+
+func init() {
+	registerEngine(LEVELDB_NAME, NewLevelDbInitializer)
+}
+
+type LevelDB struct {
+	db    *levigo.DB
+	path  string
+	ro    *levigo.ReadOptions
+	wo    *levigo.WriteOptions
+	delRo *levigo.ReadOptions
+}
+
+// The options (including the LRU cache) are shared by all the shards
+func NewLevelDbInitializer(config *configuration.Configuration) (Opener, error) {
+	opts := levigo.NewOptions()
+	opts.SetCache(levigo.NewLRUCache(config.LevelDbLruCacheSize))
+	opts.SetCreateIfMissing(true)
+	opts.SetBlockSize(64 * ONE_KILOBYTE)
+	filter := levigo.NewBloomFilter(SHARD_BLOOM_FILTER_BITS_PER_KEY)
+	opts.SetFilterPolicy(filter)
+	opts.SetMaxOpenFiles(config.LevelDbMaxOpenFiles)
+
+	return func(path string) (Engine, error) {
+		return NewLevelDB(path, opts)
+	}, nil
+}
+
+func NewLevelDB(path string, opts *levigo.Options) (*LevelDB, error) {
+	db, err := levigo.Open(path, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// don't fill the cache with the keys we're about to delete
+	delRo := levigo.NewReadOptions()
+	delRo.SetFillCache(false)
+
+	return &LevelDB{
+		db:    db,
+		path:  path,
+		ro:    levigo.NewReadOptions(),
+		wo:    levigo.NewWriteOptions(),
+		delRo: delRo,
+	}, nil
+}
+
+func (self *LevelDB) Name() string {
+	return LEVELDB_NAME
+}
+
+func (self *LevelDB) Path() string {
+	return self.path
+}
+
+func (self *LevelDB) Get(key []byte) ([]byte, error) {
+	return self.db.Get(self.ro, key)
+}
+
+func (self *LevelDB) Put(key, value []byte) error {
+	return self.db.Put(self.wo, key, value)
+}
+
+func (self *LevelDB) BatchPut(writes []Write) error {
+	wb := levigo.NewWriteBatch()
+	defer wb.Close()
+	for _, w := range writes {
+		if w.Value == nil {
+			wb.Delete(w.Key)
+			continue
+		}
+		wb.Put(w.Key, w.Value)
+	}
+	return self.db.Write(self.wo, wb)
+}
+
+func (self *LevelDB) Del(first, last []byte) error {
+	it := self.db.NewIterator(self.delRo)
+	defer it.Close()
+
+	wb := levigo.NewWriteBatch()
+	defer wb.Close()
+
+	count := 0
+	for it.Seek(first); it.Valid(); it.Next() {
+		key := it.Key()
+		if bytes.Compare(key, last) > 0 {
+			break
+		}
+		wb.Delete(key)
+		count++
+		if count >= LEVELDB_DELETE_BATCH_SIZE {
+			if err := self.db.Write(self.wo, wb); err != nil {
+				return err
+			}
+			wb.Clear()
+			count = 0
+		}
+	}
+	if err := it.GetError(); err != nil {
+		return err
+	}
+	return self.db.Write(self.wo, wb)
+}
+
+func (self *LevelDB) Iterator() Iterator {
+	return &LevelDbIterator{self.db.NewIterator(self.ro)}
+}
+
+func (self *LevelDB) Compact() {
+	self.db.CompactRange(levigo.Range{})
+}
+
+func (self *LevelDB) CompactRange(first, last []byte) {
+	self.db.CompactRange(levigo.Range{Start: first, Limit: last})
+}
+
+// LevelDB doesn't keep track of the number of keys, they're counted with
+// an iterator that doesn't fill the cache
+func (self *LevelDB) Stats() Stats {
+	sizes := self.db.GetApproximateSizes([]levigo.Range{{Start: nil, Limit: []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}}})
+	size := int64(sizes[0])
+
+	it := self.db.NewIterator(self.delRo)
+	defer it.Close()
+	keys := int64(0)
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		keys++
+	}
+
+	return Stats{
+		Size: size,
+		Keys: keys,
+		Info: self.db.PropertyValue("leveldb.stats"),
+	}
+}
+
+func (self *LevelDB) Close() {
+	self.ro.Close()
+	self.wo.Close()
+	self.delRo.Close()
+	self.db.Close()
+}
+
+type LevelDbIterator struct {
+	*levigo.Iterator
+}
+
+func (self *LevelDbIterator) Error() error {
+	return self.GetError()
+}
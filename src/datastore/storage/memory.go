@@ -0,0 +1,220 @@
+package storage
+
+import (
+	"bytes"
+	"configuration"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+const MEMORY_NAME = "memory"
+
+func init() {
+	registerEngine(MEMORY_NAME, NewMemoryInitializer)
+}
+
+// A pure go engine that keeps the data in memory, the data is lost when
+// the engine is closed. Useful for tests and nodes that don't need to
+// persist data (e.g. when the data is replicated on other nodes).
+//
+// The keys are kept in a sorted slice that's never modified in place,
+// writes create a new slice. This makes writes O(n) but iterators can
+// use the slice they were created with as a snapshot without locking.
+type Memory struct {
+	path    string
+	lock    sync.RWMutex
+	entries []memoryEntry
+	closed  bool
+}
+
+type memoryEntry struct {
+	key   []byte
+	value []byte
+}
+
+func NewMemoryInitializer(config *configuration.Configuration) (Opener, error) {
+	return func(path string) (Engine, error) {
+		return NewMemory(path), nil
+	}, nil
+}
+
+func NewMemory(path string) *Memory {
+	return &Memory{path: path}
+}
+
+func (self *Memory) Name() string {
+	return MEMORY_NAME
+}
+
+func (self *Memory) Path() string {
+	return self.path
+}
+
+// returns the index of the first entry with a key >= key
+func searchEntries(entries []memoryEntry, key []byte) int {
+	return sort.Search(len(entries), func(i int) bool {
+		return bytes.Compare(entries[i].key, key) >= 0
+	})
+}
+
+func copyBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	c := make([]byte, len(b))
+	copy(c, b)
+	return c
+}
+
+func (self *Memory) Get(key []byte) ([]byte, error) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	if self.closed {
+		return nil, fmt.Errorf("Storage engine %s is closed", self.path)
+	}
+	idx := searchEntries(self.entries, key)
+	if idx < len(self.entries) && bytes.Equal(self.entries[idx].key, key) {
+		return copyBytes(self.entries[idx].value), nil
+	}
+	return nil, nil
+}
+
+func (self *Memory) Put(key, value []byte) error {
+	return self.BatchPut([]Write{{key, value}})
+}
+
+type writesByKey []Write
+
+func (self writesByKey) Len() int           { return len(self) }
+func (self writesByKey) Less(i, j int) bool { return bytes.Compare(self[i].Key, self[j].Key) < 0 }
+func (self writesByKey) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+
+func (self *Memory) BatchPut(writes []Write) error {
+	sorted := make([]Write, len(writes))
+	copy(sorted, writes)
+	// stable, if a key is written twice the last write wins
+	sort.Stable(writesByKey(sorted))
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.closed {
+		return fmt.Errorf("Storage engine %s is closed", self.path)
+	}
+
+	// merge the sorted writes with the existing entries
+	entries := make([]memoryEntry, 0, len(self.entries)+len(sorted))
+	i := 0
+	for j := 0; j < len(sorted); j++ {
+		w := sorted[j]
+		if j+1 < len(sorted) && bytes.Equal(w.Key, sorted[j+1].Key) {
+			continue
+		}
+		for i < len(self.entries) && bytes.Compare(self.entries[i].key, w.Key) < 0 {
+			entries = append(entries, self.entries[i])
+			i++
+		}
+		if i < len(self.entries) && bytes.Equal(self.entries[i].key, w.Key) {
+			i++
+		}
+		if w.Value != nil {
+			entries = append(entries, memoryEntry{copyBytes(w.Key), copyBytes(w.Value)})
+		}
+	}
+	entries = append(entries, self.entries[i:]...)
+	self.entries = entries
+	return nil
+}
+
+func (self *Memory) Del(first, last []byte) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.closed {
+		return fmt.Errorf("Storage engine %s is closed", self.path)
+	}
+	start := searchEntries(self.entries, first)
+	end := start
+	for end < len(self.entries) && bytes.Compare(self.entries[end].key, last) <= 0 {
+		end++
+	}
+	if start == end {
+		return nil
+	}
+	entries := make([]memoryEntry, 0, len(self.entries)-(end-start))
+	entries = append(entries, self.entries[:start]...)
+	entries = append(entries, self.entries[end:]...)
+	self.entries = entries
+	return nil
+}
+
+func (self *Memory) Iterator() Iterator {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return &MemoryIterator{entries: self.entries, idx: -1}
+}
+
+func (self *Memory) Compact() {}
+
+func (self *Memory) CompactRange(first, last []byte) {}
+
+func (self *Memory) Stats() Stats {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	size := int64(0)
+	for _, entry := range self.entries {
+		size += int64(len(entry.key) + len(entry.value))
+	}
+	return Stats{Size: size, Keys: int64(len(self.entries)), Info: fmt.Sprintf("%d keys", len(self.entries))}
+}
+
+func (self *Memory) Close() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.closed = true
+	self.entries = nil
+}
+
+// Iterates over a snapshot of the entries taken when the iterator was
+// created
+type MemoryIterator struct {
+	entries []memoryEntry
+	idx     int
+}
+
+func (self *MemoryIterator) Seek(key []byte) {
+	self.idx = searchEntries(self.entries, key)
+}
+
+func (self *MemoryIterator) SeekToFirst() {
+	self.idx = 0
+}
+
+func (self *MemoryIterator) SeekToLast() {
+	self.idx = len(self.entries) - 1
+}
+
+func (self *MemoryIterator) Next() {
+	self.idx++
+}
+
+func (self *MemoryIterator) Prev() {
+	self.idx--
+}
+
+func (self *MemoryIterator) Valid() bool {
+	return self.idx >= 0 && self.idx < len(self.entries)
+}
+
+func (self *MemoryIterator) Key() []byte {
+	return copyBytes(self.entries[self.idx].key)
+}
+
+func (self *MemoryIterator) Value() []byte {
+	return copyBytes(self.entries[self.idx].value)
+}
+
+func (self *MemoryIterator) Error() error {
+	return nil
+}
+
+func (self *MemoryIterator) Close() {}
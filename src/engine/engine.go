@@ -40,12 +40,18 @@ type QueryEngine struct {
 	aggregateYield func(*protocol.Series) error
 
 	// variables for aggregate queries
-	aggregators  []Aggregator
-	elems        []*parser.Value // group by columns other than time()
-	duration     *time.Duration  // the time by duration if any
-	seriesStates map[string]*SeriesState
-
-	// query statistics
+	aggregators           []Aggregator
+	elems                 []*parser.Value // group by columns other than time()
+	duration              *time.Duration  // the time by duration if any
+	seriesStates          map[string]*SeriesState
+	maxGroupByCardinality int // the maximum number of groups per series, 0 for no limit
+
+	// the first error that stopped the query, it's sent back with the
+	// end of stream response
+	err error
+
+	// query statistics, sent for explain queries and if the slow query
+	// log is enabled
 	explain       bool
 	runStartTime  float64
 	runEndTime    float64
@@ -80,7 +86,8 @@ func (self *QueryEngine) distributeQuery(query *parser.SelectQuery, yield func(*
 	return nil
 }
 
-func NewQueryEngine(query *parser.SelectQuery, responseChan chan *protocol.Response) (*QueryEngine, error) {
+func NewQueryEngine(querySpec *parser.QuerySpec, responseChan chan *protocol.Response) (*QueryEngine, error) {
+	query := querySpec.SelectQuery()
 	limit := query.Limit
 
 	queryEngine := &QueryEngine{
@@ -90,15 +97,16 @@ func NewQueryEngine(query *parser.SelectQuery, responseChan chan *protocol.Respo
 		responseChan:   responseChan,
 		seriesToPoints: make(map[string]*protocol.Series),
 		// stats stuff
-		explain:       query.IsExplainQuery(),
-		runStartTime:  0,
-		runEndTime:    0,
-		pointsRead:    0,
-		pointsWritten: 0,
-		shardId:       0,
-		shardLocal:    false, //that really doesn't matter if it is not EXPLAIN query
-		duration:      nil,
-		seriesStates:  make(map[string]*SeriesState),
+		explain:               querySpec.CollectStats(),
+		runStartTime:          0,
+		runEndTime:            0,
+		pointsRead:            0,
+		pointsWritten:         0,
+		shardId:               0,
+		shardLocal:            false, //that really doesn't matter if it is not EXPLAIN query
+		duration:              nil,
+		seriesStates:          make(map[string]*SeriesState),
+		maxGroupByCardinality: querySpec.Limits().MaxGroupByCardinality,
 	}
 
 	if queryEngine.explain {
@@ -176,6 +184,9 @@ func (self *QueryEngine) yieldSeriesData(series *protocol.Series) bool {
 	err := self.yield(series)
 	if err != nil {
 		log.Error(err)
+		if self.err == nil {
+			self.err = err
+		}
 		return false
 	}
 	return true
@@ -212,6 +223,9 @@ func (self *QueryEngine) Close() {
 		self.SendQueryStats()
 	}
 	response := &protocol.Response{Type: &endStreamResponse}
+	if self.err != nil {
+		err = self.err
+	}
 	if err != nil {
 		message := err.Error()
 		response.ErrorMessage = &message
@@ -454,6 +468,9 @@ func (self *QueryEngine) aggregateValuesForSeries(series *protocol.Series) error
 
 		// update the state of the given group
 		node := seriesState.trie.GetNode(group)
+		if self.maxGroupByCardinality > 0 && seriesState.trie.NumberOfGroups() > self.maxGroupByCardinality {
+			return common.NewQueryError(common.QueryLimitExceeded, "Group by on %s exceeded the limit of %d groups", series.GetName(), self.maxGroupByCardinality)
+		}
 		var err error
 		for idx, aggregator := range self.aggregators {
 			node.states[idx], err = aggregator.AggregatePoint(node.states[idx], point)
@@ -16,6 +16,7 @@ import (
 type Trie struct {
 	numLevels int
 	numStates int
+	numGroups int // the number of leaf nodes created by GetNode since the last Clear
 	rootNode  *Node
 }
 
@@ -31,13 +32,20 @@ type Node struct {
 }
 
 func NewTrie(numLevels, numStates int) *Trie {
-	trie := &Trie{numLevels, numStates, nil}
+	trie := &Trie{numLevels, numStates, 0, nil}
 	trie.Clear()
 	return trie
 }
 
 func (self *Trie) Clear() {
 	self.rootNode = &Node{true, nil, make([]interface{}, self.numStates), nil}
+	self.numGroups = 0
+}
+
+// Returns the number of groups in the trie, unlike CountLeafNodes this
+// doesn't traverse the trie
+func (self *Trie) NumberOfGroups() int {
+	return self.numGroups
 }
 
 func (self *Trie) CountLeafNodes() int {
@@ -74,7 +82,12 @@ func (self *Trie) GetNode(values []*protocol.FieldValue) *Node {
 		if self.numLevels-idx-1 > 0 {
 			node = node.findOrCreateNode(v, 0)
 		} else {
-			node = node.findOrCreateNode(v, self.numStates)
+			parent := node
+			childCount := len(parent.childNodes)
+			node = parent.findOrCreateNode(v, self.numStates)
+			if len(parent.childNodes) > childCount {
+				self.numGroups++
+			}
 		}
 	}
 
@@ -48,6 +48,7 @@ func (self *TrieTestSuite) TestTrie(c *C) {
 		return nil
 	}), IsNil)
 	c.Assert(nodes, Equals, trie.CountLeafNodes())
+	c.Assert(trie.NumberOfGroups(), Equals, 3)
 
 	// make sure TraverseLevel work as expected
 	ns := []*Node{}
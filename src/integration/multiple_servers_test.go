@@ -1055,6 +1055,147 @@ func (self *ServerSuite) TestDropShard(c *C) {
 	c.Assert(exists, Equals, false)
 }
 
+func (self *ServerSuite) TestCopyShardToAnotherServer(c *C) {
+	// put this far in the future so it doesn't mess up the other tests
+	secondsOffset := int64(86400 * 1080)
+	startSeconds := time.Now().Unix() + secondsOffset
+	endSeconds := startSeconds + 3600
+	data := fmt.Sprintf(`{
+		"startTime":%d,
+		"endTime":%d,
+		"longTerm": false,
+		"shards": [{
+			"serverIds": [%d, %d]
+		}]
+	}`, startSeconds, endSeconds, 1, 2)
+	resp := self.serverProcesses[0].Post("/cluster/shards?u=root&p=root", data, c)
+	c.Assert(resp.StatusCode, Equals, http.StatusAccepted)
+
+	t := (time.Now().Unix() + secondsOffset) * 1000
+	data = fmt.Sprintf(`[{"points": [[2, %d]], "name": "test_copy_shard", "columns": ["value", "time"]}]`, t)
+	resp = self.serverProcesses[0].Post("/db/test_rep/series?u=paul&p=pass", data, c)
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	for _, s := range self.serverProcesses {
+		s.WaitForServerToSync()
+	}
+
+	body := self.serverProcesses[0].Get("/cluster/shards?u=root&p=root", c)
+	res := make(map[string]interface{})
+	c.Assert(json.Unmarshal(body, &res), IsNil)
+	var shardId int
+	for _, s := range res["shortTerm"].([]interface{}) {
+		sh := s.(map[string]interface{})
+		if sh["startTime"].(float64) == float64(startSeconds) && sh["endTime"].(float64) == float64(endSeconds) {
+			shardId = int(sh["id"].(float64))
+			break
+		}
+	}
+
+	// server 3 isn't one of the servers of the shard until the copy is done
+	body = self.serverProcesses[0].PostGetBody(fmt.Sprintf("/cluster/shards/%d/copy?u=root&p=root&from=1&to=3", shardId), "", c)
+	job := map[string]interface{}{}
+	c.Assert(json.Unmarshal(body, &job), IsNil)
+	jobId := int(job["id"].(float64))
+	for i := 0; i < 100 && job["done"] != true; i++ {
+		time.Sleep(100 * time.Millisecond)
+		body = self.serverProcesses[0].Get(fmt.Sprintf("/cluster/shard_jobs/%d?u=root&p=root", jobId), c)
+		c.Assert(json.Unmarshal(body, &job), IsNil)
+	}
+	c.Assert(job["done"], Equals, true)
+	c.Assert(job["error"], IsNil)
+	c.Assert(job["pointsCopied"], Equals, 1.0)
+	for _, s := range self.serverProcesses {
+		s.WaitForServerToSync()
+	}
+
+	exists, _ := dirExists(fmt.Sprintf("/tmp/influxdb/test/3/db/shard_db/%.5d", shardId))
+	c.Assert(exists, Equals, true)
+	body = self.serverProcesses[2].Get("/cluster/shards?u=root&p=root", c)
+	c.Assert(json.Unmarshal(body, &res), IsNil)
+	for _, s := range res["shortTerm"].([]interface{}) {
+		sh := s.(map[string]interface{})
+		if int(sh["id"].(float64)) == shardId {
+			c.Assert(sh["serverIds"], DeepEquals, []interface{}{1.0, 2.0, 3.0})
+		}
+	}
+}
+
+// returns the stats of the shard on every server from
+// GET /cluster/shards/:id/stats
+func (self *ServerSuite) getShardStats(shardId int, c *C) []interface{} {
+	body := self.serverProcesses[0].Get(fmt.Sprintf("/cluster/shards/%d/stats?u=root&p=root", shardId), c)
+	stats := []interface{}{}
+	err := json.Unmarshal(body, &stats)
+	c.Assert(err, IsNil)
+	return stats
+}
+
+func (self *ServerSuite) TestShardStatsAndCompaction(c *C) {
+	// put this far in the future so it doesn't mess up the other tests
+	secondsOffset := int64(86400 * 900)
+	startSeconds := time.Now().Unix() + secondsOffset
+	endSeconds := startSeconds + 3600
+	data := fmt.Sprintf(`{
+		"startTime":%d,
+		"endTime":%d,
+		"longTerm": false,
+		"shards": [{
+			"serverIds": [%d, %d]
+		}]
+	}`, startSeconds, endSeconds, 1, 2)
+	resp := self.serverProcesses[0].Post("/cluster/shards?u=root&p=root", data, c)
+	c.Assert(resp.StatusCode, Equals, http.StatusAccepted)
+
+	t := (time.Now().Unix() + secondsOffset) * 1000
+	data = fmt.Sprintf(`[{"points": [[2, %d]], "name": "test_shard_stats", "columns": ["value", "time"]}]`, t)
+	resp = self.serverProcesses[0].Post("/db/test_rep/series?u=paul&p=pass", data, c)
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	for _, s := range self.serverProcesses {
+		s.WaitForServerToSync()
+	}
+
+	body := self.serverProcesses[0].Get("/cluster/shards?u=root&p=root", c)
+	res := make(map[string]interface{})
+	c.Assert(json.Unmarshal(body, &res), IsNil)
+	var shardId int
+	for _, s := range res["shortTerm"].([]interface{}) {
+		sh := s.(map[string]interface{})
+		if sh["startTime"].(float64) == float64(startSeconds) && sh["endTime"].(float64) == float64(endSeconds) {
+			shardId = int(sh["id"].(float64))
+			// the stats are only returned with stats=true
+			c.Assert(sh["stats"], IsNil)
+			break
+		}
+	}
+
+	stats := self.getShardStats(shardId, c)
+	c.Assert(stats, HasLen, 2)
+	for _, s := range stats {
+		st := s.(map[string]interface{})
+		c.Assert(st["error"], IsNil)
+		c.Assert(st["series"], Equals, 1.0)
+		c.Assert(st["keys"].(float64) > 0, Equals, true)
+	}
+
+	resp = self.serverProcesses[0].Post(fmt.Sprintf("/cluster/shards/%d/compact?u=root&p=root", shardId), "", c)
+	c.Assert(resp.StatusCode, Equals, http.StatusAccepted)
+	for i := 0; i < 50; i++ {
+		compacted := 0
+		for _, s := range self.getShardStats(shardId, c) {
+			st := s.(map[string]interface{})
+			if st["compacting"] == false && st["lastCompaction"].(float64) > 0 {
+				c.Assert(st["compactionProgress"], Equals, 1.0)
+				compacted++
+			}
+		}
+		if compacted == 2 {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	c.Fatal("The shard wasn't compacted")
+}
+
 func dirExists(path string) (bool, error) {
 	_, err := os.Stat(path)
 	if err == nil {
@@ -1215,3 +1356,50 @@ func (self *ServerSuite) TestShardIdUniquenessAfterReStart(c *C) {
 	}
 	c.Assert(len(shardIds) > 0, Equals, true)
 }
+
+func (self *ServerSuite) TestPerDatabaseReplicationFactor(c *C) {
+	for db, rf := range map[string]int{"rf_one": 1, "rf_three": 3} {
+		resp := self.serverProcesses[0].Post("/db?u=root&p=root", fmt.Sprintf(`{"name": "%s", "replicationFactor": %d}`, db, rf), c)
+		c.Assert(resp.StatusCode, Equals, http.StatusCreated)
+	}
+
+	body := self.serverProcesses[1].Get("/db?u=root&p=root", c)
+	dbs := []map[string]interface{}{}
+	c.Assert(json.Unmarshal(body, &dbs), IsNil)
+	replicationFactors := map[string]float64{}
+	for _, db := range dbs {
+		replicationFactors[db["name"].(string)] = db["replicationFactor"].(float64)
+	}
+	c.Assert(replicationFactors["rf_one"], Equals, 1.0)
+	c.Assert(replicationFactors["rf_three"], Equals, 3.0)
+	c.Assert(replicationFactors["test_rep"], Equals, 2.0)
+
+	// put this far in the future so it doesn't mess up the other tests
+	t := (time.Now().Unix() + 86400*1000) * 1000
+	for _, db := range []string{"rf_one", "rf_three"} {
+		data := fmt.Sprintf(`[{"points": [[1, %d]], "name": "test_rf", "columns": ["value", "time"]}]`, t)
+		resp := self.serverProcesses[0].Post(fmt.Sprintf("/db/%s/series?u=root&p=root", db), data, c)
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	}
+	for _, s := range self.serverProcesses {
+		s.WaitForServerToSync()
+	}
+
+	body = self.serverProcesses[0].Get("/cluster/shards?u=root&p=root", c)
+	res := make(map[string]interface{})
+	c.Assert(json.Unmarshal(body, &res), IsNil)
+	servers := map[float64]int{}
+	for _, s := range res["shortTerm"].([]interface{}) {
+		sh := s.(map[string]interface{})
+		if sh["startTime"].(float64)*1000 <= float64(t) && float64(t) < sh["endTime"].(float64)*1000 {
+			servers[sh["replicationFactor"].(float64)] = len(sh["serverIds"].([]interface{}))
+		}
+	}
+	c.Assert(servers, DeepEquals, map[float64]int{1: 1, 3: 3})
+
+	for _, db := range []string{"rf_one", "rf_three"} {
+		collection := self.serverProcesses[2].QueryWithUsername(db, "select * from test_rf", false, c, "root", "root")
+		series := collection.GetSeries("test_rf", c)
+		c.Assert(series.Points, HasLen, 1)
+	}
+}
@@ -45,6 +45,7 @@ type SelectQuery struct {
 	Limit         int
 	Ascending     bool
 	Explain       bool
+	ExplainPlan   bool
 }
 
 type ListType int
@@ -52,6 +53,7 @@ type ListType int
 const (
 	Series ListType = iota
 	ContinuousQueries
+	RunningQueries
 )
 
 type ListQuery struct {
@@ -62,6 +64,10 @@ type DropQuery struct {
 	Id int
 }
 
+type KillQuery struct {
+	Id uint64
+}
+
 type DropSeriesQuery struct {
 	tableName string
 }
@@ -81,6 +87,7 @@ type Query struct {
 	ListQuery       *ListQuery
 	DropSeriesQuery *DropSeriesQuery
 	DropQuery       *DropQuery
+	KillQuery       *KillQuery
 }
 
 func (self *IntoClause) GetString() string {
@@ -117,6 +124,10 @@ func (self *Query) IsExplainQuery() bool {
 	return self.SelectQuery != nil && self.SelectQuery.Explain
 }
 
+func (self *Query) IsExplainPlanQuery() bool {
+	return self.SelectQuery != nil && self.SelectQuery.ExplainPlan
+}
+
 func (self *Query) IsListSeriesQuery() bool {
 	return self.ListQuery != nil && self.ListQuery.Type == Series
 }
@@ -125,6 +136,10 @@ func (self *Query) IsListContinuousQueriesQuery() bool {
 	return self.ListQuery != nil && self.ListQuery.Type == ContinuousQueries
 }
 
+func (self *Query) IsListRunningQueriesQuery() bool {
+	return self.ListQuery != nil && self.ListQuery.Type == RunningQueries
+}
+
 func (self *DeleteQuery) GetQueryString(withTime bool) string {
 	buffer := bytes.NewBufferString("delete ")
 	fmt.Fprintf(buffer, "from %s", self.FromClause.GetString())
@@ -144,6 +159,10 @@ func (self *SelectQuery) IsExplainQuery() bool {
 	return self.Explain
 }
 
+func (self *SelectQuery) IsExplainPlanQuery() bool {
+	return self.ExplainPlan
+}
+
 func (self *SelectQuery) GetQueryString() string {
 	return self.commonGetQueryStringWithTimes(false, true, self.startTime, self.endTime)
 }
@@ -568,6 +587,10 @@ func ParseQuery(query string) ([]*Query, error) {
 		return []*Query{&Query{QueryString: query, ListQuery: &ListQuery{Type: ContinuousQueries}}}, nil
 	}
 
+	if q.list_running_queries_query != 0 {
+		return []*Query{&Query{QueryString: query, ListQuery: &ListQuery{Type: RunningQueries}}}, nil
+	}
+
 	if q.select_query != nil {
 		selectQuery, err := parseSelectQuery(q.select_query)
 		if err != nil {
@@ -589,6 +612,8 @@ func ParseQuery(query string) ([]*Query, error) {
 		return []*Query{&Query{QueryString: query, DropSeriesQuery: dropSeriesQuery}}, nil
 	} else if q.drop_query != nil {
 		return []*Query{&Query{QueryString: query, DropQuery: &DropQuery{Id: int(q.drop_query.id)}}}, nil
+	} else if q.kill_query != nil {
+		return []*Query{&Query{QueryString: query, KillQuery: &KillQuery{Id: uint64(q.kill_query.id)}}}, nil
 	}
 	return nil, fmt.Errorf("Unknown query type encountered")
 }
@@ -665,9 +690,10 @@ func parseSelectQuery(q *C.select_query) (*SelectQuery, error) {
 
 	goQuery := &SelectQuery{
 		SelectDeleteCommonQuery: basicQuery,
-		Limit:     int(limit),
-		Ascending: q.ascending != 0,
-		Explain:   q.explain != 0,
+		Limit:       int(limit),
+		Ascending:   q.ascending != 0,
+		Explain:     q.explain != 0,
+		ExplainPlan: q.explain_plan != 0,
 	}
 
 	// get the column names
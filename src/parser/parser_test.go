@@ -47,6 +47,16 @@ func (self *QueryParserSuite) TestExplainQueries(c *C) {
 	c.Assert(queries[0].SelectQuery.IsExplainQuery(), Equals, true)
 }
 
+func (self *QueryParserSuite) TestExplainPlanQueries(c *C) {
+	query := "explain plan select foo, bar from /baz.*/ group by time(1d)"
+	queries, err := ParseQuery(query)
+
+	c.Assert(err, IsNil)
+	c.Assert(queries, HasLen, 1)
+	c.Assert(queries[0].IsExplainPlanQuery(), Equals, true)
+	c.Assert(queries[0].IsExplainQuery(), Equals, false)
+}
+
 func (self *QueryParserSuite) TestParseBasicSelectQuery(c *C) {
 	for _, query := range []string{
 		"select value from t where c = '5';",
@@ -898,6 +908,30 @@ func (self *QueryParserSuite) TestParseContinuousQueryList(c *C) {
 	c.Assert(queries[0].IsListContinuousQueriesQuery(), Equals, true)
 }
 
+func (self *QueryParserSuite) TestParseRunningQueriesList(c *C) {
+	queries, err := ParseQuery("list queries;")
+	c.Assert(err, IsNil)
+	c.Assert(queries, HasLen, 1)
+	c.Assert(queries[0].IsListQuery(), Equals, true)
+	c.Assert(queries[0].IsListRunningQueriesQuery(), Equals, true)
+	c.Assert(queries[0].IsListContinuousQueriesQuery(), Equals, false)
+}
+
+func (self *QueryParserSuite) TestQueriesIsNotAKeyword(c *C) {
+	q, err := ParseSelectQuery("select queries from queries;")
+	c.Assert(err, IsNil)
+	c.Assert(q.GetFromClause().Names[0].Name.Name, Equals, "queries")
+	c.Assert(q.GetColumnNames(), DeepEquals, ToValueArray("queries"))
+}
+
+func (self *QueryParserSuite) TestParseKillQuery(c *C) {
+	queries, err := ParseQuery("kill query 120001;")
+	c.Assert(err, IsNil)
+	c.Assert(queries, HasLen, 1)
+	c.Assert(queries[0].KillQuery, NotNil)
+	c.Assert(queries[0].KillQuery.Id, Equals, uint64(120001))
+}
+
 // For issue #466 - allow all characters in column names - https://github.com/influxdb/influxdb/issues/267
 func (self *QueryParserSuite) TestParseColumnWithPeriodOrDash(c *C) {
 	query := "select count(\"column-a.foo\") as \"count-column-a.foo\" from seriesA;"
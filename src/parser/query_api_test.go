@@ -1,6 +1,7 @@
 package parser
 
 import (
+	"common"
 	"math"
 	"time"
 	. "launchpad.net/gocheck"
@@ -252,3 +253,19 @@ func (self *QueryApiSuite) TestAliasing(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(query.GetTableAliases("user.events"), DeepEquals, []string{"user.events"})
 }
+
+func (self *QueryApiSuite) TestSharedPointsScannedLimit(c *C) {
+	query, err := ParseQuery("select * from t")
+	c.Assert(err, IsNil)
+	limits := &common.QueryLimits{MaxPointsScanned: 3}
+	first := NewQuerySpec(nil, "db", query[0])
+	first.SetLimits(limits)
+	second := NewQuerySpec(nil, "db", query[0])
+	second.SetLimits(limits)
+	second.SharePointsScanned(first)
+
+	c.Assert(first.ScanPoint(), IsNil)
+	c.Assert(first.ScanPoint(), IsNil)
+	c.Assert(second.ScanPoint(), IsNil)
+	c.Assert(second.ScanPoint(), NotNil)
+}
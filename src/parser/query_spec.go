@@ -2,6 +2,7 @@ package parser
 
 import (
 	"common"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,10 +18,68 @@ type QuerySpec struct {
 	RunAgainstAllServersInShard bool
 	groupByInterval             *time.Duration
 	groupByColumnCount          int
+	queryId                     uint64
+	killed                      int32
+	limits                      *common.QueryLimits
+	pointsScanned               *int64
+	collectStats                bool
 }
 
+var noQueryLimits = &common.QueryLimits{}
+
 func NewQuerySpec(user common.User, database string, query *Query) *QuerySpec {
-	return &QuerySpec{user: user, query: query, database: database}
+	return &QuerySpec{user: user, query: query, database: database, pointsScanned: new(int64)}
+}
+
+// the id the coordinator assigned to the running query, remote
+// servers use it to find the query if it gets killed
+func (self *QuerySpec) QueryId() uint64 {
+	return self.queryId
+}
+
+func (self *QuerySpec) SetQueryId(id uint64) {
+	self.queryId = id
+}
+
+// Kill marks the query as killed, shards check this flag while
+// scanning and stop yielding points once it's set
+func (self *QuerySpec) Kill() {
+	atomic.StoreInt32(&self.killed, 1)
+}
+
+func (self *QuerySpec) IsKilled() bool {
+	return atomic.LoadInt32(&self.killed) == 1
+}
+
+// Returns the resource limits of this query, a zero limit means
+// there's no limit
+func (self *QuerySpec) Limits() *common.QueryLimits {
+	if self.limits == nil {
+		return noQueryLimits
+	}
+	return self.limits
+}
+
+func (self *QuerySpec) SetLimits(limits *common.QueryLimits) {
+	self.limits = limits
+}
+
+// Counts the points scanned together with the other query spec. A remote
+// server gets a query spec for every shard of a query, they share the
+// count so the limit is per query and server like on the coordinator.
+func (self *QuerySpec) SharePointsScanned(other *QuerySpec) {
+	self.pointsScanned = other.pointsScanned
+}
+
+// Called by the shards for every point they read. Returns an error if
+// the query read more points than it's allowed to. The same query
+// spec is used by all the local shards, hence the atomic counter.
+func (self *QuerySpec) ScanPoint() error {
+	scanned := atomic.AddInt64(self.pointsScanned, 1)
+	if max := self.Limits().MaxPointsScanned; max > 0 && scanned > max {
+		return common.NewQueryError(common.QueryLimitExceeded, "Query exceeded the limit of %d points scanned", max)
+	}
+	return nil
 }
 
 func (self *QuerySpec) AllShardsQuery() bool {
@@ -141,6 +200,16 @@ func (self *QuerySpec) IsExplainQuery() bool {
 	return false
 }
 
+// Makes the query engines send the explain query stats even if the
+// query isn't an explain query
+func (self *QuerySpec) SetCollectStats(collectStats bool) {
+	self.collectStats = collectStats
+}
+
+func (self *QuerySpec) CollectStats() bool {
+	return self.collectStats || self.IsExplainQuery()
+}
+
 func (self *QuerySpec) SelectQuery() *SelectQuery {
 	return self.query.SelectQuery
 }
@@ -92,6 +92,7 @@ typedef struct {
   int limit;
   char ascending;
   char explain;
+  char explain_plan;
 } select_query;
 
 typedef struct {
@@ -108,13 +109,19 @@ typedef struct {
   int id;
 } drop_query;
 
+typedef struct {
+  unsigned long long id;
+} kill_query;
+
 typedef struct {
   select_query *select_query;
   delete_query *delete_query;
   drop_series_query *drop_series_query;
   drop_query *drop_query;
+  kill_query *kill_query;
   char list_series_query;
   char list_continuous_queries_query;
+  char list_running_queries_query;
   error *error;
 } query;
 
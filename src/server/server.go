@@ -38,8 +38,17 @@ func NewServer(config *configuration.Configuration) (*Server, error) {
 		return nil, err
 	}
 
+	raftTlsConfig, err := config.RaftTlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	protobufTlsConfig, err := config.ProtobufTlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
 	newClient := func(connectString string) cluster.ServerConnection {
-		return coordinator.NewProtobufClient(connectString, config.ProtobufTimeout.Duration)
+		return coordinator.NewProtobufClient(connectString, config.ProtobufTimeout.Duration, protobufTlsConfig)
 	}
 	writeLog, err := wal.NewWAL(config)
 	if err != nil {
@@ -47,14 +56,15 @@ func NewServer(config *configuration.Configuration) (*Server, error) {
 	}
 
 	clusterConfig := cluster.NewClusterConfiguration(config, writeLog, shardDb, newClient)
-	raftServer := coordinator.NewRaftServer(config, clusterConfig)
+	writeLog.SetServers(clusterConfig.ServerIds, clusterConfig.IsServerUp)
+	raftServer := coordinator.NewRaftServer(config, clusterConfig, raftTlsConfig)
 	clusterConfig.LocalRaftName = raftServer.GetRaftName()
 	clusterConfig.SetShardCreator(raftServer)
 	clusterConfig.CreateFutureShardsAutomaticallyBeforeTimeComes()
 
 	coord := coordinator.NewCoordinatorImpl(config, raftServer, clusterConfig)
 	requestHandler := coordinator.NewProtobufRequestHandler(coord, clusterConfig)
-	protobufServer := coordinator.NewProtobufServer(config.ProtobufListenString(), requestHandler)
+	protobufServer := coordinator.NewProtobufServer(config.ProtobufListenString(), requestHandler, protobufTlsConfig)
 
 	raftServer.AssignCoordinator(coord)
 	httpApi := http.NewHttpServer(config.ApiHttpPortString(), config.ApiReadTimeout, config.AdminAssetsDir, coord, coord, clusterConfig, raftServer)
@@ -150,6 +160,11 @@ func (self *Server) ListenAndServe() error {
 	// start processing continuous queries
 	self.RaftServer.StartProcessingContinuousQueries()
 
+	if self.Config.AntiEntropyInterval > 0 {
+		log.Info("Comparing the replicas of the shards every %s", self.Config.AntiEntropyInterval)
+		go self.ClusterConfig.RepairShardsPeriodically(self.Config.AntiEntropyInterval)
+	}
+
 	log.Info("Starting Http Api server on port %d", self.Config.ApiHttpPort)
 	self.HttpApi.ListenAndServe()
 
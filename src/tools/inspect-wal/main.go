@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"wal"
+)
+
+const usage = `Usage:
+  go run tools/inspect-wal/main.go list -path <wal dir>
+  go run tools/inspect-wal/main.go dump -path <wal dir> [-file <suffix>]
+  go run tools/inspect-wal/main.go check -path <wal dir>
+  go run tools/inspect-wal/main.go repair -path <wal dir>
+  go run tools/inspect-wal/main.go rebuild-bookmark -path <wal dir> -server-id <id>
+
+The server has to be stopped before repair and rebuild-bookmark are run.`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(1)
+	}
+
+	command, args := os.Args[1], os.Args[2:]
+	flagSet := flag.NewFlagSet(command, flag.ExitOnError)
+	path := flagSet.String("path", "", "Path to the wal directory")
+	suffix := flagSet.Int("file", -1, "The suffix of the log file to dump, dumps all the log files by default")
+	serverId := flagSet.Int("server-id", 0, "The id of the server the wal belongs to")
+	flagSet.Parse(args)
+
+	if *path == "" {
+		fmt.Fprintln(os.Stderr, "Path must be set to a value. Run with -h for more info")
+		os.Exit(1)
+	}
+
+	var err error
+	switch command {
+	case "list":
+		var files []*wal.LogFileInfo
+		if files, err = wal.ListLogFiles(*path); err == nil {
+			err = printJson(files)
+		}
+	case "dump":
+		// one request per line so big logs can be piped
+		encoder := json.NewEncoder(os.Stdout)
+		err = wal.ReadRequests(*path, *suffix, func(request *wal.RequestInfo) error {
+			return encoder.Encode(request)
+		})
+	case "check":
+		var problems []*wal.IndexProblem
+		if problems, err = wal.CheckIndexes(*path); err == nil {
+			err = printJson(problems)
+			if err == nil && len(problems) > 0 {
+				os.Exit(2)
+			}
+		}
+	case "repair":
+		var truncated map[string]int64
+		if truncated, err = wal.RepairLogFiles(*path); err == nil {
+			for name, size := range truncated {
+				fmt.Printf("Truncated %d bytes from %s\n", size, name)
+			}
+		}
+	case "rebuild-bookmark":
+		if *serverId <= 0 {
+			fmt.Fprintln(os.Stderr, "The server id must be set to rebuild the bookmark")
+			os.Exit(1)
+		}
+		var state *wal.GlobalState
+		if state, err = wal.RebuildGlobalState(*path, uint32(*serverId)); err == nil {
+			fmt.Printf("Rebuilt the bookmark, largest request number: %d, first log file: %d, current log file: %d at offset %d, shards: %d\n",
+				state.LargestRequestNumber, state.FirstSuffix, state.CurrentFileSuffix, state.CurrentFileOffset, len(state.ShardLastSequenceNumber))
+		}
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(1)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func printJson(v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"configuration"
+	"datastore"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// Rewrites the local shards with another storage engine or point block
+// size. The server has to be stopped, use the
+// /cluster/shards/:id/migrate endpoint to migrate the shards of a
+// running server.
+func main() {
+	configFile := flag.String("config", "config.toml", "Path to the configuration file of the server")
+	engine := flag.String("engine", "", "The storage engine to migrate the shards to, defaults to the configured engine")
+	pointBlockSize := flag.Int("point-block-size", -1, "The number of points in a block, defaults to the configured size")
+	shardId := flag.Int("shard", -1, "The id of the shard to migrate, migrates all the local shards by default")
+	flag.Parse()
+
+	config := configuration.LoadConfiguration(*configFile)
+	if *engine == "" {
+		*engine = config.StorageEngine
+	}
+	if *engine == "" {
+		*engine = datastore.DEFAULT_ENGINE
+	}
+	if *pointBlockSize < 0 {
+		*pointBlockSize = config.StoragePointBlockSize
+	}
+
+	store, err := datastore.NewLevelDbShardDatastore(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot open the datastore: %s\n", err)
+		os.Exit(1)
+	}
+	defer store.Close()
+
+	ids := []uint32{uint32(*shardId)}
+	if *shardId < 0 {
+		ids, err = store.LocalShardIds()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot list the shards: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	for _, id := range ids {
+		fmt.Printf("Migrating shard %d to %s with point blocks of %d\n", id, *engine, *pointBlockSize)
+		migration, err := store.MigrateShard(id, *engine, *pointBlockSize)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot migrate shard %d: %s\n", id, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Migrated %d series, %d columns and %d points\n", migration.Series, migration.Columns, migration.Points)
+	}
+}
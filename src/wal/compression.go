@@ -0,0 +1,41 @@
+package wal
+
+import (
+	"configuration"
+	"fmt"
+	"protocol"
+
+	"github.com/golang/snappy"
+)
+
+// Encodes the request and compresses it with the compression of the
+// config. Returns the bytes and the compression that was used.
+func encodeRequest(request *protocol.Request, config *configuration.Configuration) ([]byte, uint32, error) {
+	bytes, err := request.Encode()
+	if err != nil {
+		return nil, 0, err
+	}
+	if config.WalCompression != configuration.WAL_COMPRESSION_SNAPPY {
+		return bytes, entryNotCompressed, nil
+	}
+	return snappy.Encode(nil, bytes), entrySnappyCompressed, nil
+}
+
+// Decompresses the body of the entry and decodes the request
+func decodeRequest(hdr *entryHeader, body []byte) (*protocol.Request, error) {
+	switch hdr.compression {
+	case entryNotCompressed:
+	case entrySnappyCompressed:
+		var err error
+		if body, err = snappy.Decode(nil, body); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("Unknown compression %d of request %d", hdr.compression, hdr.requestNumber)
+	}
+	request := &protocol.Request{}
+	if err := request.Decode(body); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
@@ -4,3 +4,8 @@ type confirmation struct {
 	requestNumber uint32
 	err           error
 }
+
+type unsyncedConfirmation struct {
+	confirmation  chan *confirmation
+	requestNumber uint32
+}
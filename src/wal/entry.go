@@ -25,3 +25,13 @@ type appendEntry struct {
 	request      *protocol.Request
 	shardId      uint32
 }
+
+type removeServerEntry struct {
+	confirmation chan *confirmation
+	serverId     uint32
+}
+
+type serverLagEntry struct {
+	serverIds []uint32
+	lags      chan map[uint32]uint32
+}
@@ -5,16 +5,34 @@ import (
 	"io"
 )
 
+// The compression of the entry is stored in the two highest bits of
+// the length, the entries that were written before compression was
+// added have them cleared
+const (
+	ENTRY_COMPRESSION_SHIFT = 30
+	ENTRY_LENGTH_MASK       = uint32(1)<<ENTRY_COMPRESSION_SHIFT - 1
+)
+
+// the size of the request number, the shard id and the length
+const ENTRY_HEADER_SIZE = 12
+
+const (
+	entryNotCompressed uint32 = iota
+	entrySnappyCompressed
+)
+
 type entryHeader struct {
 	requestNumber uint32
 	shardId       uint32
 	length        uint32
+	compression   uint32
 }
 
 func (self *entryHeader) Write(w io.Writer) (int, error) {
 	size := 0
 
-	for _, n := range []uint32{self.requestNumber, self.shardId, self.length} {
+	length := self.length | self.compression<<ENTRY_COMPRESSION_SHIFT
+	for _, n := range []uint32{self.requestNumber, self.shardId, length} {
 		if err := binary.Write(w, binary.BigEndian, n); err != nil {
 			return size, err
 		}
@@ -32,5 +50,7 @@ func (self *entryHeader) Read(r io.Reader) (int, error) {
 		}
 		size += 4
 	}
+	self.compression = self.length >> ENTRY_COMPRESSION_SHIFT
+	self.length &= ENTRY_LENGTH_MASK
 	return size, nil
 }
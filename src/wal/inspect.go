@@ -0,0 +1,399 @@
+package wal
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The functions in this file read the wal directory without opening
+// the WAL, they're used by the inspect-wal tool to look at and repair
+// the files of a server that doesn't start.
+
+// A log file and the request numbers in it
+type LogFileInfo struct {
+	Name               string `json:"name"`
+	Suffix             int    `json:"suffix"`
+	Size               int64  `json:"size"`
+	Requests           int    `json:"requests"`
+	FirstRequestNumber uint32 `json:"firstRequestNumber"`
+	LastRequestNumber  uint32 `json:"lastRequestNumber"`
+	// the number of bytes after the last complete request
+	TornBytes    int64 `json:"tornBytes"`
+	IndexEntries int   `json:"indexEntries"`
+}
+
+type SeriesInfo struct {
+	Name   string `json:"name"`
+	Points int    `json:"points"`
+}
+
+// A request in a log file
+type RequestInfo struct {
+	LogFile       string        `json:"logFile"`
+	Offset        int64         `json:"offset"`
+	RequestNumber uint32        `json:"requestNumber"`
+	ShardId       uint32        `json:"shardId"`
+	Type          string        `json:"type"`
+	Database      string        `json:"database"`
+	Compressed    bool          `json:"compressed"`
+	Series        []*SeriesInfo `json:"series"`
+}
+
+// An index entry that doesn't match the log file
+type IndexProblem struct {
+	IndexFile string `json:"indexFile"`
+	Entry     int    `json:"entry"`
+	Problem   string `json:"problem"`
+}
+
+// Returns the suffixes of the log files in the directory in order
+func logFileSuffixes(dir string) ([]int, error) {
+	names, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	suffixes := []int{}
+	for _, info := range names {
+		if !strings.HasPrefix(info.Name(), "log.") {
+			continue
+		}
+		suffix, err := strconv.Atoi(strings.TrimPrefix(info.Name(), "log."))
+		if err != nil {
+			continue
+		}
+		suffixes = append(suffixes, suffix)
+	}
+	sort.Ints(suffixes)
+	return suffixes, nil
+}
+
+func logFilePath(dir string, suffix int) string {
+	return path.Join(dir, fmt.Sprintf("log.%d", suffix))
+}
+
+func indexFilePath(dir string, suffix int) string {
+	return path.Join(dir, fmt.Sprintf("index.%d", suffix))
+}
+
+// Calls yield with the header, offset and body of every complete entry
+// of the log file, the body is nil unless readBody is set. Returns the
+// offset of the end of the last complete entry and the size of the
+// file. An entry is incomplete if the file ends before the entry does
+// or if its length is zero, the same way the WAL checks the log files.
+func scanLogFile(filePath string, readBody bool, yield func(hdr *entryHeader, offset int64, body []byte) error) (int64, int64, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	size := info.Size()
+
+	reader := bufio.NewReader(file)
+	offset := int64(0)
+	for {
+		hdr := &entryHeader{}
+		n, err := hdr.Read(reader)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return offset, size, nil
+		}
+		if err != nil {
+			return offset, size, err
+		}
+		end := offset + int64(n) + int64(hdr.length)
+		if hdr.length == 0 || end > size {
+			return offset, size, nil
+		}
+
+		var body []byte
+		if readBody {
+			body = make([]byte, hdr.length)
+			if _, err := io.ReadFull(reader, body); err != nil {
+				return offset, size, err
+			}
+		} else if _, err := io.CopyN(ioutil.Discard, reader, int64(hdr.length)); err != nil {
+			return offset, size, err
+		}
+		if err := yield(hdr, offset, body); err != nil {
+			return offset, size, err
+		}
+		offset = end
+	}
+}
+
+// Lists the log files in the directory with the range of request
+// numbers they have
+func ListLogFiles(dir string) ([]*LogFileInfo, error) {
+	suffixes, err := logFileSuffixes(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]*LogFileInfo, 0, len(suffixes))
+	for _, suffix := range suffixes {
+		filePath := logFilePath(dir, suffix)
+		info := &LogFileInfo{Name: path.Base(filePath), Suffix: suffix}
+		end, size, err := scanLogFile(filePath, false, func(hdr *entryHeader, offset int64, body []byte) error {
+			if info.Requests == 0 {
+				info.FirstRequestNumber = hdr.requestNumber
+			}
+			info.LastRequestNumber = hdr.requestNumber
+			info.Requests++
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		info.Size = size
+		info.TornBytes = size - end
+
+		if index, err := readIndexEntries(indexFilePath(dir, suffix)); err == nil {
+			info.IndexEntries = len(index)
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// Calls yield with every request in the log files of the directory. If
+// suffix isn't negative only the log file with the suffix is read.
+func ReadRequests(dir string, suffix int, yield func(*RequestInfo) error) error {
+	suffixes := []int{suffix}
+	if suffix < 0 {
+		var err error
+		if suffixes, err = logFileSuffixes(dir); err != nil {
+			return err
+		}
+	}
+
+	for _, suffix := range suffixes {
+		filePath := logFilePath(dir, suffix)
+		_, _, err := scanLogFile(filePath, true, func(hdr *entryHeader, offset int64, body []byte) error {
+			request, err := decodeRequest(hdr, body)
+			if err != nil {
+				return fmt.Errorf("Cannot decode request %d at offset %d of %s: %s", hdr.requestNumber, offset, filePath, err)
+			}
+			info := &RequestInfo{
+				LogFile:       path.Base(filePath),
+				Offset:        offset,
+				RequestNumber: hdr.requestNumber,
+				ShardId:       hdr.shardId,
+				Type:          request.GetType().String(),
+				Database:      request.GetDatabase(),
+				Compressed:    hdr.compression != entryNotCompressed,
+				Series:        []*SeriesInfo{},
+			}
+			for _, series := range request.MultiSeries {
+				info.Series = append(info.Series, &SeriesInfo{series.GetName(), len(series.Points)})
+			}
+			return yield(info)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reads the entries of the index file without creating it if it doesn't exist
+func readIndexEntries(filePath string) ([]*indexEntry, error) {
+	if _, err := os.Stat(filePath); err != nil {
+		return nil, err
+	}
+	index, err := newIndex(filePath)
+	if err != nil {
+		return nil, err
+	}
+	index.close()
+	return index.Entries, nil
+}
+
+// Returns the index entries that don't point to the beginning and the end
+// of complete requests in the log files
+func CheckIndexes(dir string) ([]*IndexProblem, error) {
+	suffixes, err := logFileSuffixes(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	problems := []*IndexProblem{}
+	for _, suffix := range suffixes {
+		entries, err := readIndexEntries(indexFilePath(dir, suffix))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// the request numbers of the requests that start and end at every offset
+		starts := map[int64]uint32{}
+		ends := map[int64]uint32{}
+		_, _, err = scanLogFile(logFilePath(dir, suffix), false, func(hdr *entryHeader, offset int64, body []byte) error {
+			starts[offset] = hdr.requestNumber
+			ends[offset+ENTRY_HEADER_SIZE+int64(hdr.length)] = hdr.requestNumber
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		indexFile := path.Base(indexFilePath(dir, suffix))
+		for i, entry := range entries {
+			problem := checkIndexEntry(entry, starts, ends)
+			if problem != "" {
+				problems = append(problems, &IndexProblem{indexFile, i, problem})
+			}
+		}
+	}
+	return problems, nil
+}
+
+func checkIndexEntry(entry *indexEntry, starts, ends map[int64]uint32) string {
+	if entry.FirstOffset >= entry.LastOffset {
+		return fmt.Sprintf("first offset %d isn't before the last offset %d", entry.FirstOffset, entry.LastOffset)
+	}
+	if _, ok := starts[entry.FirstOffset]; !ok {
+		return fmt.Sprintf("there's no request at offset %d", entry.FirstOffset)
+	}
+	requestNumber, ok := ends[entry.LastOffset]
+	if !ok {
+		return fmt.Sprintf("there's no request that ends at offset %d", entry.LastOffset)
+	}
+	if requestNumber != entry.LastRequestNumber {
+		return fmt.Sprintf("the request that ends at offset %d is %d, expected %d", entry.LastOffset, requestNumber, entry.LastRequestNumber)
+	}
+	return ""
+}
+
+// Truncates the incomplete requests at the end of the log files and
+// removes the index entries that don't match the log files. Returns
+// the number of bytes that were truncated from every log file.
+func RepairLogFiles(dir string) (map[string]int64, error) {
+	suffixes, err := logFileSuffixes(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	truncated := map[string]int64{}
+	for _, suffix := range suffixes {
+		filePath := logFilePath(dir, suffix)
+		starts := map[int64]uint32{}
+		ends := map[int64]uint32{}
+		end, size, err := scanLogFile(filePath, false, func(hdr *entryHeader, offset int64, body []byte) error {
+			starts[offset] = hdr.requestNumber
+			ends[offset+ENTRY_HEADER_SIZE+int64(hdr.length)] = hdr.requestNumber
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if end < size {
+			if err := os.Truncate(filePath, end); err != nil {
+				return nil, err
+			}
+			truncated[path.Base(filePath)] = size - end
+		}
+
+		indexPath := indexFilePath(dir, suffix)
+		entries, err := readIndexEntries(indexPath)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		valid := make([]*indexEntry, 0, len(entries))
+		for _, entry := range entries {
+			if checkIndexEntry(entry, starts, ends) == "" {
+				valid = append(valid, entry)
+			}
+		}
+		if len(valid) == len(entries) {
+			continue
+		}
+		if err := writeIndexEntries(indexPath, valid); err != nil {
+			return nil, err
+		}
+	}
+	return truncated, nil
+}
+
+// Replaces the index file with the given entries
+func writeIndexEntries(filePath string, entries []*indexEntry) error {
+	if err := os.Remove(filePath); err != nil {
+		return err
+	}
+	index, err := newIndex(filePath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		index.addEntry(entry.FirstRequestNumber, entry.LastRequestNumber, entry.FirstOffset, entry.LastOffset)
+	}
+	if err := index.syncFile(); err != nil {
+		index.close()
+		return err
+	}
+	return index.close()
+}
+
+// Rebuilds the bookmark from the log files. The committed request
+// numbers of the servers are kept if the old bookmark can be read,
+// otherwise the servers are replayed from the first log file. The server
+// id is needed to recover the sequence numbers of the shards.
+func RebuildGlobalState(dir string, serverId uint32) (*GlobalState, error) {
+	suffixes, err := logFileSuffixes(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	statePath := path.Join(dir, "bookmark")
+	state := &GlobalState{
+		ServerLastRequestNumber: map[uint32]uint32{},
+		ShardLastSequenceNumber: map[uint32]uint64{},
+		path:                    statePath,
+	}
+	if old, err := newGlobalState(statePath); err == nil && old.ServerLastRequestNumber != nil {
+		state.ServerLastRequestNumber = old.ServerLastRequestNumber
+	}
+
+	for idx, suffix := range suffixes {
+		filePath := logFilePath(dir, suffix)
+		end, _, err := scanLogFile(filePath, true, func(hdr *entryHeader, offset int64, body []byte) error {
+			request, err := decodeRequest(hdr, body)
+			if err != nil {
+				return fmt.Errorf("Cannot decode request %d at offset %d of %s: %s", hdr.requestNumber, offset, filePath, err)
+			}
+			if hdr.requestNumber > state.LargestRequestNumber {
+				state.LargestRequestNumber = hdr.requestNumber
+			}
+			for _, s := range request.MultiSeries {
+				for _, point := range s.Points {
+					sequenceNumber := (point.GetSequenceNumber() - uint64(serverId)) / HOST_ID_OFFSET
+					state.recover(hdr.shardId, sequenceNumber)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if idx == 0 {
+			state.FirstSuffix = suffix
+		}
+		state.CurrentFileSuffix = suffix
+		state.CurrentFileOffset = end
+	}
+	return state, state.writeToFile()
+}
@@ -67,11 +67,11 @@ func (self *log) check() error {
 			return err
 		}
 		if n == 0 || hdr.length == 0 {
-			return self.file.Truncate(offset)
+			return self.truncate(offset)
 		}
 		if offset+int64(n)+int64(hdr.length) > size {
 			// file is incomplete, truncate
-			return self.file.Truncate(offset)
+			return self.truncate(offset)
 		}
 		if err := self.skipRequest(file, hdr); err != nil {
 			return err
@@ -80,6 +80,11 @@ func (self *log) check() error {
 	}
 }
 
+func (self *log) truncate(size int64) error {
+	self.fileSize = uint64(size)
+	return self.file.Truncate(size)
+}
+
 func (self *log) offset() int64 {
 	offset, _ := self.file.Seek(0, os.SEEK_CUR)
 	return offset
@@ -105,16 +110,20 @@ func (self *log) delete() error {
 }
 
 func (self *log) appendRequest(request *protocol.Request, shardId uint32) error {
-	bytes, err := request.Encode()
+	bytes, compression, err := encodeRequest(request, self.config)
 
 	if err != nil {
 		return err
 	}
+	if uint32(len(bytes)) > ENTRY_LENGTH_MASK {
+		return fmt.Errorf("Request %d is too big to be written to the wal", request.GetRequestNumber())
+	}
 	// every request is preceded with the length, shard id and the request number
 	hdr := &entryHeader{
 		shardId:       shardId,
 		requestNumber: request.GetRequestNumber(),
 		length:        uint32(len(bytes)),
+		compression:   compression,
 	}
 	writtenHdrBytes, err := hdr.Write(self.file)
 	if err != nil {
@@ -270,8 +279,7 @@ func (self *log) replayFromFileLocation(file *os.File,
 			return
 		}
 
-		req := &protocol.Request{}
-		err = req.Decode(bytes)
+		req, err := decodeRequest(hdr, bytes)
 		if err != nil {
 			sendOrStop(newErrorReplayRequest(err), replayChan, stopChan)
 			return
@@ -9,6 +9,7 @@ import (
 	"protocol"
 	"sort"
 	"strings"
+	"time"
 
 	"code.google.com/p/goprotobuf/proto"
 	logger "code.google.com/p/log4go"
@@ -23,8 +24,17 @@ type WAL struct {
 	nextLogFileSuffix int
 	entries           chan interface{}
 
-	// counters to force index creation, bookmark and flushing
-	requestsSinceLastFlush    int
+	// the confirmations of the appended requests that weren't fsynced yet
+	unsyncedConfirmations []*unsyncedConfirmation
+	// the number of fsyncs since the wal was opened
+	syncs int
+	// the ids of the servers in the cluster and whether they're up, only
+	// the requests of the servers that are down are dropped when the wal
+	// is over its max size
+	serverIds  func() []uint32
+	isServerUp func(serverId uint32) bool
+
+	// counters to force index creation and bookmark
 	requestsSinceLastBookmark int
 	requestsSinceLastIndex    int
 	requestsSinceRotation     int
@@ -105,6 +115,15 @@ func NewWAL(config *configuration.Configuration) (*WAL, error) {
 	return wal, err
 }
 
+// Sets the functions that return the ids of the servers in the cluster
+// and tell if a server is up. Until they're set only the servers that
+// committed a request are known and they're considered up. Should be
+// called before the wal is used.
+func (self *WAL) SetServers(serverIds func() []uint32, isServerUp func(serverId uint32) bool) {
+	self.serverIds = serverIds
+	self.isServerUp = isServerUp
+}
+
 func (self *WAL) SetServerId(id uint32) {
 	logger.Info("Setting server id to %d and recovering", id)
 	self.serverId = id
@@ -122,6 +141,24 @@ func (self *WAL) Commit(requestNumber uint32, serverId uint32) error {
 	return confirmation.err
 }
 
+// Forgets the requests committed by a server that was removed from the
+// cluster, the log files it didn't commit yet aren't kept for it anymore
+func (self *WAL) RemoveServer(serverId uint32) error {
+	confirmationChan := make(chan *confirmation)
+	self.entries <- &removeServerEntry{confirmationChan, serverId}
+	confirmation := <-confirmationChan
+	return confirmation.err
+}
+
+// Returns the number of requests the servers didn't commit yet by the
+// server id. The servers that didn't commit any request lag from the
+// start of the wal, that's where they would be recovered from.
+func (self *WAL) ServerLag(serverIds []uint32) map[uint32]uint32 {
+	lags := make(chan map[uint32]uint32)
+	self.entries <- &serverLagEntry{serverIds, lags}
+	return <-lags
+}
+
 func (self *WAL) RecoverServerFromLastCommit(serverId uint32, shardIds []uint32, yield func(request *protocol.Request, shardId uint32) error) error {
 	requestNumber, ok := self.state.ServerLastRequestNumber[serverId]
 	requestNumber += 1
@@ -248,30 +285,74 @@ func (self *WAL) processClose(shouldBookmark bool) error {
 // PRIVATE functions
 
 func (self *WAL) processEntries() {
+	var fsyncTicks <-chan time.Time
+	if self.config.WalFsync == configuration.WAL_FSYNC_INTERVAL {
+		ticker := time.NewTicker(self.config.WalFsyncInterval)
+		defer ticker.Stop()
+		fsyncTicks = ticker.C
+	}
+
 	for {
-		e := <-self.entries
-		switch x := e.(type) {
-		case *commitEntry:
-			self.processCommitEntry(x)
-		case *appendEntry:
-			self.processAppendEntry(x)
-		case *bookmarkEntry:
-			err := self.bookmark()
-			if err != nil {
-				x.confirmation <- &confirmation{0, err}
-				continue
+		select {
+		case e := <-self.entries:
+			if !self.processEntry(e) {
+				return
 			}
-			x.confirmation <- &confirmation{0, self.index()}
-		case *closeEntry:
-			x.confirmation <- &confirmation{0, self.processClose(x.shouldBookmark)}
-			logger.Info("Closing wal")
-			return
-		default:
-			panic(fmt.Errorf("unknown entry type %T", e))
+		case <-fsyncTicks:
+			self.sync()
 		}
 	}
 }
 
+// Returns false if the wal was closed
+func (self *WAL) processEntry(e interface{}) bool {
+	switch x := e.(type) {
+	case *commitEntry:
+		self.processCommitEntry(x)
+	case *appendEntry:
+		self.processAppendEntry(x)
+		if self.config.WalFsync == configuration.WAL_FSYNC_INTERVAL || self.config.WalFsync == configuration.WAL_FSYNC_NEVER {
+			return true
+		}
+
+		// group commit, append the requests that are waiting and fsync
+		// once for all of them
+		for {
+			select {
+			case e := <-self.entries:
+				if x, ok := e.(*appendEntry); ok {
+					self.processAppendEntry(x)
+					continue
+				}
+				self.sync()
+				return self.processEntry(e)
+			default:
+				self.sync()
+				return true
+			}
+		}
+	case *removeServerEntry:
+		self.processRemoveServerEntry(x)
+	case *serverLagEntry:
+		self.processServerLagEntry(x)
+	case *bookmarkEntry:
+		err := self.bookmark()
+		if err != nil {
+			x.confirmation <- &confirmation{0, err}
+			return true
+		}
+		x.confirmation <- &confirmation{0, self.index()}
+	case *closeEntry:
+		self.sync()
+		x.confirmation <- &confirmation{0, self.processClose(x.shouldBookmark)}
+		logger.Info("Closing wal")
+		return false
+	default:
+		panic(fmt.Errorf("unknown entry type %T", e))
+	}
+	return true
+}
+
 func (self *WAL) assignSequenceNumbers(shardId uint32, request *protocol.Request) {
 	if len(request.MultiSeries) == 0 {
 		return
@@ -310,19 +391,62 @@ func (self *WAL) processAppendEntry(e *appendEntry) {
 		return
 	}
 	self.state.CurrentFileOffset = self.logFiles[len(self.logFiles)-1].offset()
+	self.confirmAfterSync(e.confirmation, e.request.GetRequestNumber())
 
 	self.requestsSinceLastIndex++
 	self.requestsSinceLastBookmark++
-	self.requestsSinceLastFlush++
 	self.requestsSinceRotation++
 	logger.Debug("requestsSinceRotation: %d", self.requestsSinceRotation)
 	if rotated, err := self.rotateTheLogFile(nextRequestNumber); err != nil || rotated {
-		e.confirmation <- &confirmation{e.request.GetRequestNumber(), err}
+		if err != nil {
+			logger.Error("Cannot rotate the log file: %s", err)
+			self.failUnsyncedConfirmations(err)
+			return
+		}
+		self.removeLogFilesOverMaxSize()
 		return
 	}
 
 	self.conditionalBookmarkAndIndex()
-	e.confirmation <- &confirmation{e.request.GetRequestNumber(), nil}
+}
+
+// The request is confirmed right away if the wal isn't fsynced,
+// otherwise the confirmation is sent after the next fsync
+func (self *WAL) confirmAfterSync(confirmationChan chan *confirmation, requestNumber uint32) {
+	if self.config.WalFsync == configuration.WAL_FSYNC_NEVER {
+		confirmationChan <- &confirmation{requestNumber, nil}
+		return
+	}
+	self.unsyncedConfirmations = append(self.unsyncedConfirmations, &unsyncedConfirmation{confirmationChan, requestNumber})
+}
+
+// Fsyncs the last log file and sends the confirmations of the requests
+// that were appended since the last fsync
+func (self *WAL) sync() {
+	if len(self.unsyncedConfirmations) == 0 {
+		return
+	}
+	if err := self.flush(); err != nil {
+		logger.Error("Cannot fsync the wal: %s", err)
+		self.failUnsyncedConfirmations(err)
+		return
+	}
+	self.syncs++
+	self.sendUnsyncedConfirmations()
+}
+
+func (self *WAL) sendUnsyncedConfirmations() {
+	for _, c := range self.unsyncedConfirmations {
+		c.confirmation <- &confirmation{c.requestNumber, nil}
+	}
+	self.unsyncedConfirmations = nil
+}
+
+func (self *WAL) failUnsyncedConfirmations(err error) {
+	for _, c := range self.unsyncedConfirmations {
+		c.confirmation <- &confirmation{0, err}
+	}
+	self.unsyncedConfirmations = nil
 }
 
 func (self *WAL) processCommitEntry(e *commitEntry) {
@@ -334,10 +458,40 @@ func (self *WAL) processCommitEntry(e *commitEntry) {
 		return
 	}
 
+	logger.Debug("Removing some unneeded log files: %d", idx)
+	self.removeLogFiles(idx)
+	e.confirmation <- &confirmation{0, nil}
+}
+
+func (self *WAL) processRemoveServerEntry(e *removeServerEntry) {
+	logger.Info("Removing server %d from the wal", e.serverId)
+	delete(self.state.ServerLastRequestNumber, e.serverId)
+	if idx := self.firstLogFile(); idx > 0 {
+		self.removeLogFiles(idx)
+	}
+	e.confirmation <- &confirmation{0, nil}
+}
+
+func (self *WAL) processServerLagEntry(e *serverLagEntry) {
+	lags := make(map[uint32]uint32, len(e.serverIds))
+	for _, serverId := range e.serverIds {
+		// the request numbers roll over, so does the difference
+		if requestNumber, ok := self.state.ServerLastRequestNumber[serverId]; ok {
+			lags[serverId] = self.state.LargestRequestNumber - requestNumber
+		} else if len(self.logFiles) > 0 {
+			lags[serverId] = self.state.LargestRequestNumber - uint32(self.state.FirstSuffix) + 1
+		} else {
+			lags[serverId] = 0
+		}
+	}
+	e.lags <- lags
+}
+
+// Removes the first idx log files and their indexes
+func (self *WAL) removeLogFiles(idx int) {
 	var unusedLogFiles []*log
 	var unusedLogIndex []*index
 
-	logger.Debug("Removing some unneeded log files: %d", idx)
 	unusedLogFiles, self.logFiles = self.logFiles[:idx], self.logFiles[idx:]
 	unusedLogIndex, self.logIndex = self.logIndex[:idx], self.logIndex[idx:]
 	for logIdx, logFile := range unusedLogFiles {
@@ -349,7 +503,72 @@ func (self *WAL) processCommitEntry(e *commitEntry) {
 		logIndex.delete()
 	}
 	self.state.FirstSuffix = self.logFiles[0].suffix()
-	e.confirmation <- &confirmation{0, nil}
+}
+
+// Removes the oldest log files if the log files are bigger than the max
+// size. Only the requests that every live server committed are removed,
+// the servers that are down and didn't commit the requests in the
+// removed files will be recovered from the first log file that is left.
+func (self *WAL) removeLogFilesOverMaxSize() {
+	if self.config.WalMaxSize <= 0 {
+		return
+	}
+
+	size := int64(0)
+	for _, logFile := range self.logFiles {
+		size += int64(logFile.fileSize)
+	}
+	if size <= self.config.WalMaxSize {
+		return
+	}
+
+	idx := 0
+	// the last log file is the one that is being written to, the log file
+	// can be removed if the live servers committed all of its requests
+	for ; idx < len(self.logFiles)-1 && size > self.config.WalMaxSize; idx++ {
+		if !self.committedByLiveServers(uint32(self.logFiles[idx+1].suffix()) - 1) {
+			break
+		}
+		size -= int64(self.logFiles[idx].fileSize)
+	}
+	if idx == 0 {
+		logger.Warn("The wal is bigger than %d bytes but the servers that are up didn't commit the oldest log file", self.config.WalMaxSize)
+		return
+	}
+
+	logger.Warn("The wal is bigger than %d bytes, removing the %d oldest log files", self.config.WalMaxSize, idx)
+	self.removeLogFiles(idx)
+	firstRequestNumber := uint32(self.state.FirstSuffix)
+	for serverId, requestNumber := range self.state.ServerLastRequestNumber {
+		if requestNumber+1 < firstRequestNumber {
+			logger.Warn("Server %d is down, it will miss the requests %d to %d that it didn't commit", serverId, requestNumber+1, firstRequestNumber-1)
+			self.state.commitRequestNumber(serverId, firstRequestNumber-1)
+		}
+	}
+}
+
+// Returns true if the servers that are up committed the request. The
+// servers that didn't commit any request yet would be recovered from the
+// start of the wal, they didn't commit it either.
+func (self *WAL) committedByLiveServers(requestNumber uint32) bool {
+	serverIds := make(map[uint32]bool, len(self.state.ServerLastRequestNumber))
+	for serverId, _ := range self.state.ServerLastRequestNumber {
+		serverIds[serverId] = true
+	}
+	if self.serverIds != nil {
+		for _, serverId := range self.serverIds() {
+			serverIds[serverId] = true
+		}
+	}
+	for serverId, _ := range serverIds {
+		if committed, ok := self.state.ServerLastRequestNumber[serverId]; ok && committed >= requestNumber {
+			continue
+		}
+		if serverId == self.serverId || self.isServerUp == nil || self.isServerUp(serverId) {
+			return false
+		}
+	}
+	return true
 }
 
 // creates a new log file using the next suffix and initializes its
@@ -394,6 +613,7 @@ func (self *WAL) openLog(logFileName string) (*log, *index, error) {
 
 // Will assign sequence numbers if null. Returns a unique id that
 // should be marked as committed for each server as it gets confirmed.
+// Returns after the request is on disk according to the fsync policy.
 func (self *WAL) AssignSequenceNumbersAndLog(request *protocol.Request, shard Shard) (uint32, error) {
 	confirmationChan := make(chan *confirmation)
 	self.entries <- &appendEntry{confirmationChan, request, shard.Id()}
@@ -424,7 +644,11 @@ func (self *WAL) firstLogFile() int {
 }
 
 func (self *WAL) shouldRotateTheLogFile() bool {
-	return self.requestsSinceRotation >= self.config.WalRequestsPerLogFile
+	if self.requestsSinceRotation >= self.config.WalRequestsPerLogFile {
+		return true
+	}
+	maxSize := self.config.WalMaxLogFileSize
+	return maxSize > 0 && int64(self.logFiles[len(self.logFiles)-1].fileSize) >= maxSize
 }
 
 func (self *WAL) recover() error {
@@ -498,12 +722,11 @@ func (self *WAL) rotateTheLogFile(nextRequestNumber uint32) (bool, error) {
 	lastEntryIndex := len(self.logFiles) - 1
 	lastLogFile := self.logFiles[lastEntryIndex]
 	lastIndex := self.logIndex[lastEntryIndex]
-	if err := lastLogFile.syncFile(); err != nil {
-		return false, err
-	}
-	if err := lastIndex.syncFile(); err != nil {
+	if err := self.flush(); err != nil {
 		return false, err
 	}
+	// the requests in the log file are on disk now
+	self.sendUnsyncedConfirmations()
 	lastLogFile.close()
 	lastIndex.close()
 	lastLogFile, err := self.createNewLog(nextRequestNumber + 1)
@@ -515,7 +738,6 @@ func (self *WAL) rotateTheLogFile(nextRequestNumber uint32) (bool, error) {
 }
 
 func (self *WAL) conditionalBookmarkAndIndex() {
-	shouldFlush := false
 	logger.Debug("requestsSinceLastIndex: %d", self.requestsSinceLastIndex)
 	if self.requestsSinceLastIndex >= self.config.WalIndexAfterRequests {
 		self.index()
@@ -524,15 +746,10 @@ func (self *WAL) conditionalBookmarkAndIndex() {
 	if self.requestsSinceLastBookmark >= self.config.WalBookmarkAfterRequests {
 		self.bookmark()
 	}
-
-	if self.requestsSinceLastFlush >= self.config.WalFlushAfterRequests || shouldFlush {
-		self.flush()
-	}
 }
 
 func (self *WAL) flush() error {
 	logger.Debug("Fsyncing the log file to disk")
-	self.requestsSinceLastFlush = 0
 	lastEntryIndex := len(self.logFiles) - 1
 	if err := self.logFiles[lastEntryIndex].syncFile(); err != nil {
 		return err
@@ -70,7 +70,7 @@ func newWal(c *C) *WAL {
 		WalDir: dir,
 		WalBookmarkAfterRequests: 1000,
 		WalIndexAfterRequests:    1000,
-		WalFlushAfterRequests:    1000,
+		WalFsync:                 configuration.WAL_FSYNC_NEVER,
 		WalRequestsPerLogFile:    10000,
 	}
 	wal, err := NewWAL(config)
@@ -158,6 +158,37 @@ func (_ *WalSuite) TestLogFilesCompaction(c *C) {
 	c.Assert(os.IsNotExist(err), Equals, true)
 }
 
+func (_ *WalSuite) TestLogFilesCompactionAfterRemovingServer(c *C) {
+	wal := newWal(c)
+	wal.config.WalRequestsPerLogFile = 2000
+	wal.Commit(1, 1)
+	wal.Commit(1, 2)
+	for i := 0; i < 2500; i++ {
+		request := generateRequest(2)
+		_, err := wal.AssignSequenceNumbersAndLog(request, &MockShard{id: 1})
+		c.Assert(err, IsNil)
+	}
+	c.Assert(wal.Commit(2001, 1), IsNil)
+	c.Assert(wal.logFiles, HasLen, 2)
+	// server 2 was removed from the cluster, nothing waits for it anymore
+	c.Assert(wal.RemoveServer(2), IsNil)
+	c.Assert(wal.logFiles, HasLen, 1)
+	_, ok := wal.state.ServerLastRequestNumber[2]
+	c.Assert(ok, Equals, false)
+}
+
+func (_ *WalSuite) TestServerLag(c *C) {
+	wal := newWal(c)
+	for i := 0; i < 10; i++ {
+		request := generateRequest(2)
+		_, err := wal.AssignSequenceNumbersAndLog(request, &MockShard{id: 1})
+		c.Assert(err, IsNil)
+	}
+	c.Assert(wal.Commit(10, 1), IsNil)
+	c.Assert(wal.Commit(4, 2), IsNil)
+	c.Assert(wal.ServerLag([]uint32{1, 2, 3}), DeepEquals, map[uint32]uint32{1: 0, 2: 6, 3: 10})
+}
+
 func (_ *WalSuite) TestMultipleLogFiles(c *C) {
 	wal := newWal(c)
 	wal.config.WalRequestsPerLogFile = 2000
@@ -387,7 +418,7 @@ func (_ *WalSuite) TestRecoveryFromCrash(c *C) {
 	filePath := path.Join(wal.config.WalDir, "log.1")
 	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
 	c.Assert(err, IsNil)
-	hdr := &entryHeader{1, 1, 500}
+	hdr := &entryHeader{requestNumber: 1, shardId: 1, length: 500}
 	_, err = hdr.Write(file)
 	c.Assert(err, IsNil)
 	// write an incomplete request, 200 bytes as opposed to 500 bytes in
@@ -436,7 +467,7 @@ func (_ *WalSuite) TestAnotherRecoveryFromCrash(c *C) {
 	filePath := path.Join(wal.config.WalDir, "log.1")
 	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
 	c.Assert(err, IsNil)
-	hdr := &entryHeader{0, 0, 0}
+	hdr := &entryHeader{requestNumber: 0, shardId: 0, length: 0}
 	_, err = hdr.Write(file)
 	c.Assert(err, IsNil)
 	defer file.Close()
@@ -635,3 +666,220 @@ func (_ *WalSuite) TestSequenceNumberAssignmentPerServer(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(request.MultiSeries[0].Points[0].GetSequenceNumber(), Not(Equals), anotherRequest.MultiSeries[0].Points[0].GetSequenceNumber())
 }
+
+func (_ *WalSuite) TestFsyncPolicies(c *C) {
+	for _, policy := range []string{configuration.WAL_FSYNC_ALWAYS, configuration.WAL_FSYNC_INTERVAL, configuration.WAL_FSYNC_NEVER} {
+		wal := newWal(c)
+		c.Assert(wal.Close(), IsNil)
+		wal.config.WalFsync = policy
+		wal.config.WalFsyncInterval = 10 * time.Millisecond
+		wal, err := NewWAL(wal.config)
+		c.Assert(err, IsNil)
+		wal.SetServerId(1)
+
+		// block the wal until the appends are queued, they share one
+		// fsync with the always policy
+		bookmarked := make(chan *confirmation)
+		wal.entries <- &bookmarkEntry{bookmarked}
+		type appended struct {
+			id  uint32
+			err error
+		}
+		appends := make(chan appended, cap(wal.entries))
+		for i := 0; i < cap(wal.entries); i++ {
+			go func() {
+				id, err := wal.AssignSequenceNumbersAndLog(generateRequest(2), &MockShard{id: 1})
+				appends <- appended{id, err}
+			}()
+		}
+		for len(wal.entries) < cap(wal.entries) {
+			time.Sleep(time.Millisecond)
+		}
+		c.Assert((<-bookmarked).err, IsNil)
+		seen := map[uint32]bool{}
+		for i := 0; i < cap(wal.entries); i++ {
+			a := <-appends
+			c.Assert(a.err, IsNil)
+			seen[a.id] = true
+		}
+		c.Assert(seen, HasLen, cap(wal.entries))
+		c.Assert(wal.closeWithoutBookmarking(), IsNil)
+		switch policy {
+		case configuration.WAL_FSYNC_ALWAYS:
+			c.Assert(wal.syncs, Equals, 1)
+		case configuration.WAL_FSYNC_INTERVAL:
+			c.Assert(wal.syncs > 0, Equals, true)
+		case configuration.WAL_FSYNC_NEVER:
+			c.Assert(wal.syncs, Equals, 0)
+		}
+
+		wal, err = NewWAL(wal.config)
+		c.Assert(err, IsNil)
+		wal.SetServerId(1)
+		requests := 0
+		err = wal.RecoverServerFromRequestNumber(1, []uint32{1}, func(req *protocol.Request, shardId uint32) error {
+			requests++
+			return nil
+		})
+		c.Assert(err, IsNil)
+		c.Assert(requests, Equals, cap(wal.entries))
+		c.Assert(wal.Close(), IsNil)
+	}
+}
+
+func (_ *WalSuite) TestCompressedRequests(c *C) {
+	wal := newWal(c)
+	for i := 0; i < 10; i++ {
+		if i == 5 {
+			// the old uncompressed requests can still be read
+			wal.config.WalCompression = configuration.WAL_COMPRESSION_SNAPPY
+		}
+		_, err := wal.AssignSequenceNumbersAndLog(generateRequest(100), &MockShard{id: 1})
+		c.Assert(err, IsNil)
+	}
+	c.Assert(wal.Close(), IsNil)
+
+	wal, err := NewWAL(wal.config)
+	c.Assert(err, IsNil)
+	wal.SetServerId(1)
+	requests := []*protocol.Request{}
+	err = wal.RecoverServerFromRequestNumber(1, []uint32{1}, func(request *protocol.Request, _ uint32) error {
+		requests = append(requests, request)
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(requests, HasLen, 10)
+	for _, request := range requests {
+		c.Assert(request.MultiSeries[0].Points, HasLen, 100)
+	}
+
+	compressed := 0
+	err = ReadRequests(wal.config.WalDir, -1, func(request *RequestInfo) error {
+		if request.Compressed {
+			compressed++
+		}
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(compressed, Equals, 5)
+}
+
+func (_ *WalSuite) TestSizeBasedRotationAndMaxSize(c *C) {
+	wal := newWal(c)
+	// a request with 2 points takes 70 bytes, the first one 69, so the
+	// log file is rotated after every 10 requests
+	wal.config.WalMaxLogFileSize = 650
+	wal.config.WalMaxSize = 1050
+	serverUp := true
+	wal.SetServers(func() []uint32 {
+		return []uint32{2, 3}
+	}, func(serverId uint32) bool {
+		return serverId == 2 || serverUp
+	})
+	for i := 0; i < 25; i++ {
+		id, err := wal.AssignSequenceNumbersAndLog(generateRequest(2), &MockShard{id: 1})
+		c.Assert(err, IsNil)
+		c.Assert(wal.Commit(id, 2), IsNil)
+	}
+
+	// server 2 committed everything but server 3 is up and didn't commit
+	// any request yet
+	c.Assert(wal.logFiles, HasLen, 3)
+
+	serverUp = false
+	for i := 25; i < 35; i++ {
+		id, err := wal.AssignSequenceNumbersAndLog(generateRequest(2), &MockShard{id: 1})
+		c.Assert(err, IsNil)
+		c.Assert(wal.Commit(id, 2), IsNil)
+	}
+
+	// log.1 and log.11 were removed even though server 3 didn't commit
+	// them since it's down
+	c.Assert(wal.logFiles, HasLen, 2)
+	c.Assert(wal.logFiles[0].suffix(), Equals, 21)
+	c.Assert(wal.logFiles[1].suffix(), Equals, 31)
+	_, err := os.Stat(path.Join(wal.config.WalDir, "log.1"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	requests := 0
+	err = wal.RecoverServerFromLastCommit(3, []uint32{1}, func(request *protocol.Request, _ uint32) error {
+		c.Assert(request.GetRequestNumber(), Equals, uint32(requests+21))
+		requests++
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(requests, Equals, 15)
+}
+
+func (_ *WalSuite) TestInspectAndRepair(c *C) {
+	wal := newWal(c)
+	wal.config.WalIndexAfterRequests = 2
+	for i := 0; i < 3; i++ {
+		_, err := wal.AssignSequenceNumbersAndLog(generateRequest(2), &MockShard{id: 1})
+		c.Assert(err, IsNil)
+	}
+	c.Assert(wal.Close(), IsNil)
+	dir := wal.config.WalDir
+
+	// a torn request at the end of the log and a bad index entry
+	file, err := os.OpenFile(path.Join(dir, "log.1"), os.O_RDWR|os.O_APPEND, 0644)
+	c.Assert(err, IsNil)
+	hdr := &entryHeader{requestNumber: 4, shardId: 1, length: 500}
+	_, err = hdr.Write(file)
+	c.Assert(err, IsNil)
+	_, err = file.Write(make([]byte, 200))
+	c.Assert(err, IsNil)
+	c.Assert(file.Close(), IsNil)
+	index, err := os.OpenFile(path.Join(dir, "index.1"), os.O_RDWR|os.O_APPEND, 0644)
+	c.Assert(err, IsNil)
+	_, err = fmt.Fprintf(index, "%d,%d,%d,%d\n", 3, 150, 3, 600)
+	c.Assert(err, IsNil)
+	c.Assert(index.Close(), IsNil)
+
+	files, err := ListLogFiles(dir)
+	c.Assert(err, IsNil)
+	c.Assert(files, HasLen, 1)
+	c.Assert(files[0].Requests, Equals, 3)
+	c.Assert(files[0].FirstRequestNumber, Equals, uint32(1))
+	c.Assert(files[0].LastRequestNumber, Equals, uint32(3))
+	c.Assert(files[0].TornBytes, Equals, int64(212))
+	c.Assert(files[0].IndexEntries, Equals, 2)
+
+	requests := []*RequestInfo{}
+	c.Assert(ReadRequests(dir, -1, func(request *RequestInfo) error {
+		requests = append(requests, request)
+		return nil
+	}), IsNil)
+	c.Assert(requests, HasLen, 3)
+	c.Assert(requests[2].RequestNumber, Equals, uint32(3))
+	c.Assert(requests[2].Database, Equals, "db")
+	c.Assert(requests[2].Series[0].Points, Equals, 2)
+
+	problems, err := CheckIndexes(dir)
+	c.Assert(err, IsNil)
+	c.Assert(problems, HasLen, 1)
+	c.Assert(problems[0].Entry, Equals, 1)
+
+	truncated, err := RepairLogFiles(dir)
+	c.Assert(err, IsNil)
+	c.Assert(truncated["log.1"], Equals, int64(212))
+	problems, err = CheckIndexes(dir)
+	c.Assert(err, IsNil)
+	c.Assert(problems, HasLen, 0)
+
+	c.Assert(os.Remove(path.Join(dir, "bookmark")), IsNil)
+	state, err := RebuildGlobalState(dir, 1)
+	c.Assert(err, IsNil)
+	c.Assert(state.LargestRequestNumber, Equals, uint32(3))
+	info, err := os.Stat(path.Join(dir, "log.1"))
+	c.Assert(err, IsNil)
+	c.Assert(state.CurrentFileOffset, Equals, info.Size())
+	c.Assert(state.ShardLastSequenceNumber[1], Equals, uint64(6))
+
+	wal, err = NewWAL(wal.config)
+	c.Assert(err, IsNil)
+	wal.SetServerId(1)
+	id, err := wal.AssignSequenceNumbersAndLog(generateRequest(2), &MockShard{id: 1})
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, uint32(4))
+}